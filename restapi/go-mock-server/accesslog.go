@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogFormat picks the access log sinks a stub's requests go to. false
+// is shorthand for no sinks at all, true for the default of every sink.
+type AccessLogFormat struct {
+	// Sinks named by --access-log to write to, default all
+	Sinks []string `json:"sinks"`
+	// Exclude names sinks not to write to
+	Exclude []string `json:"exclude"`
+	// Body adds the request and response bodies to the records
+	Body bool `json:"body"`
+	// Off keeps the stub's requests out of every sink
+	Off bool `json:"off"`
+}
+
+func (a *AccessLogFormat) UnmarshalJSON(b []byte) error {
+	var on bool
+	if json.Unmarshal(b, &on) == nil {
+		*a = AccessLogFormat{Off: !on}
+		return nil
+	}
+	type plain AccessLogFormat
+	return json.Unmarshal(b, (*plain)(a))
+}
+
+// validate checks the sinks named exist.
+func (a *AccessLogFormat) validate() error {
+	for _, name := range append(append([]string{}, a.Sinks...), a.Exclude...) {
+		if accessLogs[name] == nil {
+			return fmt.Errorf("access log sink %q is not configured, available: %s", name, strings.Join(accessLogFlags.names(), ", "))
+		}
+	}
+	return nil
+}
+
+// writesTo reports whether requests to a stub with this config go to sink.
+func (a *AccessLogFormat) writesTo(sink string) bool {
+	if a == nil {
+		return true
+	}
+	if a.Off {
+		return false
+	}
+	for _, name := range a.Exclude {
+		if name == sink {
+			return false
+		}
+	}
+	if len(a.Sinks) == 0 {
+		return true
+	}
+	for _, name := range a.Sinks {
+		if name == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogFlag collects repeated "[name=]target" --access-log flags.
+type accessLogFlag map[string]string
+
+func (f accessLogFlag) String() string {
+	pairs := []string{}
+	for name, target := range f {
+		pairs = append(pairs, name+"="+target)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f accessLogFlag) names() []string {
+	names := []string{}
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f accessLogFlag) Set(value string) error {
+	name, target, ok := strings.Cut(value, "=")
+	if !ok || strings.ContainsAny(name, ":/") {
+		// without a name the kind of sink, or the file name minus
+		// extension, is used
+		target = value
+		switch kind, _, _ := strings.Cut(value, ":"); kind {
+		case "stdout", "stderr", "syslog", "syslog+tcp", "http", "https":
+			name = strings.TrimSuffix(kind, "+tcp")
+		default:
+			name = strings.TrimSuffix(filepath.Base(value), filepath.Ext(value))
+		}
+	}
+	if name == "" || target == "" {
+		return fmt.Errorf("want [name=]target, e.g. audit=/var/log/mock.log")
+	}
+	if _, dup := f[name]; dup {
+		return fmt.Errorf("access log sink %q is given twice", name)
+	}
+	f[name] = target
+	return nil
+}
+
+var accessLogFlags = accessLogFlag{}
+
+// accessLogs holds the open sinks by name.
+var accessLogs = map[string]io.Writer{}
+
+// openAccessLogs opens the sinks given with --access-log.
+func openAccessLogs(flags accessLogFlag) error {
+	for _, name := range flags.names() {
+		sink, err := openAccessLog(flags[name])
+		if err != nil {
+			return fmt.Errorf("access log %s: %w", name, err)
+		}
+		accessLogs[name] = sink
+	}
+	return nil
+}
+
+func openAccessLog(target string) (io.Writer, error) {
+	switch {
+	case target == "stdout":
+		return &lockedWriter{w: os.Stdout}, nil
+	case target == "stderr":
+		return &lockedWriter{w: os.Stderr}, nil
+	case target == "syslog" || strings.HasPrefix(target, "syslog://") || strings.HasPrefix(target, "syslog+tcp://"):
+		return newSyslogSink(target)
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return newCollectorSink(target), nil
+	}
+	file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedWriter{w: file}, nil
+}
+
+// lockedWriter keeps the records of concurrent requests from interleaving.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// syslogSink sends each record as an RFC 5424 message, facility local0,
+// to the local syslog socket or a server over UDP or TCP.
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	conn     net.Conn
+	hostname string
+}
+
+func newSyslogSink(target string) (*syslogSink, error) {
+	s := &syslogSink{}
+	s.hostname, _ = os.Hostname()
+	switch {
+	case target == "syslog":
+		s.network, s.addr = "unixgram", "/dev/log"
+	case strings.HasPrefix(target, "syslog+tcp://"):
+		s.network, s.addr = "tcp", strings.TrimPrefix(target, "syslog+tcp://")
+	default:
+		s.network, s.addr = "udp", strings.TrimPrefix(target, "syslog://")
+	}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil && s.network != "unixgram" {
+		s.addr = net.JoinHostPort(s.addr, "514")
+	}
+	return s, s.dial()
+}
+
+func (s *syslogSink) dial() error {
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil && s.network == "unixgram" {
+		conn, err = net.Dial("unix", s.addr)
+	}
+	s.conn = conn
+	return err
+}
+
+func (s *syslogSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// <134> is local0.info
+	msg := fmt.Sprintf("<134>1 %s %s mock-server %d - - %s", time.Now().Format(time.RFC3339Nano), s.hostname, os.Getpid(), bytes.TrimRight(b, "\n"))
+	if s.network == "tcp" {
+		msg += "\n"
+	}
+	if s.conn != nil {
+		if _, err := io.WriteString(s.conn, msg); err == nil {
+			return len(b), nil
+		}
+		s.conn.Close()
+	}
+	// the server may have gone away, try once more on a new connection
+	if err := s.dial(); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(s.conn, msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// collectorSink posts records to an HTTP collector as NDJSON, batched in the
+// background so the mock never waits on it. Records are dropped while the
+// queue is full.
+type collectorSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	// dropped counts the records lost to a full queue since the last post
+	dropped atomic.Int64
+}
+
+// collectorBatch caps the bytes posted at once; smaller batches go out
+// every collectorInterval.
+const (
+	collectorBatch    = 256 << 10
+	collectorInterval = time.Second
+)
+
+func newCollectorSink(url string) *collectorSink {
+	s := &collectorSink{url: url, client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan []byte, 4096)}
+	go s.run()
+	return s
+}
+
+func (s *collectorSink) Write(b []byte) (int, error) {
+	select {
+	case s.queue <- append([]byte{}, b...):
+		return len(b), nil
+	default:
+		s.dropped.Add(1)
+		return len(b), nil
+	}
+}
+
+func (s *collectorSink) run() {
+	var batch bytes.Buffer
+	tick := time.NewTicker(collectorInterval)
+	for {
+		select {
+		case line := <-s.queue:
+			batch.Write(line)
+			if batch.Len() < collectorBatch {
+				continue
+			}
+		case <-tick.C:
+			if batch.Len() == 0 {
+				continue
+			}
+		}
+		s.post(batch.Bytes())
+		batch.Reset()
+	}
+}
+
+func (s *collectorSink) post(body []byte) {
+	if n := s.dropped.Swap(0); n > 0 {
+		slog.Warn("Dropped access log records, the collector queue was full", "url", s.url, "dropped", n)
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to post access log", "url", s.url, "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Access log collector refused records", "url", s.url, "status", resp.StatusCode)
+	}
+}
+
+// accessRecord is one line of the access log.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Workspace string    `json:"workspace,omitempty"`
+	Stub      string    `json:"stub,omitempty"`
+	ClientIP  string    `json:"clientIp"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Status    int       `json:"status"`
+	// Duration in milliseconds
+	Duration float64 `json:"duration"`
+	// RequestBody and ResponseBody are only kept for stubs asking for
+	// them, up to journalBodyLimit bytes each
+	RequestBody  string `json:"requestBody,omitempty"`
+	ResponseBody string `json:"responseBody,omitempty"`
+}
+
+// writeAccessLog sends the record of a served request to the sinks its
+// stub's accessLog allows.
+func writeAccessLog(entry journalEntry, r *http.Request, info *requestInfo) {
+	rec := accessRecord{
+		Time:      entry.Time,
+		RequestID: entry.RequestID,
+		Workspace: entry.Workspace,
+		Stub:      entry.Stub,
+		ClientIP:  clientHost(r),
+		Method:    entry.Method,
+		Path:      entry.Path,
+		Query:     entry.Query,
+		UserAgent: r.UserAgent(),
+		Status:    entry.Status,
+		Duration:  entry.Duration,
+	}
+	if info.access != nil && info.access.Body {
+		rec.RequestBody = entry.Body
+		rec.ResponseBody = info.responseBody.String()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for name, sink := range accessLogs {
+		if !info.access.writesTo(name) {
+			continue
+		}
+		if _, err := sink.Write(line); err != nil {
+			slog.Warn("Failed to write access log", "sink", name, "error", err)
+		}
+	}
+}
+
+// accessCapture keeps the start of the response body for stubs whose
+// access log records include it.
+type accessCapture struct {
+	http.ResponseWriter
+	info *requestInfo
+}
+
+func (c *accessCapture) Write(b []byte) (int, error) {
+	if c.info.access != nil && c.info.access.Body {
+		if room := journalBodyLimit - c.info.responseBody.Len(); room > 0 {
+			c.info.responseBody.Write(b[:min(len(b), room)])
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *accessCapture) Flush() {
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *accessCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
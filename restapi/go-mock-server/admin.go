@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// adminPrefix is reserved for the admin API.
+const adminPrefix = "/__admin"
+
+// adminAuth protects the admin API with a bearer token and/or basic auth
+// credentials. With neither configured the API is open.
+type adminAuth struct {
+	token    string
+	user     string
+	password string
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a adminAuth) allowed(r *http.Request) bool {
+	if a.token == "" && a.user == "" {
+		return true
+	}
+	if a.token != "" && secureEqual(r.Header.Get("Authorization"), "Bearer "+a.token) {
+		return true
+	}
+	if a.user != "" {
+		user, password, ok := r.BasicAuth()
+		return ok && secureEqual(user, a.user) && secureEqual(password, a.password)
+	}
+	return false
+}
+
+func (a adminAuth) protect(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r) {
+			slog.Warn("Rejected admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			if a.user != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mock-server admin"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mock-server admin"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func registerAdmin(mux *router, auth adminAuth) {
+	handle := func(pattern string, h http.HandlerFunc) {
+		method, path, _ := splitPattern(pattern)
+		check(mux.handle(method+" "+adminPrefix+path, auth.protect(h)))
+	}
+
+	handle("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		reports := []statsReport{}
+		for _, s := range routesFor(r).registry.list() {
+			reports = append(reports, s.stats.report())
+		}
+		writeJSON(w, http.StatusOK, reports)
+	})
+	handle("DELETE /stats", func(w http.ResponseWriter, r *http.Request) {
+		for _, s := range routesFor(r).registry.list() {
+			s.stats.reset()
+		}
+		slog.Info("Stats reset")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /load", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, limiter.report())
+	})
+	handle("DELETE /load", func(w http.ResponseWriter, r *http.Request) {
+		limiter.reset()
+		slog.Info("Load counters reset")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /stubs", func(w http.ResponseWriter, r *http.Request) {
+		reports := []stubReport{}
+		for _, s := range routesFor(r).registry.list() {
+			reports = append(reports, s.report())
+		}
+		writeJSON(w, http.StatusOK, reports)
+	})
+	toggle := func(enabled bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			s := routesFor(r).registry.get(r.PathValue("id"))
+			if s == nil {
+				http.Error(w, "no stub with id "+r.PathValue("id"), http.StatusNotFound)
+				return
+			}
+			s.enabled.Store(enabled)
+			slog.Info("Stub toggled", "id", s.id, "method", s.api.Method, "url", s.api.Url, "enabled", enabled)
+			writeJSON(w, http.StatusOK, s.report())
+		}
+	}
+	handle("POST /stubs", serveAddStubs)
+	handle("DELETE /stubs/{id}", serveRemoveStub)
+	handle("GET /stubs/{id}", serveStub)
+	handle("GET /routes", serveRouteDump)
+	handle("PATCH /stubs/{id}", servePatchStub)
+	handle("DELETE /stubs/{id}/patches", serveRevertStub)
+	handle("POST /stubs/{id}/enable", toggle(true))
+	handle("POST /stubs/{id}/disable", toggle(false))
+
+	handle("POST /reload", serveReload)
+	handle("GET /profile", serveProfile)
+	handle("POST /profile", serveSwitchProfile)
+	handle("GET /snapshot", serveSnapshot)
+	handle("POST /restore", serveRestore)
+
+	handle("GET /requests", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		writeJSON(w, http.StatusOK, routesFor(r).journal.report().filter(q.Get("method"), q.Get("path"), q.Get("stub")))
+	})
+	handle("DELETE /requests", func(w http.ResponseWriter, r *http.Request) {
+		routesFor(r).journal.reset()
+		slog.Info("Journal cleared")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /unmatched", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, routesFor(r).misses.report())
+	})
+	handle("DELETE /unmatched", func(w http.ResponseWriter, r *http.Request) {
+		routesFor(r).misses.reset()
+		slog.Info("Unmatched requests cleared")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /mutations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, routesFor(r).mutations.report())
+	})
+	handle("POST /mutations/{requestId}", serveMutationResult)
+	handle("DELETE /mutations", func(w http.ResponseWriter, r *http.Request) {
+		routesFor(r).mutations.reset()
+		slog.Info("Mutations cleared")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /emails", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, mailbox.report(r.URL.Query().Get("to")))
+	})
+	handle("GET /emails/{id}", serveEmail)
+	handle("DELETE /emails", func(w http.ResponseWriter, r *http.Request) {
+		mailbox.reset()
+		slog.Info("Emails cleared")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("GET /tls-faults", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, tlsFaultState.report)
+	})
+	handle("GET /tls-faults/ca.pem", serveTLSFaultCA)
+	handle("GET /schema", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, configSchema())
+	})
+
+	handle("GET /scenarios", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, routesFor(r).scenariosReport())
+	})
+	handle("POST /scenarios/{name}/run", serveRunScenario)
+	handle("DELETE /render-cache", func(w http.ResponseWriter, r *http.Request) {
+		renderCacheGeneration.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("GET /counters", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, templateCounters.report())
+	})
+	handle("DELETE /counters", func(w http.ResponseWriter, r *http.Request) {
+		templateCounters.reset()
+		slog.Info("Template counters reset")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	handle("GET /clock", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+	handle("DELETE /clock", func(w http.ResponseWriter, r *http.Request) {
+		clock.reset()
+		slog.Info("Clock reset")
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+	handle("POST /clock/freeze", func(w http.ResponseWriter, r *http.Request) {
+		clock.freeze()
+		slog.Info("Clock frozen", "now", clock.Now())
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+	handle("POST /clock/resume", func(w http.ResponseWriter, r *http.Request) {
+		clock.resume()
+		slog.Info("Clock resumed", "now", clock.Now())
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+	handle("POST /clock/advance", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			By string `json:"by"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		d, err := time.ParseDuration(req.By)
+		if err != nil {
+			http.Error(w, `expected {"by": "<duration>"}: `+err.Error(), http.StatusBadRequest)
+			return
+		}
+		clock.advance(d)
+		slog.Info("Clock advanced", "by", d, "now", clock.Now())
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+	handle("POST /clock/set", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Time time.Time `json:"time"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Time.IsZero() {
+			http.Error(w, `expected {"time": "<RFC 3339 time>"}`, http.StatusBadRequest)
+			return
+		}
+		clock.set(req.Time)
+		slog.Info("Clock set", "now", clock.Now())
+		writeJSON(w, http.StatusOK, clock.report())
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// AMQP 0-9-1 frame types and the method ids used to publish.
+const (
+	amqpMethodFrame    = 1
+	amqpHeaderFrame    = 2
+	amqpBodyFrame      = 3
+	amqpHeartbeatFrame = 8
+	amqpFrameEnd       = 0xce
+
+	amqpConnection = 10
+	amqpChannel    = 20
+	amqpBasic      = 60
+)
+
+type amqpMethod struct{ class, method uint16 }
+
+var (
+	amqpConnectionStart   = amqpMethod{amqpConnection, 10}
+	amqpConnectionStartOk = amqpMethod{amqpConnection, 11}
+	amqpConnectionTune    = amqpMethod{amqpConnection, 30}
+	amqpConnectionTuneOk  = amqpMethod{amqpConnection, 31}
+	amqpConnectionOpen    = amqpMethod{amqpConnection, 40}
+	amqpConnectionOpenOk  = amqpMethod{amqpConnection, 41}
+	amqpConnectionClose   = amqpMethod{amqpConnection, 50}
+	amqpConnectionCloseOk = amqpMethod{amqpConnection, 51}
+	amqpChannelOpen       = amqpMethod{amqpChannel, 10}
+	amqpChannelOpenOk     = amqpMethod{amqpChannel, 11}
+	amqpChannelClose      = amqpMethod{amqpChannel, 40}
+	amqpChannelCloseOk    = amqpMethod{amqpChannel, 41}
+	amqpBasicPublish      = amqpMethod{amqpBasic, 40}
+)
+
+// amqpConn speaks just enough AMQP 0-9-1 to publish over one channel.
+type amqpConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+func amqpShortString(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func amqpLongString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.WriteString(s)
+}
+
+// amqpTable encodes a field table of string values.
+func amqpTable(b *bytes.Buffer, fields map[string]string) {
+	var table bytes.Buffer
+	for key, val := range fields {
+		amqpShortString(&table, key)
+		table.WriteByte('S')
+		amqpLongString(&table, val)
+	}
+	binary.Write(b, binary.BigEndian, uint32(table.Len()))
+	b.Write(table.Bytes())
+}
+
+func (c *amqpConn) frame(kind byte, channel uint16, payload []byte) error {
+	var b bytes.Buffer
+	b.WriteByte(kind)
+	binary.Write(&b, binary.BigEndian, channel)
+	binary.Write(&b, binary.BigEndian, uint32(len(payload)))
+	b.Write(payload)
+	b.WriteByte(amqpFrameEnd)
+	_, err := c.w.Write(b.Bytes())
+	return err
+}
+
+func (c *amqpConn) call(channel uint16, m amqpMethod, args []byte) error {
+	payload := binary.BigEndian.AppendUint16(nil, m.class)
+	payload = binary.BigEndian.AppendUint16(payload, m.method)
+	return c.frame(amqpMethodFrame, channel, append(payload, args...))
+}
+
+// expect reads up to the next method, which must be want, and returns its
+// arguments. A close from the broker is returned as an error with the
+// broker's reason.
+func (c *amqpConn) expect(want amqpMethod) ([]byte, error) {
+	for {
+		var head [7]byte
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("amqp: connection closed by the broker, waiting for method %d.%d", want.class, want.method)
+			}
+			return nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, err
+		}
+		if payload[len(payload)-1] != amqpFrameEnd {
+			return nil, fmt.Errorf("amqp: bad frame end")
+		}
+		payload = payload[:len(payload)-1]
+		if head[0] == amqpHeartbeatFrame {
+			continue
+		}
+		if head[0] != amqpMethodFrame || len(payload) < 4 {
+			return nil, fmt.Errorf("amqp: unexpected frame type %d", head[0])
+		}
+		got := amqpMethod{binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])}
+		args := payload[4:]
+		if got == want {
+			return args, nil
+		}
+		if (got == amqpConnectionClose || got == amqpChannelClose) && len(args) >= 3 {
+			code := binary.BigEndian.Uint16(args)
+			text := args[3:]
+			if n := int(args[2]); n <= len(text) {
+				text = text[:n]
+			}
+			return nil, fmt.Errorf("amqp: closed by the broker: %d %s", code, text)
+		}
+		return nil, fmt.Errorf("amqp: unexpected method %d.%d, waiting for %d.%d", got.class, got.method, want.class, want.method)
+	}
+}
+
+// amqpVhost reads the virtual host from the broker URL path: "/" when
+// there is none, as RabbitMQ clients do, or the unescaped path.
+func amqpVhost(broker *url.URL) string {
+	vhost := strings.TrimPrefix(broker.Path, "/")
+	if vhost == "" {
+		return "/"
+	}
+	return vhost
+}
+
+// publishAMQP logs in with PLAIN, guest/guest by default, publishes a
+// persistent message on channel 1 and closes the channel and connection.
+// The close handshakes report a missing exchange or refused message.
+func publishAMQP(p *compiledPublish, msg *brokerMessage) error {
+	conn, err := p.dial(p.hosts[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	broker := p.broker
+	c := &amqpConn{w: conn, r: bufio.NewReader(conn)}
+	if _, err := conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpConnectionStart); err != nil {
+		return err
+	}
+	user, password := "guest", "guest"
+	if broker.User != nil {
+		user = broker.User.Username()
+		password, _ = broker.User.Password()
+	}
+	var args bytes.Buffer
+	amqpTable(&args, map[string]string{"product": "mock-server"})
+	amqpShortString(&args, "PLAIN")
+	amqpLongString(&args, "\x00"+user+"\x00"+password)
+	amqpShortString(&args, "en_US")
+	if err := c.call(0, amqpConnectionStartOk, args.Bytes()); err != nil {
+		return err
+	}
+	tune, err := c.expect(amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	if len(tune) < 8 {
+		return fmt.Errorf("amqp: short connection.tune")
+	}
+	channelMax, frameMax := binary.BigEndian.Uint16(tune), binary.BigEndian.Uint32(tune[2:])
+	if frameMax == 0 {
+		frameMax = 131072
+	}
+	args.Reset()
+	binary.Write(&args, binary.BigEndian, channelMax)
+	binary.Write(&args, binary.BigEndian, frameMax)
+	binary.Write(&args, binary.BigEndian, uint16(0)) // no heartbeats
+	if err := c.call(0, amqpConnectionTuneOk, args.Bytes()); err != nil {
+		return err
+	}
+	args.Reset()
+	amqpShortString(&args, amqpVhost(broker))
+	amqpShortString(&args, "")
+	args.WriteByte(0)
+	if err := c.call(0, amqpConnectionOpen, args.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpConnectionOpenOk); err != nil {
+		return err
+	}
+	if err := c.call(1, amqpChannelOpen, []byte{0}); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpChannelOpenOk); err != nil {
+		return err
+	}
+
+	args.Reset()
+	binary.Write(&args, binary.BigEndian, uint16(0))
+	amqpShortString(&args, msg.exchange)
+	amqpShortString(&args, msg.routingKey)
+	args.WriteByte(0) // not mandatory, not immediate
+	if err := c.call(1, amqpBasicPublish, args.Bytes()); err != nil {
+		return err
+	}
+	args.Reset()
+	binary.Write(&args, binary.BigEndian, uint16(amqpBasic))
+	binary.Write(&args, binary.BigEndian, uint16(0)) // weight
+	binary.Write(&args, binary.BigEndian, uint64(len(msg.payload)))
+	// properties: content-type, headers when there are some, delivery-mode
+	if len(msg.headers) > 0 {
+		binary.Write(&args, binary.BigEndian, uint16(0x8000|0x2000|0x1000))
+		amqpShortString(&args, msg.contentType)
+		amqpTable(&args, msg.headers)
+	} else {
+		binary.Write(&args, binary.BigEndian, uint16(0x8000|0x1000))
+		amqpShortString(&args, msg.contentType)
+	}
+	args.WriteByte(2) // persistent
+	if err := c.frame(amqpHeaderFrame, 1, args.Bytes()); err != nil {
+		return err
+	}
+	for rest, size := msg.payload, int(frameMax)-8; len(rest) > 0; {
+		chunk := rest[:min(size, len(rest))]
+		if err := c.frame(amqpBodyFrame, 1, chunk); err != nil {
+			return err
+		}
+		rest = rest[len(chunk):]
+	}
+
+	closeArgs := func() []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, uint16(200))
+		amqpShortString(&b, "done")
+		binary.Write(&b, binary.BigEndian, uint32(0)) // no failing class and method
+		return b.Bytes()
+	}
+	if err := c.call(1, amqpChannelClose, closeArgs()); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpChannelCloseOk); err != nil {
+		return err
+	}
+	if err := c.call(0, amqpConnectionClose, closeArgs()); err != nil {
+		return err
+	}
+	_, err = c.expect(amqpConnectionCloseOk)
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// amqpFrame is a frame received by the fake broker.
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func (f amqpFrame) method() amqpMethod {
+	if f.kind != amqpMethodFrame || len(f.payload) < 4 {
+		return amqpMethod{}
+	}
+	return amqpMethod{binary.BigEndian.Uint16(f.payload), binary.BigEndian.Uint16(f.payload[2:])}
+}
+
+func readAMQPFrame(r io.Reader) (amqpFrame, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return amqpFrame{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return amqpFrame{}, err
+	}
+	return amqpFrame{head[0], binary.BigEndian.Uint16(head[1:]), payload[:len(payload)-1]}, nil
+}
+
+// fakeAMQP accepts one client and walks it through the handshake with the
+// given frame size, answering its publish with a channel.close when refuse
+// is set. It hands the protocol header and every frame it gets to the test.
+func fakeAMQP(t *testing.T, frameMax uint32, refuse bool) (string, chan amqpFrame) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	frames := make(chan amqpFrame, 20)
+	go func() {
+		defer close(frames)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &amqpConn{w: conn, r: bufio.NewReader(conn)}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return
+		}
+		frames <- amqpFrame{payload: header}
+		c.call(0, amqpConnectionStart, nil)
+		for {
+			f, err := readAMQPFrame(c.r)
+			if err != nil {
+				return
+			}
+			frames <- f
+			switch f.method() {
+			case amqpConnectionStartOk:
+				tune := binary.BigEndian.AppendUint16(nil, 2047)
+				tune = binary.BigEndian.AppendUint32(tune, frameMax)
+				c.call(0, amqpConnectionTune, binary.BigEndian.AppendUint16(tune, 60))
+			case amqpConnectionOpen:
+				c.call(0, amqpConnectionOpenOk, []byte{0})
+			case amqpChannelOpen:
+				c.call(1, amqpChannelOpenOk, []byte{0, 0, 0, 0})
+			case amqpBasicPublish:
+				if refuse {
+					var args bytes.Buffer
+					binary.Write(&args, binary.BigEndian, uint16(404))
+					amqpShortString(&args, "NOT_FOUND - no exchange 'orders'")
+					binary.Write(&args, binary.BigEndian, uint32(60<<16|40))
+					c.call(1, amqpChannelClose, args.Bytes())
+				}
+			case amqpChannelClose:
+				c.call(1, amqpChannelCloseOk, nil)
+			case amqpConnectionClose:
+				c.call(0, amqpConnectionCloseOk, nil)
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), frames
+}
+
+// readAMQPShortString reads a short string off b.
+func readAMQPShortString(b *bytes.Reader) string {
+	n, _ := b.ReadByte()
+	s := make([]byte, n)
+	b.Read(s)
+	return string(s)
+}
+
+func readAMQPLongString(b *bytes.Reader) string {
+	var n uint32
+	binary.Read(b, binary.BigEndian, &n)
+	s := make([]byte, n)
+	b.Read(s)
+	return string(s)
+}
+
+func TestPublishAMQP(t *testing.T) {
+	// a small frame size splits the body over frames of 8 bytes
+	addr, frames := fakeAMQP(t, 16, false)
+	p := compileTestPublish(t, PublishFormat{Broker: "amqp://ada:secret@" + addr + "/orders%2Fprod", Exchange: "orders", RoutingKey: "created"})
+	msg := &brokerMessage{exchange: "orders", routingKey: "created", contentType: "application/json",
+		payload: []byte(`{"id": 7, "rush": true}`), headers: map[string]string{"source": "mock"}}
+	if err := p.send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if header := <-frames; string(header.payload) != "AMQP\x00\x00\x09\x01" {
+		t.Errorf("protocol header %q", header.payload)
+	}
+	startOk := <-frames
+	b := bytes.NewReader(startOk.payload[4:])
+	var tableSize uint32
+	binary.Read(b, binary.BigEndian, &tableSize)
+	b.Seek(int64(tableSize), io.SeekCurrent)
+	if mechanism, response := readAMQPShortString(b), readAMQPLongString(b); mechanism != "PLAIN" || response != "\x00ada\x00secret" {
+		t.Errorf("logged in with %s %q", mechanism, response)
+	}
+	tuneOk := <-frames
+	if tuneOk.method() != amqpConnectionTuneOk || !bytes.Equal(tuneOk.payload[4:], []byte{0x07, 0xff, 0, 0, 0, 16, 0, 0}) {
+		t.Errorf("tune-ok %x, want the broker's limits and no heartbeats", tuneOk.payload)
+	}
+	open := <-frames
+	if vhost := readAMQPShortString(bytes.NewReader(open.payload[4:])); open.method() != amqpConnectionOpen || vhost != "orders/prod" {
+		t.Errorf("opened vhost %q", vhost)
+	}
+	if channel := <-frames; channel.method() != amqpChannelOpen || channel.channel != 1 {
+		t.Errorf("channel open %+v", channel)
+	}
+
+	publish := <-frames
+	b = bytes.NewReader(publish.payload[4:])
+	b.Seek(2, io.SeekCurrent) // reserved
+	if exchange, key := readAMQPShortString(b), readAMQPShortString(b); publish.method() != amqpBasicPublish || exchange != "orders" || key != "created" {
+		t.Errorf("published to %q with key %q", exchange, key)
+	}
+	header := <-frames
+	if header.kind != amqpHeaderFrame || header.channel != 1 {
+		t.Fatalf("content header %+v", header)
+	}
+	b = bytes.NewReader(header.payload)
+	var class, weight, flags uint16
+	var size uint64
+	binary.Read(b, binary.BigEndian, &class)
+	binary.Read(b, binary.BigEndian, &weight)
+	binary.Read(b, binary.BigEndian, &size)
+	binary.Read(b, binary.BigEndian, &flags)
+	if class != amqpBasic || size != uint64(len(msg.payload)) || flags != 0xb000 {
+		t.Errorf("content header class %d, size %d, flags %x", class, size, flags)
+	}
+	if contentType := readAMQPShortString(b); contentType != "application/json" {
+		t.Errorf("content type %q", contentType)
+	}
+	binary.Read(b, binary.BigEndian, &tableSize)
+	if tableSize != 1+6+1+4+4 || readAMQPShortString(b) != "source" {
+		t.Errorf("headers table of %d bytes", tableSize)
+	}
+	b.Seek(int64(tableSize)-7, io.SeekCurrent)
+	if mode, _ := b.ReadByte(); mode != 2 || b.Len() != 0 {
+		t.Errorf("delivery mode %d, %d bytes left", mode, b.Len())
+	}
+	var body []byte
+	for {
+		f := <-frames
+		if f.kind != amqpBodyFrame {
+			if f.method() != amqpChannelClose {
+				t.Errorf("got method %+v after the body, want channel.close", f.method())
+			}
+			break
+		}
+		if len(f.payload) > 8 {
+			t.Errorf("body frame of %d bytes over the frame size", len(f.payload))
+		}
+		body = append(body, f.payload...)
+	}
+	if string(body) != string(msg.payload) {
+		t.Errorf("body %q", body)
+	}
+	if f := <-frames; f.method() != amqpConnectionClose {
+		t.Errorf("got method %+v, want connection.close", f.method())
+	}
+}
+
+func TestPublishAMQPDefaults(t *testing.T) {
+	addr, frames := fakeAMQP(t, 0, false)
+	p := compileTestPublish(t, PublishFormat{Broker: "amqp://" + addr, Exchange: "orders"})
+	if err := p.send(&brokerMessage{exchange: "orders", contentType: "text/plain", payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	<-frames
+	startOk := bytes.NewReader((<-frames).payload[4:])
+	var tableSize uint32
+	binary.Read(startOk, binary.BigEndian, &tableSize)
+	startOk.Seek(int64(tableSize), io.SeekCurrent)
+	if readAMQPShortString(startOk); readAMQPLongString(startOk) != "\x00guest\x00guest" {
+		t.Error("didn't log in as guest")
+	}
+	<-frames
+	if vhost := readAMQPShortString(bytes.NewReader((<-frames).payload[4:])); vhost != "/" {
+		t.Errorf("opened vhost %q, want /", vhost)
+	}
+	<-frames
+	<-frames
+	if header := <-frames; binary.BigEndian.Uint16(header.payload[12:]) != 0x9000 {
+		t.Errorf("flags %x without headers, want content type and delivery mode", header.payload[12:14])
+	}
+}
+
+func TestPublishAMQPRefused(t *testing.T) {
+	addr, _ := fakeAMQP(t, 0, true)
+	p := compileTestPublish(t, PublishFormat{Broker: "amqp://" + addr, Exchange: "orders"})
+	err := p.send(&brokerMessage{exchange: "orders", payload: []byte("x")})
+	if err == nil || !strings.Contains(err.Error(), "closed by the broker: 404 NOT_FOUND") {
+		t.Errorf("got %v, want the broker's close reason", err)
+	}
+}
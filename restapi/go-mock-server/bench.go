@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchRequest struct {
+	method string
+	path   string
+}
+
+// benchPath turns a stub url into a concrete path by filling wildcards.
+func benchPath(url string) string {
+	path := strings.ReplaceAll(url, "{$}", "")
+	return wildcardPattern.ReplaceAllStringFunc(path, func(w string) string {
+		if strings.HasSuffix(w, "...}") {
+			return "bench"
+		}
+		return "1"
+	})
+}
+
+func benchRequests(mockData, basePath, path, method string) ([]benchRequest, error) {
+	if path != "" {
+		return []benchRequest{{method, path}}, nil
+	}
+	apis, _, _, err := loadConfig(mockData, basePath)
+	if err != nil {
+		return nil, err
+	}
+	requests := []benchRequest{}
+	for _, api := range apis {
+		m := api.Method
+		if m == "" {
+			m = http.MethodGet
+		}
+		requests = append(requests, benchRequest{m, benchPath(api.Url)})
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%s has no stubs to use as requests", mockData)
+	}
+	return requests, nil
+}
+
+type benchResult struct {
+	latency time.Duration
+	status  int
+	err     bool
+}
+
+// runBench implements the "bench" subcommand: it fires concurrent load at
+// target, cycling through the stubs of the mock data file as requests, and
+// prints throughput and latency percentiles.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base url to send requests to")
+	mockData := fs.String("mock-data", "../data/sample.json", "stub definitions used as request templates")
+	basePath := fs.String("base-path", "", "base path the mock was started with")
+	path := fs.String("path", "", "benchmark a single path instead of the mock data stubs")
+	method := fs.String("method", http.MethodGet, "method used with -path")
+	concurrency := fs.Int("concurrency", 16, "number of concurrent workers")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send requests")
+	total := fs.Int("requests", 0, "stop after this many requests instead of after -duration")
+	fs.Parse(args)
+
+	requests, err := benchRequests(*mockData, *basePath, *path, *method)
+	check(err)
+	base := strings.TrimSuffix(*target, "/")
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		// redirects are responses worth measuring, not following
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	var sent atomic.Int64
+	deadline := time.Now().Add(*duration)
+	results := make([][]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for worker := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := sent.Add(1)
+				if *total > 0 && n > int64(*total) || *total <= 0 && time.Now().After(deadline) {
+					return
+				}
+				req := requests[int(n-1)%len(requests)]
+				began := time.Now()
+				res := benchResult{}
+				httpReq, err := http.NewRequest(req.method, base+req.path, nil)
+				if err == nil {
+					var resp *http.Response
+					resp, err = client.Do(httpReq)
+					if err == nil {
+						io.Copy(io.Discard, resp.Body)
+						resp.Body.Close()
+						res.status = resp.StatusCode
+					}
+				}
+				res.err = err != nil
+				res.latency = time.Since(began)
+				results[worker] = append(results[worker], res)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	latencies := []time.Duration{}
+	statuses := map[int]int{}
+	failed := 0
+	for _, worker := range results {
+		for _, res := range worker {
+			if res.err {
+				failed++
+				continue
+			}
+			statuses[res.status]++
+			latencies = append(latencies, res.latency)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	count := len(latencies) + failed
+
+	fmt.Printf("requests:   %d in %s (%d workers, %d distinct requests)\n", count, elapsed.Round(time.Millisecond), *concurrency, len(requests))
+	fmt.Printf("throughput: %.1f req/s\n", float64(count)/elapsed.Seconds())
+	fmt.Printf("errors:     %d\n", failed)
+	codes := []int{}
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	for _, status := range codes {
+		fmt.Printf("status %d: %d\n", status, statuses[status])
+	}
+	if len(latencies) > 0 {
+		at := func(p float64) time.Duration { return latencies[int(p*float64(len(latencies)-1))] }
+		fmt.Printf("latency:    p50 %s  p95 %s  p99 %s  max %s\n", at(0.50), at(0.95), at(0.99), latencies[len(latencies)-1])
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// BodyLimitFormat caps the request bodies a stub accepts, answering larger
+// ones with a 413. A plain JSON number is shorthand for {"bytes": N}.
+type BodyLimitFormat struct {
+	// Bytes a body may have, 0 for no limit, e.g. to lift -max-body
+	Bytes int64 `json:"bytes"`
+	// RetryAfter in seconds is sent with the 413 when set, for a limit
+	// clients may wait out
+	RetryAfter int `json:"retryAfter"`
+}
+
+func (l *BodyLimitFormat) UnmarshalJSON(b []byte) error {
+	var n int64
+	if json.Unmarshal(b, &n) == nil {
+		*l = BodyLimitFormat{Bytes: n}
+		return nil
+	}
+	type plain BodyLimitFormat
+	return json.Unmarshal(b, (*plain)(l))
+}
+
+// defaultBodyLimit is -max-body, the limit of stubs without maxBody.
+var defaultBodyLimit int64
+
+// stubBodyLimit is the body limit of api, its maxBody or -max-body.
+func stubBodyLimit(api ApiFormat) BodyLimitFormat {
+	if api.MaxBody != nil {
+		return *api.MaxBody
+	}
+	return BodyLimitFormat{Bytes: defaultBodyLimit}
+}
+
+// bodyLimitReport is the body of a 413, telling how much of the body was
+// read before giving up.
+type bodyLimitReport struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit"`
+	// Read is 0 when the Content-Length was over the limit, and the bytes
+	// read up to and just past the limit otherwise
+	Read          int64 `json:"read"`
+	ContentLength int64 `json:"contentLength,omitempty"`
+}
+
+// withBodyLimit rejects bodies over the limit before the stub sees them: at
+// once by Content-Length, otherwise after reading one byte past the limit.
+// Accepted bodies are read into memory and restored for the handler.
+func withBodyLimit(api ApiFormat, limit BodyLimitFormat, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := bodyLimitReport{Error: "request body too large", Limit: limit.Bytes}
+		if r.ContentLength > limit.Bytes {
+			report.ContentLength = r.ContentLength
+		} else if r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, limit.Bytes+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) <= limit.Bytes {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				next(w, r)
+				return
+			}
+			report.Read = int64(len(body))
+		} else {
+			next(w, r)
+			return
+		}
+		slog.Debug("Request body over limit", "url", api.Url, "limit", limit.Bytes, "read", report.Read, "contentLength", r.ContentLength)
+		rejectBody(w, limit, report)
+	}
+}
+
+func rejectBody(w http.ResponseWriter, limit BodyLimitFormat, report bodyLimitReport) {
+	// the rest of the body is left unread, so the connection can't be reused
+	w.Header().Set("Connection", "close")
+	if limit.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(limit.RetryAfter))
+	}
+	writeJSON(w, http.StatusRequestEntityTooLarge, report)
+}
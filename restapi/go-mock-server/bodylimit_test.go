@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingReader is an endless body of spaces, counting the bytes read.
+type countingReader struct {
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	c.read += int64(len(p))
+	return len(p), nil
+}
+
+func serveBody(lr *liveRoutes, body io.Reader, contentLength int64) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders", body)
+	r.ContentLength = contentLength
+	w := httptest.NewRecorder()
+	lr.ServeHTTP(w, r)
+	return w
+}
+
+func TestBodyMatchingHonorsBodyLimit(t *testing.T) {
+	defer func(limit int64) { defaultBodyLimit = limit }(defaultBodyLimit)
+	defaultBodyLimit = 64
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"only conditional stubs", `[{"url": "/orders", "method": "POST", "match": {"body": {"rush": "true"}}, "response": {"status": 201}}]`},
+		{"xpath", `[{"url": "/orders", "method": "POST", "match": {"xpath": {"/order/@rush": "true"}}, "response": {"status": 201}}]`},
+		{"with a fallback", `[{"url": "/orders", "method": "POST", "match": {"body": {"rush": "true"}}, "response": {"status": 201}},
+			{"url": "/orders", "method": "POST", "response": {"status": 200}}]`},
+		{"own limit", `[{"url": "/orders", "method": "POST", "maxBody": 64, "match": {"body": {"rush": "true"}}, "response": {"status": 201}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "own limit" {
+				defaultBodyLimit = 0
+				defer func() { defaultBodyLimit = 64 }()
+			}
+			lr, _ := newTestRoutes(t, tt.config)
+
+			body := &countingReader{}
+			w := serveBody(lr, body, -1)
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("streamed body answered %d, want 413", w.Code)
+			}
+			// reads are buffered, but never more than a buffer past the limit
+			if body.read > 64+32<<10 {
+				t.Errorf("read %d bytes of the body", body.read)
+			}
+			var report bodyLimitReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.Limit != 64 || report.Read != 65 {
+				t.Errorf("got %s, want the limit and the bytes read", w.Body.Bytes())
+			}
+
+			body = &countingReader{}
+			w = serveBody(lr, body, 1<<30)
+			if w.Code != http.StatusRequestEntityTooLarge || body.read != 0 {
+				t.Errorf("body over the limit by Content-Length answered %d after reading %d bytes, want 413 at once", w.Code, body.read)
+			}
+		})
+	}
+}
+
+func TestBodyMatchingWithinLimit(t *testing.T) {
+	defer func(limit int64) { defaultBodyLimit = limit }(defaultBodyLimit)
+	defaultBodyLimit = 64
+	lr, _ := newTestRoutes(t, `[{"url": "/orders", "method": "POST", "match": {"body": {"rush": "true"}}, "response": {"status": 201}},
+		{"url": "/orders", "method": "POST", "response": {"status": 200}}]`)
+	for body, want := range map[string]int{`{"rush": true}`: 201, `{"rush": false}`: 200, "": 200} {
+		if w := serveBody(lr, strings.NewReader(body), -1); w.Code != want {
+			t.Errorf("%q answered %d, want %d", body, w.Code, want)
+		}
+	}
+}
+
+func TestMatchBodyKeepsBodyForHandler(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	if _, ok := readBodyUpTo(r, BodyLimitFormat{Bytes: 4}); ok {
+		t.Fatal("body over the limit was read")
+	}
+	if body, ok := readBodyUpTo(r, BodyLimitFormat{Bytes: 20}); !ok || string(body) != "0123456789" {
+		t.Fatalf("got %q, %v with a larger limit", body, ok)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != "0123456789" {
+		t.Fatalf("handler read %q", body)
+	}
+}
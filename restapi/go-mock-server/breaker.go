@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerFormat makes a stub behave like a dependency behind a circuit
+// breaker: after Failures failed responses in a row it trips and answers
+// fast 503s, skipping any delay, for CoolDown. Then it is half-open and
+// lets trial requests through, closing again on success and re-opening on
+// failure.
+type BreakerFormat struct {
+	// Failures in a row that trip the breaker, default 5
+	Failures int `json:"failures"`
+	// FailureStatus is the lowest status counted as failure, default 500
+	FailureStatus int `json:"failureStatus"`
+	// CoolDown in ms the breaker stays open, default 10000
+	CoolDown int `json:"coolDown"`
+	// HalfOpenRequests let through at a time while half-open, default 1
+	HalfOpenRequests int `json:"halfOpenRequests"`
+	// Status answered while open, default 503
+	Status int                    `json:"status"`
+	Body   map[string]interface{} `json:"body"`
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// breaker is the state shared by every request to one stub.
+type breaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+// admit reports whether a request may reach the stub, and whether it is a
+// half-open trial.
+func (b *breaker) admit(cfg *BreakerFormat) (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && clock.Since(b.openedAt) >= time.Duration(cfg.CoolDown)*time.Millisecond {
+		b.state, b.trials = breakerHalfOpen, 0
+	}
+	switch b.state {
+	case breakerOpen:
+		return false, false
+	case breakerHalfOpen:
+		if b.trials >= cfg.HalfOpenRequests {
+			return false, false
+		}
+		b.trials++
+		return true, true
+	}
+	return true, false
+}
+
+// result records the outcome of an admitted request and returns the new
+// state if it changed.
+func (b *breaker) result(cfg *BreakerFormat, failed, trial bool) (breakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.state
+	switch {
+	case trial && failed:
+		b.state, b.openedAt = breakerOpen, clock.Now()
+	case trial:
+		b.state, b.failures = breakerClosed, 0
+	case b.state != breakerClosed:
+		// a request admitted before the breaker tripped
+	case failed:
+		b.failures++
+		if b.failures >= cfg.Failures {
+			b.state, b.openedAt, b.failures = breakerOpen, clock.Now(), 0
+		}
+	default:
+		b.failures = 0
+	}
+	return b.state, b.state != previous
+}
+
+func withBreaker(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Breaker
+	if cfg.Failures == 0 {
+		cfg.Failures = 5
+	}
+	if cfg.FailureStatus == 0 {
+		cfg.FailureStatus = http.StatusInternalServerError
+	}
+	if cfg.CoolDown == 0 {
+		cfg.CoolDown = 10000
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusServiceUnavailable
+	}
+	body := cfg.Body
+	if body == nil {
+		body = map[string]interface{}{"error": "circuit open"}
+	}
+	retryAfter := strconv.Itoa((cfg.CoolDown + 999) / 1000)
+	state := &breaker{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		admitted, trial := state.admit(cfg)
+		if !admitted {
+			w.Header().Set("Retry-After", retryAfter)
+			writeJSON(w, cfg.Status, body)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		// a panic counts as a failure, and frees a half-open trial slot
+		completed := false
+		defer func() {
+			failed := !completed || rec.status >= cfg.FailureStatus
+			if now, changed := state.result(cfg, failed, trial); changed {
+				slog.Info("Circuit breaker changed state", "method", api.Method, "url", api.Url, "state", now)
+			}
+		}()
+		next(rec, r)
+		completed = true
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerCountsPanickedTrialAsFailure(t *testing.T) {
+	clock.freeze()
+	defer clock.reset()
+	fail := true
+	h := withBreaker(ApiFormat{Url: "/pay", Breaker: &BreakerFormat{Failures: 1, CoolDown: 1000}}, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			panic("dependency down")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	call := func() (code int, panicked bool) {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodPost, "/pay", nil))
+		return w.Code, false
+	}
+	if _, panicked := call(); !panicked {
+		t.Fatal("the handler's panic was swallowed")
+	}
+	if code, _ := call(); code != http.StatusServiceUnavailable {
+		t.Fatalf("after a panic the breaker answered %d, want 503", code)
+	}
+	// the half-open trial panics too, re-opening the breaker
+	clock.advance(1001 * time.Millisecond)
+	if _, panicked := call(); !panicked {
+		t.Fatal("the trial didn't reach the handler")
+	}
+	if code, _ := call(); code != http.StatusServiceUnavailable {
+		t.Fatalf("after a panicked trial the breaker answered %d, want 503", code)
+	}
+	// and the next trial is let through once it cools down again
+	fail = false
+	clock.advance(1001 * time.Millisecond)
+	if code, _ := call(); code != http.StatusOK {
+		t.Errorf("the next trial answered %d, want 200", code)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A bundled binary is the server executable followed by a zip of the
+// config directory and a trailer holding the zip's length and bundleMagic.
+// The zip comment names the mock data file to load.
+const bundleMagic = "MOCKZIP1"
+
+const bundleTrailer = 8 + len(bundleMagic)
+
+// bundleRange finds the bundled zip in an executable of the given size,
+// returning offset and length, or a zero length if there is none.
+func bundleRange(exe io.ReaderAt, size int64) (int64, int64, error) {
+	if size < int64(bundleTrailer) {
+		return 0, 0, nil
+	}
+	trailer := make([]byte, bundleTrailer)
+	if _, err := exe.ReadAt(trailer, size-int64(bundleTrailer)); err != nil {
+		return 0, 0, err
+	}
+	if string(trailer[8:]) != bundleMagic {
+		return 0, 0, nil
+	}
+	length := int64(binary.LittleEndian.Uint64(trailer))
+	offset := size - int64(bundleTrailer) - length
+	if offset < 0 {
+		return 0, 0, errors.New("corrupt config bundle trailer")
+	}
+	return offset, length, nil
+}
+
+// openExecutable opens the running binary and finds its bundle, if any.
+func openExecutable() (*os.File, int64, int64, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	exe, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	info, err := exe.Stat()
+	if err != nil {
+		exe.Close()
+		return nil, 0, 0, err
+	}
+	offset, length, err := bundleRange(exe, info.Size())
+	if err != nil {
+		exe.Close()
+		return nil, 0, 0, err
+	}
+	return exe, offset, length, nil
+}
+
+// extractBundle unpacks the config baked into the running binary into a
+// temporary directory and returns the path of its mock data file, "" when
+// the binary carries no config.
+func extractBundle() (string, error) {
+	exe, offset, length, err := openExecutable()
+	if err != nil {
+		return "", err
+	}
+	defer exe.Close()
+	if length == 0 {
+		return "", nil
+	}
+	archive, err := zip.NewReader(io.NewSectionReader(exe, offset, length), length)
+	if err != nil {
+		return "", fmt.Errorf("config bundle: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "mock-server-config-")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range archive.File {
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			return "", fmt.Errorf("config bundle: bad file name %q", f.Name)
+		}
+		if err := extractFile(f, target); err != nil {
+			return "", fmt.Errorf("config bundle: %w", err)
+		}
+	}
+	slog.Debug("Extracted bundled config", "dir", dir, "mock_data", archive.Comment)
+	return filepath.Join(dir, filepath.FromSlash(archive.Comment)), nil
+}
+
+func extractFile(f *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// zipConfig archives the directory holding mockData, so includes and other
+// files referenced relative to it come along.
+func zipConfig(mockData string) ([]byte, error) {
+	dir := filepath.Dir(mockData)
+	entry, err := filepath.Rel(dir, mockData)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		w, err := archive.Create(filepath.ToSlash(name))
+		if err != nil {
+			return err
+		}
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.SetComment(filepath.ToSlash(entry)); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runBuild implements the "build" subcommand: it writes a copy of this
+// binary with a mock data file and its directory baked in, which it serves
+// without needing -mock-data.
+func runBuild(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	config := fs.String("config", "", "mock data file to bake in, together with everything in its directory")
+	out := fs.String("o", "mock-server-bundle", "output binary")
+	fs.Parse(args)
+	if *config == "" {
+		check(errors.New("build needs -config"))
+	}
+
+	// validated now rather than on the QA box
+	_, _, _, err := loadConfig(*config, "")
+	check(err)
+	archive, err := zipConfig(*config)
+	check(err)
+
+	exe, offset, length, err := openExecutable()
+	check(err)
+	defer exe.Close()
+	if length == 0 {
+		info, err := exe.Stat()
+		check(err)
+		offset = info.Size()
+	}
+	// a bundled binary can be rebundled; its own config is left out
+	binaryPart, err := io.ReadAll(io.NewSectionReader(exe, 0, offset))
+	check(err)
+
+	trailer := binary.LittleEndian.AppendUint64(nil, uint64(len(archive)))
+	trailer = append(trailer, bundleMagic...)
+	bundled := append(append(binaryPart, archive...), trailer...)
+	check(os.WriteFile(*out, bundled, 0o755))
+	fmt.Printf("wrote %s with %s (%d bytes of config)\n", *out, *config, len(archive))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CacheFormat sets consistent caching headers on a stub's responses from
+// a named preset. A plain JSON string is shorthand for {"preset": "..."}.
+type CacheFormat struct {
+	// Preset is one of "no-store", "no-cache", "short", "private" or
+	// "immutable"
+	Preset string `json:"preset"`
+	// MaxAge in seconds overrides the preset's, where it has one
+	MaxAge int `json:"maxAge"`
+	// Vary lists request headers the response depends on
+	Vary []string `json:"vary"`
+}
+
+func (c *CacheFormat) UnmarshalJSON(b []byte) error {
+	var preset string
+	if json.Unmarshal(b, &preset) == nil {
+		*c = CacheFormat{Preset: preset}
+		return nil
+	}
+	type plain CacheFormat
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+type cachePreset struct {
+	control string
+	// maxAge in seconds, -1 for presets that must not be stored or reused
+	maxAge int
+}
+
+var cachePresets = map[string]cachePreset{
+	"no-store":  {"no-store", -1},
+	"no-cache":  {"no-cache", -1},
+	"short":     {"public, max-age=%d", 60},
+	"private":   {"private, max-age=%d", 300},
+	"immutable": {"public, max-age=%d, immutable", 31536000},
+}
+
+// epoch is the Expires value of responses that are stale at once.
+var epoch = time.Unix(0, 0).UTC().Format(http.TimeFormat)
+
+func withCache(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Cache
+	preset, ok := cachePresets[cfg.Preset]
+	if !ok {
+		check(fmt.Errorf("unknown cache preset %q for %s %s", cfg.Preset, api.Method, api.Url))
+	}
+	if cfg.MaxAge > 0 && preset.maxAge >= 0 {
+		preset.maxAge = cfg.MaxAge
+	}
+	control := preset.control
+	if preset.maxAge >= 0 {
+		control = fmt.Sprintf(control, preset.maxAge)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", control)
+		if preset.maxAge < 0 {
+			h.Set("Expires", epoch)
+			h.Set("Pragma", "no-cache")
+		} else {
+			h.Set("Expires", clock.Now().Add(time.Duration(preset.maxAge)*time.Second).UTC().Format(http.TimeFormat))
+		}
+		for _, header := range cfg.Vary {
+			h.Add("Vary", header)
+		}
+		next(w, r)
+	}
+}
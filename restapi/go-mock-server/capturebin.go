@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// captureStub names the catch-all capture handler in the journal.
+const captureStub = "capture-all"
+
+// newCaptureHandler builds a "capture" response: it reads the whole request
+// body, so the journal keeps it, and answers with the configured response,
+// by default a 200 with the request id.
+func newCaptureHandler(api ApiFormat) http.HandlerFunc {
+	if api.Response.Status == 0 {
+		api.Response.Status = http.StatusOK
+	}
+	if api.Response.Body == nil {
+		api.Response.Body = map[string]interface{}{"captured": true, "requestId": "{{.RequestID}}"}
+	}
+	if api.Response.Headers == nil {
+		api.Response.Headers = map[string]interface{}{"Content-Type": "application/json"}
+	}
+	respond := newStaticHandler(api)
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Debug("Request captured", "method", r.Method, "path", r.URL.Path, "bytes", n)
+		respond(w, r)
+	}
+}
@@ -0,0 +1,282 @@
+// Package client drives a running mock server through its admin API, for
+// tests and scripts that add stubs, switch profiles and verify the calls
+// the system under test made.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the admin API of the mock server at BaseURL, e.g.
+// http://localhost:8080, or the -admin-listen address.
+type Client struct {
+	BaseURL string
+	// Token is sent as a bearer token, for -admin-token
+	Token string
+	// User and Password are sent with basic auth, for -admin-user
+	User, Password string
+	// Workspace addresses a workspace's admin API instead of the default
+	Workspace  string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the mock server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Error is a response from the admin API other than a success.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("admin api: %d %s", e.Status, e.Message)
+}
+
+// Stub is a registered stub as the admin API lists it.
+type Stub struct {
+	ID      string `json:"id"`
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+}
+
+// ReloadReport tells which stub ids a change of the stubs added, removed
+// or changed.
+type ReloadReport struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// Profile is the active profile and those the config defines.
+type Profile struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+// Request is a journal entry of a request the mock received.
+type Request struct {
+	RequestID string              `json:"requestId"`
+	Time      time.Time           `json:"time"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"`
+	Query     string              `json:"query,omitempty"`
+	Headers   map[string][]string `json:"headers"`
+	Body      string              `json:"body,omitempty"`
+	Workspace string              `json:"workspace,omitempty"`
+	Stub      string              `json:"stub,omitempty"`
+	Status    int                 `json:"status"`
+	// Duration in milliseconds
+	Duration float64 `json:"duration"`
+}
+
+// Filter selects journal entries; empty fields match any.
+type Filter struct {
+	Method string
+	Path   string
+	Stub   string
+}
+
+func (f Filter) String() string {
+	parts := []string{}
+	for _, part := range []string{f.Method, f.Path} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if f.Stub != "" {
+		parts = append(parts, "served by "+f.Stub)
+	}
+	if len(parts) == 0 {
+		return "any request"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	prefix := c.BaseURL
+	if c.Workspace != "" {
+		prefix += "/workspaces/" + url.PathEscape(c.Workspace)
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, prefix+"/__admin"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.User != "":
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Stubs lists the registered stubs in load order.
+func (c *Client) Stubs(ctx context.Context) ([]Stub, error) {
+	var stubs []Stub
+	err := c.do(ctx, http.MethodGet, "/stubs", nil, &stubs)
+	return stubs, err
+}
+
+// AddStubs registers stubs, each anything encoding to a stub of the mock
+// data format, e.g. a map or json.RawMessage. Those without an id are
+// named added-N, as the report tells.
+func (c *Client) AddStubs(ctx context.Context, stubs ...interface{}) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodPost, "/stubs", stubs, &report)
+	return report, err
+}
+
+// RemoveStub drops a stub added with AddStubs.
+func (c *Client) RemoveStub(ctx context.Context, id string) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodDelete, "/stubs/"+url.PathEscape(id), nil, &report)
+	return report, err
+}
+
+// PatchStub changes a stub of the config or one added with AddStubs, until
+// RevertStub: patch is a JSON merge patch object, e.g. a map, or a JSON
+// Patch array of operations.
+func (c *Client) PatchStub(ctx context.Context, id string, patch interface{}) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodPatch, "/stubs/"+url.PathEscape(id), patch, &report)
+	return report, err
+}
+
+// RevertStub drops the patches made to a stub with PatchStub.
+func (c *Client) RevertStub(ctx context.Context, id string) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodDelete, "/stubs/"+url.PathEscape(id)+"/patches", nil, &report)
+	return report, err
+}
+
+// SetStubEnabled switches a stub on or off.
+func (c *Client) SetStubEnabled(ctx context.Context, id string, enabled bool) (Stub, error) {
+	action := "/disable"
+	if enabled {
+		action = "/enable"
+	}
+	var stub Stub
+	err := c.do(ctx, http.MethodPost, "/stubs/"+url.PathEscape(id)+action, nil, &stub)
+	return stub, err
+}
+
+// Reload reads the mock data file again.
+func (c *Client) Reload(ctx context.Context) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodPost, "/reload", nil, &report)
+	return report, err
+}
+
+// Profile tells the active profile and those available.
+func (c *Client) Profile(ctx context.Context) (Profile, error) {
+	var profile Profile
+	err := c.do(ctx, http.MethodGet, "/profile", nil, &profile)
+	return profile, err
+}
+
+// SwitchProfile applies the named profile, "" for none.
+func (c *Client) SwitchProfile(ctx context.Context, name string) (ReloadReport, error) {
+	var report ReloadReport
+	err := c.do(ctx, http.MethodPost, "/profile", map[string]string{"name": name}, &report)
+	return report, err
+}
+
+// Requests returns the journal entries matching f, oldest first.
+func (c *Client) Requests(ctx context.Context, f Filter) ([]Request, error) {
+	q := url.Values{}
+	for key, val := range map[string]string{"method": f.Method, "path": f.Path, "stub": f.Stub} {
+		if val != "" {
+			q.Set(key, val)
+		}
+	}
+	path := "/requests"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var report struct {
+		Requests []Request `json:"requests"`
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &report)
+	return report.Requests, err
+}
+
+// ResetRequests clears the journal.
+func (c *Client) ResetRequests(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/requests", nil, nil)
+}
+
+// VerificationError is returned when the number of matching requests is
+// out of range.
+type VerificationError struct {
+	Filter Filter
+	Got    int
+	// Min and Max are the accepted range, Max -1 for no upper bound
+	Min, Max int
+}
+
+func (e *VerificationError) Error() string {
+	want := fmt.Sprintf("%d to %d", e.Min, e.Max)
+	switch {
+	case e.Min == e.Max:
+		want = fmt.Sprint(e.Min)
+	case e.Max < 0:
+		want = fmt.Sprintf("at least %d", e.Min)
+	}
+	return fmt.Sprintf("expected %s requests matching %s, got %d", want, e.Filter, e.Got)
+}
+
+// Verify checks that between min and max requests, max -1 for no upper
+// bound, in the journal match f, and returns them.
+func (c *Client) Verify(ctx context.Context, f Filter, min, max int) ([]Request, error) {
+	requests, err := c.Requests(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) < min || max >= 0 && len(requests) > max {
+		return requests, &VerificationError{Filter: f, Got: len(requests), Min: min, Max: max}
+	}
+	return requests, nil
+}
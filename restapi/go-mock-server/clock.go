@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// mockClock is the virtual time used by templates and time based stub
+// behavior. It follows the wall clock, shifted by an offset, until it is
+// frozen through the admin API.
+type mockClock struct {
+	mu       sync.Mutex
+	offset   time.Duration
+	frozen   bool
+	frozenAt time.Time
+}
+
+var clock = &mockClock{}
+
+func (c *mockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		return c.frozenAt
+	}
+	return time.Now().Add(c.offset)
+}
+
+func (c *mockClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *mockClock) freeze() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.frozen {
+		c.frozenAt = time.Now().Add(c.offset)
+		c.frozen = true
+	}
+}
+
+// resume lets a frozen clock tick again from the time it was frozen at.
+func (c *mockClock) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.offset = time.Until(c.frozenAt)
+		c.frozen = false
+	}
+}
+
+func (c *mockClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.frozenAt = c.frozenAt.Add(d)
+	} else {
+		c.offset += d
+	}
+}
+
+func (c *mockClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frozen {
+		c.frozenAt = t
+	} else {
+		c.offset = time.Until(t)
+	}
+}
+
+// reset returns to real, ticking time.
+func (c *mockClock) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = 0
+	c.frozen = false
+}
+
+type clockReport struct {
+	Now    time.Time `json:"now"`
+	Frozen bool      `json:"frozen"`
+	// Offset from the wall clock, in Go duration syntax
+	Offset string `json:"offset"`
+}
+
+func (c *mockClock) report() clockReport {
+	now := c.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return clockReport{Now: now, Frozen: c.frozen, Offset: time.Until(now).Round(time.Millisecond).String()}
+}
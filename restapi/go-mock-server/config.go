@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// joinPath prepends a base path or group prefix to a stub url.
+func joinPath(prefix, url string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return url
+	}
+	if !strings.HasPrefix(url, "/") {
+		url = "/" + url
+	}
+	return "/" + prefix + url
+}
+
+// expandGroups flattens group entries into plain stubs, prepending each
+// group's prefix, and the base path, to the urls inside it.
+func expandGroups(apis []ApiFormat, prefix string) []ApiFormat {
+	expanded := make([]ApiFormat, 0, len(apis))
+	for _, api := range apis {
+		if api.Stubs != nil {
+			expanded = append(expanded, expandGroups(api.Stubs, joinPath(prefix, api.Prefix))...)
+			continue
+		}
+		api.Url = joinPath(prefix, api.Url)
+		expanded = append(expanded, api)
+	}
+	return expanded
+}
+
+// jsonErrorPosition locates a syntax or type error in the document as
+// ":line:column", "" for other errors.
+func jsonErrorPosition(doc []byte, err error) string {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return ""
+	}
+	if offset > int64(len(doc)) {
+		offset = int64(len(doc))
+	}
+	before := doc[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf(":%d:%d", line, column)
+}
+
+// readConfig parses a mock data file, replacing include entries with the
+// stubs of the files they name, relative to the including file.
+func readConfig(path string, including []string) ([]ApiFormat, error) {
+	path = filepath.Clean(path)
+	for _, parent := range including {
+		if parent == path {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(including, path), " -> "))
+		}
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".wsdl") {
+		apis, err := importWSDL(path, file)
+		for i := range apis {
+			apis[i].source = stubSource{Origin: "config", File: path}
+		}
+		return apis, err
+	}
+	apis := []ApiFormat{}
+	if err := json.Unmarshal(file, &apis); err != nil {
+		return nil, fmt.Errorf("parse %s%s: %w", path, jsonErrorPosition(file, err), err)
+	}
+	locateStubs(apis, file, 0, stubSource{Origin: "config", File: path}, file)
+	return resolveIncludes(apis, path, append(including, path))
+}
+
+func resolveIncludes(apis []ApiFormat, path string, including []string) ([]ApiFormat, error) {
+	resolved := make([]ApiFormat, 0, len(apis))
+	for _, api := range apis {
+		switch {
+		case api.Include != "":
+			included := api.Include
+			if !filepath.IsAbs(included) {
+				included = filepath.Join(filepath.Dir(path), included)
+			}
+			stubs, err := readConfig(included, including)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, stubs...)
+			continue
+		case api.Stubs != nil:
+			stubs, err := resolveIncludes(api.Stubs, path, including)
+			if err != nil {
+				return nil, err
+			}
+			api.Stubs = stubs
+		}
+		resolved = append(resolved, api)
+	}
+	return resolved, nil
+}
+
+// collectDefines moves define entries, from any group, out of apis into
+// defines.
+func collectDefines(apis []ApiFormat, defines map[string]ResponseFormat) ([]ApiFormat, error) {
+	stubs := make([]ApiFormat, 0, len(apis))
+	for _, api := range apis {
+		if api.Define != "" {
+			if _, dup := defines[api.Define]; dup {
+				return nil, fmt.Errorf("response %q is defined twice", api.Define)
+			}
+			defines[api.Define] = api.Response
+			continue
+		}
+		if api.Stubs != nil {
+			var err error
+			if api.Stubs, err = collectDefines(api.Stubs, defines); err != nil {
+				return nil, err
+			}
+		}
+		stubs = append(stubs, api)
+	}
+	return stubs, nil
+}
+
+// mergeBodies overlays body on base, merging nested objects.
+func mergeBodies(base, body map[string]interface{}) map[string]interface{} {
+	if base == nil {
+		return body
+	}
+	merged := make(map[string]interface{}, len(base)+len(body))
+	for key, val := range base {
+		merged[key] = val
+	}
+	for key, val := range body {
+		inner, isMap := val.(map[string]interface{})
+		baseInner, baseIsMap := merged[key].(map[string]interface{})
+		if isMap && baseIsMap {
+			val = mergeBodies(baseInner, inner)
+		}
+		merged[key] = val
+	}
+	return merged
+}
+
+// extendResponse fills in the fields r leaves unset from the response it
+// extends, following chains of extends.
+func extendResponse(r ResponseFormat, defines map[string]ResponseFormat, seen []string) (ResponseFormat, error) {
+	if r.Extends == "" {
+		return r, nil
+	}
+	for _, name := range seen {
+		if name == r.Extends {
+			return r, fmt.Errorf("extends cycle: %s", strings.Join(append(seen, name), " -> "))
+		}
+	}
+	base, ok := defines[r.Extends]
+	if !ok {
+		return r, fmt.Errorf("extends unknown response %q", r.Extends)
+	}
+	base, err := extendResponse(base, defines, append(seen, r.Extends))
+	if err != nil {
+		return r, err
+	}
+	if r.Status == 0 {
+		r.Status = base.Status
+	}
+	headers := map[string]interface{}{}
+	for key, val := range base.Headers {
+		headers[key] = val
+	}
+	for key, val := range r.Headers {
+		headers[key] = val
+	}
+	if len(headers) > 0 {
+		r.Headers = headers
+	}
+	if r.Text == nil {
+		r.Body = mergeBodies(base.Body, r.Body)
+		if r.Body == nil && r.File == "" {
+			r.Text = base.Text
+		}
+	}
+	if r.File == "" && r.Body == nil && r.Text == nil {
+		r.File = base.File
+	}
+	if r.Type == "" {
+		r.Type = base.Type
+	}
+	if r.Redirect == nil {
+		r.Redirect = base.Redirect
+	}
+	if r.Login == nil {
+		r.Login = base.Login
+	}
+	if r.Upload == nil {
+		r.Upload = base.Upload
+	}
+	if r.Payload == nil {
+		r.Payload = base.Payload
+	}
+	if r.Schema == nil {
+		r.Schema = base.Schema
+	}
+	if r.Soap == nil {
+		r.Soap = base.Soap
+	}
+	if r.Webdav == nil {
+		r.Webdav = base.Webdav
+	}
+	if r.Problem == nil {
+		r.Problem = base.Problem
+	}
+	if r.Locales == nil {
+		r.Locales = base.Locales
+	}
+	r.Extends = ""
+	return r, nil
+}
+
+// loadConfig reads the stubs of a mock data file, includes resolved,
+// defined responses applied and groups expanded, and the profiles and
+// client scenarios it defines.
+func loadConfig(path, basePath string) ([]ApiFormat, profileSet, scenarioSet, error) {
+	apis, err := readConfig(path, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defines := map[string]ResponseFormat{}
+	if apis, err = collectDefines(apis, defines); err != nil {
+		return nil, nil, nil, err
+	}
+	profiles := profileSet{}
+	if apis, err = collectProfiles(apis, profiles); err != nil {
+		return nil, nil, nil, err
+	}
+	scenarios := scenarioSet{}
+	if apis, err = collectScenarios(apis, scenarios); err != nil {
+		return nil, nil, nil, err
+	}
+	apis = expandGroups(apis, basePath)
+	for i := range apis {
+		api := &apis[i]
+		for _, name := range api.Trigger {
+			if scenarios[name] == nil {
+				return nil, nil, nil, fmt.Errorf("%s %s: trigger names unknown scenario %q", api.Method, api.Url, name)
+			}
+		}
+		if api.Response, err = extendResponse(api.Response, defines, nil); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s %s: %w", api.Method, api.Url, err)
+		}
+		if api.Variants == nil {
+			continue
+		}
+		for name, response := range api.Variants.Responses {
+			if api.Variants.Responses[name], err = extendResponse(response, defines, nil); err != nil {
+				return nil, nil, nil, fmt.Errorf("%s %s variant %s: %w", api.Method, api.Url, name, err)
+			}
+		}
+	}
+	return apis, profiles, scenarios, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schemaShorthands are the plain JSON values types with an UnmarshalJSON
+// accept in place of their object form.
+var schemaShorthands = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(ValueMatcher{}):        {"type": "string"},
+	reflect.TypeOf(CacheFormat{}):         {"type": "string", "enum": cachePresetNames()},
+	reflect.TypeOf(BodyLimitFormat{}):     {"type": "integer", "minimum": 0},
+	reflect.TypeOf(LinkFormat{}):          {"type": "string"},
+	reflect.TypeOf(AccessLogFormat{}):     {"type": "boolean"},
+	reflect.TypeOf(MirrorFormat{}):        {"type": []string{"boolean", "string"}},
+	reflect.TypeOf(EncodingFaultFormat{}): {"type": "string", "enum": encodingFaultNames()},
+}
+
+// schemaEnums lists the values of string fields that only take a few, by
+// type and JSON name.
+var schemaEnums = map[string][]string{
+	"ResponseFormat.type": {"", "redirect", "login", "upload", "payload", "echo", "schema", "capture", "soap", "webdav", "problem"},
+}
+
+func cachePresetNames() []string {
+	names := []string{}
+	for name := range cachePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configSchema describes the mock data format as a JSON Schema, built
+// from the config types so it can't fall behind them.
+func configSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "go-mock-server mock data",
+		"description": "Stubs, groups, includes, defined responses, profiles and client scenarios served by go-mock-server.",
+		"type":        "array",
+		"items":       typeSchema(reflect.TypeOf(ApiFormat{}), defs),
+		"$defs":       defs,
+	}
+}
+
+// typeSchema returns the schema of values of type t, adding the schemas of
+// the structs it refers to to defs.
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		if _, done := defs[t.Name()]; !done {
+			// placeholder first, for types that contain themselves
+			defs[t.Name()] = nil
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		if short, ok := schemaShorthands[t]; ok {
+			return map[string]interface{}{"anyOf": []interface{}{short, ref}}
+		}
+		return ref
+	}
+	// interface{} holds any JSON value
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		prop := typeSchema(field.Type, defs)
+		if values, ok := schemaEnums[t.Name()+"."+name]; ok {
+			prop = map[string]interface{}{"type": "string", "enum": values}
+		}
+		props[name] = prop
+	}
+	// unknown fields are ignored by the loader, flagging them catches typos
+	return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+}
+
+// runSchema prints the JSON Schema of the mock data format, for editors to
+// validate and complete mock files with.
+func runSchema(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	out := fs.String("o", "", "write the schema to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: go-mock-server schema [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	doc, err := json.MarshalIndent(configSchema(), "", "  ")
+	check(err)
+	doc = append(doc, '\n')
+	if *out == "" {
+		os.Stdout.Write(doc)
+		return
+	}
+	check(os.WriteFile(*out, doc, 0o644))
+}
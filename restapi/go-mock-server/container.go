@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// envPrefix names the environment variables that set flags, e.g.
+// MOCK_PORT for -port or MOCK_MOCK_DATA for -mock-data, for containers
+// configured through their environment.
+const envPrefix = "MOCK_"
+
+// repeatedFlags take a comma separated list from the environment, one value
+// per repetition on the command line.
+var repeatedFlags = map[string]bool{"data-file": true, "workspace": true, "preset": true, "tls-fault": true, "access-log": true}
+
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flagsFromEnv sets the flags of fs given in the environment. Call it
+// before fs.Parse, so the command line still wins.
+func flagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		val, ok := os.LookupEnv(flagEnvName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		vals := []string{val}
+		if repeatedFlags[f.Name] {
+			vals = strings.Split(val, ",")
+		}
+		for _, v := range vals {
+			if setErr := f.Value.Set(strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("%s: %w", flagEnvName(f.Name), setErr)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// healthPath is -health-path, kept out of the journal so probes don't
+// crowd out the requests under test.
+var healthPath = "/__health"
+
+var startedAt = time.Now()
+
+type healthReport struct {
+	Status    string `json:"status"`
+	Workspace string `json:"workspace,omitempty"`
+	Stubs     int    `json:"stubs"`
+	// Uptime in seconds
+	Uptime int64 `json:"uptime"`
+}
+
+// serveHealth answers 200 once the stubs are loaded, for container health
+// checks and wait strategies. It needs no admin credentials.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	lr := routesFor(r)
+	writeJSON(w, http.StatusOK, healthReport{
+		Status:    "ok",
+		Workspace: lr.name,
+		Stubs:     len(lr.registry.list()),
+		Uptime:    int64(time.Since(startedAt).Seconds()),
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ContinueFormat controls the 100 Continue interim response to requests
+// sent with Expect: 100-continue, which clients wait for before sending
+// the body. By default it goes out as soon as the stub reads the body.
+type ContinueFormat struct {
+	// Delay in milliseconds before the 100 Continue is sent, e.g. past the
+	// client's expect timeout so it sends the body unasked
+	Delay int `json:"delay"`
+	// Refuse answers with this response instead, by default a 417, so the
+	// client never sends the body
+	Refuse *ResponseFormat `json:"refuse"`
+}
+
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// withContinue delays or refuses the 100 Continue of requests expecting
+// one. It has to run before anything reads the body, which sends it.
+func withContinue(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Continue
+	var refuse http.HandlerFunc
+	if cfg.Refuse != nil {
+		response := *cfg.Refuse
+		if response.Status == 0 {
+			response.Status = http.StatusExpectationFailed
+		}
+		refuse = newResponder(ApiFormat{Url: api.Url, Method: api.Method, Response: response})
+	}
+	delay := time.Duration(cfg.Delay) * time.Millisecond
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !expectsContinue(r) {
+			next(w, r)
+			return
+		}
+		if refuse != nil {
+			slog.Debug("100 Continue refused", "method", api.Method, "url", api.Url)
+			refuse(w, r)
+			return
+		}
+		if delay > 0 {
+			sleepFor(r, delay)
+			// an empty read sends the 100 Continue now, even if the stub
+			// never reads the body
+			r.Body.Read(nil)
+			slog.Debug("100 Continue sent", "method", api.Method, "url", api.Url, "delay", delay)
+		}
+		next(w, r)
+	}
+}
+
+// checkContinue rejects continue settings routing would defeat: matching
+// on the body, of the stub or of one tried before it on the same url,
+// reads it and so sends the 100 Continue before the stub is chosen.
+func checkContinue(stubs []*stub) error {
+	for i, s := range stubs {
+		if s.api.Continue == nil {
+			continue
+		}
+		for j, o := range stubs {
+			if !o.conditions.readsBody() || o.api.Url != s.api.Url {
+				continue
+			}
+			if o.api.Method != s.api.Method && o.api.Method != "" && s.api.Method != "" {
+				continue
+			}
+			switch {
+			case o == s:
+				return fmt.Errorf("stub %s: continue can't be combined with body or xpath matching, which reads the body and sends the 100 Continue", s.id)
+			case j < i || !s.Conditional():
+				return fmt.Errorf("stub %s: continue can't take effect, stub %s on the same url matches on the body, which sends the 100 Continue first", s.id, o.id)
+			}
+		}
+	}
+	return nil
+}
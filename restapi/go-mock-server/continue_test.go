@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// expectContinue sends only the headers of an upload expecting a 100
+// Continue and returns the status line the server answers with.
+func expectContinue(t *testing.T, addr, path string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := "PUT " + path + " HTTP/1.1\r\nHost: mock\r\nContent-Type: application/json\r\nContent-Length: 11\r\nExpect: 100-continue\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestContinueRefusedBeforeDelayRulesReadBody(t *testing.T) {
+	_, server := newTestRoutes(t, `[{"url": "/uploads", "method": "PUT",
+		"continue": {"refuse": {}},
+		"delays": [{"match": {"body": {"size": "large"}}, "delay": 10}],
+		"response": {"status": 201}}]`)
+	addr := strings.TrimPrefix(server.URL, "http://")
+	if line := expectContinue(t, addr, "/uploads"); line != "HTTP/1.1 417 Expectation Failed" {
+		t.Fatalf("got %q, want the 417 before any 100 Continue", line)
+	}
+}
+
+func TestContinueRejectedWithBodyMatching(t *testing.T) {
+	for name, config := range map[string]string{
+		"own matcher": `[{"url": "/uploads", "method": "PUT", "continue": {"refuse": {}},
+			"match": {"body": {"size": "large"}}, "response": {"status": 201}}]`,
+		"stub tried first": `[{"url": "/uploads", "method": "PUT", "match": {"xpath": {"/upload/@size": "large"}}, "response": {"status": 413}},
+			{"url": "/uploads", "method": "PUT", "continue": {"refuse": {}}, "response": {"status": 201}}]`,
+		"any method": `[{"url": "/uploads", "match": {"body": {"size": "large"}}, "response": {"status": 413}},
+			{"url": "/uploads", "method": "PUT", "continue": {"delay": 100}, "response": {"status": 201}}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			lr := &liveRoutes{registry: newStubRegistry(), mockData: writeConfig(t, config), workspaceStores: newWorkspaceStores(1000, "mock_session")}
+			if _, err := lr.load(); err == nil || !strings.Contains(err.Error(), "100 Continue") {
+				t.Fatalf("load returned %v, want the continue setting rejected", err)
+			}
+		})
+	}
+}
+
+func TestContinueAllowedAfterBodyMatching(t *testing.T) {
+	// the conditional stub is tried first, reading the body only once the
+	// continue decision is made
+	_, server := newTestRoutes(t, `[{"url": "/uploads", "method": "PUT", "continue": {"refuse": {"status": 401}},
+			"match": {"headers": {"X-Anonymous": "yes"}}, "response": {"status": 201}},
+		{"url": "/uploads", "method": "PUT", "match": {"body": {"size": "large"}}, "response": {"status": 413}},
+		{"url": "/uploads", "method": "PUT", "response": {"status": 201}}]`)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/uploads", strings.NewReader(`{"size": "large"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d, want the body matcher's 413", resp.StatusCode)
+	}
+}
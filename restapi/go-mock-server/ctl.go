@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go-mock-server/client"
+)
+
+const ctlUsage = `usage: mock-server ctl [flags] command [args]
+
+commands:
+  stubs                      list the registered stubs
+  add-stub FILE              add the stub, or array of stubs, in FILE ("-" for stdin)
+  remove-stub ID             remove a stub added with add-stub
+  patch-stub ID FILE         apply the merge patch or JSON Patch in FILE ("-" for stdin) to a stub
+  revert-stub ID             drop the patches made to a stub
+  enable ID / disable ID     switch a stub on or off
+  reload                     read the mock data file again
+  profile [NAME]             show the profiles, or switch to NAME ("" for none)
+  requests                   list the journal, filtered like verify
+  reset-requests             clear the journal
+  verify                     exit 1 unless the journal has the requests expected
+
+flags:
+`
+
+// runCtl drives a running mock server through its admin API, printing the
+// answers as JSON.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base url of the mock, or of its -admin-listen address")
+	token := fs.String("admin-token", os.Getenv("MOCK_ADMIN_TOKEN"), "bearer token for the admin API")
+	user := fs.String("admin-user", "", "basic auth user for the admin API")
+	password := fs.String("admin-password", os.Getenv("MOCK_ADMIN_PASSWORD"), "basic auth password for -admin-user")
+	workspace := fs.String("workspace", "", "workspace whose admin API to use")
+	method := fs.String("method", "", "requests and verify: only requests with this method")
+	path := fs.String("path", "", "requests and verify: only requests for this path")
+	stub := fs.String("stub", "", "requests and verify: only requests served by this stub id")
+	times := fs.Int("times", -1, "verify: exactly this many requests")
+	atLeast := fs.Int("at-least", 1, "verify: at least this many requests")
+	atMost := fs.Int("at-most", -1, "verify: at most this many requests, -1 for no limit")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// flags may come after the command too
+	command := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	rest := fs.Args()
+	c := client.New(*target)
+	c.Token, c.User, c.Password, c.Workspace = *token, *user, *password, *workspace
+	ctx := context.Background()
+	filter := client.Filter{Method: *method, Path: *path, Stub: *stub}
+	arg := func() string {
+		if len(rest) != 1 {
+			fmt.Fprintf(os.Stderr, "ctl %s takes one argument\n", command)
+			os.Exit(2)
+		}
+		return rest[0]
+	}
+
+	var out interface{}
+	var err error
+	switch command {
+	case "stubs":
+		out, err = c.Stubs(ctx)
+	case "add-stub":
+		var stubs []json.RawMessage
+		if stubs, err = readStubs(arg()); err == nil {
+			stubsArgs := make([]interface{}, len(stubs))
+			for i, s := range stubs {
+				stubsArgs[i] = s
+			}
+			out, err = c.AddStubs(ctx, stubsArgs...)
+		}
+	case "remove-stub":
+		out, err = c.RemoveStub(ctx, arg())
+	case "patch-stub":
+		if len(rest) != 2 {
+			fmt.Fprintln(os.Stderr, "ctl patch-stub takes a stub id and a file")
+			os.Exit(2)
+		}
+		var patch []byte
+		if patch, err = readInput(rest[1]); err == nil {
+			out, err = c.PatchStub(ctx, rest[0], json.RawMessage(patch))
+		}
+	case "revert-stub":
+		out, err = c.RevertStub(ctx, arg())
+	case "enable", "disable":
+		out, err = c.SetStubEnabled(ctx, arg(), command == "enable")
+	case "reload":
+		out, err = c.Reload(ctx)
+	case "profile":
+		if len(rest) == 0 {
+			out, err = c.Profile(ctx)
+		} else {
+			out, err = c.SwitchProfile(ctx, arg())
+		}
+	case "requests":
+		out, err = c.Requests(ctx, filter)
+	case "reset-requests":
+		err = c.ResetRequests(ctx)
+	case "verify":
+		min, max := *atLeast, *atMost
+		if *times >= 0 {
+			min, max = *times, *times
+		}
+		out, err = c.Verify(ctx, filter, min, max)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown ctl command %q\n\n", command)
+		fs.Usage()
+		os.Exit(2)
+	}
+	var verifyErr *client.VerificationError
+	if err != nil && !errors.As(err, &verifyErr) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if out != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	}
+	if verifyErr != nil {
+		fmt.Fprintln(os.Stderr, verifyErr)
+		os.Exit(1)
+	}
+}
+
+// readInput reads a JSON file, "-" reading stdin.
+func readInput(path string) ([]byte, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err == nil && !json.Valid(data) {
+		err = fmt.Errorf("%s is not JSON", path)
+	}
+	return data, err
+}
+
+// readStubs reads a stub or array of stubs from a file, or stdin for "-".
+func readStubs(path string) ([]json.RawMessage, error) {
+	data, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	var stubs []json.RawMessage
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &stubs)
+	} else {
+		stubs = []json.RawMessage{data}
+	}
+	return stubs, err
+}
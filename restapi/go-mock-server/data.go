@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// datasets are tables loaded from CSV or JSON files with --data-file and
+// queried from templates, e.g. {{(lookup "users" "id" .Params.id).name}}.
+var datasets = struct {
+	sync.RWMutex
+	tables map[string][]map[string]interface{}
+}{tables: map[string][]map[string]interface{}{}}
+
+// dataFileFlag collects repeated "name=path" --data-file flags.
+type dataFileFlag map[string]string
+
+func (f dataFileFlag) String() string {
+	pairs := []string{}
+	for name, path := range f {
+		pairs = append(pairs, name+"="+path)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f dataFileFlag) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok {
+		// without a name the file name minus extension is used
+		path = value
+		name = strings.TrimSuffix(filepath.Base(value), filepath.Ext(value))
+	}
+	f[name] = path
+	return nil
+}
+
+// loadDataFile reads a CSV file with a header row, or a JSON array of
+// objects, into rows keyed by column name.
+func loadDataFile(path string) ([]map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rows := []map[string]interface{}{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		// numbers keep the digits they were written with, e.g. long ids
+		dec := json.NewDecoder(file)
+		dec.UseNumber()
+		if err := dec.Decode(&rows); err != nil {
+			return nil, fmt.Errorf("%s: expected an array of objects: %w", path, err)
+		}
+		return rows, nil
+	}
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(records) == 0 {
+		return rows, nil
+	}
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func loadDatasets(files map[string]string) error {
+	datasets.Lock()
+	defer datasets.Unlock()
+	for name, path := range files {
+		rows, err := loadDataFile(path)
+		if err != nil {
+			return err
+		}
+		datasets.tables[name] = rows
+	}
+	return nil
+}
+
+func tableRows(table string) []map[string]interface{} {
+	datasets.RLock()
+	defer datasets.RUnlock()
+	return datasets.tables[table]
+}
+
+// dataWhere returns the rows of table whose column equals value. Values
+// are compared as text, see jsonText, so a path param matches a JSON
+// number.
+func dataWhere(table, column string, value interface{}) []map[string]interface{} {
+	want := jsonText(value)
+	matches := []map[string]interface{}{}
+	for _, row := range tableRows(table) {
+		if val, ok := row[column]; ok && jsonText(val) == want {
+			matches = append(matches, row)
+		}
+	}
+	return matches
+}
+
+// dataLookup returns the first matching row, or an empty row.
+func dataLookup(table, column string, value interface{}) map[string]interface{} {
+	if matches := dataWhere(table, column, value); len(matches) > 0 {
+		return matches[0]
+	}
+	return map[string]interface{}{}
+}
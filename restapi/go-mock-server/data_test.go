@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataWhereComparesNumbersAsText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(path, []byte(`[{"id": 1000000, "name": "big"}, {"id": 12345678901234567890, "name": "long"}, {"id": 1.5, "name": "half"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(tables map[string][]map[string]interface{}) { datasets.tables = tables }(datasets.tables)
+	datasets.tables = map[string][]map[string]interface{}{}
+	if err := loadDatasets(map[string]string{"accounts": path}); err != nil {
+		t.Fatal(err)
+	}
+	for value, want := range map[interface{}]string{
+		"1000000":              "big",
+		1000000.0:              "big",
+		"12345678901234567890": "long",
+		"1.5":                  "half",
+		"1.50":                 "",
+	} {
+		if got, _ := dataLookup("accounts", "id", value)["name"].(string); got != want {
+			t.Errorf("lookup of id %v found %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DelayRule adds latency to requests matching its conditions, on top of
+// the stub's flat delay, e.g. for large payloads or a slow tenant.
+type DelayRule struct {
+	Match *MatchFormat `json:"match"`
+	// MinBodySize in bytes, by Content-Length, the request must reach
+	MinBodySize int64 `json:"minBodySize"`
+	// Delay in milliseconds
+	Delay int `json:"delay"`
+}
+
+type delayRule struct {
+	conditions  *requestConditions
+	minBodySize int64
+	delay       time.Duration
+}
+
+func compileDelays(rules []DelayRule) ([]delayRule, error) {
+	compiled := make([]delayRule, 0, len(rules))
+	for _, rule := range rules {
+		conditions, err := compileConditions(rule.Match)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, delayRule{conditions, rule.MinBodySize, time.Duration(rule.Delay) * time.Millisecond})
+	}
+	return compiled, nil
+}
+
+// requestDelay sums the flat delay and that of every rule r matches.
+func requestDelay(base time.Duration, rules []delayRule, r *http.Request) time.Duration {
+	total := base
+	for _, rule := range rules {
+		if rule.minBodySize > 0 && r.ContentLength < rule.minBodySize {
+			continue
+		}
+		if rule.conditions != nil && !rule.conditions.matches(r) {
+			continue
+		}
+		total += rule.delay
+	}
+	return total
+}
+
+// sleepFor waits for d unless the request is cancelled or times out first.
+func sleepFor(r *http.Request, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// withTimeout bounds how long the stub may take: the request context is
+// cancelled and writes fail once the timeout passes, cutting off slow and
+// streaming responses the way a server-side timeout would.
+func withTimeout(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	timeout := time.Duration(api.Timeout) * time.Millisecond
+	return func(w http.ResponseWriter, r *http.Request) {
+		deadline := time.Now().Add(timeout)
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		// not every writer supports deadlines, the context still applies
+		http.NewResponseController(w).SetWriteDeadline(deadline)
+		next(w, r.WithContext(ctx))
+		if !time.Now().Before(deadline) {
+			slog.Warn("Stub timed out", "method", api.Method, "url", api.Url, "timeout", timeout)
+		}
+	}
+}
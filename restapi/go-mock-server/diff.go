@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+type diffRequest struct {
+	method string
+	// target is the path with its query
+	target  string
+	headers http.Header
+	body    string
+}
+
+// harFile is the part of a HAR archive the diff replays.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string `json:"method"`
+				Url     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// replayHeaders are not sent again: the client sets them for each request.
+var replayHeaders = []string{"Host", "Content-Length", "Connection", requestIDHeader}
+
+// readTraffic loads the requests of a journal, as GET /__admin/requests
+// returns it, or of a HAR archive.
+func readTraffic(path string) ([]diffRequest, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(file, &har); err == nil && len(har.Log.Entries) > 0 {
+		requests := []diffRequest{}
+		for _, e := range har.Log.Entries {
+			u, err := url.Parse(e.Request.Url)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			req := diffRequest{method: e.Request.Method, target: u.RequestURI(), headers: http.Header{}}
+			for _, h := range e.Request.Headers {
+				// HTTP/2 pseudo headers such as :authority
+				if !strings.HasPrefix(h.Name, ":") {
+					req.headers.Add(h.Name, h.Value)
+				}
+			}
+			if e.Request.PostData != nil {
+				req.body = e.Request.PostData.Text
+			}
+			requests = append(requests, req)
+		}
+		return requests, nil
+	}
+	var report journalReport
+	if err := json.Unmarshal(file, &report); err != nil {
+		return nil, fmt.Errorf("parse %s%s: %w", path, jsonErrorPosition(file, err), err)
+	}
+	requests := []diffRequest{}
+	for _, e := range report.Requests {
+		target := e.Path
+		if e.Query != "" {
+			target += "?" + e.Query
+		}
+		requests = append(requests, diffRequest{method: e.Method, target: target, headers: e.Headers, body: e.Body})
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%s has no requests to replay", path)
+	}
+	return requests, nil
+}
+
+type diffResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// diffTarget answers replayed requests: a server by base url, or a mock
+// data file served in-process.
+type diffTarget func(req diffRequest) (diffResponse, error)
+
+func newDiffTarget(target string) (diffTarget, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		base := strings.TrimSuffix(target, "/")
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		return func(req diffRequest) (diffResponse, error) {
+			httpReq, err := http.NewRequest(req.method, base+req.target, strings.NewReader(req.body))
+			if err != nil {
+				return diffResponse{}, err
+			}
+			httpReq.Header = req.headers.Clone()
+			for _, h := range replayHeaders {
+				httpReq.Header.Del(h)
+			}
+			resp, err := client.Do(httpReq)
+			if err != nil {
+				return diffResponse{}, err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			return diffResponse{resp.StatusCode, resp.Header.Get("Content-Type"), body}, err
+		}, nil
+	}
+	lr := &liveRoutes{registry: newStubRegistry(), mockData: target}
+	if _, err := lr.load(); err != nil {
+		return nil, err
+	}
+	return func(req diffRequest) (diffResponse, error) {
+		httpReq, err := http.NewRequest(req.method, req.target, strings.NewReader(req.body))
+		if err != nil {
+			return diffResponse{}, err
+		}
+		httpReq.Header = req.headers.Clone()
+		httpReq.RemoteAddr = "127.0.0.1:0"
+		buf := newResponseBuffer()
+		lr.ServeHTTP(buf, httpReq)
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+		return diffResponse{buf.status, buf.header.Get("Content-Type"), buf.body.Bytes()}, nil
+	}, nil
+}
+
+// jsonKind names the JSON type of a decoded value.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// structureDiff compares the shape of two JSON documents: which fields
+// exist and their types, not their values. Arrays are compared by their
+// first element.
+func structureDiff(path string, a, b interface{}) []string {
+	if jsonKind(a) != jsonKind(b) {
+		return []string{fmt.Sprintf("%s: %s vs %s", path, jsonKind(a), jsonKind(b))}
+	}
+	diffs := []string{}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		keys := []string{}
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			va, inA := a[key]
+			vb, inB := b[key]
+			switch {
+			case !inB:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: only in a", path, key))
+			case !inA:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: only in b", path, key))
+			default:
+				diffs = append(diffs, structureDiff(path+"."+key, va, vb)...)
+			}
+		}
+	case []interface{}:
+		b := b.([]interface{})
+		if len(a) > 0 && len(b) > 0 {
+			diffs = append(diffs, structureDiff(path+".0", a[0], b[0])...)
+		}
+	}
+	return diffs
+}
+
+func mediaType(contentType string) string {
+	media, _, _ := mime.ParseMediaType(contentType)
+	return media
+}
+
+// responseDiff lists how two responses to the same request differ.
+func responseDiff(a, b diffResponse) []string {
+	diffs := []string{}
+	if a.status != b.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d vs %d", a.status, b.status))
+	}
+	if mediaType(a.contentType) != mediaType(b.contentType) {
+		diffs = append(diffs, fmt.Sprintf("content type: %q vs %q", a.contentType, b.contentType))
+	}
+	var docA, docB interface{}
+	errA := json.Unmarshal(a.body, &docA)
+	errB := json.Unmarshal(b.body, &docB)
+	switch {
+	case errA == nil && errB == nil:
+		diffs = append(diffs, structureDiff("body", docA, docB)...)
+	case errA == nil || errB == nil:
+		diffs = append(diffs, "body: JSON in only one response")
+	case !bytes.Equal(bytes.TrimSpace(a.body), bytes.TrimSpace(b.body)):
+		diffs = append(diffs, fmt.Sprintf("body: %d bytes vs %d bytes of other content", len(a.body), len(b.body)))
+	}
+	return diffs
+}
+
+// runDiff implements the "diff" subcommand: it replays recorded traffic
+// against two targets, e.g. the mock and the real backend, and reports
+// where their responses differ in status, content type or body structure.
+// It exits with status 1 if any do, for use in CI.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	traffic := fs.String("traffic", "", "journal from /__admin/requests or a HAR file with the requests to replay")
+	left := fs.String("a", "", "first target: a base url, or a mock data file served in-process")
+	right := fs.String("b", "", "second target, e.g. the real backend")
+	fs.Parse(args)
+	if *traffic == "" || *left == "" || *right == "" {
+		check(fmt.Errorf("diff needs -traffic, -a and -b"))
+	}
+
+	// stub registration would drown out the report
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+	requests, err := readTraffic(*traffic)
+	check(err)
+	targetA, err := newDiffTarget(*left)
+	check(err)
+	targetB, err := newDiffTarget(*right)
+	check(err)
+
+	differing := 0
+	for _, req := range requests {
+		a, errA := targetA(req)
+		b, errB := targetB(req)
+		var diffs []string
+		switch {
+		case errA != nil || errB != nil:
+			diffs = []string{fmt.Sprintf("request failed: %v vs %v", errA, errB)}
+		default:
+			diffs = responseDiff(a, b)
+		}
+		if len(diffs) == 0 {
+			continue
+		}
+		differing++
+		fmt.Printf("%s %s\n", req.method, req.target)
+		for _, d := range diffs {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+	fmt.Printf("%d requests replayed, %d differ between %s and %s\n", len(requests), differing, *left, *right)
+	if differing > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// echoReport is the request as an "echo" response describes it.
+type echoReport struct {
+	Method     string              `json:"method"`
+	Url        string              `json:"url"`
+	Path       string              `json:"path"`
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remoteAddr"`
+	Query      map[string][]string `json:"query"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	// Json is the body decoded, when it is valid JSON
+	Json interface{} `json:"json,omitempty"`
+}
+
+func echoRequest(r *http.Request) (echoReport, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return echoReport{}, err
+	}
+	report := echoReport{
+		Method:     r.Method,
+		Url:        r.URL.String(),
+		Path:       r.URL.Path,
+		Proto:      r.Proto,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Query:      r.URL.Query(),
+		Headers:    r.Header,
+		Body:       string(body),
+	}
+	var decoded interface{}
+	if json.Unmarshal(body, &decoded) == nil {
+		report.Json = decoded
+	}
+	return report, nil
+}
+
+// newEchoHandler builds an "echo" response, which answers with the request
+// it received as JSON: method, url, headers, query and body.
+func newEchoHandler(api ApiFormat) http.HandlerFunc {
+	headers := compileHeaders(api.Response.Headers)
+	status := api.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := echoRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !headers.apply(w, r, api) {
+			return
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+		slog.Debug("API request echoed", "method", api.Method, "url", api.Url, "bytes", len(report.Body))
+	}
+}
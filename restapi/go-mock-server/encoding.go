@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EncodingFaultFormat serves a stub's response with a broken
+// Content-Encoding, to test how clients cope with decompression going
+// wrong. A plain string is shorthand for the fault.
+type EncodingFaultFormat struct {
+	// Fault is one of encodingFaults
+	Fault string `json:"fault"`
+	// Encoding is the Content-Encoding claimed, "gzip" by default or "br"
+	// for wrong, and the compression used, gzip or deflate
+	Encoding string `json:"encoding"`
+	// Truncate keeps this many bytes of the compressed body, default half
+	Truncate int `json:"truncate"`
+	// Megabytes a bomb inflates to, default 1024
+	Megabytes int `json:"megabytes"`
+}
+
+func (e *EncodingFaultFormat) UnmarshalJSON(b []byte) error {
+	var fault string
+	if json.Unmarshal(b, &fault) == nil {
+		*e = EncodingFaultFormat{Fault: fault}
+		return nil
+	}
+	type plain EncodingFaultFormat
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+var encodingFaults = map[string]string{
+	"mislabeled": "claims the encoding but sends the body uncompressed",
+	"wrong":      "sends a gzip body labeled with another encoding",
+	"truncated":  "cuts the compressed stream short, with a matching Content-Length",
+	"corrupt":    "flips bytes inside the compressed stream, failing its checksum",
+	"bomb":       "replaces the body with zeros inflating to megabytes, at a ratio of about 1000:1",
+}
+
+func encodingFaultNames() []string {
+	names := []string{}
+	for name := range encodingFaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newCompressor compresses to w as encoding, gzip or deflate.
+func newCompressor(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == "deflate" {
+		zw, _ := zlib.NewWriterLevel(w, zlib.BestCompression)
+		return zw
+	}
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	return zw
+}
+
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw := newCompressor(encoding, &out)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// compressZeros deflates n zero bytes a chunk at a time, never holding
+// them in memory.
+func compressZeros(encoding string, n int64) ([]byte, error) {
+	var out bytes.Buffer
+	zw := newCompressor(encoding, &out)
+	zeros := make([]byte, 1<<20)
+	for n > 0 {
+		chunk := min(n, int64(len(zeros)))
+		if _, err := zw.Write(zeros[:chunk]); err != nil {
+			return nil, err
+		}
+		n -= chunk
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func withEncodingFault(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := *api.EncodingFault
+	if encodingFaults[cfg.Fault] == "" {
+		check(fmt.Errorf("%s %s: unknown encoding fault %q, available: %s", api.Method, api.Url, cfg.Fault, strings.Join(encodingFaultNames(), ", ")))
+	}
+	label := cfg.Encoding
+	switch {
+	case label == "" && cfg.Fault == "wrong":
+		label = "br"
+	case label == "":
+		label = "gzip"
+	case cfg.Fault != "mislabeled" && cfg.Fault != "wrong" && label != "gzip" && label != "deflate":
+		check(fmt.Errorf("%s %s: encoding fault %s compresses with gzip or deflate, not %q", api.Method, api.Url, cfg.Fault, label))
+	}
+	compression := label
+	if cfg.Fault == "wrong" {
+		compression = "gzip"
+	}
+	if cfg.Megabytes == 0 {
+		cfg.Megabytes = 1024
+	}
+	// a bomb is the same for every request, and costs a second or so per
+	// gigabyte to build, so it's made once when first needed
+	var bomb struct {
+		once sync.Once
+		body []byte
+		err  error
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := getResponseBuffer()
+		defer buf.release()
+		next(buf, r)
+		body := buf.body.Bytes()
+		var err error
+		switch cfg.Fault {
+		case "mislabeled":
+		case "bomb":
+			bomb.once.Do(func() {
+				bomb.body, bomb.err = compressZeros(compression, int64(cfg.Megabytes)<<20)
+			})
+			body, err = bomb.body, bomb.err
+		default:
+			body, err = compressBody(compression, body)
+		}
+		if err != nil {
+			slog.Error("Failed to compress response", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch cfg.Fault {
+		case "truncated":
+			keep := len(body) / 2
+			if cfg.Truncate > 0 {
+				keep = min(cfg.Truncate, len(body))
+			}
+			body = body[:keep]
+		case "corrupt":
+			// past the header, so the stream starts fine and fails later
+			body = append([]byte{}, body...)
+			for i := len(body) / 2; i < len(body) && i < len(body)/2+4; i++ {
+				body[i] ^= 0xff
+			}
+		}
+		buf.header.Set("Content-Encoding", label)
+		buf.header.Add("Vary", "Accept-Encoding")
+		slog.Debug("Encoding fault", "url", api.Url, "fault", cfg.Fault, "encoding", label, "bytes", len(body))
+		buf.send(w, body)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// newFileHandler serves a fixture file as the body, opened per request so
+// edits show up without a reload. With the default status it goes through
+// http.ServeContent, which answers Range and If-Modified-Since requests;
+// either way the file is copied to the connection with sendfile where the
+// platform has it instead of being read into memory.
+func newFileHandler(api ApiFormat) http.HandlerFunc {
+	path := api.Response.File
+	if api.Response.Body != nil || api.Response.Text != nil {
+		check(fmt.Errorf("response for %s %s has both a body and a file", api.Method, api.Url))
+	}
+	info, err := os.Stat(path)
+	check(err)
+	if info.IsDir() {
+		check(fmt.Errorf("response file %s for %s %s is a directory", path, api.Method, api.Url))
+	}
+	headers := compileHeaders(api.Response.Headers)
+	status := api.Response.Status
+	name := filepath.Base(path)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(path)
+		if err != nil {
+			slog.Error("Failed to open response file", "url", api.Url, "file", path, "error", err)
+			http.Error(w, "response file unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			slog.Error("Failed to stat response file", "url", api.Url, "file", path, "error", err)
+			http.Error(w, "response file unavailable", http.StatusInternalServerError)
+			return
+		}
+		if !headers.apply(w, r, api) {
+			return
+		}
+		if status == 0 || status == http.StatusOK {
+			http.ServeContent(w, r, name, stat.ModTime(), f)
+			slog.Debug("API request handled", "method", api.Method, "url", api.Url, "file", path)
+			return
+		}
+		h := w.Header()
+		if h.Get("Content-Type") == "" {
+			if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+				h.Set("Content-Type", ctype)
+			}
+		}
+		h.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, f)
+		}
+		slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", status)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyFormat replays the first response for repeated requests that
+// carry the same idempotency key header.
+type IdempotencyFormat struct {
+	// Header carrying the key, default "Idempotency-Key"
+	Header string `json:"header"`
+	// Required rejects requests without the header with a 400
+	Required bool `json:"required"`
+	// TTL in seconds a key is remembered, 0 keeps it forever
+	TTL int `json:"ttl"`
+}
+
+type idempotentResponse struct {
+	fingerprint string
+	done        bool
+	created     time.Time
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// requestFingerprint identifies the payload a key was first used with.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func withIdempotency(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Idempotency
+	if cfg.Header == "" {
+		cfg.Header = "Idempotency-Key"
+	}
+	ttl := time.Duration(cfg.TTL) * time.Second
+
+	var mu sync.Mutex
+	responses := map[string]*idempotentResponse{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(cfg.Header)
+		if key == "" {
+			if cfg.Required {
+				http.Error(w, "missing "+cfg.Header+" header", http.StatusBadRequest)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		mu.Lock()
+		cached, ok := responses[key]
+		if ok && ttl > 0 && clock.Since(cached.created) > ttl {
+			delete(responses, key)
+			ok = false
+		}
+		if !ok {
+			cached = &idempotentResponse{fingerprint: fingerprint, created: clock.Now()}
+			responses[key] = cached
+		}
+		mu.Unlock()
+
+		if !ok {
+			// a handler that panics leaves nothing to replay, so the key
+			// is released for the client to retry
+			completed := false
+			defer func() {
+				if !completed {
+					mu.Lock()
+					if responses[key] == cached {
+						delete(responses, key)
+					}
+					mu.Unlock()
+				}
+			}()
+			capture := newResponseCapture(w)
+			next(capture, r)
+			completed = true
+			mu.Lock()
+			cached.done = true
+			cached.status = capture.status
+			cached.header = capture.header
+			cached.body = capture.body.Bytes()
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		done, status, header, replay := cached.done, cached.status, cached.header, cached.body
+		mu.Unlock()
+		switch {
+		case cached.fingerprint != fingerprint:
+			slog.Debug("Idempotency key reused with different payload", "url", api.Url, "key", key)
+			http.Error(w, "idempotency key "+key+" was used with a different request", http.StatusConflict)
+		case !done:
+			http.Error(w, "a request with idempotency key "+key+" is in progress", http.StatusConflict)
+		default:
+			slog.Debug("Replaying idempotent response", "url", api.Url, "key", key, "status", status)
+			for name, vals := range header {
+				w.Header()[name] = vals
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(status)
+			w.Write(replay)
+		}
+	}
+}
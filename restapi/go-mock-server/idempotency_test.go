@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyReleasesKeyAfterPanic(t *testing.T) {
+	calls := 0
+	h := withIdempotency(ApiFormat{Url: "/orders", Idempotency: &IdempotencyFormat{}}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"id": 7}`))
+		r.Header.Set("Idempotency-Key", "k1")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("the handler's panic was swallowed")
+			}
+		}()
+		post()
+	}()
+	if w := post(); w.Code != http.StatusCreated {
+		t.Fatalf("retry after the panic answered %d, want 201", w.Code)
+	}
+	if w := post(); w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("second retry answered %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
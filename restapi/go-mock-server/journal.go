@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalBodyLimit caps the request body bytes kept per journal entry.
+const journalBodyLimit = 64 << 10
+
+type journalEntry struct {
+	RequestID string              `json:"requestId"`
+	Time      time.Time           `json:"time"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"`
+	Query     string              `json:"query,omitempty"`
+	Headers   map[string][]string `json:"headers"`
+	// Body holds what the handler read of the request body
+	Body string `json:"body,omitempty"`
+	// Workspace and Stub name what served the request, if anything
+	Workspace string `json:"workspace,omitempty"`
+	Stub      string `json:"stub,omitempty"`
+	Status    int    `json:"status"`
+	// Duration in milliseconds
+	Duration float64 `json:"duration"`
+	// Scenario names the client scenario that sent an outbound request;
+	// URL, Response and Error are only set on those entries
+	Scenario string           `json:"scenario,omitempty"`
+	URL      string           `json:"url,omitempty"`
+	Response *journalResponse `json:"response,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// journalResponse is the answer to an outbound request.
+type journalResponse struct {
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body,omitempty"`
+}
+
+// requestJournal keeps the most recent requests served by the mock, for
+// inspection through the admin API.
+type requestJournal struct {
+	mu   sync.Mutex
+	size int
+	// entries is a ring once full, next is the oldest entry then
+	entries []journalEntry
+	next    int
+	total   int
+}
+
+func (j *requestJournal) add(e journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.size <= 0 {
+		return
+	}
+	j.total++
+	if len(j.entries) < j.size {
+		j.entries = append(j.entries, e)
+		return
+	}
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % j.size
+}
+
+type journalReport struct {
+	Total    int            `json:"total"`
+	Requests []journalEntry `json:"requests"`
+}
+
+func (j *requestJournal) report() journalReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	requests := append([]journalEntry{}, j.entries[j.next:]...)
+	return journalReport{Total: j.total, Requests: append(requests, j.entries[:j.next]...)}
+}
+
+// filter keeps the requests with the method, path and serving stub given,
+// "" matching any.
+func (rep journalReport) filter(method, path, stub string) journalReport {
+	if method == "" && path == "" && stub == "" {
+		return rep
+	}
+	kept := []journalEntry{}
+	for _, e := range rep.Requests {
+		if (method == "" || strings.EqualFold(e.Method, method)) && (path == "" || e.Path == path) && (stub == "" || e.Stub == stub) {
+			kept = append(kept, e)
+		}
+	}
+	rep.Requests = kept
+	return rep
+}
+
+func (j *requestJournal) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total, j.next = 0, 0
+	j.entries = nil
+}
+
+const requestIDHeader = "X-Request-ID"
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestInfo collects what handlers learn about a request for its journal
+// entry.
+type requestInfo struct {
+	stub string
+	// access is the serving stub's access log config, responseBody what
+	// was kept of its response for the access log
+	access       *AccessLogFormat
+	responseBody strings.Builder
+	// mirror is the serving stub's mirror config
+	mirror *MirrorFormat
+}
+
+type requestInfoKey struct{}
+
+// setServingStub notes on r's journal entry which stub served it.
+func setServingStub(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.stub = id
+	}
+}
+
+// bodyTee keeps a copy of the first bytes a handler reads from the body.
+type bodyTee struct {
+	io.ReadCloser
+	buf strings.Builder
+}
+
+func (t *bodyTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if room := journalBodyLimit - t.buf.Len(); room > 0 {
+		t.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// withRequestTracking gives every request an X-Request-ID, reusing the
+// client's, which is echoed in the response and available to templates as
+// .RequestID. Requests other than admin calls are added to the journal.
+func withRequestTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		if strings.HasPrefix(r.URL.Path, adminPrefix+"/") || r.URL.Path == healthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		info := &requestInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		entry := journalEntry{
+			Workspace: routesFor(r).name,
+			RequestID: id,
+			Time:      time.Now(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			Headers:   r.Header.Clone(),
+		}
+		tee := &bodyTee{ReadCloser: r.Body}
+		r.Body = tee
+		var mirror *mirrorCapture
+		if mirroring() {
+			mirror = &mirrorCapture{ReadCloser: tee}
+			r.Body = mirror
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		if len(accessLogs) > 0 {
+			rec.ResponseWriter = &accessCapture{ResponseWriter: w, info: info}
+		}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if mirror != nil {
+			mirrorRequest(r, mirror, info.mirror)
+		}
+		if info.access != nil && info.access.Body {
+			// the access log wants the body even where the stub ignored it
+			io.Copy(io.Discard, io.LimitReader(tee, int64(journalBodyLimit-tee.buf.Len())))
+		}
+		entry.Body = tee.buf.String()
+		entry.Stub = info.stub
+		entry.Status = rec.status
+		entry.Duration = milliseconds(time.Since(start))
+		routesFor(r).journal.add(entry)
+		if len(accessLogs) > 0 {
+			writeAccessLog(entry, r, info)
+		}
+		slog.Debug("Request served", "request_id", id, "method", r.Method, "path", r.URL.Path, "stub", info.stub, "status", rec.status)
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kafka API keys and the versions spoken: old enough for any broker since
+// 1.0 and not yet removed from 4.x.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaErrors names the error codes a publication is likely to meet.
+var kafkaErrors = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	17: "INVALID_TOPIC_EXCEPTION",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	35: "UNSUPPORTED_VERSION",
+	87: "INVALID_RECORD",
+}
+
+// kafkaError is an error code from a broker.
+type kafkaError int16
+
+const (
+	kafkaUnknownTopic       kafkaError = 3
+	kafkaLeaderNotAvailable kafkaError = 5
+)
+
+func (e kafkaError) Error() string {
+	if name := kafkaErrors[int16(e)]; name != "" {
+		return "kafka: " + name
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+func kafkaString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, int16(len(s)))
+	b.WriteString(s)
+}
+
+// kafkaReader decodes a response, remembering the first short read.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		if r.err == nil {
+			r.err = fmt.Errorf("kafka: short response")
+		}
+		return make([]byte, max(n, 8))
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string or nullable string, null as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// kafkaConn sends requests one at a time on a broker connection.
+type kafkaConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+func (c *kafkaConn) request(apiKey, version int16, body []byte) (*kafkaReader, error) {
+	c.correlationID++
+	var req bytes.Buffer
+	binary.Write(&req, binary.BigEndian, apiKey)
+	binary.Write(&req, binary.BigEndian, version)
+	binary.Write(&req, binary.BigEndian, c.correlationID)
+	kafkaString(&req, "mock-server")
+	req.Write(body)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(req.Len()))
+	if _, err := c.conn.Write(append(frame, req.Bytes()...)); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, fmt.Errorf("kafka: reading response: %w", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, fmt.Errorf("kafka: reading response: %w", err)
+	}
+	r := &kafkaReader{b: resp}
+	if id := r.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka: response %d to request %d", id, c.correlationID)
+	}
+	return r, nil
+}
+
+// kafkaTopic is what the metadata tells about a topic: the address of each
+// partition's leader, empty while there is none.
+type kafkaTopic struct {
+	leaders []string
+}
+
+func (c *kafkaConn) metadata(topic string) (*kafkaTopic, error) {
+	var req bytes.Buffer
+	binary.Write(&req, binary.BigEndian, int32(1))
+	kafkaString(&req, topic)
+	req.WriteByte(1) // allow auto topic creation
+	r, err := c.request(kafkaMetadata, kafkaMetadataVersion, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	r.int32() // throttle time
+	brokers := map[int32]string{}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster id
+	r.int32()  // controller id
+	var t *kafkaTopic
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code, name := r.int16(), r.string()
+		r.next(1) // is internal
+		partitions := map[int32]string{}
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int16() // partition error
+			index, leader := r.int32(), r.int32()
+			r.next(4 * int(r.int32())) // replicas
+			r.next(4 * int(r.int32())) // in-sync replicas
+			partitions[index] = brokers[leader]
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			return nil, kafkaError(code)
+		}
+		t = &kafkaTopic{leaders: make([]string, len(partitions))}
+		for index, addr := range partitions {
+			if int(index) < len(t.leaders) {
+				t.leaders[index] = addr
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if t == nil || len(t.leaders) == 0 {
+		return nil, kafkaUnknownTopic
+	}
+	return t, nil
+}
+
+// kafkaRecordBatch encodes msg as a magic v2 batch holding one record.
+func kafkaRecordBatch(msg *brokerMessage, at time.Time) []byte {
+	var record []byte
+	record = append(record, 0)              // attributes
+	record = binary.AppendVarint(record, 0) // timestamp delta
+	record = binary.AppendVarint(record, 0) // offset delta
+	if msg.key == "" {
+		record = binary.AppendVarint(record, -1)
+	} else {
+		record = binary.AppendVarint(record, int64(len(msg.key)))
+		record = append(record, msg.key...)
+	}
+	record = binary.AppendVarint(record, int64(len(msg.payload)))
+	record = append(record, msg.payload...)
+	record = binary.AppendVarint(record, int64(len(msg.headers)))
+	for key, val := range msg.headers {
+		record = binary.AppendVarint(record, int64(len(key)))
+		record = append(record, key...)
+		record = binary.AppendVarint(record, int64(len(val)))
+		record = append(record, val...)
+	}
+
+	ms := at.UnixMilli()
+	// the part of the batch the CRC covers
+	var tail bytes.Buffer
+	binary.Write(&tail, binary.BigEndian, int16(0))  // attributes
+	binary.Write(&tail, binary.BigEndian, int32(0))  // last offset delta
+	binary.Write(&tail, binary.BigEndian, ms)        // first timestamp
+	binary.Write(&tail, binary.BigEndian, ms)        // max timestamp
+	binary.Write(&tail, binary.BigEndian, int64(-1)) // producer id
+	binary.Write(&tail, binary.BigEndian, int16(-1)) // producer epoch
+	binary.Write(&tail, binary.BigEndian, int32(-1)) // base sequence
+	binary.Write(&tail, binary.BigEndian, int32(1))  // records
+	tail.Write(binary.AppendVarint(nil, int64(len(record))))
+	tail.Write(record)
+
+	var batch bytes.Buffer
+	binary.Write(&batch, binary.BigEndian, int64(0))                // base offset
+	binary.Write(&batch, binary.BigEndian, int32(4+1+4+tail.Len())) // length
+	binary.Write(&batch, binary.BigEndian, int32(-1))               // partition leader epoch
+	batch.WriteByte(2)                                              // magic
+	binary.Write(&batch, binary.BigEndian, crc32.Checksum(tail.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes()
+}
+
+func (c *kafkaConn) produce(topic string, partition int32, batch []byte) error {
+	var req bytes.Buffer
+	binary.Write(&req, binary.BigEndian, int16(-1))   // no transactional id
+	binary.Write(&req, binary.BigEndian, int16(-1))   // acks from all in-sync replicas
+	binary.Write(&req, binary.BigEndian, int32(5000)) // timeout ms
+	binary.Write(&req, binary.BigEndian, int32(1))
+	kafkaString(&req, topic)
+	binary.Write(&req, binary.BigEndian, int32(1))
+	binary.Write(&req, binary.BigEndian, partition)
+	binary.Write(&req, binary.BigEndian, int32(len(batch)))
+	req.Write(batch)
+	r, err := c.request(kafkaProduce, kafkaProduceVersion, req.Bytes())
+	if err != nil {
+		return err
+	}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string()
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int32() // partition
+			if code := r.int16(); code != 0 {
+				return kafkaError(code)
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	return r.err
+}
+
+// murmur2 is the hash the Java client's default partitioner applies to
+// record keys, so keyed records land where a real producer puts them.
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch tail := data[n:]; len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaLookup asks the bootstrap brokers in turn for the topic's metadata.
+func kafkaLookup(c *compiledPublish, name string) (*kafkaTopic, error) {
+	var err error
+	for _, host := range c.hosts {
+		var conn net.Conn
+		if conn, err = c.dial(host); err != nil {
+			continue
+		}
+		var topic *kafkaTopic
+		topic, err = (&kafkaConn{conn: conn}).metadata(name)
+		conn.Close()
+		if err == nil {
+			return topic, nil
+		}
+	}
+	return nil, err
+}
+
+// publishKafka looks the topic up on the first bootstrap broker that
+// answers, creating it where the cluster allows, and produces msg to the
+// partition's leader. A fresh topic without a leader yet is retried.
+func publishKafka(c *compiledPublish, msg *brokerMessage) error {
+	var topic *kafkaTopic
+	var err error
+	for attempt := 1; ; attempt++ {
+		topic, err = kafkaLookup(c, msg.topic)
+		if err != kafkaLeaderNotAvailable || attempt == 5 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+
+	var partition int32
+	switch {
+	case c.cfg.Partition != nil:
+		partition = int32(*c.cfg.Partition)
+		if int(partition) >= len(topic.leaders) || partition < 0 {
+			return fmt.Errorf("kafka: topic %s has no partition %d", msg.topic, partition)
+		}
+	case msg.key != "":
+		partition = (murmur2([]byte(msg.key)) & 0x7fffffff) % int32(len(topic.leaders))
+	default:
+		partition = int32(randomInt(0, len(topic.leaders)-1))
+	}
+	leader := topic.leaders[partition]
+	if leader == "" {
+		return fmt.Errorf("kafka: partition %d of %s has no leader", partition, msg.topic)
+	}
+	conn, err := c.dial(leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return (&kafkaConn{conn: conn}).produce(msg.topic, partition, kafkaRecordBatch(msg, time.Now()))
+}
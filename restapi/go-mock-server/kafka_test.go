@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMurmur2(t *testing.T) {
+	// the Java client's test vectors
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+// kafkaRecord is a record decoded from a batch.
+type kafkaRecord struct {
+	key, value string
+	// nullKey is set for a record without a key
+	nullKey bool
+	headers map[string]string
+}
+
+// decodeKafkaBatch checks the framing and CRC of a magic v2 batch and
+// returns its records.
+func decodeKafkaBatch(t *testing.T, batch []byte) []kafkaRecord {
+	t.Helper()
+	r := &kafkaReader{b: batch}
+	r.int64() // base offset
+	if length := r.int32(); int(length) != len(r.b) {
+		t.Fatalf("batch length %d, %d bytes follow", length, len(r.b))
+	}
+	r.int32() // partition leader epoch
+	if magic := r.next(1)[0]; magic != 2 {
+		t.Fatalf("magic %d", magic)
+	}
+	crc := uint32(r.int32())
+	if sum := crc32.Checksum(r.b, crc32.MakeTable(crc32.Castagnoli)); sum != crc {
+		t.Fatalf("crc %x, computed %x", crc, sum)
+	}
+	r.int16()          // attributes
+	r.int32()          // last offset delta
+	r.int64()          // first timestamp
+	r.int64()          // max timestamp
+	r.int64()          // producer id
+	r.int16()          // producer epoch
+	r.int32()          // base sequence
+	count := r.int32() // records
+	rest := bytes.NewReader(r.b)
+	varint := func() int64 {
+		n, err := binary.ReadVarint(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	bytesOf := func(n int64) string {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(rest, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	records := []kafkaRecord{}
+	for ; count > 0; count-- {
+		length := varint()
+		start := rest.Len()
+		rest.ReadByte() // attributes
+		varint()        // timestamp delta
+		varint()        // offset delta
+		rec := kafkaRecord{headers: map[string]string{}}
+		if n := varint(); n < 0 {
+			rec.nullKey = true
+		} else {
+			rec.key = bytesOf(n)
+		}
+		rec.value = bytesOf(varint())
+		for n := varint(); n > 0; n-- {
+			key := bytesOf(varint())
+			rec.headers[key] = bytesOf(varint())
+		}
+		if read := int64(start - rest.Len()); read != length {
+			t.Fatalf("record length %d, read %d", length, read)
+		}
+		records = append(records, rec)
+	}
+	if rest.Len() != 0 || r.err != nil {
+		t.Fatalf("%d bytes left after the records, %v", rest.Len(), r.err)
+	}
+	return records
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	msg := &brokerMessage{key: "order-7", payload: []byte(`{"id": 7}`), headers: map[string]string{"source": "mock", "trace": "abc"}}
+	got := decodeKafkaBatch(t, kafkaRecordBatch(msg, time.Now()))
+	want := []kafkaRecord{{key: "order-7", value: `{"id": 7}`, headers: msg.headers}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	got = decodeKafkaBatch(t, kafkaRecordBatch(&brokerMessage{payload: []byte("x")}, time.Now()))
+	if len(got) != 1 || !got[0].nullKey || got[0].value != "x" {
+		t.Errorf("unkeyed record decoded as %+v", got)
+	}
+}
+
+// fakeKafka is a broker answering Metadata v4 and Produce v3, for a topic
+// with partitions led by itself.
+type fakeKafka struct {
+	ln         net.Listener
+	partitions int
+	// topicError is the metadata error code of the topic
+	topicError int16
+	produced   chan fakeProduce
+}
+
+type fakeProduce struct {
+	topic     string
+	partition int32
+	batch     []byte
+}
+
+func newFakeKafka(t *testing.T, partitions int) *fakeKafka {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeKafka{ln: ln, partitions: partitions, produced: make(chan fakeProduce, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(t, conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeKafka) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	host, portText, _ := net.SplitHostPort(f.ln.Addr().String())
+	port, _ := strconv.Atoi(portText)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		r := &kafkaReader{b: req}
+		apiKey, version, correlation := r.int16(), r.int16(), r.int32()
+		r.string() // client id
+		var resp bytes.Buffer
+		binary.Write(&resp, binary.BigEndian, correlation)
+		switch {
+		case apiKey == kafkaMetadata && version == kafkaMetadataVersion:
+			r.int32()
+			topic := r.string()
+			binary.Write(&resp, binary.BigEndian, int32(0)) // throttle time
+			binary.Write(&resp, binary.BigEndian, int32(1)) // brokers
+			binary.Write(&resp, binary.BigEndian, int32(1))
+			kafkaString(&resp, host)
+			binary.Write(&resp, binary.BigEndian, int32(port))
+			binary.Write(&resp, binary.BigEndian, int16(-1)) // rack
+			kafkaString(&resp, "cluster")
+			binary.Write(&resp, binary.BigEndian, int32(1)) // controller
+			binary.Write(&resp, binary.BigEndian, int32(1)) // topics
+			binary.Write(&resp, binary.BigEndian, f.topicError)
+			kafkaString(&resp, topic)
+			resp.WriteByte(0)
+			binary.Write(&resp, binary.BigEndian, int32(f.partitions))
+			for p := 0; p < f.partitions; p++ {
+				binary.Write(&resp, binary.BigEndian, int16(0))
+				binary.Write(&resp, binary.BigEndian, int32(p))
+				binary.Write(&resp, binary.BigEndian, int32(1)) // leader
+				binary.Write(&resp, binary.BigEndian, int32(1)) // replicas
+				binary.Write(&resp, binary.BigEndian, int32(1))
+				binary.Write(&resp, binary.BigEndian, int32(1)) // in-sync replicas
+				binary.Write(&resp, binary.BigEndian, int32(1))
+			}
+		case apiKey == kafkaProduce && version == kafkaProduceVersion:
+			r.string() // transactional id
+			if acks := r.int16(); acks != -1 {
+				t.Errorf("produce with acks %d", acks)
+			}
+			r.int32() // timeout
+			r.int32() // topics
+			topic := r.string()
+			r.int32() // partitions
+			partition := r.int32()
+			batch := r.next(int(r.int32()))
+			f.produced <- fakeProduce{topic, partition, append([]byte{}, batch...)}
+			binary.Write(&resp, binary.BigEndian, int32(1))
+			kafkaString(&resp, topic)
+			binary.Write(&resp, binary.BigEndian, int32(1))
+			binary.Write(&resp, binary.BigEndian, partition)
+			binary.Write(&resp, binary.BigEndian, int16(0))
+			binary.Write(&resp, binary.BigEndian, int64(0))  // base offset
+			binary.Write(&resp, binary.BigEndian, int64(-1)) // log append time
+			binary.Write(&resp, binary.BigEndian, int32(0))  // throttle time
+		default:
+			t.Errorf("unexpected request %d v%d", apiKey, version)
+			return
+		}
+		frame := binary.BigEndian.AppendUint32(nil, uint32(resp.Len()))
+		conn.Write(append(frame, resp.Bytes()...))
+	}
+}
+
+func TestPublishKafka(t *testing.T) {
+	broker := newFakeKafka(t, 3)
+	p := compileTestPublish(t, PublishFormat{Broker: "kafka://127.0.0.1:1," + broker.ln.Addr().String(), Topic: "orders"})
+	msg := &brokerMessage{topic: "orders", key: "foobar", payload: []byte(`{"id": 7}`), headers: map[string]string{"h": "v"}}
+	// the first bootstrap broker is down, the second answers
+	if err := p.send(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := <-broker.produced
+	// where the Java client puts the key
+	wantPartition := (murmur2([]byte("foobar")) & 0x7fffffff) % 3
+	if got.topic != "orders" || got.partition != wantPartition {
+		t.Errorf("produced to %s/%d, want orders/%d", got.topic, got.partition, wantPartition)
+	}
+	records := decodeKafkaBatch(t, got.batch)
+	if len(records) != 1 || records[0].key != "foobar" || records[0].value != `{"id": 7}` || records[0].headers["h"] != "v" {
+		t.Errorf("produced %+v", records)
+	}
+
+	partition := 2
+	p = compileTestPublish(t, PublishFormat{Broker: "kafka://" + broker.ln.Addr().String(), Topic: "orders", Partition: &partition})
+	if err := p.send(&brokerMessage{topic: "orders", key: "foobar"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-broker.produced; got.partition != 2 {
+		t.Errorf("produced to partition %d, want the pinned 2", got.partition)
+	}
+	partition = 3
+	if err := p.send(&brokerMessage{topic: "orders"}); err == nil {
+		t.Error("produced to a partition the topic doesn't have")
+	}
+}
+
+func TestPublishKafkaTopicError(t *testing.T) {
+	broker := newFakeKafka(t, 1)
+	broker.topicError = 29
+	p := compileTestPublish(t, PublishFormat{Broker: "kafka://" + broker.ln.Addr().String(), Topic: "orders"})
+	if err := p.send(&brokerMessage{topic: "orders"}); err == nil || err.Error() != "kafka: TOPIC_AUTHORIZATION_FAILED" {
+		t.Errorf("got %v, want the broker's error", err)
+	}
+}
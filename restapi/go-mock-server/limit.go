@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadLimiter bounds how many requests are served at once, so the mock
+// behaves like a saturated server under load instead of growing
+// goroutines without limit. Requests over the limit wait in a bounded
+// queue for up to wait, then are shed with a 503.
+type loadLimiter struct {
+	max      int
+	maxQueue int
+	wait     time.Duration
+	slots    chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	peak     int
+	served   int
+	shed     int
+}
+
+var limiter = &loadLimiter{wait: time.Second}
+
+type loadReport struct {
+	MaxInFlight  int `json:"maxInFlight"`
+	InFlight     int `json:"inFlight"`
+	PeakInFlight int `json:"peakInFlight"`
+	MaxQueue     int `json:"maxQueue"`
+	Queued       int `json:"queued"`
+	Served       int `json:"served"`
+	Shed         int `json:"shed"`
+}
+
+func (l *loadLimiter) report() loadReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return loadReport{
+		MaxInFlight:  l.max,
+		InFlight:     l.inFlight,
+		PeakInFlight: l.peak,
+		MaxQueue:     l.maxQueue,
+		Queued:       l.queued,
+		Served:       l.served,
+		Shed:         l.shed,
+	}
+}
+
+// reset clears the counters, keeping the requests currently in flight.
+func (l *loadLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peak, l.served, l.shed = l.inFlight, 0, 0
+}
+
+func (l *loadLimiter) started() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight++
+	l.peak = max(l.peak, l.inFlight)
+}
+
+func (l *loadLimiter) finished() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.served++
+}
+
+// enqueue takes a place in the queue, false if it is full.
+func (l *loadLimiter) enqueue() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queued >= l.maxQueue {
+		l.shed++
+		return false
+	}
+	l.queued++
+	return true
+}
+
+func (l *loadLimiter) dequeue(admitted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queued--
+	if !admitted {
+		l.shed++
+	}
+}
+
+// acquire waits for a slot, false when the request is shed.
+func (l *loadLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !l.enqueue() {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	admitted := false
+	select {
+	case l.slots <- struct{}{}:
+		admitted = true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	l.dequeue(admitted)
+	return admitted
+}
+
+// withLoadLimit applies the limiter to every request but admin calls;
+// without -max-in-flight it only keeps the in-flight counts.
+func withLoadLimit(next http.Handler) http.Handler {
+	if limiter.max > 0 {
+		limiter.slots = make(chan struct{}, limiter.max)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, adminPrefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if limiter.slots != nil {
+			if !limiter.acquire(r) {
+				slog.Debug("Request shed", "method", r.Method, "path", r.URL.Path, "max_in_flight", limiter.max)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+				return
+			}
+			defer func() { <-limiter.slots }()
+		}
+		limiter.started()
+		defer limiter.finished()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// LinksFormat adds hypermedia links to a stub's responses, built from the
+// urls of the stubs they point at so they stay consistent across resources.
+type LinksFormat struct {
+	// Rels maps each link relation to the stub it points at
+	Rels map[string]LinkFormat `json:"rels"`
+	// Field of JSON object bodies the links are added to, as HAL style
+	// {"rel": {"href": "..."}}, default "_links"; "-" adds none
+	Field string `json:"field"`
+	// Header lists the links in a Link header too
+	Header bool `json:"header"`
+}
+
+// LinkFormat is one link. A plain JSON string is shorthand for
+// {"stub": "..."}.
+type LinkFormat struct {
+	// Stub is the id of the stub linked to, by default the stub itself
+	Stub string `json:"stub"`
+	// Params fill the wildcards of the stub's url and may be templates. A
+	// wildcard without one takes the request's path parameter of the same
+	// name.
+	Params map[string]string `json:"params"`
+	// Title is added to the link when set, a template
+	Title string `json:"title"`
+}
+
+func (l *LinkFormat) UnmarshalJSON(b []byte) error {
+	var stub string
+	if json.Unmarshal(b, &stub) == nil {
+		*l = LinkFormat{Stub: stub}
+		return nil
+	}
+	type plain LinkFormat
+	return json.Unmarshal(b, (*plain)(l))
+}
+
+// validate checks that the links point at stubs of reg, taking nil for
+// no links.
+func (cfg *LinksFormat) validate(reg *stubRegistry) error {
+	if cfg == nil {
+		return nil
+	}
+	for rel, l := range cfg.Rels {
+		if l.Stub != "" && reg.get(l.Stub) == nil {
+			return fmt.Errorf("link %s to unknown stub %q", rel, l.Stub)
+		}
+	}
+	return nil
+}
+
+// expandURL fills the wildcards of a stub url with params, escaped, and
+// drops the {$} anchor. A {rest...} wildcard keeps the slashes of its value
+// and may be left empty.
+func expandURL(pattern string, params map[string]string) (string, error) {
+	var missing []string
+	path := wildcardPattern.ReplaceAllStringFunc(pattern, func(m string) string {
+		sub := wildcardPattern.FindStringSubmatch(m)
+		val := params[sub[1]]
+		if val == "" && sub[2] == "" {
+			missing = append(missing, sub[1])
+			return ""
+		}
+		if sub[2] == "" {
+			return url.PathEscape(val)
+		}
+		segments := strings.Split(val, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		return strings.Join(segments, "/")
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for %s in %s", strings.Join(missing, ", "), pattern)
+	}
+	return strings.ReplaceAll(path, "{$}", ""), nil
+}
+
+// Link returns the path of the stub with the given id, its wildcards
+// filled from name, value pairs and otherwise the request's path
+// parameters, e.g. {{.Link "get-order" "id" .Vars.id}}.
+func (d templateData) Link(id string, pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("link %s: params must be name, value pairs", id)
+	}
+	s := routesFor(d.req).registry.get(id)
+	if s == nil {
+		return "", fmt.Errorf("link to unknown stub %q", id)
+	}
+	params := map[string]string{}
+	for name, val := range d.Params {
+		params[name] = val
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		params[pairs[i]] = pairs[i+1]
+	}
+	return expandURL(s.api.Url, params)
+}
+
+type compiledLink struct {
+	rel    string
+	stub   string
+	params map[string]*textTemplate
+	title  *textTemplate
+}
+
+// withLinks adds the configured links to the stub's responses: to the
+// field of JSON object bodies and, with header, a Link header. Other
+// bodies are passed on as they are.
+func withLinks(api ApiFormat, id string, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Links
+	field := cfg.Field
+	if field == "" {
+		field = "_links"
+	}
+	rels := make([]string, 0, len(cfg.Rels))
+	for rel := range cfg.Rels {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	links := []compiledLink{}
+	for _, rel := range rels {
+		l := cfg.Rels[rel]
+		c := compiledLink{rel: rel, stub: l.Stub}
+		if c.stub == "" {
+			c.stub = id
+		}
+		var err error
+		c.params, err = compileTemplates(api.Url, l.Params)
+		check(err)
+		c.title, err = compileTemplate(api.Url, l.Title)
+		check(err)
+		links = append(links, c)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := getResponseBuffer()
+		defer buf.release()
+		next(buf, r)
+		data := newTemplateData(r, api)
+		body := map[string]interface{}{}
+		var header []string
+		for _, l := range links {
+			params, err := renderTemplates(l.params, data)
+			if err == nil {
+				pairs := []string{}
+				for name, val := range params {
+					pairs = append(pairs, name, val)
+				}
+				var href, title string
+				if href, err = data.Link(l.stub, pairs...); err == nil {
+					title, err = l.title.render(data)
+				}
+				link := map[string]interface{}{"href": href}
+				attrs := ""
+				if title != "" {
+					link["title"] = title
+					attrs = fmt.Sprintf("; title=%q", title)
+				}
+				body[l.rel] = link
+				header = append(header, fmt.Sprintf("<%s>; rel=%q%s", href, l.rel, attrs))
+			}
+			if err != nil {
+				slog.Error("Failed to build link", "url", api.Url, "rel", l.rel, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if cfg.Header {
+			buf.header.Add("Link", strings.Join(header, ", "))
+		}
+		out := buf.body.Bytes()
+		var doc interface{}
+		if field != "-" && json.Unmarshal(out, &doc) == nil {
+			if obj, ok := doc.(map[string]interface{}); ok {
+				obj[field] = body
+				out, _ = json.Marshal(obj)
+				out = append(out, '\n')
+			}
+		}
+		buf.send(w, out)
+	}
+}
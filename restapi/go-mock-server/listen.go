@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+)
+
+// listenAddrs works out the addresses to serve on. listen is a full
+// host:port and wins over host and port. An empty host binds every
+// interface; a name is resolved and bound on each of its addresses, so
+// "localhost" serves both 127.0.0.1 and ::1.
+func listenAddrs(listen, host string, port int) ([]string, error) {
+	if listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil, fmt.Errorf("listen address %q: %w", listen, err)
+		}
+		return []string{listen}, nil
+	}
+	portText := strconv.Itoa(port)
+	if host == "" {
+		return []string{":" + portText}, nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []string{net.JoinHostPort(addr.String(), portText)}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("host %q: %w", host, err)
+	}
+	addrs, seen := []string{}, map[string]bool{}
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), portText)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// none when the process wasn't started that way.
+func systemdListeners() ([]net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %w", err)
+	}
+	// not passed on to anything the mock starts
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, 0, count)
+	for fd := 3; fd < 3+count; fd++ {
+		file := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// openListeners binds every address, closing the ones already bound if
+// one fails.
+func openListeners(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// boundAddrs lists the addresses actually listened on, with the port the
+// system picked for port 0.
+func boundAddrs(listeners []net.Listener) []string {
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+// serveOn serves server on every listener, over TLS when certFile is set,
+// and returns when one of them fails.
+func serveOn(server *http.Server, listeners []net.Listener, certFile, keyFile string) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if certFile != "" {
+				errs <- server.ServeTLS(l, certFile, keyFile)
+				return
+			}
+			errs <- server.Serve(l)
+		}(l)
+	}
+	return <-errs
+}
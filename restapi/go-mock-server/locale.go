@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LocalesFormat gives a response per-locale bodies chosen by the request's
+// Accept-Language header.
+type LocalesFormat struct {
+	// Bodies maps language tags like "en", "fr-CA" to response bodies
+	Bodies map[string]map[string]interface{} `json:"bodies"`
+	// Fallback is used when no accepted language has a body; empty falls
+	// back to the response's own body
+	Fallback string `json:"fallback"`
+}
+
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// acceptedLanguages parses Accept-Language into lower case tags ordered by
+// preference, dropping ranges with q=0.
+func acceptedLanguages(header string) []languageRange {
+	ranges := []languageRange{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			ranges = append(ranges, languageRange{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+func newLocalizedHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Locales
+	if cfg.Fallback != "" {
+		if _, ok := cfg.Bodies[cfg.Fallback]; !ok {
+			check(fmt.Errorf("fallback locale %q of %s %s has no body", cfg.Fallback, api.Method, api.Url))
+		}
+	}
+	// each locale is served by the handler its body would get on its own
+	handlers := map[string]http.HandlerFunc{}
+	tags := map[string]string{}
+	for tag, body := range cfg.Bodies {
+		localized := api
+		localized.Response.Locales = nil
+		localized.Response.Body = body
+		handlers[tag] = newResponder(localized)
+		tags[strings.ToLower(tag)] = tag
+	}
+	plain := api
+	plain.Response.Locales = nil
+	fallback := newResponder(plain)
+
+	choose := func(r *http.Request) string {
+		for _, lang := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+			if lang.tag == "*" {
+				break
+			}
+			if tag, ok := tags[lang.tag]; ok {
+				return tag
+			}
+			// a regional range like en-gb still accepts plain en
+			if base, _, found := strings.Cut(lang.tag, "-"); found {
+				if tag, ok := tags[base]; ok {
+					return tag
+				}
+			}
+		}
+		return cfg.Fallback
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		tag := choose(r)
+		if tag == "" {
+			fallback(w, r)
+			return
+		}
+		w.Header().Set("Content-Language", tag)
+		handlers[tag](w, r)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// LoginFormat configures a "login" response: GET serves a login form with
+// a CSRF token, POST checks the token and credentials and stores the user
+// in the session. Register it without a method so both are routed to it.
+type LoginFormat struct {
+	// Users maps usernames to passwords
+	Users map[string]string `json:"users"`
+	// form field names, default "username", "password" and "csrf_token"
+	UsernameField string `json:"usernameField"`
+	PasswordField string `json:"passwordField"`
+	CsrfField     string `json:"csrfField"`
+	// SessionKey receives the username on success, default "user"
+	SessionKey string `json:"sessionKey"`
+	// SuccessRedirect is where a successful login is sent, default "/"
+	SuccessRedirect string `json:"successRedirect"`
+	// Page is the login page template; .Vars.csrf holds the token and
+	// .Vars.error the reason a previous attempt failed
+	Page string `json:"page"`
+}
+
+// RequireSessionFormat rejects requests whose session lacks any of Keys,
+// which protects stubs behind the login module.
+type RequireSessionFormat struct {
+	// Keys that must be set, default ["user"]
+	Keys []string `json:"keys"`
+	// Redirect sends rejected requests there instead of answering Status
+	Redirect string `json:"redirect"`
+	// Status of rejected requests, default 401
+	Status int `json:"status"`
+}
+
+const defaultLoginPage = `<!DOCTYPE html>
+<html>
+<body>
+{{with .Vars.error}}<p class="error">{{.}}</p>{{end}}
+<form method="POST" action="{{.Path}}">
+<input type="hidden" name="{{.Vars.csrfField}}" value="{{.Vars.csrf}}">
+<input name="{{.Vars.usernameField}}" placeholder="username">
+<input name="{{.Vars.passwordField}}" type="password" placeholder="password">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`
+
+func newCsrfToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newLoginHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Login
+	if cfg == nil {
+		check(fmt.Errorf("login response for %s has no login block", api.Url))
+	}
+	if cfg.UsernameField == "" {
+		cfg.UsernameField = "username"
+	}
+	if cfg.PasswordField == "" {
+		cfg.PasswordField = "password"
+	}
+	if cfg.CsrfField == "" {
+		cfg.CsrfField = "csrf_token"
+	}
+	if cfg.SessionKey == "" {
+		cfg.SessionKey = "user"
+	}
+	if cfg.SuccessRedirect == "" {
+		cfg.SuccessRedirect = "/"
+	}
+	if cfg.Page == "" {
+		cfg.Page = defaultLoginPage
+	}
+	page, err := compileTemplate(api.Url, cfg.Page)
+	check(err)
+
+	renderPage := func(w http.ResponseWriter, r *http.Request, status int, reason string) {
+		sessions := routesFor(r).sessions
+		id := sessions.start(w, r)
+		token := newCsrfToken()
+		sessions.update(id, func(values map[string]interface{}) {
+			values["csrf"] = token
+		})
+		data := newTemplateData(r, api)
+		data.Vars["csrf"] = token
+		data.Vars["error"] = reason
+		data.Vars["usernameField"] = cfg.UsernameField
+		data.Vars["passwordField"] = cfg.PasswordField
+		data.Vars["csrfField"] = cfg.CsrfField
+		html, err := page.render(data)
+		if err != nil {
+			slog.Error("Failed to render login page", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(html))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			renderPage(w, r, http.StatusOK, "")
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.PostFormValue(cfg.CsrfField)
+		if token == "" {
+			token = r.Header.Get("X-CSRF-Token")
+		}
+		sessions := routesFor(r).sessions
+		expected, _ := sessions.values(r)["csrf"].(string)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			slog.Debug("Login rejected", "url", api.Url, "reason", "csrf")
+			renderPage(w, r, http.StatusForbidden, "invalid csrf token")
+			return
+		}
+
+		username := r.PostFormValue(cfg.UsernameField)
+		password, ok := cfg.Users[username]
+		if !ok || subtle.ConstantTimeCompare([]byte(r.PostFormValue(cfg.PasswordField)), []byte(password)) != 1 {
+			slog.Debug("Login rejected", "url", api.Url, "reason", "credentials", "user", username)
+			renderPage(w, r, http.StatusUnauthorized, "invalid username or password")
+			return
+		}
+
+		// issue a fresh session on login so a pre-login id can't be reused
+		sessions.end(w, r)
+		r.Header.Del("Cookie")
+		id := sessions.start(w, r)
+		sessions.update(id, func(values map[string]interface{}) {
+			values[cfg.SessionKey] = username
+		})
+		slog.Debug("Login succeeded", "url", api.Url, "user", username)
+		http.Redirect(w, r, cfg.SuccessRedirect, http.StatusSeeOther)
+	}
+}
+
+func withRequireSession(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.RequireSession
+	if len(cfg.Keys) == 0 {
+		cfg.Keys = []string{"user"}
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusUnauthorized
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := routesFor(r).sessions.values(r)
+		for _, key := range cfg.Keys {
+			if _, ok := values[key]; ok {
+				continue
+			}
+			slog.Debug("Request without required session", "method", api.Method, "url", api.Url, "missing", key)
+			if cfg.Redirect != "" {
+				http.Redirect(w, r, cfg.Redirect, http.StatusFound)
+				return
+			}
+			http.Error(w, "login required", cfg.Status)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MatchFormat adds request conditions to a stub, so several stubs can share
+// a method and url and be chosen by what the request carries.
+type MatchFormat struct {
+	Headers map[string]ValueMatcher `json:"headers"`
+	Query   map[string]ValueMatcher `json:"query"`
+	// Body conditions use dotted paths into a JSON body, e.g. "user.id",
+	// or name the fields of a url-encoded form body
+	Body map[string]ValueMatcher `json:"body"`
+	// Xpath conditions apply to an XML body, e.g. "//order/@id", using the
+	// prefixes of Namespaces besides the predefined soap and soap12
+	Xpath      map[string]ValueMatcher `json:"xpath"`
+	Namespaces map[string]string       `json:"namespaces"`
+	// ClientIps lists addresses or CIDR ranges, one of which the caller's
+	// remote address must be in
+	ClientIps []string `json:"clientIps"`
+	// ClientCert conditions apply to the TLS client certificate by
+	// attribute: "cn", "o", "ou" or "san" (DNS, URI, email and IP names)
+	ClientCert map[string]ValueMatcher `json:"clientCert"`
+}
+
+// ValueMatcher is a condition on one header, query param or body field.
+// An empty matcher requires the value to be present; a plain JSON string
+// is shorthand for {"equals": "..."}.
+type ValueMatcher struct {
+	Equals  *string `json:"equals"`
+	Pattern string  `json:"pattern"`
+	// Absent requires the value to be missing
+	Absent bool `json:"absent"`
+	// Not inverts the condition, e.g. a pattern the value must not match
+	Not bool `json:"not"`
+
+	re *regexp.Regexp
+}
+
+func (m *ValueMatcher) UnmarshalJSON(b []byte) error {
+	var equals string
+	if json.Unmarshal(b, &equals) == nil {
+		*m = ValueMatcher{Equals: &equals}
+		return nil
+	}
+	type plain ValueMatcher
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+func (m *ValueMatcher) compile() error {
+	if m.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(m.Pattern)
+	m.re = re
+	return err
+}
+
+// String describes the condition for unmatched request logs.
+func (m *ValueMatcher) String() string {
+	desc := "present"
+	switch {
+	case m.Absent:
+		desc = "absent"
+	case m.Equals != nil:
+		desc = strconv.Quote(*m.Equals)
+	case m.re != nil:
+		desc = "match of " + m.Pattern
+	}
+	if m.Not {
+		return "not " + desc
+	}
+	return desc
+}
+
+func (m *ValueMatcher) matches(value string, present bool) bool {
+	ok := present
+	switch {
+	case m.Absent:
+		ok = !present
+	case !present:
+	case m.Equals != nil && value != *m.Equals:
+		ok = false
+	case m.re != nil && !m.re.MatchString(value):
+		ok = false
+	}
+	return ok != m.Not
+}
+
+// matchesAny applies the condition to an attribute with several values,
+// any of which may satisfy it; Not then means none may.
+func (m *ValueMatcher) matchesAny(values []string) bool {
+	if len(values) == 0 {
+		return m.matches("", false)
+	}
+	positive := *m
+	positive.Not = false
+	for _, value := range values {
+		if positive.matches(value, true) {
+			return !m.Not
+		}
+	}
+	return m.Not
+}
+
+// requestConditions is a compiled MatchFormat.
+type requestConditions struct {
+	headers map[string]*ValueMatcher
+	query   map[string]*ValueMatcher
+	body    map[string]*ValueMatcher
+	xpath   map[*xpathExpr]*ValueMatcher
+	clients []netip.Prefix
+	cert    map[string]*ValueMatcher
+	// bodyLimit caps the body read for body and xpath matching, that of
+	// the stub
+	bodyLimit BodyLimitFormat
+}
+
+func compileMatchers(name string, in map[string]ValueMatcher, canonical bool) (map[string]*ValueMatcher, error) {
+	out := make(map[string]*ValueMatcher, len(in))
+	for key, m := range in {
+		m := m
+		if err := m.compile(); err != nil {
+			return nil, fmt.Errorf("%s matcher %q: %w", name, key, err)
+		}
+		if canonical {
+			key = http.CanonicalHeaderKey(key)
+		}
+		out[key] = &m
+	}
+	return out, nil
+}
+
+func compileConditions(cfg *MatchFormat) (*requestConditions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	c := &requestConditions{}
+	var err error
+	if c.headers, err = compileMatchers("header", cfg.Headers, true); err != nil {
+		return nil, err
+	}
+	if c.query, err = compileMatchers("query", cfg.Query, false); err != nil {
+		return nil, err
+	}
+	if c.body, err = compileMatchers("body", cfg.Body, false); err != nil {
+		return nil, err
+	}
+	if c.cert, err = compileMatchers("client cert", cfg.ClientCert, false); err != nil {
+		return nil, err
+	}
+	xpaths, err := compileMatchers("xpath", cfg.Xpath, false)
+	if err != nil {
+		return nil, err
+	}
+	c.xpath = make(map[*xpathExpr]*ValueMatcher, len(xpaths))
+	for expr, m := range xpaths {
+		x, err := compileXPath(expr, cfg.Namespaces)
+		if err != nil {
+			return nil, fmt.Errorf("xpath matcher %w", err)
+		}
+		c.xpath[x] = m
+	}
+	for attr := range c.cert {
+		if _, ok := certAttributes[attr]; !ok {
+			return nil, fmt.Errorf("unknown client cert attribute %q", attr)
+		}
+	}
+	for _, client := range cfg.ClientIps {
+		prefix, err := parsePrefix(client)
+		if err != nil {
+			return nil, fmt.Errorf("client ip matcher: %w", err)
+		}
+		c.clients = append(c.clients, prefix)
+	}
+	return c, nil
+}
+
+// readsBody reports whether matching needs the request body.
+func (c *requestConditions) readsBody() bool {
+	return c != nil && (len(c.body) > 0 || len(c.xpath) > 0)
+}
+
+// parsePrefix accepts a CIDR range or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (c *requestConditions) clientAllowed(r *http.Request) bool {
+	addr, err := netip.ParseAddr(clientHost(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.clients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// certAttributes extract the values of client certificate attributes.
+var certAttributes = map[string]func(*x509.Certificate) []string{
+	"cn": func(c *x509.Certificate) []string { return []string{c.Subject.CommonName} },
+	"o":  func(c *x509.Certificate) []string { return c.Subject.Organization },
+	"ou": func(c *x509.Certificate) []string { return c.Subject.OrganizationalUnit },
+	"san": func(c *x509.Certificate) []string {
+		names := append([]string{}, c.DNSNames...)
+		names = append(names, c.EmailAddresses...)
+		for _, u := range c.URIs {
+			names = append(names, u.String())
+		}
+		for _, ip := range c.IPAddresses {
+			names = append(names, ip.String())
+		}
+		return names
+	},
+}
+
+// certValues returns an attribute of the request's client certificate,
+// nothing for plain HTTP or when the client sent none.
+func certValues(r *http.Request, attr string) []string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return certAttributes[attr](r.TLS.PeerCertificates[0])
+}
+
+// jsonField walks a dotted path through a decoded JSON document; numeric
+// parts index into arrays.
+func jsonField(doc interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			val, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			doc = val
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonText formats a JSON value for comparison as text, by matchers and
+// dataWhere.
+func jsonText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64, json.Number:
+		return numberText(v)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// bodyDocument decodes a body for body conditions: a url-encoded form as
+// its fields' first values, anything else as JSON.
+func bodyDocument(r *http.Request, body []byte) interface{} {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		form, _ := url.ParseQuery(string(body))
+		doc := make(map[string]interface{}, len(form))
+		for key, vals := range form {
+			doc[key] = vals[0]
+		}
+		return doc
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	dec.Decode(&doc)
+	return doc
+}
+
+// numberText formats a decoded JSON number without an exponent, so 1e6
+// and 1000000 both give "1000000". Integers decoded with UseNumber keep
+// all their digits.
+func numberText(v interface{}) string {
+	switch n := v.(type) {
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case json.Number:
+		if !strings.ContainsAny(string(n), ".eE") {
+			return string(n)
+		}
+		if f, err := n.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return string(n)
+	}
+	return fmt.Sprint(v)
+}
+
+// readBody returns the request body and restores it for the handler.
+func readBody(r *http.Request) []byte {
+	body, _ := readBodyUpTo(r, BodyLimitFormat{})
+	return body
+}
+
+// matchBody is a request body read while routing, possibly only up to a
+// stub's body limit: matchers share what was read, and the handler reads
+// it followed by the rest.
+type matchBody struct {
+	data []byte
+	off  int
+	// rest is the unread part of the body, nil once read to the end
+	rest io.ReadCloser
+	// over is the limit of a stub the body was too large to match, see
+	// rejectOversized
+	over *BodyLimitFormat
+}
+
+func (b *matchBody) Read(p []byte) (int, error) {
+	if b.off < len(b.data) {
+		n := copy(p, b.data[b.off:])
+		b.off += n
+		return n, nil
+	}
+	if b.rest == nil {
+		return 0, io.EOF
+	}
+	return b.rest.Read(p)
+}
+
+func (b *matchBody) Close() error {
+	if b.rest == nil {
+		return nil
+	}
+	return b.rest.Close()
+}
+
+// readBodyUpTo returns the request body for matching, reading no more
+// than limit allows; ok is false for a body over it.
+func readBodyUpTo(r *http.Request, limit BodyLimitFormat) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	b, shared := r.Body.(*matchBody)
+	if !shared || b.off > 0 {
+		b = &matchBody{rest: r.Body}
+		r.Body = b
+	}
+	max := limit.Bytes
+	if max > 0 && r.ContentLength > max {
+		b.rejected(limit)
+		return nil, false
+	}
+	if b.rest != nil && (max <= 0 || int64(len(b.data)) <= max) {
+		var more io.Reader = b.rest
+		if max > 0 {
+			more = io.LimitReader(b.rest, max+1-int64(len(b.data)))
+		}
+		read, err := io.ReadAll(more)
+		b.data = append(b.data, read...)
+		if err != nil || max <= 0 || int64(len(b.data)) <= max {
+			b.rest = nil
+		}
+	}
+	if max > 0 && int64(len(b.data)) > max {
+		b.rejected(limit)
+		return nil, false
+	}
+	return b.data, true
+}
+
+// rejected keeps the smallest limit the body was over.
+func (b *matchBody) rejected(limit BodyLimitFormat) {
+	if b.over == nil || limit.Bytes < b.over.Bytes {
+		b.over = &limit
+	}
+}
+
+// rejectOversized answers 413, as the stub's body limit would, a request
+// no stub took because its body was over the limit of one matching on it.
+// It reports false for other requests.
+func rejectOversized(w http.ResponseWriter, r *http.Request) bool {
+	b, ok := r.Body.(*matchBody)
+	if !ok || b.over == nil {
+		return false
+	}
+	report := bodyLimitReport{Error: "request body too large", Limit: b.over.Bytes}
+	if r.ContentLength > b.over.Bytes {
+		report.ContentLength = r.ContentLength
+	} else {
+		report.Read = int64(len(b.data))
+	}
+	slog.Debug("Request body over limit while matching", "path", r.URL.Path, "limit", b.over.Bytes, "read", report.Read, "contentLength", r.ContentLength)
+	rejectBody(w, *b.over, report)
+	return true
+}
+
+var errMismatch = []string{"mismatch"}
+
+func (c *requestConditions) matches(r *http.Request) bool {
+	return len(c.mismatches(r, false)) == 0
+}
+
+// mismatches describes the conditions r fails, stopping at the first one
+// unless all is set.
+func (c *requestConditions) mismatches(r *http.Request, all bool) []string {
+	failed := []string(nil)
+	fail := func(format string, args ...interface{}) bool {
+		if !all {
+			// routing only needs to know that something failed
+			failed = errMismatch
+			return true
+		}
+		failed = append(failed, fmt.Sprintf(format, args...))
+		return false
+	}
+	if len(c.clients) > 0 && !c.clientAllowed(r) {
+		if fail("client ip %s not in %v", clientHost(r), c.clients) {
+			return failed
+		}
+	}
+	for attr, m := range c.cert {
+		values := certValues(r, attr)
+		if !m.matchesAny(values) && fail("client cert %s: want %s, got %q", attr, m, values) {
+			return failed
+		}
+	}
+	for key, m := range c.headers {
+		vals, ok := r.Header[key]
+		value := ""
+		if ok {
+			value = strings.Join(vals, ", ")
+		}
+		if !m.matches(value, ok) && fail("header %s: want %s, got %s", key, m, describeValue(value, ok)) {
+			return failed
+		}
+	}
+	if len(c.query) > 0 {
+		query := r.URL.Query()
+		for key, m := range c.query {
+			vals, ok := query[key]
+			value := ""
+			if ok {
+				value = vals[0]
+			}
+			if !m.matches(value, ok) && fail("query %s: want %s, got %s", key, m, describeValue(value, ok)) {
+				return failed
+			}
+		}
+	}
+	if len(c.body) > 0 || len(c.xpath) > 0 {
+		if _, ok := readBodyUpTo(r, c.bodyLimit); !ok && fail("body over the %d byte limit", c.bodyLimit.Bytes) {
+			return failed
+		}
+	}
+	if len(c.body) > 0 {
+		body, _ := readBodyUpTo(r, c.bodyLimit)
+		doc := bodyDocument(r, body)
+		for path, m := range c.body {
+			val, ok := jsonField(doc, path)
+			value := jsonText(val)
+			if !m.matches(value, ok) && fail("body %s: want %s, got %s", path, m, describeValue(value, ok)) {
+				return failed
+			}
+		}
+	}
+	if len(c.xpath) > 0 {
+		// a body that isn't XML selects nothing
+		body, _ := readBodyUpTo(r, c.bodyLimit)
+		doc, err := parseXML(body)
+		for x, m := range c.xpath {
+			var values []string
+			if err == nil {
+				values = x.eval(doc)
+			}
+			if !m.matchesAny(values) && fail("xpath %s: want %s, got %q", x.source, m, values) {
+				return failed
+			}
+		}
+	}
+	return failed
+}
+
+func describeValue(value string, present bool) string {
+	if !present {
+		return "nothing"
+	}
+	return strconv.Quote(value)
+}
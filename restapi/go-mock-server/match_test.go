@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBodyMatchingComparesNumbersAsWritten(t *testing.T) {
+	_, server := newTestRoutes(t, `[
+		{"url": "/orders", "method": "POST", "match": {"body": {"amount": "1000000", "rate": "0.000001"}}, "response": {"status": 201}},
+		{"url": "/orders", "method": "POST", "response": {"status": 400}}]`)
+	for body, want := range map[string]int{
+		`{"amount": 1000000, "rate": 0.000001}`: http.StatusCreated,
+		`{"amount": 1e6, "rate": 1e-6}`:         http.StatusCreated,
+		`{"amount": 1000001, "rate": 0.000001}`: http.StatusBadRequest,
+	} {
+		resp, err := http.Post(server.URL+"/orders", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s answered %d, want %d", body, resp.StatusCode, want)
+		}
+	}
+}
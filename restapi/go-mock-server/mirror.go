@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorFormat adjusts, for one stub, how its requests are copied to the
+// --mirror shadow target. false is shorthand for not mirroring them, a
+// string for the url to mirror them to.
+type MirrorFormat struct {
+	// Url is the shadow target's base url, default --mirror
+	Url string `json:"url"`
+	// Sample is the fraction of requests mirrored, default --mirror-sample
+	Sample *float64 `json:"sample"`
+	// Redact names further headers, query params and JSON body fields,
+	// at any depth, whose values are masked in the copy
+	Redact []string `json:"redact"`
+	// Off keeps the stub's requests from being mirrored
+	Off bool `json:"off"`
+}
+
+func (m *MirrorFormat) UnmarshalJSON(b []byte) error {
+	var on bool
+	if json.Unmarshal(b, &on) == nil {
+		*m = MirrorFormat{Off: !on}
+		return nil
+	}
+	var target string
+	if json.Unmarshal(b, &target) == nil {
+		*m = MirrorFormat{Url: target}
+		return nil
+	}
+	type plain MirrorFormat
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+// mirrorBodyLimit caps the request body copied to the shadow target;
+// larger bodies aren't mirrored.
+const mirrorBodyLimit = 1 << 20
+
+// redactedValue replaces what a mirrored request mustn't carry.
+const redactedValue = "REDACTED"
+
+// mirrorConfig is the mirroring set up by the --mirror flags.
+var mirrorConfig = struct {
+	url    string
+	sample float64
+	redact string
+	// stubs is set once a stub has its own mirror url, so bodies are
+	// captured even without --mirror
+	stubs atomic.Bool
+	// inFlight caps the copies being sent, dropping more
+	inFlight chan struct{}
+	client   *http.Client
+	dropped  atomic.Int64
+}{
+	sample:   1,
+	redact:   "Authorization,Cookie,Proxy-Authorization",
+	inFlight: make(chan struct{}, 64),
+	client:   &http.Client{Timeout: 10 * time.Second},
+}
+
+func mirroring() bool {
+	return mirrorConfig.url != "" || mirrorConfig.stubs.Load()
+}
+
+// mirrorCapture keeps a copy of the request body for the mirrored request.
+type mirrorCapture struct {
+	io.ReadCloser
+	body bytes.Buffer
+	// tooLarge is set once the body passed mirrorBodyLimit
+	tooLarge bool
+}
+
+func (c *mirrorCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.tooLarge {
+		if c.body.Len()+n > mirrorBodyLimit {
+			c.tooLarge = true
+			c.body.Reset()
+		} else {
+			c.body.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// mirrorRequest sends a copy of r to the shadow target in the background,
+// unless its stub opts out or it isn't sampled. The response is discarded.
+func mirrorRequest(r *http.Request, capture *mirrorCapture, cfg *MirrorFormat) {
+	target, sample, redact := mirrorConfig.url, mirrorConfig.sample, splitList(mirrorConfig.redact)
+	if cfg != nil {
+		if cfg.Off {
+			return
+		}
+		if cfg.Url != "" {
+			target = cfg.Url
+		}
+		if cfg.Sample != nil {
+			sample = *cfg.Sample
+		}
+		redact = append(redact, cfg.Redact...)
+	}
+	if target == "" || random.Float64() >= sample {
+		return
+	}
+	// read what the stub left of the body, while the request is still open
+	io.Copy(io.Discard, io.LimitReader(capture, mirrorBodyLimit+1))
+	if capture.tooLarge {
+		slog.Debug("Request body too large to mirror", "path", r.URL.Path)
+		return
+	}
+	select {
+	case mirrorConfig.inFlight <- struct{}{}:
+	default:
+		mirrorConfig.dropped.Add(1)
+		return
+	}
+	req, err := mirroredRequest(r, target, capture.body.Bytes(), redact)
+	if err != nil {
+		<-mirrorConfig.inFlight
+		slog.Warn("Failed to mirror request", "target", target, "error", err)
+		return
+	}
+	go func() {
+		defer func() { <-mirrorConfig.inFlight }()
+		if n := mirrorConfig.dropped.Swap(0); n > 0 {
+			slog.Warn("Dropped mirrored requests, too many in flight", "dropped", n)
+		}
+		resp, err := mirrorConfig.client.Do(req)
+		if err != nil {
+			slog.Warn("Mirrored request failed", "url", req.URL.String(), "error", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		slog.Debug("Request mirrored", "method", req.Method, "url", req.URL.String(), "status", resp.StatusCode)
+	}()
+}
+
+// mirroredRequest builds the copy of r for the target, redacted.
+func mirroredRequest(r *http.Request, target string, body []byte, redact []string) (*http.Request, error) {
+	u := strings.TrimSuffix(target, "/") + r.URL.EscapedPath()
+	query, redacted := r.URL.Query(), false
+	for key := range query {
+		if containsFold(redact, key) {
+			query[key], redacted = []string{redactedValue}, true
+		}
+	}
+	switch {
+	case redacted:
+		u += "?" + query.Encode()
+	case r.URL.RawQuery != "":
+		u += "?" + r.URL.RawQuery
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		var doc interface{}
+		if json.Unmarshal(body, &doc) == nil && redactJSON(doc, redact) {
+			if redacted, err := json.Marshal(doc); err == nil {
+				body = redacted
+			}
+		}
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			redacted := false
+			for key := range form {
+				if containsFold(redact, key) {
+					form[key], redacted = []string{redactedValue}, true
+				}
+			}
+			if redacted {
+				body = []byte(form.Encode())
+			}
+		}
+	}
+	req, err := http.NewRequest(r.Method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, hop := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Expect", "Content-Length"} {
+		req.Header.Del(hop)
+	}
+	for key := range req.Header {
+		if containsFold(redact, key) {
+			req.Header[key] = []string{redactedValue}
+		}
+	}
+	req.Header.Set("X-Forwarded-For", clientHost(r))
+	req.Header.Set("X-Mirrored-From", r.Host)
+	return req, nil
+}
+
+// redactJSON masks the fields of doc named in redact, at any depth,
+// reporting whether there were any.
+func redactJSON(doc interface{}, redact []string) bool {
+	redacted := false
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if containsFold(redact, key) {
+				v[key], redacted = redactedValue, true
+			} else if redactJSON(val, redact) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if redactJSON(val, redact) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
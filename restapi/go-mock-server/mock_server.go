@@ -4,23 +4,115 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 type ApiFormat struct {
+	// Id names the stub in the admin API, default "stub-N" by load order
+	Id string `json:"id"`
+	// Enabled false registers the stub switched off, see /__admin/stubs
+	Enabled  *bool          `json:"enabled"`
 	Url      string         `json:"url"`
 	Method   string         `json:"method"`
+	Match    *MatchFormat   `json:"match"`
 	Response ResponseFormat `json:"response"`
 	Delay    int            `json:"delay"`
+	Delays   []DelayRule    `json:"delays"`
+	Timeout  int            `json:"timeout"`
+	// MaxBody answers request bodies over the limit with a 413
+	MaxBody *BodyLimitFormat `json:"maxBody"`
+	// Continue delays or refuses the 100 Continue of Expect: 100-continue
+	// requests
+	Continue *ContinueFormat `json:"continue"`
+	Retry    *RetryFormat    `json:"retry"`
+	Breaker  *BreakerFormat  `json:"breaker"`
+	Cache    *CacheFormat    `json:"cache"`
+	// RenderCache reuses rendered responses instead of building them again
+	RenderCache *RenderCacheFormat `json:"renderCache"`
+	Idempotency *IdempotencyFormat `json:"idempotency"`
+	// Replay rejects repeated requests and stale nonces or timestamps
+	Replay *ReplayFormat `json:"replay"`
+	// AccessLog picks the --access-log sinks the stub's requests go to
+	AccessLog *AccessLogFormat `json:"accessLog"`
+	// EncodingFault breaks the response's Content-Encoding on purpose
+	EncodingFault *EncodingFaultFormat `json:"encodingFault"`
+	// Mirror adjusts how the stub's requests are copied to a shadow target
+	Mirror  *MirrorFormat  `json:"mirror"`
+	Session *SessionFormat `json:"session"`
+	// Variants switches between responses by an experiment cookie or header
+	Variants *VariantsFormat `json:"variants"`
+	// RequireSession protects the stub, e.g. behind the login module
+	RequireSession *RequireSessionFormat `json:"requireSession"`
+	// Trailers are sent after the body, templates which see its digests
+	Trailers map[string]string `json:"trailers"`
+	// Links adds hypermedia links to other stubs
+	Links *LinksFormat `json:"links"`
+	// Transform adjusts the finished response, step by step
+	Transform []TransformStep `json:"transform"`
+	// Schedule swaps the response during time windows, or on a profile
+	// entry activates the profile
+	Schedule []ScheduleRule `json:"schedule"`
+	// Mutate perturbs JSON responses to test client deserialization
+	Mutate *MutateFormat `json:"mutate"`
+	// Signature verifies HMAC signed webhook deliveries
+	Signature *SignatureFormat `json:"signature"`
+	// Publish sends messages to MQTT, AMQP or Kafka brokers after each
+	// response
+	Publish []PublishFormat `json:"publish"`
+	// Trigger names client scenarios to run after each response
+	Trigger []string `json:"trigger"`
+	// Prefix and Stubs make the entry a group of stubs mounted under Prefix
+	Prefix string      `json:"prefix"`
+	Stubs  []ApiFormat `json:"stubs"`
+	// Include makes the entry stand for the stubs of another file
+	Include string `json:"include"`
+	// Define makes the entry a named response for others to extend
+	Define string `json:"define"`
+	// Profile makes the entry a named set of Overrides to other stubs
+	Profile   string            `json:"profile"`
+	Overrides []json.RawMessage `json:"overrides"`
+	// Scenario makes the entry a named list of Calls the mock sends, every
+	// Every milliseconds, on Schedule or when triggered
+	Scenario string         `json:"scenario"`
+	Every    int            `json:"every"`
+	Calls    []ScenarioCall `json:"calls"`
+
+	// source is where the stub was defined, for the route dump
+	source stubSource
 }
 
 type ResponseFormat struct {
 	Status  int                    `json:"status"`
 	Headers map[string]interface{} `json:"headers"`
 	Body    map[string]interface{} `json:"body"`
+	// Text is a string template sent as the body instead, e.g. an XML
+	// document; "" sends an empty body
+	Text *string `json:"text"`
+	// File serves the body from a file instead, at its path when it was
+	// read
+	File string `json:"file"`
+	// Type selects a special response kind; empty means a static response
+	Type     string          `json:"type"`
+	Redirect *RedirectFormat `json:"redirect"`
+	Login    *LoginFormat    `json:"login"`
+	Upload   *UploadFormat   `json:"upload"`
+	Payload  *PayloadFormat  `json:"payload"`
+	Schema   *SchemaFormat   `json:"schema"`
+	Soap     *SoapFormat     `json:"soap"`
+	Webdav   *WebdavFormat   `json:"webdav"`
+	Problem  *ProblemFormat  `json:"problem"`
+	// Locales picks the body by Accept-Language
+	Locales *LocalesFormat `json:"locales"`
+	// Extends names a defined response whose fields this one overrides
+	Extends string `json:"extends"`
 }
 
 func check(e error) {
@@ -30,10 +122,366 @@ func check(e error) {
 	}
 }
 
+// newResponder builds the handler writing the configured response.
+func newResponder(api ApiFormat) http.HandlerFunc {
+	if api.Schedule != nil {
+		return newScheduleHandler(api)
+	}
+	if api.Variants != nil {
+		return newVariantsHandler(api)
+	}
+	if api.Response.Locales != nil {
+		return newLocalizedHandler(api)
+	}
+	switch api.Response.Type {
+	case "":
+		if api.Response.File != "" {
+			return newFileHandler(api)
+		}
+		return newStaticHandler(api)
+	case "redirect":
+		return newRedirectHandler(api)
+	case "login":
+		return newLoginHandler(api)
+	case "upload":
+		return newUploadHandler(api)
+	case "payload":
+		return newPayloadHandler(api)
+	case "echo":
+		return newEchoHandler(api)
+	case "schema":
+		return newSchemaHandler(api)
+	case "capture":
+		return newCaptureHandler(api)
+	case "soap":
+		return newSoapHandler(api)
+	case "webdav":
+		return newWebdavHandler(api)
+	case "problem":
+		return newProblemHandler(api)
+	}
+	check(fmt.Errorf("unknown response type %q for %s %s", api.Response.Type, api.Method, api.Url))
+	return nil
+}
+
+// newHandler builds the request handler for a single configured api.
+func newHandler(api ApiFormat, counters *stubStats) http.HandlerFunc {
+	if api.AccessLog != nil {
+		check(api.AccessLog.validate())
+	}
+	if api.Mirror != nil && api.Mirror.Url != "" {
+		mirrorConfig.stubs.Store(true)
+	}
+	respond := newResponder(api)
+	if api.Links != nil {
+		respond = withLinks(api, counters.id, respond)
+	}
+	if len(api.Transform) > 0 {
+		respond = withTransform(api, respond)
+	}
+	if api.RenderCache != nil {
+		respond = withRenderCache(api, respond)
+	}
+	if api.EncodingFault != nil {
+		respond = withEncodingFault(api, respond)
+	}
+	if len(api.Trailers) > 0 {
+		respond = withTrailers(api, respond)
+	}
+	if len(api.Publish) > 0 {
+		respond = withPublish(api, respond)
+	}
+	if len(api.Trigger) > 0 {
+		respond = withTrigger(api, respond)
+	}
+	if api.Mutate != nil {
+		respond = withMutations(api, counters.id, respond)
+	}
+	if api.Cache != nil {
+		respond = withCache(api, respond)
+	}
+	if api.Session != nil {
+		respond = withSession(api, respond)
+	}
+	if api.Idempotency != nil {
+		respond = withIdempotency(api, respond)
+	}
+	if api.Replay != nil {
+		respond = withReplayProtection(api, respond)
+	}
+	if api.Retry != nil {
+		respond = withRetry(api, respond)
+	}
+	if api.RequireSession != nil {
+		respond = withRequireSession(api, respond)
+	}
+	if api.Signature != nil {
+		respond = withSignature(api, respond)
+	}
+	delays, err := compileDelays(api.Delays)
+	check(err)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		// worked out first, as the handler may consume the body
+		delay := requestDelay(time.Duration(api.Delay)*time.Millisecond, delays, r)
+		respond(w, r)
+		if delay > 0 {
+			sleepFor(r, delay)
+		}
+	}
+	// outside the delay rules, which may read the body
+	if bodyLimit := stubBodyLimit(api); bodyLimit.Bytes > 0 {
+		serve = withBodyLimit(api, bodyLimit, serve)
+	}
+	if api.Continue != nil {
+		serve = withContinue(api, serve)
+	}
+	if api.Timeout > 0 {
+		serve = withTimeout(api, serve)
+	}
+	if api.Breaker != nil {
+		serve = withBreaker(api, serve)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			// recorded as well when servePanic aborts the response
+			defer func() {
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				counters.record(rec.status, time.Since(start))
+			}()
+			if p := recover(); p != nil {
+				counters.panicked()
+				servePanic(rec, r, counters.id, p)
+			}
+		}()
+		serve(rec, r)
+	}
+}
+
+// headerList holds response headers resolved at load time, so handlers can
+// copy them without canonicalizing or formatting values per request. Values
+// containing template actions are rendered per request instead, e.g.
+// "Location": "/orders/{{.UUID}}".
+type headerList []headerField
+
+type headerField struct {
+	key    string
+	values []string
+	tmpl   *textTemplate
+}
+
+func compileHeaders(headers map[string]interface{}) headerList {
+	list := make(headerList, 0, len(headers))
+	for key, val := range headers {
+		key = http.CanonicalHeaderKey(key)
+		t, err := compileTemplate(key, fmt.Sprint(val))
+		if err != nil {
+			check(fmt.Errorf("header %s: %w", key, err))
+		}
+		f := headerField{key: key, values: []string{t.raw}}
+		if t.tmpl != nil {
+			f.tmpl = t
+		}
+		list = append(list, f)
+	}
+	return list
+}
+
+func (hl headerList) dynamic() bool {
+	for _, f := range hl {
+		if f.tmpl != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the headers on w, rendering templates for r. If one fails it
+// answers 500 and reports false.
+func (hl headerList) apply(w http.ResponseWriter, r *http.Request, api ApiFormat) bool {
+	var data templateData
+	if hl.dynamic() {
+		data = newTemplateData(r, api)
+	}
+	return hl.render(w, data)
+}
+
+// render is apply with the template data the caller also renders the body
+// with, so e.g. {{.UUID}} is the same in both.
+func (hl headerList) render(w http.ResponseWriter, data templateData) bool {
+	h := w.Header()
+	for _, f := range hl {
+		if f.tmpl == nil {
+			h[f.key] = f.values
+			continue
+		}
+		val, err := f.tmpl.render(data)
+		if err != nil {
+			slog.Error("Failed to render response header", "header", f.key, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		h[f.key] = []string{val}
+	}
+	return true
+}
+
+func newStaticHandler(api ApiFormat) http.HandlerFunc {
+	if api.Response.Text != nil {
+		return newTextHandler(api)
+	}
+	headers := compileHeaders(api.Response.Headers)
+	body, dynamic, err := compileJSON(api.Url, api.Response.Body)
+	check(err)
+	// static bodies are encoded once here instead of on every request
+	var encoded []byte
+	if api.Response.Body != nil && !dynamic {
+		encoded, err = json.Marshal(api.Response.Body)
+		check(err)
+		encoded = append(encoded, '\n')
+	}
+	contentLength := []string{strconv.Itoa(len(encoded))}
+	dynamicHeaders := headers.dynamic()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, length := encoded, contentLength
+		var data templateData
+		if dynamic || dynamicHeaders {
+			data = newTemplateData(r, api)
+		}
+		if dynamic {
+			rendered, err := renderJSON(body, data)
+			if err == nil {
+				payload, err = json.Marshal(rendered)
+			}
+			if err != nil {
+				slog.Error("Failed to render response body", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			payload = append(payload, '\n')
+			length = []string{strconv.Itoa(len(payload))}
+		}
+		// set response headers
+		if !headers.render(w, data) {
+			return
+		}
+		w.Header()["Content-Length"] = length
+		w.WriteHeader(api.Response.Status)
+		slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", api.Response.Status)
+		w.Write(payload)
+	}
+}
+
+// newTextHandler writes a string template body as is.
+func newTextHandler(api ApiFormat) http.HandlerFunc {
+	if api.Response.Body != nil {
+		check(fmt.Errorf("response for %s %s has both a body and a text", api.Method, api.Url))
+	}
+	headers := compileHeaders(api.Response.Headers)
+	text, err := compileTemplate(api.Url, *api.Response.Text)
+	check(err)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := newTemplateData(r, api)
+		payload, err := text.render(data)
+		if err != nil {
+			slog.Error("Failed to render response body", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !headers.render(w, data) {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.WriteHeader(api.Response.Status)
+		slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", api.Response.Status)
+		io.WriteString(w, payload)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		runBuild(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		runSchema(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
+	defaultMockData := "../data/sample.json"
+	bundled, err := extractBundle()
+	check(err)
+	if bundled != "" {
+		defaultMockData = bundled
+	}
+
 	debug := flag.Bool("debug", false, "enable debug logging")
-	mock_data := flag.String("mock-data", "../data/sample.json", "config for creating mock server")
-	port := flag.Int("port", 8080, "port exposed")
+	mock_data := flag.String("mock-data", defaultMockData, "config for creating mock server")
+	port := flag.Int("port", 8080, "port exposed, 0 picks a free one")
+	host := flag.String("host", "", "interface address or host name to bind, e.g. 127.0.0.1, ::1 or localhost; empty binds all interfaces")
+	listen := flag.String("listen", "", "address to bind as host:port, e.g. [::1]:9000, instead of -host and -port")
+	addrFile := flag.String("addr-file", "", "write the addresses listened on to this file once bound, one per line, e.g. to find the port picked for -port=0")
+	basePath := flag.String("base-path", "", "prefix prepended to every stub url, e.g. /api/v2")
+	adminListen := flag.String("admin-listen", "", "serve the admin API on this address instead of the mock port")
+	smtpListen := flag.String("smtp-listen", "", "accept email over SMTP on this address, e.g. :2525, keeping it for GET /__admin/emails instead of delivering it")
+	var admin adminAuth
+	flag.StringVar(&admin.token, "admin-token", os.Getenv("MOCK_ADMIN_TOKEN"), "bearer token required by the admin API")
+	flag.StringVar(&admin.user, "admin-user", "", "basic auth user required by the admin API")
+	flag.StringVar(&admin.password, "admin-password", os.Getenv("MOCK_ADMIN_PASSWORD"), "basic auth password for -admin-user")
+	dataFiles := dataFileFlag{}
+	flag.Var(dataFiles, "data-file", "name=path of a CSV or JSON table for template lookups, repeatable")
+	unmatched := flag.String("unmatched", "", `response for requests no stub matches as JSON, e.g. '{"status": 404, "body": {"error": "no stub"}}'`)
+	captureAll := flag.Bool("capture-all", false, "answer every request no stub serves with 200, or the -unmatched response, and keep it in the journal")
+	strict := flag.Bool("strict", false, "record unmatched requests as failures, see /__admin/unmatched")
+	strictExit := flag.Bool("strict-exit", false, "with -strict, exit with status 1 on shutdown if there were unmatched requests")
+	echoPath := flag.String("echo-path", "/__echo/", "built-in endpoint echoing requests back as JSON, empty disables it")
+	flag.StringVar(&healthPath, "health-path", healthPath, "built-in health check endpoint, outside the admin API and the journal; empty disables it")
+	tlsCert := flag.String("tls-cert", "", "serve HTTPS with this certificate file")
+	tlsKey := flag.String("tls-key", "", "key file for -tls-cert")
+	tlsFaultFlags := tlsFaultFlag{}
+	flag.Var(tlsFaultFlags, "tls-fault", "fault=address of an extra HTTPS listener misbehaving on purpose, repeatable: "+strings.Join(tlsFaultNames(), ", "))
+	tlsClientCA := flag.String("tls-client-ca", "", "request client certificates and verify them against this CA file")
+	flag.IntVar(&routes.journal.size, "journal-size", routes.journal.size, "number of recent requests kept for /__admin/requests, 0 disables the journal")
+	profile := flag.String("profile", "", "profile of the mock data to apply, e.g. degraded; switch at runtime with /__admin/profile")
+	workspaceFiles := workspaceFlag{}
+	printRoutesFormat := new(printRoutesFlag)
+	flag.Var(printRoutesFormat, "print-routes", "print every registered stub with its matchers, priority and source, as JSON or with =yaml as YAML, and exit")
+	flag.Var(accessLogFlags, "access-log", "[name=]target of access log records as JSON lines, repeatable: stdout, stderr, a file, syslog, syslog://host:port, syslog+tcp://host:port or an http(s) collector url; stubs pick sinks with accessLog")
+	flag.StringVar(&mirrorConfig.url, "mirror", "", "base url of a shadow target every request is copied to in the background, its answer ignored; stubs adjust it with mirror")
+	flag.Float64Var(&mirrorConfig.sample, "mirror-sample", mirrorConfig.sample, "fraction of requests mirrored, from 0 to 1")
+	flag.StringVar(&mirrorConfig.redact, "mirror-redact", mirrorConfig.redact, "comma separated headers, query params and JSON or form body fields masked in mirrored requests")
+	flag.Var(workspaceFiles, "workspace", "name=path of a mock data file served as an isolated workspace, repeatable; pick one with -workspace-header or a /workspaces/{name}/ prefix")
+	flag.StringVar(&workspaces.header, "workspace-header", workspaces.header, "request header naming the workspace to use, e.g. X-Api-Key with workspaces named by key")
+	presets := presetFlag{}
+	flag.Var(presets, "preset", "bundled stubs to load, name or name=/prefix, repeatable: "+strings.Join(presetNames(), ", "))
+	flag.IntVar(&limiter.max, "max-in-flight", 0, "serve at most this many requests at once, 0 for no limit")
+	flag.IntVar(&limiter.maxQueue, "max-queue", 0, "with -max-in-flight, requests that may wait for a slot before more are shed with 503")
+	flag.DurationVar(&limiter.wait, "queue-timeout", limiter.wait, "with -max-queue, how long a request waits for a slot before it is shed")
+	flag.Int64Var(&defaultBodyLimit, "max-body", 0, "answer request bodies over this many bytes with 413, for stubs without their own maxBody; 0 for no limit")
+	readTimeout := flag.Duration("read-timeout", 0, "maximum time to read a whole request, including the body, 0 for none")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 0, "maximum time to read request headers, 0 for -read-timeout")
+	writeTimeout := flag.Duration("write-timeout", 0, "maximum time from the end of reading headers to the end of the response, including delays, 0 for none")
+	idleTimeout := flag.Duration("idle-timeout", 0, "how long keep-alive connections may sit idle, 0 for -read-timeout")
+	seed := flag.Uint64("seed", 0, "seed for fake data, weighted variants, mutations and other random responses, to reproduce a run; 0 picks one and logs it")
+	flag.StringVar(&routes.sessions.cookie, "session-cookie", routes.sessions.cookie, "cookie holding the mock session id")
+	// every flag can also come from the environment, see flagsFromEnv
+	check(flagsFromEnv(flag.CommandLine))
 	flag.Parse()
 
 	// Set log level based on debug flag
@@ -41,28 +489,113 @@ func main() {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
 
-	file, err := os.ReadFile(*mock_data)
-	check(err)
-	apis := []ApiFormat{}
-	json.Unmarshal(file, &apis)
-	for _, api := range apis {
-		api := api // capture loop var for closure
-		http.HandleFunc(api.Method+" "+api.Url, func(w http.ResponseWriter, r *http.Request) {
-			// set response headers
-			for key, val := range api.Response.Headers {
-				w.Header().Set(key, fmt.Sprint(val))
-			}
-			w.WriteHeader(api.Response.Status)
-			slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", api.Response.Status)
-			if api.Response.Body != nil {
-				json.NewEncoder(w).Encode(api.Response.Body)
+	if *seed == 0 {
+		*seed = random.Uint64()
+	}
+	randomSource.seed(*seed)
+	// logged so a failing run can be replayed with -seed
+	slog.Info("Random seed", "seed", *seed)
+	check(loadDatasets(dataFiles))
+	check(openAccessLogs(accessLogFlags))
+	var unmatchedResponse *ResponseFormat
+	if *unmatched != "" {
+		unmatchedResponse = &ResponseFormat{}
+		check(json.Unmarshal([]byte(*unmatched), unmatchedResponse))
+	}
+	unmatchedHandler := newUnmatchedHandler(unmatchedResponse, *strict)
+	if *captureAll {
+		capture := ApiFormat{Url: "/"}
+		if unmatchedResponse != nil {
+			capture.Response = *unmatchedResponse
+		}
+		respond := newCaptureHandler(capture)
+		unmatchedHandler = func(w http.ResponseWriter, r *http.Request) {
+			setServingStub(r, captureStub)
+			respond(w, r)
+		}
+	}
+	if *strict {
+		go func() {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			<-stop
+			failed := routes.misses.count()
+			for _, lr := range workspaces.byName {
+				failed += lr.misses.count()
 			}
-			if api.Delay > 0 {
-				time.Sleep(time.Duration(api.Delay) * time.Millisecond)
+			slog.Info("Shutting down", "unmatched", failed)
+			if failed > 0 && *strictExit {
+				os.Exit(1)
 			}
-		})
-		slog.Info("Registered endpoint", "method", api.Method, "url", api.Url)
+			os.Exit(0)
+		}()
+	}
+	routes.mockData, routes.basePath, routes.presets, routes.profile = *mock_data, *basePath, presets, *profile
+	echo := newEchoHandler(ApiFormat{Url: *echoPath})
+	routes.setup = func(mux *router) {
+		mux.unmatched = unmatchedHandler
+		if *echoPath != "" {
+			check(mux.handle(*echoPath, echo))
+		}
+		if healthPath != "" {
+			check(mux.handle("GET "+healthPath, http.HandlerFunc(serveHealth)))
+		}
+		if *adminListen == "" {
+			registerAdmin(mux, admin)
+		}
+	}
+	_, err = routes.load()
+	check(err)
+	go routes.followSchedule()
+	go routes.runScenarios()
+	for _, name := range workspaceFiles.names() {
+		check(workspaces.add(name, workspaceFiles[name], routes))
+		go workspaces.byName[name].followSchedule()
+		go workspaces.byName[name].runScenarios()
+	}
+	if *printRoutesFormat != "" {
+		printRoutes(string(*printRoutesFormat))
+		return
+	}
+	routes.routesReport().logSummary()
+	for _, name := range workspaceFiles.names() {
+		workspaces.byName[name].routesReport().logSummary()
+	}
+	if *smtpListen != "" {
+		check(serveSMTP(*smtpListen))
+	}
+	if *adminListen != "" {
+		adminMux := newRouter()
+		registerAdmin(adminMux, admin)
+		go func() {
+			slog.Info("Starting admin server", "address", *adminListen)
+			check(http.ListenAndServe(*adminListen, withWorkspaces(withRecovery(adminMux))))
+		}()
+	}
+	listeners, err := systemdListeners()
+	check(err)
+	if len(listeners) == 0 {
+		addrs, err := listenAddrs(*listen, *host, *port)
+		check(err)
+		listeners, err = openListeners(addrs)
+		check(err)
+	}
+	bound := boundAddrs(listeners)
+	if *addrFile != "" {
+		check(os.WriteFile(*addrFile, []byte(strings.Join(bound, "\n")+"\n"), 0o644))
+	}
+	server := &http.Server{
+		Handler:           withWorkspaces(withRequestTracking(withRecovery(withLoadLimit(http.HandlerFunc(serveRoutes))))),
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if *tlsCert != "" {
+		server.TLSConfig, err = clientCertConfig(*tlsClientCA)
+		check(err)
 	}
-	slog.Info("Starting server", "port", port)
-	http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
+	check(serveTLSFaults(tlsFaultFlags, server.Handler))
+	slog.Info("Starting server", "addresses", bound, "tls", *tlsCert != "")
+	check(serveOn(server, listeners, *tlsCert, *tlsKey))
 }
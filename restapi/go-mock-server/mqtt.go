@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MQTT 3.1.1 control packet types, shifted into the fixed header.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttConnackErrors explains the CONNACK return codes refusing a client.
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+func mqttString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// writeMQTT sends a packet: the fixed header byte, the remaining length as
+// a variable byte integer, then body.
+func writeMQTT(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTT(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// publishMQTT connects with a clean session, publishes msg at QoS 0 or 1
+// (waiting for the PUBACK) and disconnects.
+func publishMQTT(c *compiledPublish, msg *brokerMessage) error {
+	conn, err := c.dial(c.hosts[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	broker, cfg := c.broker, c.cfg
+	r := bufio.NewReader(conn)
+	var connect bytes.Buffer
+	mqttString(&connect, "MQTT")
+	connect.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02)  // clean session
+	user := broker.User.Username()
+	password, hasPassword := broker.User.Password()
+	if user != "" {
+		flags |= 0x80
+		if hasPassword {
+			flags |= 0x40
+		}
+	}
+	connect.WriteByte(flags)
+	binary.Write(&connect, binary.BigEndian, uint16(30)) // keep alive
+	mqttString(&connect, "mock-server-"+strconv.Itoa(randomInt(100000, 999999)))
+	if user != "" {
+		mqttString(&connect, user)
+		if hasPassword {
+			mqttString(&connect, password)
+		}
+	}
+	if err := writeMQTT(conn, mqttConnect, connect.Bytes()); err != nil {
+		return err
+	}
+	header, body, err := readMQTT(r)
+	if err != nil {
+		return fmt.Errorf("mqtt connect: %w", err)
+	}
+	if header&0xf0 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("mqtt connect: unexpected packet type %d", header>>4)
+	}
+	if code := body[1]; code != 0 {
+		reason := mqttConnackErrors[code]
+		if reason == "" {
+			reason = "return code " + strconv.Itoa(int(code))
+		}
+		return fmt.Errorf("mqtt connect refused: %s", reason)
+	}
+
+	var publish bytes.Buffer
+	mqttString(&publish, msg.topic)
+	header = mqttPublish | byte(cfg.Qos)<<1
+	if cfg.Retain {
+		header |= 0x01
+	}
+	const packetID = 1
+	if cfg.Qos == 1 {
+		binary.Write(&publish, binary.BigEndian, uint16(packetID))
+	}
+	publish.Write(msg.payload)
+	if err := writeMQTT(conn, header, publish.Bytes()); err != nil {
+		return err
+	}
+	for cfg.Qos == 1 {
+		header, body, err := readMQTT(r)
+		if err != nil {
+			return fmt.Errorf("mqtt publish: waiting for puback: %w", err)
+		}
+		if header&0xf0 == mqttPuback && len(body) == 2 && binary.BigEndian.Uint16(body) == packetID {
+			break
+		}
+	}
+	return writeMQTT(conn, mqttDisconnect, nil)
+}
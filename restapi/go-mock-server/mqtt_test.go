@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+	// the boundaries of the 1 to 4 byte encodings
+	for n, encoded := range map[int][]byte{
+		0:       {0x00},
+		127:     {0x7f},
+		128:     {0x80, 0x01},
+		16383:   {0xff, 0x7f},
+		16384:   {0x80, 0x80, 0x01},
+		2097151: {0xff, 0xff, 0x7f},
+		2097152: {0x80, 0x80, 0x80, 0x01},
+	} {
+		var b bytes.Buffer
+		body := make([]byte, n)
+		if err := writeMQTT(&b, mqttPublish, body); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Bytes()[1 : 1+len(encoded)]; !bytes.Equal(got, encoded) {
+			t.Errorf("length %d encoded as %x, want %x", n, got, encoded)
+		}
+		header, read, err := readMQTT(bufio.NewReader(&b))
+		if err != nil || header != mqttPublish || len(read) != n {
+			t.Errorf("length %d read back as %d bytes, header %x, %v", n, len(read), header, err)
+		}
+	}
+	if _, _, err := readMQTT(bufio.NewReader(bytes.NewReader([]byte{mqttPublish, 0xff, 0xff, 0xff, 0xff, 0x01}))); err == nil {
+		t.Error("read a remaining length of five bytes")
+	}
+}
+
+// readMQTTString reads a length-prefixed string off b.
+func readMQTTString(t *testing.T, b *bytes.Reader) string {
+	t.Helper()
+	var n uint16
+	if err := binary.Read(b, binary.BigEndian, &n); err != nil {
+		t.Fatal(err)
+	}
+	s := make([]byte, n)
+	b.Read(s)
+	return string(s)
+}
+
+func compileTestPublish(t *testing.T, cfg PublishFormat) *compiledPublish {
+	t.Helper()
+	compiled, err := compilePublish(ApiFormat{Url: "/orders", Publish: []PublishFormat{cfg}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &compiled[0]
+}
+
+// mqttPacket is a packet received by the fake broker.
+type mqttPacket struct {
+	header byte
+	body   []byte
+}
+
+// fakeMQTT accepts one client, answering its CONNECT with returnCode and
+// acknowledging QoS 1 publications, and hands the packets it gets to the
+// test.
+func fakeMQTT(t *testing.T, returnCode byte) (string, chan mqttPacket) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	packets := make(chan mqttPacket, 10)
+	go func() {
+		defer close(packets)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			header, body, err := readMQTT(r)
+			if err != nil {
+				return
+			}
+			packets <- mqttPacket{header, body}
+			switch header & 0xf0 {
+			case mqttConnect:
+				writeMQTT(conn, mqttConnack, []byte{0, returnCode})
+			case mqttPublish:
+				if qos := header >> 1 & 3; qos == 1 {
+					topicLength := int(binary.BigEndian.Uint16(body))
+					writeMQTT(conn, mqttPuback, body[2+topicLength:4+topicLength])
+				}
+			case mqttDisconnect:
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), packets
+}
+
+func TestPublishMQTT(t *testing.T) {
+	addr, packets := fakeMQTT(t, 0)
+	p := compileTestPublish(t, PublishFormat{Broker: "mqtt://ada:secret@" + addr, Topic: "orders", Qos: 1, Retain: true})
+	if err := p.send(&brokerMessage{topic: "orders/7", payload: []byte(`{"id": 7}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := <-packets
+	if connect.header != mqttConnect {
+		t.Fatalf("first packet %x, want CONNECT", connect.header)
+	}
+	b := bytes.NewReader(connect.body)
+	if name := readMQTTString(t, b); name != "MQTT" {
+		t.Errorf("protocol name %q", name)
+	}
+	level, _ := b.ReadByte()
+	flags, _ := b.ReadByte()
+	// user name, password and clean session
+	if level != 4 || flags != 0xc2 {
+		t.Errorf("protocol level %d, flags %x", level, flags)
+	}
+	b.Seek(2, 1) // keep alive
+	if id := readMQTTString(t, b); !strings.HasPrefix(id, "mock-server-") {
+		t.Errorf("client id %q", id)
+	}
+	if user, password := readMQTTString(t, b), readMQTTString(t, b); user != "ada" || password != "secret" {
+		t.Errorf("credentials %q, %q", user, password)
+	}
+
+	publish := <-packets
+	// QoS 1 and retain
+	if publish.header != mqttPublish|0x02|0x01 {
+		t.Errorf("publish header %x", publish.header)
+	}
+	b = bytes.NewReader(publish.body)
+	if topic := readMQTTString(t, b); topic != "orders/7" {
+		t.Errorf("topic %q", topic)
+	}
+	var packetID uint16
+	binary.Read(b, binary.BigEndian, &packetID)
+	payload := make([]byte, b.Len())
+	b.Read(payload)
+	if packetID == 0 || string(payload) != `{"id": 7}` {
+		t.Errorf("packet id %d, payload %q", packetID, payload)
+	}
+	if disconnect := <-packets; disconnect.header != mqttDisconnect {
+		t.Errorf("last packet %x, want DISCONNECT", disconnect.header)
+	}
+}
+
+func TestPublishMQTTQos0(t *testing.T) {
+	addr, packets := fakeMQTT(t, 0)
+	p := compileTestPublish(t, PublishFormat{Broker: "mqtt://" + addr, Topic: "orders"})
+	if err := p.send(&brokerMessage{topic: "orders", payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if connect := <-packets; connect.body[7] != 0x02 {
+		t.Errorf("flags %x without credentials, want clean session only", connect.body[7])
+	}
+	publish := <-packets
+	if publish.header != mqttPublish || string(publish.body) != "\x00\x06ordersx" {
+		t.Errorf("publish %x %q", publish.header, publish.body)
+	}
+}
+
+func TestPublishMQTTRefused(t *testing.T) {
+	addr, _ := fakeMQTT(t, 5)
+	p := compileTestPublish(t, PublishFormat{Broker: "mqtt://" + addr, Topic: "orders"})
+	if err := p.send(&brokerMessage{topic: "orders"}); err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Errorf("got %v, want the refusal", err)
+	}
+}
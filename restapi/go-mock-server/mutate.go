@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MutateFormat perturbs a stub's JSON responses to test how tolerant a
+// client's deserialization is.
+type MutateFormat struct {
+	// Operators to apply, default all of mutationOperators
+	Operators []string `json:"operators"`
+	// Rate is the share of responses mutated, default 1 for every one
+	Rate float64 `json:"rate"`
+}
+
+// mutationHeader tells the client, or whoever reads the logs, what was
+// changed in a response.
+const mutationHeader = "X-Mock-Mutation"
+
+// mutationTarget is a place in a JSON document a mutation can apply to.
+type mutationTarget struct {
+	path   string
+	parent interface{}
+	key    string
+	index  int
+	value  interface{}
+}
+
+func (t mutationTarget) set(v interface{}) {
+	switch p := t.parent.(type) {
+	case map[string]interface{}:
+		p[t.key] = v
+	case []interface{}:
+		p[t.index] = v
+	}
+}
+
+// collectTargets lists every value below doc with its path.
+func collectTargets(doc interface{}, path string, targets []mutationTarget) []mutationTarget {
+	child := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			targets = append(targets, mutationTarget{path: child(key), parent: v, key: key, value: val})
+			targets = collectTargets(val, child(key), targets)
+		}
+	case []interface{}:
+		for i, val := range v {
+			targets = append(targets, mutationTarget{path: child(strconv.Itoa(i)), parent: v, index: i, value: val})
+			targets = collectTargets(val, child(strconv.Itoa(i)), targets)
+		}
+	}
+	return targets
+}
+
+// otherType replaces a value with one of a different JSON type.
+func otherType(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return 12345
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return 0
+	}
+	return "unexpected"
+}
+
+// mutationOperators apply a mutation to one of the targets they accept,
+// returning a description, or "" if the document has none they can use.
+var mutationOperators = map[string]func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string{
+	"drop-field": func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string {
+		fields := filterTargets(targets, func(t mutationTarget) bool { _, ok := t.parent.(map[string]interface{}); return ok })
+		if len(fields) == 0 {
+			return ""
+		}
+		t := fields[rnd.IntN(len(fields))]
+		delete(t.parent.(map[string]interface{}), t.key)
+		return "drop-field " + t.path
+	},
+	"null-field": func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string {
+		fields := filterTargets(targets, func(t mutationTarget) bool { return t.value != nil })
+		if len(fields) == 0 {
+			return ""
+		}
+		t := fields[rnd.IntN(len(fields))]
+		t.set(nil)
+		return "null-field " + t.path
+	},
+	"change-type": func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string {
+		if len(targets) == 0 {
+			return ""
+		}
+		t := targets[rnd.IntN(len(targets))]
+		t.set(otherType(t.value))
+		return "change-type " + t.path
+	},
+	"reorder": func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string {
+		lists := filterTargets(append(targets, mutationTarget{path: "(root)", value: doc}), func(t mutationTarget) bool {
+			list, ok := t.value.([]interface{})
+			return ok && len(list) > 1
+		})
+		if len(lists) == 0 {
+			return ""
+		}
+		t := lists[rnd.IntN(len(lists))]
+		list := t.value.([]interface{})
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+		return "reorder " + t.path
+	},
+	"add-field": func(doc interface{}, targets []mutationTarget, rnd *rand.Rand) string {
+		objects := filterTargets(append(targets, mutationTarget{path: "(root)", value: doc}), func(t mutationTarget) bool {
+			_, ok := t.value.(map[string]interface{})
+			return ok
+		})
+		if len(objects) == 0 {
+			return ""
+		}
+		t := objects[rnd.IntN(len(objects))]
+		t.value.(map[string]interface{})["mockUnexpectedField"] = "unexpected"
+		return "add-field " + t.path
+	},
+}
+
+func filterTargets(targets []mutationTarget, keep func(mutationTarget) bool) []mutationTarget {
+	kept := []mutationTarget{}
+	for _, t := range targets {
+		if keep(t) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+type mutationRecord struct {
+	RequestID string    `json:"requestId"`
+	Time      time.Time `json:"time"`
+	Stub      string    `json:"stub"`
+	Operator  string    `json:"operator"`
+	Mutation  string    `json:"mutation"`
+	// Tolerated is reported by the test through the admin API
+	Tolerated *bool `json:"tolerated"`
+}
+
+type mutationSummary struct {
+	Applied   int `json:"applied"`
+	Tolerated int `json:"tolerated"`
+	Rejected  int `json:"rejected"`
+}
+
+// mutationLog keeps the most recent mutations for the admin API.
+type mutationLog struct {
+	mu      sync.Mutex
+	records []*mutationRecord
+}
+
+const maxMutations = 1000
+
+func (l *mutationLog) add(rec *mutationRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) == maxMutations {
+		l.records = l.records[1:]
+	}
+	l.records = append(l.records, rec)
+}
+
+// mark records whether the client coped with the mutated response to a
+// request, false if no mutation was logged for it.
+func (l *mutationLog) mark(requestID string, tolerated bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rec := range l.records {
+		if rec.RequestID == requestID {
+			rec.Tolerated = &tolerated
+			return true
+		}
+	}
+	return false
+}
+
+type mutationsReport struct {
+	Mutations []mutationRecord           `json:"mutations"`
+	Summary   map[string]mutationSummary `json:"summary"`
+}
+
+func (l *mutationLog) report() mutationsReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	report := mutationsReport{Mutations: []mutationRecord{}, Summary: map[string]mutationSummary{}}
+	for _, rec := range l.records {
+		report.Mutations = append(report.Mutations, *rec)
+		sum := report.Summary[rec.Operator]
+		sum.Applied++
+		if rec.Tolerated != nil && *rec.Tolerated {
+			sum.Tolerated++
+		} else if rec.Tolerated != nil {
+			sum.Rejected++
+		}
+		report.Summary[rec.Operator] = sum
+	}
+	return report
+}
+
+func (l *mutationLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = nil
+}
+
+func serveMutationResult(w http.ResponseWriter, r *http.Request) {
+	var result struct {
+		Tolerated *bool `json:"tolerated"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil || result.Tolerated == nil {
+		http.Error(w, `expected {"tolerated": true|false}`, http.StatusBadRequest)
+		return
+	}
+	if !routesFor(r).mutations.mark(r.PathValue("requestId"), *result.Tolerated) {
+		http.Error(w, "no mutation for request "+r.PathValue("requestId"), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func withMutations(api ApiFormat, id string, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Mutate
+	if cfg.Rate == 0 {
+		cfg.Rate = 1
+	}
+	if len(cfg.Operators) == 0 {
+		for name := range mutationOperators {
+			cfg.Operators = append(cfg.Operators, name)
+		}
+		sort.Strings(cfg.Operators)
+	}
+	for _, name := range cfg.Operators {
+		if _, ok := mutationOperators[name]; !ok {
+			check(fmt.Errorf("unknown mutation operator %q for %s %s", name, api.Method, api.Url))
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if random.Float64() >= cfg.Rate {
+			next(w, r)
+			return
+		}
+		buf := getResponseBuffer()
+		defer buf.release()
+		next(buf, r)
+		var doc interface{}
+		if json.Unmarshal(buf.body.Bytes(), &doc) != nil {
+			buf.send(w, buf.body.Bytes())
+			return
+		}
+
+		rnd := rand.New(rand.NewPCG(random.Uint64(), random.Uint64()))
+		targets := collectTargets(doc, "", nil)
+		// map order varies, sorted so the choice only depends on rnd
+		sort.Slice(targets, func(i, j int) bool { return targets[i].path < targets[j].path })
+		mutation, operator := "", ""
+		for _, i := range rnd.Perm(len(cfg.Operators)) {
+			operator = cfg.Operators[i]
+			if mutation = mutationOperators[operator](doc, targets, rnd); mutation != "" {
+				break
+			}
+		}
+		if mutation == "" {
+			buf.send(w, buf.body.Bytes())
+			return
+		}
+		body, err := json.Marshal(doc)
+		if err != nil {
+			buf.send(w, buf.body.Bytes())
+			return
+		}
+		buf.header.Set(mutationHeader, mutation)
+		routesFor(r).mutations.add(&mutationRecord{
+			RequestID: r.Header.Get(requestIDHeader),
+			Time:      time.Now(),
+			Stub:      id,
+			Operator:  operator,
+			Mutation:  mutation,
+		})
+		slog.Debug("Response mutated", "method", api.Method, "url", api.Url, "mutation", mutation)
+		buf.send(w, append(body, '\n'))
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// errPatchTest reports a JSON Patch "test" operation that failed.
+var errPatchTest = errors.New("test failed")
+
+// patchOp is one operation of an RFC 6902 JSON Patch.
+type patchOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from"`
+	// Value stays nil when the operation has none, unlike a JSON null
+	Value json.RawMessage `json:"value"`
+}
+
+// applyStubPatch changes api by a patch: an RFC 6902 JSON Patch when it is
+// an array, an RFC 7396 merge patch when it is an object.
+func applyStubPatch(api ApiFormat, patch json.RawMessage) (ApiFormat, error) {
+	encoded, err := json.Marshal(api)
+	if err != nil {
+		return api, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return api, err
+	}
+	switch trimmed := bytes.TrimSpace(patch); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var ops []patchOp
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return api, fmt.Errorf("JSON Patch: %w", err)
+		}
+		for i, op := range ops {
+			if doc, err = op.apply(doc); err != nil {
+				return api, fmt.Errorf("JSON Patch operation %d (%s %s): %w", i+1, op.Op, op.Path, err)
+			}
+		}
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var merge interface{}
+		if err := json.Unmarshal(patch, &merge); err != nil {
+			return api, fmt.Errorf("merge patch: %w", err)
+		}
+		doc = mergePatch(doc, merge)
+	default:
+		return api, fmt.Errorf("expected a merge patch object or a JSON Patch array")
+	}
+	if encoded, err = json.Marshal(doc); err != nil {
+		return api, err
+	}
+	patched := ApiFormat{}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	// a misspelt field would otherwise be dropped without a word
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return api, err
+	}
+	if patched.Id != api.Id {
+		return api, fmt.Errorf("a patch can't change the stub id")
+	}
+	patched.source = api.source
+	return patched, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch: objects are merged, null
+// removes a member and anything else replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged := map[string]interface{}{}
+	if base, ok := target.(map[string]interface{}); ok {
+		for key, val := range base {
+			merged[key] = val
+		}
+	}
+	for key, val := range fields {
+		if val == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergePatch(merged[key], val)
+	}
+	return merged
+}
+
+// splitPointer parses an RFC 6901 JSON Pointer into its reference tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= length || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("no array element %q", token)
+	}
+	return i, nil
+}
+
+// pointerGet returns the value tokens point at in doc.
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			val, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			doc = val
+		case []interface{}:
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("%q is not inside an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate returns doc with the container holding the last token
+// replaced by what change makes of it.
+func pointerUpdate(doc interface{}, tokens []string, change func(container interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return change(doc, tokens[0])
+	}
+	child, err := pointerGet(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerUpdate(child, tokens[1:], change); err != nil {
+		return nil, err
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(tokens[0], len(container))
+		container[i] = child
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, tokens []string, val interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return val, nil
+	}
+	return pointerUpdate(doc, tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[key] = val
+			return c, nil
+		case []interface{}:
+			if key == "-" {
+				return append(c, val), nil
+			}
+			i, err := arrayIndex(key, len(c)+1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], append([]interface{}{val}, c[i:]...)...), nil
+		}
+		return nil, fmt.Errorf("%q is not inside an object or array", key)
+	})
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("can't remove the whole stub")
+	}
+	return pointerUpdate(doc, tokens, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[key]; !ok {
+				return nil, fmt.Errorf("no member %q", key)
+			}
+			delete(c, key)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(c))
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%q is not inside an object or array", key)
+	})
+}
+
+func (op patchOp) apply(doc interface{}) (interface{}, error) {
+	path, err := splitPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var val interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("missing value")
+		}
+		if err := json.Unmarshal(op.Value, &val); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := splitPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if val, err = pointerGet(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, fmt.Errorf("can't move a value into itself")
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			// the copy mustn't share maps with the original
+			encoded, _ := json.Marshal(val)
+			json.Unmarshal(encoded, &val)
+		}
+	}
+	switch op.Op {
+	case "add", "move", "copy":
+		return pointerAdd(doc, path, val)
+	case "remove":
+		return pointerRemove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return val, nil
+		}
+		if doc, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, val)
+	case "test":
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, val) {
+			return nil, errPatchTest
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// applyPatches applies the patches made through the admin API to the stubs
+// they name, with ids defaulted as the registry numbers them. Patches that
+// no longer apply, e.g. after a reload dropped their stub, are dropped.
+func (lr *liveRoutes) applyPatches(apis []ApiFormat) []ApiFormat {
+	if len(lr.patches) == 0 {
+		return apis
+	}
+	applied := make([]ApiFormat, len(apis))
+	pending := map[string]bool{}
+	for id := range lr.patches {
+		pending[id] = true
+	}
+	for i, api := range apis {
+		id := api.Id
+		if id == "" {
+			id = fmt.Sprintf("stub-%d", i+1)
+		}
+		applied[i] = api
+		for n, patch := range lr.patches[id] {
+			patched, err := applyStubPatch(applied[i], patch)
+			if err != nil {
+				slog.Warn("Dropping stub patches that no longer apply", "workspace", lr.name, "id", id, "patch", n+1, "error", err)
+				applied[i] = api
+				delete(lr.patches, id)
+				break
+			}
+			applied[i] = patched
+		}
+		delete(pending, id)
+	}
+	for id := range pending {
+		slog.Warn("Dropping patches of a stub that is gone", "workspace", lr.name, "id", id)
+		delete(lr.patches, id)
+	}
+	return applied
+}
+
+// patchStub applies a patch to a stub and reloads with it, keeping it
+// across reloads until reverted. It reports false when there is no stub
+// with the id; if the patched stub can't be loaded nothing changes.
+func (lr *liveRoutes) patchStub(id string, patch json.RawMessage) (reloadReport, bool, error) {
+	lr.mu.Lock()
+	s := lr.registry.get(id)
+	if s == nil {
+		lr.mu.Unlock()
+		return reloadReport{}, false, nil
+	}
+	if _, err := applyStubPatch(s.api, patch); err != nil {
+		lr.mu.Unlock()
+		return reloadReport{}, true, err
+	}
+	previous := lr.patches
+	patches := map[string][]json.RawMessage{}
+	for key, list := range previous {
+		patches[key] = list
+	}
+	patches[id] = append(append([]json.RawMessage{}, previous[id]...), patch)
+	lr.patches = patches
+	lr.mu.Unlock()
+	report, err := lr.load()
+	if err != nil {
+		lr.mu.Lock()
+		lr.patches = previous
+		lr.mu.Unlock()
+	}
+	return report, true, err
+}
+
+// revertStub drops the patches of a stub, back to its definition.
+func (lr *liveRoutes) revertStub(id string) (reloadReport, bool, error) {
+	lr.mu.Lock()
+	previous := lr.patches
+	if len(previous[id]) == 0 {
+		lr.mu.Unlock()
+		return reloadReport{}, false, nil
+	}
+	patches := map[string][]json.RawMessage{}
+	for key, list := range previous {
+		if key != id {
+			patches[key] = list
+		}
+	}
+	lr.patches = patches
+	lr.mu.Unlock()
+	report, err := lr.load()
+	if err != nil {
+		lr.mu.Lock()
+		lr.patches = previous
+		lr.mu.Unlock()
+	}
+	return report, true, err
+}
+
+// serveStub returns a stub's definition as served, patches applied, which
+// is what patch paths refer to.
+func serveStub(w http.ResponseWriter, r *http.Request) {
+	s := routesFor(r).registry.get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, "no stub with id "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.api)
+}
+
+func servePatchStub(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	if routes.current.Load() == nil {
+		http.Error(w, "patching stubs is not available", http.StatusNotImplemented)
+		return
+	}
+	id := r.PathValue("id")
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !json.Valid(patch) {
+		http.Error(w, "expected a merge patch object or a JSON Patch array", http.StatusBadRequest)
+		return
+	}
+	report, found, err := routes.patchStub(id, patch)
+	switch {
+	case !found:
+		http.Error(w, "no stub with id "+id, http.StatusNotFound)
+	case errors.Is(err, errPatchTest):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		slog.Error("Patching stub failed", "id", id, "error", err)
+		http.Error(w, "patching the stub failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+	default:
+		slog.Info("Stub patched", "id", id)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func serveRevertStub(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	id := r.PathValue("id")
+	report, found, err := routes.revertStub(id)
+	switch {
+	case !found:
+		http.Error(w, "no patches to stub "+id, http.StatusNotFound)
+	case err != nil:
+		slog.Error("Reverting stub failed", "id", id, "error", err)
+		http.Error(w, "reverting the stub failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+	default:
+		slog.Info("Stub patches reverted", "id", id)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return v
+}
+
+// applyJSONPatch applies the operations of patch to doc.
+func applyJSONPatch(doc interface{}, patch string) (interface{}, error) {
+	var ops []patchOp
+	if err := json.Unmarshal([]byte(patch), &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		// the examples of RFC 6902 appendix A
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		{`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		{`{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`},
+		{`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/": 9, "~1": 10}`},
+		{`{"foo": null}`, `[{"op": "test", "path": "/foo", "value": null}]`, `{"foo": null}`},
+		// copies don't share their values with the original
+		{`{"a": {"b": 1}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "replace", "path": "/c/b", "value": 2}]`, `{"a": {"b": 1}, "c": {"b": 2}}`},
+		{`{"a": 1}`, `[{"op": "replace", "path": "", "value": [1]}]`, `[1]`},
+	}
+	for _, tt := range tests {
+		got, err := applyJSONPatch(decodeJSON(t, tt.doc), tt.patch)
+		if err != nil {
+			t.Errorf("%s on %s: %v", tt.patch, tt.doc, err)
+			continue
+		}
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s on %s = %v, want %v", tt.patch, tt.doc, got, want)
+		}
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`},
+		{`{"foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`},
+		{`{"foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": 1}]`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/2", "value": 1}]`},
+		{`{"foo": ["bar"]}`, `[{"op": "remove", "path": "/foo/01"}]`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz"}]`},
+		{`{"foo": {"bar": 1}}`, `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "baz", "value": 1}]`},
+		{`{"foo": "bar"}`, `[{"op": "frobnicate", "path": "/foo"}]`},
+	}
+	for _, tt := range tests {
+		if got, err := applyJSONPatch(decodeJSON(t, tt.doc), tt.patch); err == nil {
+			t.Errorf("%s on %s = %v, want an error", tt.patch, tt.doc, got)
+		}
+	}
+	if _, err := applyJSONPatch(decodeJSON(t, `{"a": 1}`), `[{"op": "test", "path": "/a", "value": 2}]`); !errors.Is(err, errPatchTest) {
+		t.Errorf("failed test op returned %v", err)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// the examples of RFC 7396 appendix A
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+	for _, tt := range tests {
+		got := mergePatch(decodeJSON(t, tt.target), decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s on %s = %v, want %v", tt.patch, tt.target, got, want)
+		}
+	}
+}
+
+func TestApplyStubPatch(t *testing.T) {
+	api := ApiFormat{Id: "orders", Method: "GET", Url: "/orders", Delay: 100, Response: ResponseFormat{Status: 200}}
+	patched, err := applyStubPatch(api, json.RawMessage(`{"delay": null, "response": {"status": 503}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Delay != 0 || patched.Response.Status != 503 || patched.Url != "/orders" {
+		t.Errorf("merge patch gave %+v", patched)
+	}
+	patched, err = applyStubPatch(api, json.RawMessage(`[{"op": "replace", "path": "/method", "value": "POST"}]`))
+	if err != nil || patched.Method != "POST" {
+		t.Errorf("JSON Patch gave %+v, %v", patched, err)
+	}
+	for patch, want := range map[string]string{
+		`{"id": "other"}`: "can't change the stub id",
+		`{"respnse": {}}`: "unknown field",
+		`"delay"`:         "expected a merge patch",
+		`[{"op": "test", "path": "/url", "value": "/users"}]`: "test failed",
+	} {
+		if _, err := applyStubPatch(api, json.RawMessage(patch)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error with %q", patch, err, want)
+		}
+	}
+}
+
+func TestPatchStubKeptAcrossReloads(t *testing.T) {
+	lr, server := newTestRoutes(t, `[{"id": "orders", "url": "/orders", "method": "GET", "response": {"status": 200}},
+		{"url": "/users", "method": "GET", "response": {"status": 200}}]`)
+	if _, found, err := lr.patchStub("orders", json.RawMessage(`{"response": {"status": 202}}`)); !found || err != nil {
+		t.Fatalf("patching: found %v, %v", found, err)
+	}
+	// stubs without an id are patched by the id they get
+	if _, found, err := lr.patchStub("stub-2", json.RawMessage(`[{"op": "replace", "path": "/response/status", "value": 204}]`)); !found || err != nil {
+		t.Fatalf("patching: found %v, %v", found, err)
+	}
+	if _, found, _ := lr.patchStub("missing", json.RawMessage(`{}`)); found {
+		t.Error("patched a stub that doesn't exist")
+	}
+	if _, _, err := lr.patchStub("orders", json.RawMessage(`{"response": {"type": "bogus"}}`)); err == nil {
+		t.Error("a patch the stub can't be built with was accepted")
+	}
+	if _, err := lr.load(); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{"/orders": 202, "/users": 204} {
+		if got := getStatus(t, server.URL+path); got != want {
+			t.Errorf("%s answered %d after reload, want %d", path, got, want)
+		}
+	}
+	if _, found, err := lr.revertStub("orders"); !found || err != nil {
+		t.Fatalf("reverting: found %v, %v", found, err)
+	}
+	if got := getStatus(t, server.URL+"/orders"); got != 200 {
+		t.Errorf("/orders answered %d after revert, want 200", got)
+	}
+	if _, found, _ := lr.revertStub("orders"); found {
+		t.Error("reverted a stub without patches")
+	}
+}
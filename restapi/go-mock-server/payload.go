@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PayloadFormat configures a "payload" response streaming generated data
+// of a given size without any fixture on disk.
+type PayloadFormat struct {
+	// size of the body, Megabytes is added to Bytes
+	Bytes     int64   `json:"bytes"`
+	Megabytes float64 `json:"megabytes"`
+	// Mode is "random" for incompressible data or "pattern", the default,
+	// for a repeated Pattern which compresses well
+	Mode    string `json:"mode"`
+	Pattern string `json:"pattern"`
+	// Rate limits the stream to this many bytes per second, 0 is unlimited
+	Rate int64 `json:"rate"`
+	// ContentType of the body, default "application/octet-stream"
+	ContentType string `json:"contentType"`
+}
+
+const payloadChunk = 32 * 1024
+
+// payloadBuffers recycles the chunk buffers random payloads are drawn into.
+var payloadBuffers = sync.Pool{New: func() any { return new([payloadChunk]byte) }}
+
+func newPayloadHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Payload
+	headers := compileHeaders(api.Response.Headers)
+	if cfg == nil {
+		check(fmt.Errorf("payload response for %s %s has no payload block", api.Method, api.Url))
+	}
+	size := cfg.Bytes + int64(cfg.Megabytes*1024*1024)
+	if size < 0 {
+		check(fmt.Errorf("payload size for %s %s is negative", api.Method, api.Url))
+	}
+	if cfg.Pattern == "" {
+		cfg.Pattern = "0123456789abcdefghijklmnopqrstuvwxyz\n"
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/octet-stream"
+	}
+	status := api.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// pattern chunks are identical, so build one and reuse it for every write
+	var pattern []byte
+	switch cfg.Mode {
+	case "", "pattern":
+		pattern = make([]byte, 0, payloadChunk+2*len(cfg.Pattern))
+		for len(pattern) < payloadChunk+len(cfg.Pattern) {
+			pattern = append(pattern, cfg.Pattern...)
+		}
+	case "random":
+	default:
+		check(fmt.Errorf("unknown payload mode %q for %s %s", cfg.Mode, api.Method, api.Url))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", cfg.ContentType)
+		if !headers.apply(w, r, api) {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		buf := payloadBuffers.Get().(*[payloadChunk]byte)
+		defer payloadBuffers.Put(buf)
+		var rng *rand.Rand
+		if pattern == nil {
+			rng = rand.New(rand.NewSource(random.Int64()))
+		}
+		flusher, _ := w.(http.Flusher)
+		start := time.Now()
+		var sent int64
+		for sent < size {
+			n := min(int64(payloadChunk), size-sent)
+			// with a pattern, offset into the repeated data so the stream
+			// stays continuous across chunk boundaries
+			chunk := buf[:n]
+			if rng != nil {
+				rng.Read(chunk)
+			} else {
+				offset := int(sent % int64(len(cfg.Pattern)))
+				chunk = pattern[offset : offset+int(n)]
+			}
+			if _, err := w.Write(chunk); err != nil {
+				slog.Debug("Payload stream aborted", "url", api.Url, "sent", sent, "error", err)
+				return
+			}
+			sent += n
+			if cfg.Rate > 0 {
+				if flusher != nil {
+					flusher.Flush()
+				}
+				due := start.Add(time.Duration(float64(sent) / float64(cfg.Rate) * float64(time.Second)))
+				sleepFor(r, time.Until(due))
+			}
+		}
+		slog.Debug("Payload sent", "method", api.Method, "url", api.Url, "bytes", sent)
+	}
+}
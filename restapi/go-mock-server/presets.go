@@ -0,0 +1,75 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presetFiles are bundled stub sets imitating popular APIs, loaded with
+// --preset.
+//
+//go:embed presets/*.json
+var presetFiles embed.FS
+
+// presetPrefixes mount presets whose urls would shadow other stubs at the
+// root under their own prefix by default.
+var presetPrefixes = map[string]string{"s3": "/s3"}
+
+// presetFlag collects repeated "name" or "name=/prefix" --preset flags.
+type presetFlag map[string]string
+
+func (f presetFlag) String() string {
+	pairs := []string{}
+	for name, prefix := range f {
+		pairs = append(pairs, name+"="+prefix)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f presetFlag) Set(value string) error {
+	name, prefix, ok := strings.Cut(value, "=")
+	if !ok {
+		prefix = presetPrefixes[name]
+	}
+	if _, err := presetFiles.Open("presets/" + name + ".json"); err != nil {
+		return fmt.Errorf("unknown preset %q, available: %s", name, strings.Join(presetNames(), ", "))
+	}
+	f[name] = prefix
+	return nil
+}
+
+func presetNames() []string {
+	entries, _ := presetFiles.ReadDir("presets")
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return names
+}
+
+// loadPresets returns the stubs of the selected presets, each as a group
+// under its prefix, in name order.
+func loadPresets(presets map[string]string) ([]ApiFormat, error) {
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	apis := []ApiFormat{}
+	for _, name := range names {
+		file, err := presetFiles.ReadFile("presets/" + name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		stubs := []ApiFormat{}
+		if err := json.Unmarshal(file, &stubs); err != nil {
+			return nil, fmt.Errorf("preset %s%s: %w", name, jsonErrorPosition(file, err), err)
+		}
+		locateStubs(stubs, file, 0, stubSource{Origin: "preset", File: "presets/" + name + ".json"}, file)
+		apis = append(apis, ApiFormat{Prefix: presets[name], Stubs: stubs})
+	}
+	return apis, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newPresetServer(t *testing.T, presets map[string]string) *httptest.Server {
+	t.Helper()
+	lr := &liveRoutes{registry: newStubRegistry(), mockData: writeConfig(t, `[]`), presets: presets, workspaceStores: newWorkspaceStores(1000, "mock_session")}
+	if _, err := lr.load(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(lr)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestS3PresetObjects(t *testing.T) {
+	server := newPresetServer(t, map[string]string{"s3": "/s3"})
+	do := func(method, path, body string) (*http.Response, string) {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := do(http.MethodPut, "/s3/photos/2024/cat.txt", "meow")
+	if resp.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("PUT answered %d %q, want 200 and no body", resp.StatusCode, body)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"4a4be40c96ac6314e91d93f38043a634"` {
+		t.Errorf("PUT ETag %s, want the quoted md5", etag)
+	}
+	if _, body := do(http.MethodGet, "/s3/photos/2024/cat.txt", ""); body != "meow" {
+		t.Errorf("GET answered %q, want the stored object", body)
+	}
+
+	resp, body = do(http.MethodGet, "/s3/photos", "")
+	var listing struct {
+		KeyCount int
+		Contents []struct{ Key, ETag string }
+	}
+	if err := xml.Unmarshal([]byte(body), &listing); err != nil {
+		t.Fatalf("listing %q: %v", body, err)
+	}
+	if resp.Header.Get("Content-Type") != "application/xml" || listing.KeyCount != 1 || listing.Contents[0].Key != "2024/cat.txt" {
+		t.Errorf("listing answered %s %+v", resp.Header.Get("Content-Type"), listing)
+	}
+
+	if resp, _ := do(http.MethodDelete, "/s3/photos/2024/cat.txt", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE answered %d, want 204", resp.StatusCode)
+	}
+	resp, body = do(http.MethodGet, "/s3/photos/2024/cat.txt", "")
+	var s3err struct{ Code, Key string }
+	xml.Unmarshal([]byte(body), &s3err)
+	if resp.StatusCode != http.StatusNotFound || s3err.Code != "NoSuchKey" || s3err.Key != "2024/cat.txt" {
+		t.Errorf("GET after DELETE answered %d %q, want a NoSuchKey error", resp.StatusCode, body)
+	}
+}
+
+func TestStripePresetEchoesForm(t *testing.T) {
+	server := newPresetServer(t, map[string]string{"stripe": ""})
+	post := func(form url.Values) (int, map[string]interface{}) {
+		resp, err := http.PostForm(server.URL+"/v1/charges", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var doc map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&doc)
+		return resp.StatusCode, doc
+	}
+
+	status, charge := post(url.Values{"amount": {"2000"}, "currency": {"eur"}})
+	if status != http.StatusOK {
+		t.Fatalf("charge answered %d", status)
+	}
+	if charge["amount"] != 2000.0 || charge["currency"] != "eur" {
+		t.Errorf("charge has amount %#v and currency %#v, want the posted 2000 and eur", charge["amount"], charge["currency"])
+	}
+	if _, ok := charge["created"].(float64); !ok {
+		t.Errorf("created is %#v, want a number", charge["created"])
+	}
+	for _, form := range []url.Values{{"amount": {"20.5"}, "currency": {"eur"}}, {"currency": {"eur"}}, {"amount": {"2000"}, "currency": {"EUR"}}} {
+		if status, _ := post(form); status != http.StatusBadRequest {
+			t.Errorf("charge with %v answered %d, want 400", form, status)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ProblemFormat configures a "problem" response, an RFC 7807 Problem
+// Details error.
+type ProblemFormat struct {
+	// Type is a URI identifying the problem, default "about:blank"
+	Type string `json:"type"`
+	// Title defaults to the status text when Type is "about:blank"
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	// Instance identifies this occurrence, by default the request path
+	Instance string `json:"instance"`
+}
+
+// problemMembers are the members the server fills in; a body may not
+// replace them.
+var problemMembers = []string{"type", "title", "status", "detail", "instance"}
+
+// newProblemHandler builds a "problem" response: the members of the problem
+// block, which may be templates, and the response status, default 500, as
+// an application/problem+json body. Fields of the response body are added
+// as extension members.
+func newProblemHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Problem
+	if cfg == nil {
+		check(fmt.Errorf("problem response for %s %s has no problem block", api.Method, api.Url))
+	}
+	if api.Response.Status == 0 {
+		api.Response.Status = http.StatusInternalServerError
+	}
+	if api.Response.Status < 400 {
+		check(fmt.Errorf("problem response for %s %s has status %d, not an error", api.Method, api.Url, api.Response.Status))
+	}
+	body := map[string]interface{}{}
+	for key, val := range api.Response.Body {
+		body[key] = val
+	}
+	for _, key := range problemMembers {
+		if _, ok := body[key]; ok {
+			check(fmt.Errorf("problem response for %s %s sets %q in its body, use the problem block", api.Method, api.Url, key))
+		}
+	}
+	body["type"] = cfg.Type
+	if cfg.Type == "" {
+		body["type"] = "about:blank"
+	}
+	body["title"] = cfg.Title
+	if cfg.Title == "" && body["type"] == "about:blank" {
+		body["title"] = http.StatusText(api.Response.Status)
+	}
+	if body["title"] == "" {
+		delete(body, "title")
+	}
+	body["status"] = api.Response.Status
+	if cfg.Detail != "" {
+		body["detail"] = cfg.Detail
+	}
+	body["instance"] = cfg.Instance
+	if cfg.Instance == "" {
+		body["instance"] = "{{.Path}}"
+	}
+	api.Response.Body = body
+
+	headers := map[string]interface{}{}
+	for key, val := range api.Response.Headers {
+		if http.CanonicalHeaderKey(key) != "Content-Type" {
+			headers[key] = val
+		}
+	}
+	headers["Content-Type"] = "application/problem+json"
+	api.Response.Headers = headers
+	return newStaticHandler(api)
+}
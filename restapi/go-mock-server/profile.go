@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// profileSet holds the named profiles of a config. Each is a list of
+// overrides: partial stubs merged into the stubs they select, by "id", or
+// by "url" and optionally "method", or into every stub when they name
+// neither.
+type profileSet map[string]profileDef
+
+type profileDef struct {
+	overrides []json.RawMessage
+	// schedule activates the profile during its windows, see followSchedule
+	schedule []cronExpr
+}
+
+func (ps profileSet) names() []string {
+	names := []string{}
+	for name := range ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectProfiles moves profile entries, from any group, out of apis into
+// profiles.
+func collectProfiles(apis []ApiFormat, profiles profileSet) ([]ApiFormat, error) {
+	stubs := make([]ApiFormat, 0, len(apis))
+	for _, api := range apis {
+		if api.Profile != "" {
+			if _, dup := profiles[api.Profile]; dup {
+				return nil, fmt.Errorf("profile %q is defined twice", api.Profile)
+			}
+			for i, rule := range api.Schedule {
+				if rule.Response != nil {
+					return nil, fmt.Errorf("profile %s schedule rule %d: a profile's schedule takes no response", api.Profile, i+1)
+				}
+			}
+			schedule, err := compileSchedule(api.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", api.Profile, err)
+			}
+			profiles[api.Profile] = profileDef{overrides: api.Overrides, schedule: schedule}
+			continue
+		}
+		if api.Stubs != nil {
+			var err error
+			if api.Stubs, err = collectProfiles(api.Stubs, profiles); err != nil {
+				return nil, err
+			}
+		}
+		stubs = append(stubs, api)
+	}
+	return stubs, nil
+}
+
+type profileSelector struct {
+	Id     string `json:"id"`
+	Url    string `json:"url"`
+	Method string `json:"method"`
+}
+
+func (sel profileSelector) selects(api ApiFormat, id string) bool {
+	switch {
+	case sel.Id != "":
+		return sel.Id == id
+	case sel.Url != "":
+		return sel.Url == api.Url && (sel.Method == "" || sel.Method == api.Method)
+	}
+	return true
+}
+
+// overrideStub merges an override into a stub the way extends merges
+// responses: unset fields are kept and objects are merged deeply.
+func overrideStub(api ApiFormat, override map[string]interface{}) (ApiFormat, error) {
+	encoded, err := json.Marshal(api)
+	if err != nil {
+		return api, err
+	}
+	base := map[string]interface{}{}
+	if err := json.Unmarshal(encoded, &base); err != nil {
+		return api, err
+	}
+	if encoded, err = json.Marshal(mergeBodies(base, override)); err != nil {
+		return api, err
+	}
+	merged := ApiFormat{}
+	err = json.Unmarshal(encoded, &merged)
+	return merged, err
+}
+
+// apply returns apis with the overrides of the named profile merged in;
+// "" applies none.
+func (ps profileSet) apply(apis []ApiFormat, name string) ([]ApiFormat, error) {
+	if name == "" {
+		return apis, nil
+	}
+	profile, ok := ps[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, the config has %v", name, ps.names())
+	}
+	applied := make([]ApiFormat, len(apis))
+	copy(applied, apis)
+	for i, raw := range profile.overrides {
+		var sel profileSelector
+		override := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &sel); err != nil {
+			return nil, fmt.Errorf("profile %s override %d: %w", name, i+1, err)
+		}
+		if err := json.Unmarshal(raw, &override); err != nil {
+			return nil, fmt.Errorf("profile %s override %d: %w", name, i+1, err)
+		}
+		// the selector picks stubs, it doesn't change them
+		delete(override, "id")
+		delete(override, "url")
+		delete(override, "method")
+		matched := false
+		for j, api := range applied {
+			// default ids as the registry will number the stubs
+			id := api.Id
+			if id == "" {
+				id = fmt.Sprintf("stub-%d", j+1)
+			}
+			if !sel.selects(api, id) {
+				continue
+			}
+			merged, err := overrideStub(api, override)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s override %d: %w", name, i+1, err)
+			}
+			merged.Id, merged.source = api.Id, api.source
+			applied[j], matched = merged, true
+		}
+		if !matched {
+			return nil, fmt.Errorf("profile %s override %d selects no stub", name, i+1)
+		}
+	}
+	return applied, nil
+}
+
+type profileReport struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, routesFor(r).profileReport())
+}
+
+// serveSwitchProfile reloads the config with the profile named in the
+// body, "" for none, keeping the current one if that fails.
+func serveSwitchProfile(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	if routes.current.Load() == nil {
+		http.Error(w, "profiles are not available", http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Name *string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+		http.Error(w, `expected {"name": "profile"}`, http.StatusBadRequest)
+		return
+	}
+	report, err := routes.switchProfile(*req.Name)
+	if err != nil {
+		slog.Error("Profile switch failed", "profile", *req.Name, "error", err)
+		http.Error(w, "profile switch failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("Profile switched", "profile", *req.Name, "changed", len(report.Changed))
+	writeJSON(w, http.StatusOK, report)
+}
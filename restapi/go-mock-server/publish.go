@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PublishFormat sends a message to a broker each time the stub answers, for
+// services that emit events as a side effect of HTTP calls.
+type PublishFormat struct {
+	// Broker is mqtt://[user:pass@]host[:1883], amqp://[user:pass@]host
+	// [:5672][/vhost], mqtts:// and amqps:// for TLS, or
+	// kafka://host[:9092][,host...] listing bootstrap brokers
+	Broker string `json:"broker"`
+	// Topic is the MQTT or Kafka topic, a template
+	Topic string `json:"topic"`
+	// Qos is the MQTT quality of service, 0 (default) or 1
+	Qos    int  `json:"qos"`
+	Retain bool `json:"retain"`
+	// Exchange and RoutingKey address AMQP messages, templates; the empty
+	// default exchange routes by queue name
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routingKey"`
+	// Key is the Kafka record key, a template; keyed records go to the
+	// partition the Java client would pick, the others to a random one
+	Key string `json:"key"`
+	// Partition pins Kafka records to a partition
+	Partition *int `json:"partition"`
+	// Headers are Kafka record or AMQP message headers, templates
+	Headers map[string]string `json:"headers"`
+	// Payload is a string template sent as is, or JSON with templates in
+	// its strings
+	Payload interface{} `json:"payload"`
+	// ContentType of AMQP messages, default application/json for JSON
+	// payloads and text/plain for strings
+	ContentType string `json:"contentType"`
+	// Delay in milliseconds between the response and the message
+	Delay int `json:"delay"`
+}
+
+// brokerMessage is a rendered publication.
+type brokerMessage struct {
+	topic, exchange, routingKey string
+	key                         string
+	headers                     map[string]string
+	contentType                 string
+	payload                     []byte
+}
+
+// brokerClients publish a message over fresh connections, by URL scheme.
+var brokerClients = map[string]func(*compiledPublish, *brokerMessage) error{
+	"mqtt":  publishMQTT,
+	"mqtts": publishMQTT,
+	"amqp":  publishAMQP,
+	"amqps": publishAMQP,
+	"kafka": publishKafka,
+}
+
+var brokerPorts = map[string]string{"mqtt": "1883", "mqtts": "8883", "amqp": "5672", "amqps": "5671", "kafka": "9092"}
+
+type compiledPublish struct {
+	cfg    *PublishFormat
+	broker *url.URL
+	// hosts are the broker addresses with ports, several for kafka
+	hosts                            []string
+	topic, exchange, routingKey, key *textTemplate
+	headers                          map[string]*textTemplate
+	payload                          bodyTemplate
+}
+
+func compilePublish(api ApiFormat) ([]compiledPublish, error) {
+	compiled := make([]compiledPublish, len(api.Publish))
+	for i := range api.Publish {
+		cfg := &api.Publish[i]
+		broker, err := url.Parse(cfg.Broker)
+		if err != nil {
+			return nil, fmt.Errorf("publish %d: %w", i, err)
+		}
+		if brokerClients[broker.Scheme] == nil {
+			return nil, fmt.Errorf("publish %d: unsupported broker %q", i, cfg.Broker)
+		}
+		c := compiledPublish{cfg: cfg, broker: broker}
+		for _, host := range strings.Split(broker.Host, ",") {
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(strings.Trim(host, "[]"), brokerPorts[broker.Scheme])
+			}
+			c.hosts = append(c.hosts, host)
+		}
+		if len(c.hosts) > 1 && broker.Scheme != "kafka" {
+			return nil, fmt.Errorf("publish %d: only kafka takes several brokers", i)
+		}
+		if broker.Scheme != "amqp" && broker.Scheme != "amqps" && cfg.Topic == "" {
+			return nil, fmt.Errorf("publish %d: %s needs a topic", i, broker.Scheme)
+		}
+		if cfg.Qos != 0 && cfg.Qos != 1 {
+			return nil, fmt.Errorf("publish %d: qos %d, only 0 and 1 are supported", i, cfg.Qos)
+		}
+		for _, field := range []struct {
+			dst **textTemplate
+			src string
+		}{{&c.topic, cfg.Topic}, {&c.exchange, cfg.Exchange}, {&c.routingKey, cfg.RoutingKey}, {&c.key, cfg.Key}} {
+			if *field.dst, err = compileTemplate(api.Url, field.src); err != nil {
+				return nil, fmt.Errorf("publish %d: %w", i, err)
+			}
+		}
+		if c.headers, err = compileTemplates(api.Url, cfg.Headers); err != nil {
+			return nil, fmt.Errorf("publish %d headers: %w", i, err)
+		}
+		if c.payload, err = compileBody(api.Url, cfg.Payload); err != nil {
+			return nil, fmt.Errorf("publish %d payload: %w", i, err)
+		}
+		compiled[i] = c
+	}
+	return compiled, nil
+}
+
+func (c *compiledPublish) render(data templateData) (*brokerMessage, error) {
+	msg := &brokerMessage{}
+	var err error
+	for _, field := range []struct {
+		dst *string
+		src *textTemplate
+	}{{&msg.topic, c.topic}, {&msg.exchange, c.exchange}, {&msg.routingKey, c.routingKey}, {&msg.key, c.key}} {
+		if *field.dst, err = field.src.render(data); err != nil {
+			return nil, err
+		}
+	}
+	if msg.headers, err = renderTemplates(c.headers, data); err != nil {
+		return nil, err
+	}
+	if msg.payload, msg.contentType, err = c.payload.render(data); err != nil {
+		return nil, err
+	}
+	if c.cfg.ContentType != "" {
+		msg.contentType = c.cfg.ContentType
+	}
+	return msg, nil
+}
+
+// dial connects to a broker, over TLS for the mqtts and amqps schemes,
+// with a deadline for the whole exchange.
+func (c *compiledPublish) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.broker.Scheme == "mqtts" || c.broker.Scheme == "amqps" {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn, nil
+}
+
+func (c *compiledPublish) send(msg *brokerMessage) error {
+	return brokerClients[c.broker.Scheme](c, msg)
+}
+
+// withPublish renders the stub's messages once its response is written and
+// sends them in the background, so a broker that is down or slow never
+// holds up the response. Templates see the response status as .Vars.status
+// and the request body as .Vars.body.
+func withPublish(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	publications, err := compilePublish(api)
+	check(err)
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(r)
+		r = shareUUID(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		data := newTemplateData(r, api)
+		data.Vars["status"] = rec.status
+		data.Vars["body"] = string(body)
+		for i := range publications {
+			p := &publications[i]
+			msg, err := p.render(data)
+			if err != nil {
+				slog.Error("Failed to render published message", "url", api.Url, "broker", p.broker.Redacted(), "error", err)
+				continue
+			}
+			time.AfterFunc(time.Duration(p.cfg.Delay)*time.Millisecond, func() {
+				if err := p.send(msg); err != nil {
+					slog.Error("Failed to publish message", "url", api.Url, "broker", p.broker.Redacted(), "error", err)
+					return
+				}
+				slog.Info("Message published", "url", api.Url, "broker", p.broker.Redacted(), "topic", msg.topic, "exchange", msg.exchange, "routing_key", msg.routingKey)
+			})
+		}
+	}
+}
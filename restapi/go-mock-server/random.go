@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// lockedSource makes a rand.Source safe for concurrent handlers.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) seed(seed uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src = rand.NewPCG(seed, seed)
+}
+
+var randomSource = &lockedSource{src: rand.NewPCG(rand.Uint64(), rand.Uint64())}
+
+// random drives every random choice in responses: fake data, weighted
+// variants, mutations, random payloads and upload ids. Seeded with -seed,
+// a run replays the same choices for the same sequence of requests.
+// Session tokens and request ids stay truly random.
+var random = rand.New(randomSource)
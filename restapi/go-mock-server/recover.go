@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+type panicReport struct {
+	Error     string `json:"error"`
+	Stub      string `json:"stub,omitempty"`
+	Panic     string `json:"panic"`
+	RequestID string `json:"requestId"`
+}
+
+// servePanic answers a request whose handler panicked with a 500 saying
+// what went wrong. A response the handler already started is cut short by
+// panicking with http.ErrAbortHandler, so the client sees the connection
+// reset instead of a truncated body passing for a whole one. Aborted
+// handlers keep their net/http meaning.
+func servePanic(w *statusRecorder, r *http.Request, stub string, p interface{}) {
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	slog.Error("Handler panicked", "stub", stub, "method", r.Method, "path", r.URL.Path, "panic", p, "stack", string(debug.Stack()))
+	if w.status != 0 {
+		panic(http.ErrAbortHandler)
+	}
+	writeJSON(w, http.StatusInternalServerError, panicReport{
+		Error:     "handler panicked",
+		Stub:      stub,
+		Panic:     fmt.Sprint(p),
+		RequestID: r.Header.Get(requestIDHeader),
+	})
+}
+
+// withRecovery keeps a panicking handler from taking down the connection;
+// stub handlers recover by themselves so their stats count the failure.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				servePanic(rec, r, "", p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
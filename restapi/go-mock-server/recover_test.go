@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPanicAfterResponseStartedResetsConnection(t *testing.T) {
+	server := httptest.NewServer(withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// chunked, so a clean end would pass for the whole body
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic("handler failed")
+	})))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("read the partial body without an error, want the connection cut")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RedirectFormat configures a "redirect" response. A single redirect is sent
+// to Location unless Hops is greater than one, in which case the endpoint
+// first redirects to itself with an increasing hop query parameter.
+type RedirectFormat struct {
+	// Location is the final target and may be a template
+	Location string `json:"location"`
+	// Status is used for every hop unless Statuses is set, default 302
+	Status int `json:"status"`
+	// Statuses gives the code per hop, repeating the last one if short
+	Statuses []int `json:"statuses"`
+	// Hops is the number of redirects before reaching Location, default 1
+	Hops int `json:"hops"`
+	// Loop sends the last hop back to the first instead of to Location
+	Loop bool `json:"loop"`
+	// HopParam names the query parameter tracking the hop, default "hop"
+	HopParam string `json:"hopParam"`
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func newRedirectHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Redirect
+	headers := compileHeaders(api.Response.Headers)
+	if cfg == nil {
+		check(fmt.Errorf("redirect response for %s %s has no redirect block", api.Method, api.Url))
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusFound
+	}
+	if cfg.Hops < 1 {
+		cfg.Hops = 1
+	}
+	if cfg.HopParam == "" {
+		cfg.HopParam = "hop"
+	}
+	for _, status := range append([]int{cfg.Status}, cfg.Statuses...) {
+		if !isRedirectStatus(status) {
+			check(fmt.Errorf("invalid redirect status %d for %s %s", status, api.Method, api.Url))
+		}
+	}
+	if cfg.Location == "" && !cfg.Loop {
+		check(fmt.Errorf("redirect response for %s %s has no location", api.Method, api.Url))
+	}
+	location, err := compileTemplate(api.Url, cfg.Location)
+	check(err)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		hop, _ := strconv.Atoi(query.Get(cfg.HopParam))
+		if hop < 0 || hop >= cfg.Hops {
+			hop = 0
+		}
+		status := cfg.Status
+		if len(cfg.Statuses) > 0 {
+			status = cfg.Statuses[min(hop, len(cfg.Statuses)-1)]
+		}
+
+		var target string
+		switch {
+		case hop < cfg.Hops-1:
+			query.Set(cfg.HopParam, strconv.Itoa(hop+1))
+			target = (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String()
+		case cfg.Loop:
+			query.Del(cfg.HopParam)
+			target = (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String()
+		default:
+			data := newTemplateData(r, api)
+			data.Vars["hop"] = hop
+			rendered, err := location.render(data)
+			if err != nil {
+				slog.Error("Failed to render redirect location", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			target = rendered
+		}
+
+		if !headers.apply(w, r, api) {
+			return
+		}
+		w.Header().Set("Location", target)
+		w.WriteHeader(status)
+		slog.Debug("API request redirected", "method", api.Method, "url", api.Url, "status", status, "hop", hop, "location", target)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// liveRoutes serves requests through the current routing table, which a
+// reload rebuilds from the mock data file and swaps in atomically.
+type liveRoutes struct {
+	current atomic.Pointer[router]
+	// mu serializes reloads
+	mu sync.Mutex
+	// name is the workspace the routes belong to, "" for the default
+	name     string
+	registry *stubRegistry
+	mockData string
+	basePath string
+	presets  map[string]string
+	// profile names the active profile of the config, "" for none
+	profile  string
+	profiles profileSet
+	// scenarios are the config's client scenarios, see runScenarios
+	scenarios scenarioSet
+	// added are the stubs added through the admin API, kept across reloads
+	added    []ApiFormat
+	addedSeq int
+	// patches are the changes made to stubs through the admin API, by
+	// stub id, kept across reloads
+	patches map[string][]json.RawMessage
+	// setup adds what every routing table needs besides the stubs
+	setup func(*router)
+	workspaceStores
+}
+
+var routes = &liveRoutes{registry: registry, workspaceStores: newWorkspaceStores(1000, "mock_session")}
+
+func (lr *liveRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lr.current.Load().ServeHTTP(w, r)
+}
+
+type reloadReport struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// load reads the mock data file and swaps in a routing table built from
+// it. Stubs whose config didn't change are kept with their state and stats.
+// On error the current routes stay in place.
+func (lr *liveRoutes) load() (report reloadReport, err error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	// handler constructors reject bad config by panicking through check
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	apis, profiles, scenarios, err := loadConfig(lr.mockData, lr.basePath)
+	if err != nil {
+		return report, err
+	}
+	if apis, err = profiles.apply(apis, lr.profile); err != nil {
+		return report, err
+	}
+	lr.profiles = profiles
+	presets, err := loadPresets(lr.presets)
+	if err != nil {
+		return report, err
+	}
+	apis = append(apis, expandGroups(presets, lr.basePath)...)
+	added := expandGroups(lr.added, lr.basePath)
+	setOrigin(added, "admin")
+	apis = append(apis, added...)
+	apis = lr.applyPatches(apis)
+
+	report = reloadReport{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	next := newStubRegistry()
+	rt := newRouter()
+	for _, api := range apis {
+		s, err := next.addFrom(api, lr.registry)
+		if err != nil {
+			return report, err
+		}
+		// an empty method registers the url for every method
+		if err := rt.handle(strings.TrimSpace(api.Method+" "+api.Url), s); err != nil {
+			return report, fmt.Errorf("stub %s: %w", s.id, err)
+		}
+		switch old := lr.registry.get(s.id); {
+		case old == s:
+			report.Unchanged++
+			continue
+		case old == nil:
+			report.Added = append(report.Added, s.id)
+		default:
+			report.Changed = append(report.Changed, s.id)
+		}
+		slog.Info("Registered endpoint", "workspace", lr.name, "id", s.id, "method", api.Method, "url", api.Url)
+	}
+	for _, s := range next.list() {
+		if err := s.api.Links.validate(next); err != nil {
+			return report, fmt.Errorf("stub %s: %w", s.id, err)
+		}
+	}
+	if err := checkContinue(next.list()); err != nil {
+		return report, err
+	}
+	for _, old := range lr.registry.list() {
+		if next.get(old.id) == nil {
+			report.Removed = append(report.Removed, old.id)
+		}
+	}
+	if lr.setup != nil {
+		lr.setup(rt)
+	}
+	lr.current.Store(rt)
+	lr.registry.replace(next)
+	lr.scenarios = scenarios
+	return report, nil
+}
+
+// switchProfile reloads with another profile, staying on the current one
+// if the config can't be loaded with it.
+func (lr *liveRoutes) switchProfile(name string) (reloadReport, error) {
+	lr.mu.Lock()
+	previous := lr.profile
+	lr.profile = name
+	lr.mu.Unlock()
+	report, err := lr.load()
+	if err != nil {
+		lr.mu.Lock()
+		lr.profile = previous
+		lr.mu.Unlock()
+	}
+	return report, err
+}
+
+func (lr *liveRoutes) profileReport() profileReport {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return profileReport{Active: lr.profile, Profiles: lr.profiles.names()}
+}
+
+func serveReload(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	if routes.current.Load() == nil {
+		http.Error(w, "reload is not available", http.StatusNotImplemented)
+		return
+	}
+	report, err := routes.load()
+	if err != nil {
+		slog.Error("Reload failed", "file", routes.mockData, "error", err)
+		http.Error(w, "reload failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("Config reloaded", "added", len(report.Added), "removed", len(report.Removed), "changed", len(report.Changed))
+	writeJSON(w, http.StatusOK, report)
+}
+
+// addStubs registers stubs next to those of the config, naming those
+// without an id "added-N". If they can't be loaded nothing is added.
+func (lr *liveRoutes) addStubs(stubs []ApiFormat) (reloadReport, error) {
+	lr.mu.Lock()
+	previous := lr.added
+	added := append([]ApiFormat{}, previous...)
+	for _, api := range stubs {
+		if api.Id == "" {
+			lr.addedSeq++
+			api.Id = fmt.Sprintf("added-%d", lr.addedSeq)
+		}
+		added = append(added, api)
+	}
+	lr.added = added
+	lr.mu.Unlock()
+	report, err := lr.load()
+	if err != nil {
+		lr.mu.Lock()
+		lr.added = previous
+		lr.mu.Unlock()
+	}
+	return report, err
+}
+
+// removeStub drops a stub added through the admin API, reporting false
+// when there is none with the id.
+func (lr *liveRoutes) removeStub(id string) (reloadReport, bool, error) {
+	lr.mu.Lock()
+	previous := lr.added
+	added := []ApiFormat{}
+	for _, api := range previous {
+		if api.Id != id {
+			added = append(added, api)
+		}
+	}
+	if len(added) == len(previous) {
+		lr.mu.Unlock()
+		return reloadReport{}, false, nil
+	}
+	lr.added = added
+	lr.mu.Unlock()
+	report, err := lr.load()
+	if err != nil {
+		lr.mu.Lock()
+		lr.added = previous
+		lr.mu.Unlock()
+	}
+	return report, true, err
+}
+
+// serveAddStubs adds the stub, or array of stubs, in the request body.
+// They live until removed or the server stops, across reloads.
+func serveAddStubs(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	if routes.current.Load() == nil {
+		http.Error(w, "adding stubs is not available", http.StatusNotImplemented)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var stubs []ApiFormat
+	if json.Unmarshal(body, &stubs) != nil {
+		var api ApiFormat
+		if err := json.Unmarshal(body, &api); err != nil {
+			http.Error(w, "expected a stub or an array of stubs: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		stubs = []ApiFormat{api}
+	}
+	report, err := routes.addStubs(stubs)
+	if err != nil {
+		slog.Error("Adding stubs failed", "error", err)
+		http.Error(w, "adding stubs failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	slog.Info("Stubs added", "added", report.Added, "changed", report.Changed)
+	writeJSON(w, http.StatusCreated, report)
+}
+
+func serveRemoveStub(w http.ResponseWriter, r *http.Request) {
+	routes := routesFor(r)
+	id := r.PathValue("id")
+	report, found, err := routes.removeStub(id)
+	switch {
+	case !found:
+		http.Error(w, "no stub added through the admin API with id "+id, http.StatusNotFound)
+	case err != nil:
+		slog.Error("Removing stub failed", "id", id, "error", err)
+		http.Error(w, "removing the stub failed, keeping the current stubs: "+err.Error(), http.StatusUnprocessableEntity)
+	default:
+		slog.Info("Stub removed", "id", id)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
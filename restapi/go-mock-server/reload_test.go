@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes a mock data file for the test, returning its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "mock.json")
+	if err := os.WriteFile(file, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newTestRoutes loads config into a fresh workspace, served by the
+// returned server.
+func newTestRoutes(t *testing.T, config string) (*liveRoutes, *httptest.Server) {
+	t.Helper()
+	lr := &liveRoutes{registry: newStubRegistry(), mockData: writeConfig(t, config), workspaceStores: newWorkspaceStores(1000, "mock_session")}
+	if _, err := lr.load(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(lr)
+	t.Cleanup(server.Close)
+	return lr, server
+}
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReloadKeepsAddedStubState(t *testing.T) {
+	lr, server := newTestRoutes(t, `[]`)
+	stubs := []ApiFormat{{
+		Id: "flaky", Method: "GET", Url: "/flaky",
+		Retry:    &RetryFormat{Failures: 1},
+		Response: ResponseFormat{Status: 200},
+	}}
+	if _, err := lr.addStubs(stubs); err != nil {
+		t.Fatal(err)
+	}
+	if status := getStatus(t, server.URL+"/flaky"); status != http.StatusServiceUnavailable {
+		t.Fatalf("first call answered %d, want 503", status)
+	}
+	if status := getStatus(t, server.URL+"/flaky"); status != http.StatusOK {
+		t.Fatalf("retried call answered %d, want 200", status)
+	}
+
+	report, err := lr.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 0 || report.Unchanged != 1 {
+		t.Fatalf("reload reported %+v, want the added stub unchanged", report)
+	}
+	if status := getStatus(t, server.URL+"/flaky"); status != http.StatusOK {
+		t.Fatalf("call after reload answered %d, want 200 as the retry state is kept", status)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RenderCacheFormat keeps a stub's rendered responses for reuse, for
+// dynamic bodies too expensive to build on every request under load.
+type RenderCacheFormat struct {
+	// Ttl in milliseconds a response is reused for
+	Ttl int `json:"ttl"`
+	// Key lists the request attributes responses differ by: "method",
+	// "path", "query", "body", "params.<name>", "query.<name>",
+	// "header.<name>" or "cookie.<name>". The default is method, path and
+	// query.
+	Key []string `json:"key"`
+	// Max entries kept, default 1000
+	Max int `json:"max"`
+}
+
+// renderCacheGeneration is bumped by DELETE /__admin/render-cache, which
+// turns every entry made before stale.
+var renderCacheGeneration atomic.Int64
+
+type renderEntry struct {
+	// ready is closed once the response is stored; requests for the same
+	// key wait on it instead of rendering again
+	ready      chan struct{}
+	generation int64
+	expires    time.Time
+	status     int
+	header     http.Header
+	body       []byte
+}
+
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[string]*renderEntry
+}
+
+var renderKeyAttributes = map[string]bool{"method": true, "path": true, "query": true, "body": true}
+
+var renderKeyPrefixes = []string{"params.", "query.", "header.", "cookie."}
+
+func validRenderKey(attr string) bool {
+	if renderKeyAttributes[attr] {
+		return true
+	}
+	for _, prefix := range renderKeyPrefixes {
+		if name, ok := strings.CutPrefix(attr, prefix); ok && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// renderKey joins the values of the key attributes for r.
+func renderKey(attrs []string, r *http.Request) string {
+	var sb strings.Builder
+	for _, attr := range attrs {
+		var val string
+		prefix, name, _ := strings.Cut(attr, ".")
+		switch {
+		case attr == "method":
+			val = r.Method
+		case attr == "path":
+			val = r.URL.Path
+		case attr == "query":
+			// sorted, so parameter order doesn't split the cache
+			q := r.URL.Query()
+			keys := make([]string, 0, len(q))
+			for k := range q {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				val += k + "=" + strings.Join(q[k], ",") + "&"
+			}
+		case attr == "body":
+			sum := sha256.Sum256(readBody(r))
+			val = hex.EncodeToString(sum[:])
+		case prefix == "params":
+			val = r.PathValue(name)
+		case prefix == "query":
+			val = r.URL.Query().Get(name)
+		case prefix == "header":
+			val = r.Header.Get(name)
+		case prefix == "cookie":
+			if c, err := r.Cookie(name); err == nil {
+				val = c.Value
+			}
+		}
+		// quoted, so values containing the separator can't collide
+		fmt.Fprintf(&sb, "%q ", val)
+	}
+	return sb.String()
+}
+
+// withRenderCache serves responses rendered for the same key within the
+// TTL from memory. Server errors are not kept.
+func withRenderCache(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.RenderCache
+	if cfg.Ttl <= 0 {
+		check(fmt.Errorf("renderCache for %s %s needs a ttl", api.Method, api.Url))
+	}
+	attrs := cfg.Key
+	if len(attrs) == 0 {
+		attrs = []string{"method", "path", "query"}
+	}
+	for _, attr := range attrs {
+		if !validRenderKey(attr) {
+			check(fmt.Errorf("renderCache for %s %s: unknown key attribute %q", api.Method, api.Url, attr))
+		}
+	}
+	limit := cfg.Max
+	if limit <= 0 {
+		limit = 1000
+	}
+	ttl := time.Duration(cfg.Ttl) * time.Millisecond
+	cache := &renderCache{entries: map[string]*renderEntry{}}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := renderKey(attrs, r)
+		generation := renderCacheGeneration.Load()
+		now := clock.Now()
+		cache.mu.Lock()
+		entry := cache.entries[key]
+		if entry != nil {
+			select {
+			case <-entry.ready:
+				if entry.generation != generation || now.After(entry.expires) {
+					entry = nil
+				}
+			default:
+				// being rendered by another request
+			}
+		}
+		if entry != nil {
+			cache.mu.Unlock()
+			<-entry.ready
+			if entry.status != 0 {
+				slog.Debug("Response served from render cache", "method", api.Method, "url", api.Url)
+				buf := &responseBuffer{header: entry.header.Clone(), status: entry.status}
+				buf.send(w, entry.body)
+				return
+			}
+			// the rendering request got a server error, render our own
+			next(w, r)
+			return
+		}
+		if len(cache.entries) >= limit {
+			for k, e := range cache.entries {
+				select {
+				case <-e.ready:
+					if now.After(e.expires) || e.generation != generation {
+						delete(cache.entries, k)
+					}
+				default:
+				}
+			}
+			// still full of live entries: drop any one
+			for k := range cache.entries {
+				if len(cache.entries) < limit {
+					break
+				}
+				delete(cache.entries, k)
+			}
+		}
+		entry = &renderEntry{ready: make(chan struct{}), generation: generation}
+		cache.entries[key] = entry
+		cache.mu.Unlock()
+
+		buf := newResponseBuffer()
+		defer func() {
+			// server errors and panics leave nothing for the waiters
+			if entry.status == 0 {
+				cache.mu.Lock()
+				if cache.entries[key] == entry {
+					delete(cache.entries, key)
+				}
+				cache.mu.Unlock()
+			}
+			close(entry.ready)
+		}()
+		next(buf, r)
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+		body := buf.body.Bytes()
+		if buf.status < 500 {
+			entry.status, entry.header, entry.body = buf.status, buf.header.Clone(), body
+			entry.expires = clock.Now().Add(ttl)
+		}
+		buf.send(w, body)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderCacheExpiresByMockClock(t *testing.T) {
+	clock.freeze()
+	defer clock.reset()
+	renders := 0
+	h := withRenderCache(ApiFormat{Url: "/report", RenderCache: &RenderCacheFormat{Ttl: 60000}}, func(w http.ResponseWriter, r *http.Request) {
+		renders++
+		fmt.Fprint(w, renders)
+	})
+	get := func() string {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+		return w.Body.String()
+	}
+	if first, second := get(), get(); first != "1" || second != "1" {
+		t.Fatalf("got %s then %s, want the cached 1", first, second)
+	}
+	// the frozen clock keeps the entry fresh however long the test takes
+	clock.advance(59 * time.Second)
+	if got := get(); got != "1" {
+		t.Errorf("got %s before the ttl, want the cached 1", got)
+	}
+	clock.advance(2 * time.Second)
+	if got := get(); got != "2" {
+		t.Errorf("got %s once the mock clock passed the ttl, want a new render", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplayFormat rejects requests repeated within a window, as APIs with
+// anti-replay protection do, and can require a fresh nonce and timestamp
+// header on every request.
+type ReplayFormat struct {
+	// Window in milliseconds a request is remembered for, default 300000
+	Window int `json:"window"`
+	// Key lists the request attributes identical requests share, as for
+	// renderCache; the default is method, path, query and body. "-" turns
+	// duplicate detection off, leaving the nonce and timestamp checks.
+	Key []string `json:"key"`
+	// NonceHeader, when set, must carry a value not seen in the window
+	NonceHeader string `json:"nonceHeader"`
+	// TimestampHeader, when set, must carry a time in unix seconds or RFC
+	// 3339 within Tolerance of the mock clock
+	TimestampHeader string `json:"timestampHeader"`
+	// Tolerance in milliseconds, default the window
+	Tolerance int `json:"tolerance"`
+	// Response answers rejected requests, with the reason as
+	// .Vars.reason; by default a 409 with the reason in a JSON body
+	Response *ResponseFormat `json:"response"`
+}
+
+// replayGuard remembers the keys and nonces seen within the window.
+type replayGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// check notes key as seen at now, reporting whether it was already seen
+// within window.
+func (g *replayGuard) check(key string, now time.Time, window time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.seen) > 10000 {
+		for k, at := range g.seen {
+			if now.Sub(at) > window {
+				delete(g.seen, k)
+			}
+		}
+	}
+	at, ok := g.seen[key]
+	if ok && now.Sub(at) <= window {
+		return true
+	}
+	g.seen[key] = now
+	return false
+}
+
+// parseRequestTime reads a timestamp header: unix seconds, or milliseconds
+// when too large for seconds, or RFC 3339.
+func parseRequestTime(val string) (time.Time, error) {
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if n > 1e11 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+func withReplayProtection(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Replay
+	window := 5 * time.Minute
+	if cfg.Window > 0 {
+		window = time.Duration(cfg.Window) * time.Millisecond
+	}
+	tolerance := window
+	if cfg.Tolerance > 0 {
+		tolerance = time.Duration(cfg.Tolerance) * time.Millisecond
+	}
+	attrs := cfg.Key
+	if len(attrs) == 0 {
+		attrs = []string{"method", "path", "query", "body"}
+	}
+	if len(attrs) == 1 && attrs[0] == "-" {
+		attrs = nil
+	}
+	for _, attr := range attrs {
+		if !validRenderKey(attr) {
+			check(fmt.Errorf("replay for %s %s: unknown key attribute %q", api.Method, api.Url, attr))
+		}
+	}
+	response := ResponseFormat{
+		Status:  http.StatusConflict,
+		Headers: map[string]interface{}{"Content-Type": "application/json"},
+		Body:    map[string]interface{}{"error": "replay detected", "reason": "{{.Vars.reason}}"},
+	}
+	if cfg.Response != nil {
+		response = *cfg.Response
+		if response.Status == 0 {
+			response.Status = http.StatusConflict
+		}
+	}
+	headers := compileHeaders(response.Headers)
+	body, _, err := compileJSON(api.Url, response.Body)
+	check(err)
+	requests, nonces := &replayGuard{seen: map[string]time.Time{}}, &replayGuard{seen: map[string]time.Time{}}
+
+	reject := func(w http.ResponseWriter, r *http.Request, reason string) {
+		slog.Debug("Replay rejected", "method", api.Method, "url", api.Url, "reason", reason)
+		data := newTemplateData(r, api)
+		data.Vars["reason"] = reason
+		var payload []byte
+		if response.Body != nil {
+			rendered, err := renderJSON(body, data)
+			if err == nil {
+				payload, err = json.Marshal(rendered)
+			}
+			if err != nil {
+				slog.Error("Failed to render replay response", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			payload = append(payload, '\n')
+		}
+		if !headers.render(w, data) {
+			return
+		}
+		w.WriteHeader(response.Status)
+		w.Write(payload)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := clock.Now()
+		if cfg.TimestampHeader != "" {
+			val := r.Header.Get(cfg.TimestampHeader)
+			if val == "" {
+				reject(w, r, "missing "+cfg.TimestampHeader+" header")
+				return
+			}
+			at, err := parseRequestTime(val)
+			if err != nil {
+				reject(w, r, "invalid "+cfg.TimestampHeader+" header")
+				return
+			}
+			if skew := now.Sub(at); skew > tolerance || -skew > tolerance {
+				reject(w, r, "timestamp outside the allowed window")
+				return
+			}
+		}
+		if cfg.NonceHeader != "" {
+			nonce := r.Header.Get(cfg.NonceHeader)
+			if nonce == "" {
+				reject(w, r, "missing "+cfg.NonceHeader+" header")
+				return
+			}
+			if nonces.check(nonce, now, window) {
+				reject(w, r, "nonce already used")
+				return
+			}
+		}
+		if attrs != nil && requests.check(renderKey(attrs, r), now, window) {
+			reject(w, r, "duplicate request")
+			return
+		}
+		next(w, r)
+	}
+}
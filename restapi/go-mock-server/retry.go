@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryFormat makes an endpoint reject the first calls of each client with
+// a Retry-After response before serving the configured response.
+type RetryFormat struct {
+	// Failures is the number of rejected calls per client
+	Failures int `json:"failures"`
+	// Duration in ms rejects every call until this long after the first one
+	Duration int `json:"duration"`
+	// Status of rejected calls, 503 or 429, default 503
+	Status int `json:"status"`
+	// RetryAfter in seconds, default 1 or in duration mode the time left
+	RetryAfter int `json:"retryAfter"`
+	// Key is a template identifying the client, default the remote address
+	Key  string                 `json:"key"`
+	Body map[string]interface{} `json:"body"`
+}
+
+type retryClient struct {
+	calls int
+	first time.Time
+}
+
+// clientHost returns the remote address of the request without the port.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func withRetry(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Retry
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusServiceUnavailable
+	}
+	if cfg.Status != http.StatusServiceUnavailable && cfg.Status != http.StatusTooManyRequests {
+		check(fmt.Errorf("retry status for %s %s must be 503 or 429, got %d", api.Method, api.Url, cfg.Status))
+	}
+	if cfg.Failures <= 0 && cfg.Duration <= 0 {
+		check(fmt.Errorf("retry for %s %s needs failures or duration", api.Method, api.Url))
+	}
+	if cfg.Duration <= 0 && cfg.RetryAfter == 0 {
+		cfg.RetryAfter = 1
+	}
+	key, err := compileTemplate(api.Url, cfg.Key)
+	check(err)
+
+	var mu sync.Mutex
+	clients := map[string]*retryClient{}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := clientHost(r)
+		if cfg.Key != "" {
+			rendered, err := key.render(newTemplateData(r, api))
+			if err != nil {
+				slog.Error("Failed to render retry key", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			id = rendered
+		}
+
+		now := clock.Now()
+		mu.Lock()
+		client, ok := clients[id]
+		if !ok {
+			client = &retryClient{first: now}
+			clients[id] = client
+		}
+		client.calls++
+		calls := client.calls
+		elapsed := now.Sub(client.first)
+		mu.Unlock()
+
+		retryAfter := cfg.RetryAfter
+		reject := false
+		if cfg.Duration > 0 {
+			remaining := time.Duration(cfg.Duration)*time.Millisecond - elapsed
+			reject = remaining > 0
+			if retryAfter == 0 {
+				retryAfter = int((remaining + time.Second - 1) / time.Second)
+			}
+		} else {
+			reject = calls <= cfg.Failures
+		}
+		if !reject {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		if cfg.Body != nil {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(cfg.Status)
+		slog.Debug("API request rejected for retry", "method", api.Method, "url", api.Url, "client", id, "call", calls, "status", cfg.Status)
+		if cfg.Body != nil {
+			json.NewEncoder(w).Encode(cfg.Body)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// router dispatches requests through a tree keyed by path segment instead
+// of http.ServeMux's pattern list. It accepts the same pattern syntax:
+// "[METHOD ]/path/{name}/{rest...}", "{$}" for an exact trailing slash and
+// a trailing "/" for a whole subtree. Literal segments take precedence over
+// wildcards, which take precedence over catch-alls. As with ServeMux,
+// unclean paths and subtree roots without their slash are redirected.
+type router struct {
+	root node
+	// unmatched serves requests no endpoint takes, with Allow already set
+	// when the path exists for other methods; nil answers 404 or 405
+	unmatched http.Handler
+	// registered holds the unconditional endpoints, for overlap checks
+	registered []*endpoint
+}
+
+type node struct {
+	static   map[string]*node
+	wildcard *node
+	// catchAll matches one or more remaining segments, possibly empty
+	catchAll *route
+	// leaf is set when a pattern ends at this node
+	leaf *route
+}
+
+// route holds the endpoints registered for one path, keyed by method with
+// "" matching any method.
+type route struct {
+	endpoints map[string][]*endpoint
+}
+
+// A handler implementing requestMatcher is only chosen for requests it
+// matches. Conditional ones may share a pattern with other handlers and
+// are tried, in registration order, before the unconditional one.
+type requestMatcher interface {
+	Matches(r *http.Request) bool
+	Conditional() bool
+}
+
+type endpoint struct {
+	pattern string
+	method  string
+	// names of the wildcards in path order, "" for an anonymous subtree
+	names    []string
+	segments []patternSegment
+	handler  http.Handler
+	matcher  requestMatcher
+}
+
+// patternSegment is one path segment of a pattern: a literal, "" for
+// {$}, a wildcard or a catch-all of the remaining segments.
+type patternSegment struct {
+	literal  string
+	wildcard bool
+	rest     bool
+}
+
+// How the requests of one pattern relate to those of another.
+const (
+	disjoint = iota
+	equivalent
+	moreSpecific
+	lessSpecific
+	overlapping
+)
+
+// combine relates two patterns from how their parts relate.
+func combine(a, b int) int {
+	switch {
+	case a == disjoint || b == disjoint:
+		return disjoint
+	case a == equivalent:
+		return b
+	case b == equivalent || a == b:
+		return a
+	}
+	return overlapping
+}
+
+// methodRelation relates the methods of two patterns; "" matches any
+// and GET also matches HEAD.
+func methodRelation(a, b string) int {
+	switch {
+	case a == b:
+		return equivalent
+	case b == "" || a == http.MethodHead && b == http.MethodGet:
+		return moreSpecific
+	case a == "" || a == http.MethodGet && b == http.MethodHead:
+		return lessSpecific
+	}
+	return disjoint
+}
+
+// pathRelation relates the paths of two patterns segment by segment. A
+// wildcard never matches an empty segment and a catch-all matches at
+// least one.
+func pathRelation(a, b []patternSegment) int {
+	rel := equivalent
+	for i := 0; ; i++ {
+		if i == len(a) || i == len(b) {
+			if len(a) == len(b) {
+				return rel
+			}
+			return disjoint
+		}
+		x, y := a[i], b[i]
+		switch {
+		case x.rest && y.rest:
+			return rel
+		case x.rest:
+			return combine(rel, lessSpecific)
+		case y.rest:
+			return combine(rel, moreSpecific)
+		case x.wildcard && y.wildcard:
+		case x.wildcard:
+			if y.literal == "" {
+				return disjoint
+			}
+			rel = combine(rel, lessSpecific)
+		case y.wildcard:
+			if x.literal == "" {
+				return disjoint
+			}
+			rel = combine(rel, moreSpecific)
+		case x.literal != y.literal:
+			return disjoint
+		}
+	}
+}
+
+func (e *endpoint) matches(r *http.Request) bool {
+	return e.matcher == nil || e.matcher.Matches(r)
+}
+
+func (e *endpoint) conditional() bool {
+	return e.matcher != nil && e.matcher.Conditional()
+}
+
+// String describes the endpoint for conflict errors, naming the handler
+// when it can describe itself.
+func (e *endpoint) String() string {
+	if s, ok := e.handler.(fmt.Stringer); ok {
+		return fmt.Sprintf("%q of %s", e.pattern, s)
+	}
+	return strconv.Quote(e.pattern)
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+func splitPattern(pattern string) (string, string, error) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	path = strings.TrimLeft(path, " ")
+	if !strings.HasPrefix(path, "/") {
+		return "", "", fmt.Errorf("pattern %q: path must start with /", pattern)
+	}
+	return method, path, nil
+}
+
+// cleanPath is path.Clean keeping a trailing slash, as ServeMux cleans
+// request paths.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if p[len(p)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// handle registers h for pattern. Unlike ServeMux it reports conflicts as
+// errors instead of panicking: the same pattern registered twice, or two
+// patterns matching some request alike where neither is more specific,
+// such as "GET /a/{x}" and "GET /{y}/b".
+func (rt *router) handle(pattern string, h http.Handler) error {
+	method, path, err := splitPattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	n := &rt.root
+	names := []string{}
+	parsed := []patternSegment{}
+	segments := strings.Split(path[1:], "/")
+	var target **route
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch {
+		case last && seg == "":
+			// trailing slash: the pattern covers the whole subtree
+			names = append(names, "")
+			parsed = append(parsed, patternSegment{rest: true})
+			target = &n.catchAll
+		case seg == "{$}":
+			if !last {
+				return fmt.Errorf("pattern %q: {$} must be the last segment", pattern)
+			}
+			parsed = append(parsed, patternSegment{})
+			target = &n.child("").leaf
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "...}"):
+			if !last {
+				return fmt.Errorf("pattern %q: %s must be the last segment", pattern, seg)
+			}
+			names = append(names, seg[1:len(seg)-4])
+			parsed = append(parsed, patternSegment{rest: true})
+			target = &n.catchAll
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			names = append(names, seg[1:len(seg)-1])
+			parsed = append(parsed, patternSegment{wildcard: true})
+			if n.wildcard == nil {
+				n.wildcard = &node{}
+			}
+			n = n.wildcard
+		case strings.ContainsAny(seg, "{}"):
+			return fmt.Errorf("pattern %q: wildcard %q must be a whole segment", pattern, seg)
+		default:
+			unescaped, err := url.PathUnescape(seg)
+			if err != nil {
+				return fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+			parsed = append(parsed, patternSegment{literal: unescaped})
+			n = n.child(unescaped)
+		}
+	}
+	e := &endpoint{pattern: pattern, method: method, names: names, segments: parsed, handler: h}
+	e.matcher, _ = h.(requestMatcher)
+	if !e.conditional() {
+		for _, prev := range rt.registered {
+			if combine(methodRelation(method, prev.method), pathRelation(parsed, prev.segments)) == overlapping {
+				return fmt.Errorf("pattern %q conflicts with %s", pattern, prev)
+			}
+		}
+	}
+	if target == nil {
+		target = &n.leaf
+	}
+	if *target == nil {
+		*target = &route{endpoints: map[string][]*endpoint{}}
+	}
+	rte := *target
+	list := rte.endpoints[method]
+	at := len(list)
+	for i, prev := range list {
+		if !prev.conditional() {
+			if !e.conditional() {
+				return fmt.Errorf("pattern %q conflicts with %s", pattern, prev)
+			}
+			at = i
+			break
+		}
+	}
+	rte.endpoints[method] = append(list[:at], append([]*endpoint{e}, list[at:]...)...)
+	if !e.conditional() {
+		rt.registered = append(rt.registered, e)
+	}
+	return nil
+}
+
+func (n *node) child(seg string) *node {
+	if n.static == nil {
+		n.static = map[string]*node{}
+	}
+	c, ok := n.static[seg]
+	if !ok {
+		c = &node{}
+		n.static[seg] = c
+	}
+	return c
+}
+
+// allowHeader lists the methods that would serve r, "" if there are none.
+func (rte *route) allowHeader(r *http.Request) string {
+	methods := []string{}
+	for method := range rte.endpoints {
+		if rte.pick(method, r) == nil {
+			continue
+		}
+		methods = append(methods, method)
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+func (rte *route) pick(method string, r *http.Request) *endpoint {
+	for _, e := range rte.endpoints[method] {
+		if e.matches(r) {
+			return e
+		}
+	}
+	return nil
+}
+
+// endpoint picks the endpoint serving r, treating HEAD like GET.
+func (rte *route) endpoint(r *http.Request) *endpoint {
+	if e := rte.pick(r.Method, r); e != nil {
+		return e
+	}
+	if r.Method == http.MethodHead {
+		if e := rte.pick(http.MethodGet, r); e != nil {
+			return e
+		}
+	}
+	return rte.pick("", r)
+}
+
+// lookup finds the endpoint for r and the remaining path segments,
+// collecting wildcard values. Literals are tried first, then wildcards,
+// then catch-alls, backtracking when a branch has no endpoint serving r.
+// A route matching only the path is kept in pathOnly for 405s.
+func (n *node) lookup(r *http.Request, segments, values []string, pathOnly **route) (*endpoint, []string) {
+	if len(segments) == 0 {
+		return n.leaf.match(r, values, pathOnly)
+	}
+	seg := segments[0]
+	if c, ok := n.static[seg]; ok {
+		if e, vals := c.lookup(r, segments[1:], values, pathOnly); e != nil {
+			return e, vals
+		}
+	}
+	if seg != "" && n.wildcard != nil {
+		if e, vals := n.wildcard.lookup(r, segments[1:], append(values, seg), pathOnly); e != nil {
+			return e, vals
+		}
+	}
+	if n.catchAll != nil {
+		return n.catchAll.match(r, append(values, strings.Join(segments, "/")), pathOnly)
+	}
+	return nil, values
+}
+
+func (rte *route) match(r *http.Request, values []string, pathOnly **route) (*endpoint, []string) {
+	if rte == nil {
+		return nil, values
+	}
+	if e := rte.endpoint(r); e != nil {
+		return e, values
+	}
+	if *pathOnly == nil && rte.allowHeader(r) != "" {
+		*pathOnly = rte
+	}
+	return nil, values
+}
+
+// pathSegments splits the request path, unescaping segments individually
+// so an encoded "/" can't introduce extra segments.
+func pathSegments(u *url.URL) []string {
+	if u.RawPath == "" {
+		return strings.Split(u.Path[1:], "/")
+	}
+	segments := strings.Split(u.EscapedPath()[1:], "/")
+	for i, seg := range segments {
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			segments[i] = unescaped
+		}
+	}
+	return segments
+}
+
+// unmatchedStatus answers 405 when an Allow header was set, else 404.
+func unmatchedStatus(w http.ResponseWriter, r *http.Request) {
+	if w.Header().Get("Allow") != "" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// redirect sends the client to path, keeping the query, as ServeMux does.
+func redirect(w http.ResponseWriter, r *http.Request, path string) {
+	target := url.URL{Path: path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// subtreeRoot reports whether r's path with a trailing slash is served
+// whole, by a pattern such as "/docs/" or "/docs/{$}", so that ServeMux
+// would redirect to it.
+func (rt *router) subtreeRoot(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	u := *r.URL
+	u.Path += "/"
+	if u.RawPath != "" {
+		u.RawPath += "/"
+	}
+	var pathOnly *route
+	e, values := rt.root.lookup(r, pathSegments(&u), make([]string, 0, 4), &pathOnly)
+	if e == nil {
+		return false
+	}
+	// a catch-all must match nothing, as it would match the path itself
+	catchAll := strings.HasSuffix(e.pattern, "/") || strings.HasSuffix(e.pattern, "...}")
+	return !catchAll || values[len(values)-1] == ""
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		if cleaned := cleanPath(r.URL.Path); cleaned != r.URL.Path {
+			redirect(w, r, cleaned)
+			return
+		}
+	}
+	var pathOnly *route
+	e, values := rt.root.lookup(r, pathSegments(r.URL), make([]string, 0, 4), &pathOnly)
+	if e == nil {
+		if rt.subtreeRoot(r) {
+			redirect(w, r, r.URL.Path+"/")
+			return
+		}
+		if rejectOversized(w, r) {
+			return
+		}
+		if pathOnly != nil {
+			w.Header().Set("Allow", pathOnly.allowHeader(r))
+		}
+		if rt.unmatched != nil {
+			rt.unmatched.ServeHTTP(w, r)
+			return
+		}
+		unmatchedStatus(w, r)
+		return
+	}
+	for i, name := range e.names {
+		if name != "" {
+			r.SetPathValue(name, values[i])
+		}
+	}
+	e.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedHandler answers its name and the path values it was given.
+type namedHandler struct {
+	name   string
+	values []string
+	// header is a condition, matched when the request has it
+	header string
+}
+
+func (h *namedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out := []string{h.name}
+	for _, name := range h.values {
+		out = append(out, name+"="+r.PathValue(name))
+	}
+	w.Write([]byte(strings.Join(out, " ")))
+}
+
+func (h *namedHandler) Matches(r *http.Request) bool {
+	return h.header == "" || r.Header.Get(h.header) != ""
+}
+
+func (h *namedHandler) Conditional() bool {
+	return h.header != ""
+}
+
+func newTestRouter(t *testing.T, patterns map[string]*namedHandler) *router {
+	t.Helper()
+	rt := newRouter()
+	for pattern, h := range patterns {
+		if err := rt.handle(pattern, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rt
+}
+
+type routeCase struct {
+	method, target, header string
+	// want is the body, the handler's name, or the status and Location
+	// or Allow header for requests no handler serves
+	want string
+}
+
+func checkRoutes(t *testing.T, rt *router, tests []routeCase) {
+	t.Helper()
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, "1")
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		got := strings.TrimSpace(w.Body.String())
+		switch w.Code {
+		case http.StatusOK:
+		case http.StatusMovedPermanently:
+			got = "301 " + w.Header().Get("Location")
+		case http.StatusMethodNotAllowed:
+			got = "405 " + w.Header().Get("Allow")
+		default:
+			got = http.StatusText(w.Code)
+		}
+		if got != tt.want {
+			t.Errorf("%s %s (%s): got %q, want %q", tt.method, tt.target, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	rt := newTestRouter(t, map[string]*namedHandler{
+		"GET /users/me":               {name: "me"},
+		"GET /users/{id}":             {name: "user", values: []string{"id"}},
+		"GET /users/{id}/posts/{pid}": {name: "post", values: []string{"id", "pid"}},
+		"GET /users/":                 {name: "users-tree"},
+		"GET /files/{path...}":        {name: "file", values: []string{"path"}},
+		"GET /files/{$}":              {name: "files-index"},
+		"/":                           {name: "root"},
+		"GET /{$}":                    {name: "home"},
+	})
+	checkRoutes(t, rt, []routeCase{
+		{"GET", "/users/me", "", "me"},
+		{"GET", "/users/42", "", "user id=42"},
+		{"GET", "/users/42/posts/7", "", "post id=42 pid=7"},
+		// backtracks from the wildcard branch to the subtree
+		{"GET", "/users/42/comments", "", "users-tree"},
+		{"GET", "/users/", "", "users-tree"},
+		{"GET", "/files/a/b.txt", "", "file path=a/b.txt"},
+		{"GET", "/files/", "", "files-index"},
+		{"GET", "/files/a%2Fb", "", "file path=a/b"},
+		{"GET", "/", "", "home"},
+		{"GET", "/elsewhere", "", "root"},
+		{"POST", "/users/42", "", "root"},
+	})
+}
+
+func TestRouterMethods(t *testing.T) {
+	rt := newTestRouter(t, map[string]*namedHandler{
+		"GET /items":         {name: "list"},
+		"POST /items":        {name: "create"},
+		"DELETE /items/{id}": {name: "delete"},
+		"/any":               {name: "any"},
+	})
+	checkRoutes(t, rt, []routeCase{
+		{"GET", "/items", "", "list"},
+		{"HEAD", "/items", "", "list"},
+		{"POST", "/items", "", "create"},
+		{"PUT", "/items", "", "405 GET, HEAD, POST"},
+		{"GET", "/items/1", "", "405 DELETE"},
+		{"PATCH", "/any", "", "any"},
+		{"GET", "/missing", "", "Not Found"},
+	})
+}
+
+func TestRouterConditionalEndpoints(t *testing.T) {
+	rt := newRouter()
+	for _, e := range []struct {
+		pattern string
+		h       *namedHandler
+	}{
+		{"GET /orders", &namedHandler{name: "default"}},
+		{"GET /orders", &namedHandler{name: "tenant", header: "X-Tenant"}},
+		{"GET /orders", &namedHandler{name: "beta", header: "X-Beta"}},
+		{"GET /only", &namedHandler{name: "only", header: "X-Only"}},
+	} {
+		if err := rt.handle(e.pattern, e.h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRoutes(t, rt, []routeCase{
+		// conditional endpoints go first, in registration order
+		{"GET", "/orders", "X-Tenant", "tenant"},
+		{"GET", "/orders", "X-Beta", "beta"},
+		{"GET", "/orders", "", "default"},
+		{"GET", "/only", "X-Only", "only"},
+		{"GET", "/only", "", "Not Found"},
+	})
+}
+
+func TestRouterCleansPaths(t *testing.T) {
+	rt := newTestRouter(t, map[string]*namedHandler{
+		"GET /b":              {name: "b"},
+		"GET /docs/":          {name: "docs"},
+		"GET /api/{v}/{$}":    {name: "api"},
+		"GET /assets/{f...}":  {name: "asset"},
+		"GET /static/{f...}":  {name: "static"},
+		"GET /static":         {name: "static-root"},
+		"POST /upload/":       {name: "upload"},
+		"GET /search/{q}/now": {name: "now"},
+	})
+	checkRoutes(t, rt, []routeCase{
+		{"GET", "//a/../b", "", "301 /b"},
+		{"GET", "/./b?x=1", "", "301 /b?x=1"},
+		{"GET", "/docs//intro", "", "301 /docs/intro"},
+		{"GET", "/b", "", "b"},
+		// subtree roots are redirected to their slash
+		{"GET", "/docs", "", "301 /docs/"},
+		{"GET", "/docs?page=2", "", "301 /docs/?page=2"},
+		{"GET", "/api/v1", "", "301 /api/v1/"},
+		{"GET", "/assets", "", "301 /assets/"},
+		{"POST", "/upload", "", "301 /upload/"},
+		// unless the path is served as is
+		{"GET", "/static", "", "static-root"},
+		{"GET", "/search/go", "", "Not Found"},
+	})
+}
+
+func TestRouterMoreSpecificPatterns(t *testing.T) {
+	rt := newRouter()
+	for _, pattern := range []string{"/", "GET /{x}/b", "GET /a/b", "HEAD /a/b", "GET /{x}/b/{y...}", "GET /c/{$}", "POST /{x}/{y}"} {
+		if err := rt.handle(pattern, &namedHandler{}); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRouterConflicts(t *testing.T) {
+	for _, tt := range []struct {
+		patterns []string
+		err      string
+	}{
+		{[]string{"GET /a", "GET /a"}, "conflicts"},
+		{[]string{"/a/{x}", "/a/{y}"}, "conflicts"},
+		// overlapping, but neither is more specific
+		{[]string{"GET /a/{x}", "GET /{y}/b"}, "conflicts"},
+		{[]string{"/a/{rest...}", "/{x}/b/"}, "conflicts"},
+		{[]string{"GET /{x}", "/a"}, "conflicts"},
+		{[]string{"a"}, "must start with /"},
+		{[]string{"/a/{$}/b"}, "must be the last segment"},
+		{[]string{"/a/{rest...}/b"}, "must be the last segment"},
+		{[]string{"/a/x{id}"}, "must be a whole segment"},
+	} {
+		rt := newRouter()
+		var err error
+		for _, pattern := range tt.patterns {
+			if err = rt.handle(pattern, &namedHandler{}); err != nil {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want an error with %q", tt.patterns, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// stubSource tells where a stub was defined.
+type stubSource struct {
+	// Origin is "config", "preset" or "admin" for stubs added at runtime
+	Origin string `json:"origin"`
+	// File and Line locate the stub's entry, in the preset's file for
+	// presets; WSDL imports have no line
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+// arrayElements splits a JSON array into its elements, with the offset of
+// each in doc.
+func arrayElements(doc []byte) ([]json.RawMessage, []int64) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, nil
+	}
+	elems, offsets := []json.RawMessage{}, []int64{}
+	for dec.More() {
+		var raw json.RawMessage
+		if dec.Decode(&raw) != nil {
+			break
+		}
+		elems, offsets = append(elems, raw), append(offsets, dec.InputOffset()-int64(len(raw)))
+	}
+	return elems, offsets
+}
+
+// memberValue finds the value of key in a JSON object, with its offset,
+// matching the key the way json.Unmarshal does.
+func memberValue(obj []byte, key string) (json.RawMessage, int64) {
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, 0
+	}
+	for dec.More() {
+		name, err := dec.Token()
+		if err != nil {
+			return nil, 0
+		}
+		var raw json.RawMessage
+		if dec.Decode(&raw) != nil {
+			return nil, 0
+		}
+		if s, _ := name.(string); strings.EqualFold(s, key) {
+			return raw, dec.InputOffset() - int64(len(raw))
+		}
+	}
+	return nil, 0
+}
+
+// locateStubs records in apis, parsed from the JSON array doc found at
+// offset base of file, the line each entry starts on, groups included.
+func locateStubs(apis []ApiFormat, doc []byte, base int64, source stubSource, file []byte) {
+	elems, offsets := arrayElements(doc)
+	if len(elems) != len(apis) {
+		return
+	}
+	for i := range apis {
+		at := base + offsets[i]
+		apis[i].source = source
+		apis[i].source.Line = bytes.Count(file[:at], []byte("\n")) + 1
+		if apis[i].Stubs != nil {
+			if raw, offset := memberValue(elems[i], "stubs"); raw != nil {
+				locateStubs(apis[i].Stubs, raw, at+offset, source, file)
+			}
+		}
+	}
+}
+
+// setOrigin marks apis, and the stubs of groups among them, as coming from
+// origin.
+func setOrigin(apis []ApiFormat, origin string) {
+	for i := range apis {
+		apis[i].source.Origin = origin
+		setOrigin(apis[i].Stubs, origin)
+	}
+}
+
+type routeReport struct {
+	Id      string `json:"id"`
+	Method  string `json:"method,omitempty"`
+	Url     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+	// Priority orders the stubs sharing the method and url: conditional
+	// ones are tried first, by load order, the unconditional one last
+	Priority    int         `json:"priority"`
+	Conditional bool        `json:"conditional"`
+	Match       interface{} `json:"match,omitempty"`
+	Response    interface{} `json:"response,omitempty"`
+	// Options holds the rest of the stub's config, e.g. delay or cache
+	Options map[string]interface{} `json:"options,omitempty"`
+	Source  stubSource             `json:"source"`
+	// Patched is set for stubs changed with PATCH /__admin/stubs/{id}
+	Patched bool `json:"patched,omitempty"`
+}
+
+type routesReport struct {
+	Workspace string        `json:"workspace,omitempty"`
+	MockData  string        `json:"mockData"`
+	Profile   string        `json:"profile,omitempty"`
+	Total     int           `json:"total"`
+	Routes    []routeReport `json:"routes"`
+}
+
+// compactConfig returns v, a config value, without the fields left unset,
+// so a stub reads as it was written. Maps and slices of anything but
+// config structs, e.g. bodies, are user data and kept whole.
+func compactConfig(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return compactConfig(v.Elem())
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" || v.Field(i).IsZero() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if val := compactConfig(v.Field(i)); val != nil {
+				fields[name] = val
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return fields
+	case reflect.Map, reflect.Slice:
+		if v.Len() == 0 && v.IsNil() {
+			return nil
+		}
+		elem := v.Type().Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return v.Interface()
+		}
+		if v.Kind() == reflect.Map {
+			entries := map[string]interface{}{}
+			for _, key := range v.MapKeys() {
+				entries[key.String()] = compactConfig(v.MapIndex(key))
+			}
+			return entries
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = compactConfig(v.Index(i))
+		}
+		return items
+	}
+	if v.IsZero() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// routesReport describes every registered stub as the router sees it.
+func (lr *liveRoutes) routesReport() routesReport {
+	lr.mu.Lock()
+	report := routesReport{Workspace: lr.name, MockData: lr.mockData, Profile: lr.profile, Routes: []routeReport{}}
+	patched := map[string]bool{}
+	for id := range lr.patches {
+		patched[id] = true
+	}
+	lr.mu.Unlock()
+	tried := map[string]int{}
+	stubs := lr.registry.list()
+	for _, s := range stubs {
+		pattern := s.api.Method + " " + s.api.Url
+		rr := routeReport{
+			Id:          s.id,
+			Method:      s.api.Method,
+			Url:         s.api.Url,
+			Enabled:     s.Enabled(),
+			Conditional: s.Conditional(),
+			Match:       compactConfig(reflect.ValueOf(s.api.Match)),
+			Response:    compactConfig(reflect.ValueOf(s.api.Response)),
+			Source:      s.api.source,
+			Patched:     patched[s.id],
+		}
+		if rr.Source.Origin == "" {
+			rr.Source.Origin = "config"
+		}
+		if rr.Conditional {
+			tried[pattern]++
+			rr.Priority = tried[pattern]
+		}
+		options, _ := compactConfig(reflect.ValueOf(s.api)).(map[string]interface{})
+		for _, key := range []string{"id", "enabled", "url", "method", "match", "response"} {
+			delete(options, key)
+		}
+		if len(options) > 0 {
+			rr.Options = options
+		}
+		report.Routes = append(report.Routes, rr)
+	}
+	// unconditional stubs come after every conditional one on their pattern
+	for i, rr := range report.Routes {
+		if !rr.Conditional {
+			report.Routes[i].Priority = tried[rr.Method+" "+rr.Url] + 1
+		}
+	}
+	report.Total = len(report.Routes)
+	return report
+}
+
+// logSummary logs how many stubs there are, by origin, and how many are
+// conditional or switched off.
+func (rep routesReport) logSummary() {
+	origins := map[string]int{}
+	conditional, disabled := 0, 0
+	for _, rr := range rep.Routes {
+		origins[rr.Source.Origin]++
+		if rr.Conditional {
+			conditional++
+		}
+		if !rr.Enabled {
+			disabled++
+		}
+	}
+	slog.Info("Stubs loaded", "workspace", rep.Workspace, "total", rep.Total, "config", origins["config"], "preset", origins["preset"], "admin", origins["admin"], "conditional", conditional, "disabled", disabled)
+}
+
+// yamlNode is decoded JSON keeping the order of object members.
+type yamlNode struct {
+	scalar string
+	keys   []string
+	values []*yamlNode
+	object bool
+	array  bool
+}
+
+func decodeYAMLNode(dec *json.Decoder) (*yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	n := &yamlNode{}
+	switch tok := tok.(type) {
+	case json.Delim:
+		n.object, n.array = tok == '{', tok == '['
+		for dec.More() {
+			if n.object {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, key.(string))
+			}
+			child, err := decodeYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.values = append(n.values, child)
+		}
+		_, err = dec.Token()
+		return n, err
+	case string:
+		quoted, _ := json.Marshal(tok)
+		n.scalar = string(quoted)
+	case nil:
+		n.scalar = "null"
+	default:
+		n.scalar = fmt.Sprint(tok)
+	}
+	return n, nil
+}
+
+// yamlKey writes a key plain when YAML would read it back as the same
+// string, quoted otherwise.
+func yamlKey(key string) string {
+	plain := key != "" && strings.IndexFunc(key, func(c rune) bool {
+		return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.' || c == '/')
+	}) < 0
+	if plain && key[0] != '-' && key[0] != '.' {
+		return key
+	}
+	quoted, _ := json.Marshal(key)
+	return string(quoted)
+}
+
+// writeYAML writes n in block style, its first line where the cursor is
+// and the rest indented.
+func (n *yamlNode) writeYAML(b *strings.Builder, indent int, first bool) {
+	pad := strings.Repeat(" ", indent)
+	switch {
+	case n.object && len(n.keys) == 0:
+		b.WriteString("{}\n")
+	case n.array && len(n.values) == 0:
+		b.WriteString("[]\n")
+	case n.object:
+		for i, key := range n.keys {
+			if i > 0 || !first {
+				b.WriteString(pad)
+			}
+			b.WriteString(yamlKey(key) + ":")
+			child := n.values[i]
+			if (child.object && len(child.keys) > 0) || (child.array && len(child.values) > 0) {
+				b.WriteString("\n")
+				child.writeYAML(b, indent+2, false)
+			} else {
+				b.WriteString(" ")
+				child.writeYAML(b, indent+2, true)
+			}
+		}
+	case n.array:
+		for i, child := range n.values {
+			if i > 0 || !first {
+				b.WriteString(pad)
+			}
+			b.WriteString("- ")
+			child.writeYAML(b, indent+2, true)
+		}
+	default:
+		b.WriteString(n.scalar + "\n")
+	}
+}
+
+// toYAML converts v, as it encodes to JSON, to YAML.
+func toYAML(v interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeYAMLNode(json.NewDecoder(bytes.NewReader(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	n.writeYAML(&b, 0, false)
+	return []byte(b.String()), nil
+}
+
+func serveRouteDump(w http.ResponseWriter, r *http.Request) {
+	report := routesFor(r).routesReport()
+	if r.URL.Query().Get("format") != "yaml" {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	doc, err := toYAML(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(doc)
+}
+
+// printRoutesFlag is --print-routes, alone for JSON or =yaml.
+type printRoutesFlag string
+
+func (f *printRoutesFlag) String() string {
+	return string(*f)
+}
+
+func (f *printRoutesFlag) Set(value string) error {
+	switch value {
+	case "true", "json":
+		*f = "json"
+	case "yaml":
+		*f = "yaml"
+	case "false":
+		*f = ""
+	default:
+		return fmt.Errorf("want json or yaml")
+	}
+	return nil
+}
+
+func (f *printRoutesFlag) IsBoolFlag() bool {
+	return true
+}
+
+// printRoutes writes the routes of the default workspace and of the others
+// to stdout.
+func printRoutes(format string) {
+	reports := []routesReport{routes.routesReport()}
+	for _, name := range workspaces.names() {
+		reports = append(reports, workspaces.byName[name].routesReport())
+	}
+	var doc []byte
+	var err error
+	if format == "yaml" {
+		doc, err = toYAML(reports)
+	} else {
+		doc, err = json.MarshalIndent(reports, "", "  ")
+		doc = append(doc, '\n')
+	}
+	check(err)
+	os.Stdout.Write(doc)
+}
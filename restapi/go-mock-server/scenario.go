@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScenarioCall is a request a client scenario sends, e.g. a partner system
+// calling the system under test back.
+type ScenarioCall struct {
+	// Method defaults to POST when there is a body and GET otherwise
+	Method string `json:"method"`
+	// Url is absolute, a template
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Body is a string template sent as is, or JSON with templates in its
+	// strings
+	Body interface{} `json:"body"`
+	// Signature signs the body the way a signature block verifies it
+	Signature *SignatureFormat `json:"signature"`
+	// Timeout in milliseconds, default 10000
+	Timeout int `json:"timeout"`
+	// Insecure skips verifying the server's TLS certificate
+	Insecure bool `json:"insecure"`
+}
+
+// scenarioSet holds the named client scenarios of a config. A scenario
+// sends its calls in order on a fixed interval, in the minutes of its cron
+// schedule, when a stub naming it in trigger answers, or when run through
+// the admin API.
+type scenarioSet map[string]*scenarioDef
+
+type scenarioDef struct {
+	every    time.Duration
+	schedule []ScheduleRule
+	cron     []cronExpr
+	delay    time.Duration
+	calls    []compiledCall
+}
+
+type compiledCall struct {
+	cfg     ScenarioCall
+	method  string
+	url     *textTemplate
+	headers map[string]*textTemplate
+	body    bodyTemplate
+	client  *http.Client
+}
+
+func (ss scenarioSet) names() []string {
+	names := []string{}
+	for name := range ss {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func compileScenario(api ApiFormat) (*scenarioDef, error) {
+	if len(api.Calls) == 0 {
+		return nil, fmt.Errorf("no calls")
+	}
+	for i, rule := range api.Schedule {
+		if rule.Response != nil {
+			return nil, fmt.Errorf("schedule rule %d: a scenario's schedule takes no response", i+1)
+		}
+	}
+	cron, err := compileSchedule(api.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	def := &scenarioDef{
+		every:    time.Duration(api.Every) * time.Millisecond,
+		schedule: api.Schedule,
+		cron:     cron,
+		delay:    time.Duration(api.Delay) * time.Millisecond,
+	}
+	for i, cfg := range api.Calls {
+		c := compiledCall{cfg: cfg, method: cfg.Method}
+		if c.method == "" {
+			c.method = http.MethodGet
+			if cfg.Body != nil {
+				c.method = http.MethodPost
+			}
+		}
+		if c.url, err = compileTemplate(api.Scenario, cfg.Url); err != nil {
+			return nil, fmt.Errorf("call %d url: %w", i+1, err)
+		}
+		if c.url.tmpl == nil && !strings.Contains(cfg.Url, "://") {
+			return nil, fmt.Errorf("call %d: url %q is not absolute", i+1, cfg.Url)
+		}
+		if c.headers, err = compileTemplates(api.Scenario, cfg.Headers); err != nil {
+			return nil, fmt.Errorf("call %d headers: %w", i+1, err)
+		}
+		if c.body, err = compileBody(api.Scenario, cfg.Body); err != nil {
+			return nil, fmt.Errorf("call %d body: %w", i+1, err)
+		}
+		if sig := cfg.Signature; sig != nil && sig.Header == "" {
+			sig.Header = "X-Hub-Signature-256"
+			if sig.Scheme == "stripe" {
+				sig.Header = "Stripe-Signature"
+			}
+		}
+		timeout := 10 * time.Second
+		if cfg.Timeout > 0 {
+			timeout = time.Duration(cfg.Timeout) * time.Millisecond
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if cfg.Insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		c.client = &http.Client{Timeout: timeout, Transport: transport}
+		def.calls = append(def.calls, c)
+	}
+	return def, nil
+}
+
+// collectScenarios moves scenario entries, from any group, out of apis
+// into scenarios.
+func collectScenarios(apis []ApiFormat, scenarios scenarioSet) ([]ApiFormat, error) {
+	stubs := make([]ApiFormat, 0, len(apis))
+	for _, api := range apis {
+		if api.Scenario != "" {
+			if _, dup := scenarios[api.Scenario]; dup {
+				return nil, fmt.Errorf("scenario %q is defined twice", api.Scenario)
+			}
+			def, err := compileScenario(api)
+			if err != nil {
+				return nil, fmt.Errorf("scenario %s: %w", api.Scenario, err)
+			}
+			scenarios[api.Scenario] = def
+			continue
+		}
+		if api.Stubs != nil {
+			var err error
+			if api.Stubs, err = collectScenarios(api.Stubs, scenarios); err != nil {
+				return nil, err
+			}
+		}
+		stubs = append(stubs, api)
+	}
+	return stubs, nil
+}
+
+// send makes one call and returns its journal entry, and for the calls
+// after it the response as .Vars.previous: status, headers and the body,
+// decoded when it is JSON.
+func (c *compiledCall) send(data templateData) (journalEntry, map[string]interface{}) {
+	entry := journalEntry{RequestID: newRequestID(), Time: time.Now(), Method: c.method}
+	start := time.Now()
+	fail := func(err error) (journalEntry, map[string]interface{}) {
+		entry.Error = err.Error()
+		entry.Duration = milliseconds(time.Since(start))
+		return entry, nil
+	}
+	target, err := c.url.render(data)
+	if err != nil {
+		return fail(err)
+	}
+	entry.URL = target
+	headers, err := renderTemplates(c.headers, data)
+	if err != nil {
+		return fail(err)
+	}
+	body, contentType, err := c.body.render(data)
+	if err != nil {
+		return fail(err)
+	}
+	req, err := http.NewRequest(c.method, target, bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	entry.Path, entry.Query = req.URL.Path, req.URL.RawQuery
+	req.Header.Set(requestIDHeader, entry.RequestID)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	if c.cfg.Signature != nil {
+		req.Header.Set(c.cfg.Signature.Header, signPayload(c.cfg.Signature, body, clock.Now()))
+	}
+	entry.Headers = req.Header.Clone()
+	entry.Body = string(body[:min(len(body), journalBodyLimit)])
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fail(err)
+	}
+	entry.Status = resp.StatusCode
+	entry.Duration = milliseconds(time.Since(start))
+	entry.Response = &journalResponse{
+		Headers: resp.Header,
+		Body:    string(respBody[:min(len(respBody), journalBodyLimit)]),
+	}
+	var decoded interface{} = string(respBody)
+	if json.Valid(respBody) {
+		json.Unmarshal(respBody, &decoded)
+	}
+	return entry, map[string]interface{}{"status": resp.StatusCode, "headers": resp.Header, "body": decoded}
+}
+
+// run sends the scenario's calls in order, stopping at the first that gets
+// no response, and journals each.
+func (s *scenarioDef) run(name string, lr *liveRoutes, data templateData) []journalEntry {
+	workspace := lr.name
+	entries := []journalEntry{}
+	for _, call := range s.calls {
+		entry, previous := call.send(data)
+		entry.Workspace, entry.Scenario = workspace, name
+		lr.journal.add(entry)
+		entries = append(entries, entry)
+		if previous == nil {
+			slog.Error("Scenario call failed", "workspace", workspace, "scenario", name, "method", entry.Method, "url", entry.URL, "error", entry.Error)
+			break
+		}
+		slog.Info("Scenario call sent", "workspace", workspace, "scenario", name, "method", entry.Method, "url", entry.URL, "status", entry.Status)
+		data.Vars["previous"] = previous
+	}
+	return entries
+}
+
+// idleTemplateData is what templates see on runs no request triggered.
+func idleTemplateData() templateData {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	return newTemplateData(r, ApiFormat{})
+}
+
+// runScenarios starts scenarios when their interval elapses or a minute of
+// their schedule begins on the mock clock. A scenario still running when
+// it is due again is skipped that time.
+func (lr *liveRoutes) runScenarios() {
+	lastRun := map[string]time.Time{}
+	lastMinute := map[string]time.Time{}
+	var busy sync.Map
+	for range time.Tick(time.Second) {
+		lr.mu.Lock()
+		scenarios := lr.scenarios
+		lr.mu.Unlock()
+		now, minute := time.Now(), clock.Now().Truncate(time.Minute)
+		for name, s := range scenarios {
+			due := false
+			if s.every > 0 && now.Sub(lastRun[name]) >= s.every {
+				due = true
+				lastRun[name] = now
+			}
+			for _, expr := range s.cron {
+				if expr.matches(minute) && !lastMinute[name].Equal(minute) {
+					due = true
+					lastMinute[name] = minute
+				}
+			}
+			if !due {
+				continue
+			}
+			if _, running := busy.LoadOrStore(name, true); running {
+				slog.Debug("Scenario still running, skipped", "workspace", lr.name, "scenario", name)
+				continue
+			}
+			go func() {
+				defer busy.Delete(name)
+				s.run(name, lr, idleTemplateData())
+			}()
+		}
+	}
+}
+
+// withTrigger starts the scenarios a stub names in trigger once it has
+// answered, after each scenario's delay. Their templates get the stub's
+// request, with the response status as .Vars.status and the request body
+// as .Vars.body.
+func withTrigger(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(r)
+		r = shareUUID(r)
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		lr := routesFor(r)
+		lr.mu.Lock()
+		scenarios := lr.scenarios
+		lr.mu.Unlock()
+		for _, name := range api.Trigger {
+			s := scenarios[name]
+			if s == nil {
+				slog.Error("Unknown scenario triggered", "url", api.Url, "scenario", name)
+				continue
+			}
+			data := newTemplateData(r, api)
+			data.Vars["status"] = rec.status
+			data.Vars["body"] = string(body)
+			time.AfterFunc(s.delay, func() { s.run(name, lr, data) })
+		}
+	}
+}
+
+type scenarioInfo struct {
+	Name string `json:"name"`
+	// Every is the interval in milliseconds, 0 for none
+	Every    int64          `json:"every"`
+	Schedule []ScheduleRule `json:"schedule"`
+	Calls    []ScenarioCall `json:"calls"`
+}
+
+type scenariosReport struct {
+	Scenarios []scenarioInfo `json:"scenarios"`
+}
+
+func (lr *liveRoutes) scenariosReport() scenariosReport {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	report := scenariosReport{Scenarios: []scenarioInfo{}}
+	for _, name := range lr.scenarios.names() {
+		s := lr.scenarios[name]
+		info := scenarioInfo{Name: name, Every: s.every.Milliseconds(), Schedule: s.schedule, Calls: []ScenarioCall{}}
+		for _, c := range s.calls {
+			call := c.cfg
+			call.Method = c.method
+			info.Calls = append(info.Calls, call)
+		}
+		report.Scenarios = append(report.Scenarios, info)
+	}
+	return report
+}
+
+type scenarioRunReport struct {
+	Scenario string         `json:"scenario"`
+	Calls    []journalEntry `json:"calls"`
+}
+
+// serveRunScenario runs a scenario right away, without its delay, and
+// answers with the calls it made.
+func serveRunScenario(w http.ResponseWriter, r *http.Request) {
+	lr := routesFor(r)
+	name := r.PathValue("name")
+	lr.mu.Lock()
+	s := lr.scenarios[name]
+	lr.mu.Unlock()
+	if s == nil {
+		http.Error(w, fmt.Sprintf("no scenario %q", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, scenarioRunReport{Scenario: name, Calls: s.run(name, lr, idleTemplateData())})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleRule is a time window in cron syntax. On a stub it swaps in
+// Response while the window is open; on a profile entry it activates the
+// profile for the window.
+type ScheduleRule struct {
+	// Cron is "minute hour day-of-month month day-of-week", e.g.
+	// "10-14 * * * *" for minutes 10 to 14 of every hour
+	Cron     string          `json:"cron"`
+	Response *ResponseFormat `json:"response"`
+}
+
+// cronExpr holds the values each field matches as bits.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	// anyDay is set when either day field starts with "*"
+	anyDay bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronField reads a list of "*", "n", "a-b", each optionally "/step".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("bad value %q", from)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("bad value %q", to)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseCron(expr string) (cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return cronExpr{}, fmt.Errorf("cron %q needs 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range cronFields {
+		var err error
+		if bits[i], err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return cronExpr{}, fmt.Errorf("cron %q %s: %w", expr, f.name, err)
+		}
+	}
+	// 7 is Sunday as well as 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	anyDay := strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+	return cronExpr{bits[0], bits[1], bits[2], bits[3], bits[4], anyDay}, nil
+}
+
+// matches reports whether t falls in a minute the expression selects. All
+// fields must match, except that as in Vixie cron either day field will
+// do when both are restricted, so "0 0 1 * 1" is the 1st and every Monday.
+func (c cronExpr) matches(t time.Time) bool {
+	day := c.dom&(1<<t.Day()) != 0
+	weekday := c.dow&(1<<int(t.Weekday())) != 0
+	days := day || weekday
+	if c.anyDay {
+		days = day && weekday
+	}
+	return c.minute&(1<<t.Minute()) != 0 &&
+		c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 &&
+		days
+}
+
+// compileSchedule parses the windows of rules.
+func compileSchedule(rules []ScheduleRule) ([]cronExpr, error) {
+	exprs := make([]cronExpr, len(rules))
+	for i, rule := range rules {
+		var err error
+		if exprs[i], err = parseCron(rule.Cron); err != nil {
+			return nil, err
+		}
+	}
+	return exprs, nil
+}
+
+// newScheduleHandler serves the response of the first rule whose window
+// the mock clock is in, and the stub's own response outside all of them.
+func newScheduleHandler(api ApiFormat) http.HandlerFunc {
+	exprs, err := compileSchedule(api.Schedule)
+	if err != nil {
+		check(fmt.Errorf("schedule of %s %s: %w", api.Method, api.Url, err))
+	}
+	handlers := make([]http.HandlerFunc, len(api.Schedule))
+	for i, rule := range api.Schedule {
+		if rule.Response == nil {
+			check(fmt.Errorf("schedule rule %d of %s %s has no response", i+1, api.Method, api.Url))
+		}
+		scheduled := api
+		scheduled.Schedule = nil
+		scheduled.Response = *rule.Response
+		handlers[i] = newResponder(scheduled)
+	}
+	plain := api
+	plain.Schedule = nil
+	fallback := newResponder(plain)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := clock.Now()
+		for i, expr := range exprs {
+			if expr.matches(now) {
+				slog.Debug("Scheduled response", "method", api.Method, "url", api.Url, "cron", api.Schedule[i].Cron)
+				handlers[i](w, r)
+				return
+			}
+		}
+		fallback(w, r)
+	}
+}
+
+// scheduledProfile returns the first profile, by name, whose schedule
+// includes t, "" if none does.
+func (ps profileSet) scheduledProfile(t time.Time) string {
+	for _, name := range ps.names() {
+		for _, expr := range ps[name].schedule {
+			if expr.matches(t) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// followSchedule switches to scheduled profiles as their windows open and
+// back to the profile active before once they close. It acts only when the
+// scheduled profile changes, so a profile picked through the admin API
+// stays until the next window opens or closes.
+func (lr *liveRoutes) followSchedule() {
+	scheduled, resume := "", ""
+	for range time.Tick(time.Second) {
+		lr.mu.Lock()
+		profiles, active := lr.profiles, lr.profile
+		lr.mu.Unlock()
+		want := profiles.scheduledProfile(clock.Now())
+		if want == scheduled {
+			continue
+		}
+		if scheduled == "" {
+			resume = active
+		}
+		scheduled = want
+		target := want
+		if want == "" {
+			target = resume
+		}
+		if _, err := lr.switchProfile(target); err != nil {
+			slog.Error("Scheduled profile switch failed", "workspace", lr.name, "profile", target, "error", err)
+			continue
+		}
+		slog.Info("Profile switched by schedule", "workspace", lr.name, "profile", target)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronDayFields(t *testing.T) {
+	// 2024-07-01 is a Monday
+	monday1st := time.Date(2024, 7, 1, 0, 0, 0, 0, time.Local)
+	monday8th := time.Date(2024, 7, 8, 0, 0, 0, 0, time.Local)
+	tuesday2nd := time.Date(2024, 7, 2, 0, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		cron string
+		t    time.Time
+		want bool
+	}{
+		// both restricted: either day field will do
+		{"0 0 1 * 1", monday8th, true},
+		{"0 0 1 * 1", monday1st, true},
+		{"0 0 1 * 1", tuesday2nd, false},
+		{"0 0 2 * 1", tuesday2nd, true},
+		// a "*" day field leaves the other to decide
+		{"0 0 * * 1", tuesday2nd, false},
+		{"0 0 2 * *", tuesday2nd, true},
+		{"0 0 */2 * 1", monday8th, false},
+		{"0 0 */2 * 1", tuesday2nd, false},
+		{"0 0 1 * */2", monday1st, false},
+	} {
+		expr, err := parseCron(tt.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expr.matches(tt.t); got != tt.want {
+			t.Errorf("%q on %s: got %v, want %v", tt.cron, tt.t.Format("Mon Jan 2"), got, tt.want)
+		}
+	}
+}
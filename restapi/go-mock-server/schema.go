@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SchemaFormat configures a "schema" response, whose body is generated
+// from a JSON Schema with plausible values for each request.
+type SchemaFormat struct {
+	// Definition is the schema inline; File reads it from a file instead
+	Definition map[string]interface{} `json:"definition"`
+	File       string                 `json:"file"`
+	// Seed makes every response the same; 0 generates new values each time
+	Seed uint64 `json:"seed"`
+}
+
+// fakeWords back generated strings whose property name hints at their
+// meaning, e.g. "email" or "city".
+var fakeWords = map[string][]string{
+	"firstName": {"Ada", "Alan", "Grace", "Linus", "Margaret", "Ken", "Barbara", "Dennis"},
+	"lastName":  {"Lovelace", "Turing", "Hopper", "Torvalds", "Hamilton", "Thompson", "Liskov", "Ritchie"},
+	"city":      {"Lisbon", "Osaka", "Toronto", "Nairobi", "Berlin", "Austin", "Chennai", "Oslo"},
+	"country":   {"Portugal", "Japan", "Canada", "Kenya", "Germany", "United States", "India", "Norway"},
+	"company":   {"Acme", "Globex", "Initech", "Umbrella", "Hooli", "Stark Industries"},
+	"street":    {"Main Street", "High Street", "Park Avenue", "Elm Street", "Station Road"},
+	"word":      {"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel"},
+}
+
+type fakeGenerator struct {
+	rnd  *rand.Rand
+	root map[string]interface{}
+}
+
+func (g *fakeGenerator) pick(words []string) string {
+	return words[g.rnd.IntN(len(words))]
+}
+
+func (g *fakeGenerator) hex(n int) string {
+	const digits = "0123456789abcdef"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = digits[g.rnd.IntN(16)]
+	}
+	return string(b)
+}
+
+func number(schema map[string]interface{}, key string, fallback float64) float64 {
+	if v, ok := schema[key].(float64); ok {
+		return v
+	}
+	return fallback
+}
+
+// numberBounds reads the range of a number schema. exclusiveMinimum and
+// exclusiveMaximum are either bounds of their own, as in later drafts, or
+// booleans making minimum and maximum exclusive, as in draft 4 and OpenAPI
+// 3.0. Without a minimum the range starts at 0, or 1000 below a negative
+// maximum, and spans 1000 without a maximum.
+func numberBounds(schema map[string]interface{}) (min, max float64, minExclusive, maxExclusive bool) {
+	min, hasMin := schema["minimum"].(float64)
+	max, hasMax := schema["maximum"].(float64)
+	if v, ok := schema["exclusiveMinimum"].(float64); ok && (!hasMin || v >= min) {
+		min, hasMin, minExclusive = v, true, true
+	} else if exclusive, _ := schema["exclusiveMinimum"].(bool); exclusive && hasMin {
+		minExclusive = true
+	}
+	if v, ok := schema["exclusiveMaximum"].(float64); ok && (!hasMax || v <= max) {
+		max, hasMax, maxExclusive = v, true, true
+	} else if exclusive, _ := schema["exclusiveMaximum"].(bool); exclusive && hasMax {
+		maxExclusive = true
+	}
+	if !hasMin {
+		min = 0
+		if hasMax && max <= 0 {
+			min = max - 1000
+		}
+	}
+	if !hasMax {
+		max = min + 1000
+	}
+	return min, max, minExclusive, maxExclusive
+}
+
+// resolve follows a local "#/..." $ref.
+func (g *fakeGenerator) resolve(schema map[string]interface{}) (map[string]interface{}, error) {
+	for depth := 0; depth < 32; depth++ {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema, nil
+		}
+		if !strings.HasPrefix(ref, "#/") {
+			return nil, fmt.Errorf("only local $refs are supported, got %q", ref)
+		}
+		target, ok := jsonField(g.root, strings.ReplaceAll(ref[2:], "/", "."))
+		if schema, ok = target.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("$ref %q not found", ref)
+		}
+	}
+	return nil, fmt.Errorf("$ref chain too deep")
+}
+
+func (g *fakeGenerator) generate(schema map[string]interface{}, name string, depth int) (interface{}, error) {
+	schema, err := g.resolve(schema)
+	if err != nil {
+		return nil, err
+	}
+	if depth > 16 {
+		return nil, nil
+	}
+	if v, ok := schema["const"]; ok {
+		return v, nil
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		return enum[g.rnd.IntN(len(enum))], nil
+	}
+	if examples, ok := schema["examples"].([]interface{}); ok && len(examples) > 0 {
+		return examples[g.rnd.IntN(len(examples))], nil
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if options, ok := schema[key].([]interface{}); ok && len(options) > 0 {
+			if option, ok := options[g.rnd.IntN(len(options))].(map[string]interface{}); ok {
+				return g.generate(option, name, depth+1)
+			}
+		}
+	}
+
+	typ, _ := schema["type"].(string)
+	if types, ok := schema["type"].([]interface{}); ok && len(types) > 0 {
+		typ, _ = types[0].(string)
+	}
+	if typ == "" {
+		if _, ok := schema["properties"]; ok {
+			typ = "object"
+		} else if _, ok := schema["items"]; ok {
+			typ = "array"
+		}
+	}
+	switch typ {
+	case "object":
+		obj := map[string]interface{}{}
+		props, _ := schema["properties"].(map[string]interface{})
+		// sorted so a seed gives the same values every time
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propSchema, ok := props[key].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if obj[key], err = g.generate(propSchema, key, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		minItems := int(number(schema, "minItems", 1))
+		maxItems := int(number(schema, "maxItems", float64(minItems+2)))
+		n := minItems
+		if maxItems > minItems {
+			n += g.rnd.IntN(maxItems - minItems + 1)
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = g.generate(items, name, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case "integer", "number":
+		min, max, minExclusive, maxExclusive := numberBounds(schema)
+		if typ == "integer" {
+			lo, hi := math.Ceil(min), math.Floor(max)
+			if minExclusive && lo == min {
+				lo++
+			}
+			if maxExclusive && hi == max {
+				hi--
+			}
+			if hi < lo {
+				return nil, fmt.Errorf("no integer within the bounds of %q", name)
+			}
+			return int64(lo) + g.rnd.Int64N(int64(hi-lo)+1), nil
+		}
+		// values in cents, like prices, unless the range is narrower
+		lo, hi := math.Ceil(min*100), math.Floor(max*100)
+		if minExclusive && lo == min*100 {
+			lo++
+		}
+		if maxExclusive && hi == max*100 {
+			hi--
+		}
+		if hi < lo {
+			if min < max || min == max && !minExclusive && !maxExclusive {
+				return (min + max) / 2, nil
+			}
+			return nil, fmt.Errorf("no number within the bounds of %q", name)
+		}
+		return math.Min(lo+math.Floor(g.rnd.Float64()*(hi-lo+1)), hi) / 100, nil
+	case "boolean":
+		return g.rnd.IntN(2) == 1, nil
+	case "null":
+		return nil, nil
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		return g.fakePattern(schema, pattern)
+	}
+	return g.fakeString(schema, name), nil
+}
+
+// fakePattern generates a string matching the regular expression, within
+// minLength and maxLength when one of a few tries is.
+func (g *fakeGenerator) fakePattern(schema map[string]interface{}, pattern string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("pattern %q: %w", pattern, err)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", fmt.Errorf("pattern %q: %w", pattern, err)
+	}
+	parsed = parsed.Simplify()
+	minLength := int(number(schema, "minLength", 0))
+	maxLength := int(number(schema, "maxLength", 0))
+	match := ""
+	for try := 0; try < 20; try++ {
+		var b strings.Builder
+		g.regexpString(&b, parsed)
+		value := b.String()
+		if !re.MatchString(value) {
+			continue
+		}
+		match = value
+		if n := utf8.RuneCountInString(value); n >= minLength && (maxLength == 0 || n <= maxLength) {
+			return value, nil
+		}
+	}
+	if match == "" {
+		return "", fmt.Errorf("can't generate a string matching pattern %q", pattern)
+	}
+	return match, nil
+}
+
+// regexpString writes a random string re matches, repeating unbounded
+// parts up to three times. Anchors and word boundaries aren't written.
+func (g *fakeGenerator) regexpString(b *strings.Builder, re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		b.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		b.WriteRune(g.classRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteByte(byte('a' + g.rnd.IntN(26)))
+	case syntax.OpCapture:
+		g.regexpString(b, re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			g.regexpString(b, sub)
+		}
+	case syntax.OpAlternate:
+		g.regexpString(b, re.Sub[g.rnd.IntN(len(re.Sub))])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		min, max := re.Min, re.Max
+		switch re.Op {
+		case syntax.OpStar:
+			min, max = 0, 3
+		case syntax.OpPlus:
+			min, max = 1, 3
+		case syntax.OpQuest:
+			min, max = 0, 1
+		}
+		if max < 0 {
+			max = min + 3
+		}
+		for n := min + g.rnd.IntN(max-min+1); n > 0; n-- {
+			g.regexpString(b, re.Sub[0])
+		}
+	}
+}
+
+// classRune picks a rune of a character class, given as pairs of ranges,
+// printable ASCII when the class has some.
+func (g *fakeGenerator) classRune(ranges []rune) rune {
+	var printable []rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for r := max(ranges[i], ' '); r <= min(ranges[i+1], '~'); r++ {
+			printable = append(printable, r)
+		}
+	}
+	if len(printable) > 0 {
+		return printable[g.rnd.IntN(len(printable))]
+	}
+	if len(ranges) < 2 {
+		return utf8.RuneError
+	}
+	i := 2 * g.rnd.IntN(len(ranges)/2)
+	return ranges[i] + rune(g.rnd.IntN(int(ranges[i+1]-ranges[i])+1))
+}
+
+func (g *fakeGenerator) fakeString(schema map[string]interface{}, name string) string {
+	format, _ := schema["format"].(string)
+	switch format {
+	case "email":
+		return strings.ToLower(g.pick(fakeWords["firstName"])+"."+g.pick(fakeWords["lastName"])) + "@example.com"
+	case "uuid":
+		h := g.hex(32)
+		return h[:8] + "-" + h[8:12] + "-4" + h[13:16] + "-a" + h[17:20] + "-" + h[20:]
+	case "date-time":
+		return clock.Now().Add(-time.Duration(g.rnd.Int64N(int64(365 * 24 * time.Hour)))).UTC().Format(time.RFC3339)
+	case "date":
+		return clock.Now().AddDate(0, 0, -g.rnd.IntN(365)).Format(time.DateOnly)
+	case "time":
+		return time.Unix(g.rnd.Int64N(86400), 0).UTC().Format(time.TimeOnly)
+	case "uri", "url":
+		return "https://example.com/" + g.pick(fakeWords["word"])
+	case "hostname":
+		return g.pick(fakeWords["word"]) + ".example.com"
+	case "ipv4":
+		return fmt.Sprintf("10.%d.%d.%d", g.rnd.IntN(256), g.rnd.IntN(256), g.rnd.IntN(256))
+	case "ipv6":
+		return "fd00::" + g.hex(4)
+	}
+
+	lower := strings.ToLower(name)
+	value := ""
+	switch {
+	case strings.Contains(lower, "email"):
+		value = g.fakeString(map[string]interface{}{"format": "email"}, "")
+	case lower == "firstname" || lower == "first_name":
+		value = g.pick(fakeWords["firstName"])
+	case lower == "lastname" || lower == "last_name" || lower == "surname":
+		value = g.pick(fakeWords["lastName"])
+	case strings.Contains(lower, "name") && !strings.Contains(lower, "user"):
+		value = g.pick(fakeWords["firstName"]) + " " + g.pick(fakeWords["lastName"])
+	case strings.Contains(lower, "city"):
+		value = g.pick(fakeWords["city"])
+	case strings.Contains(lower, "country"):
+		value = g.pick(fakeWords["country"])
+	case strings.Contains(lower, "company"):
+		value = g.pick(fakeWords["company"])
+	case strings.Contains(lower, "street") || strings.Contains(lower, "address"):
+		value = fmt.Sprintf("%d %s", 1+g.rnd.IntN(999), g.pick(fakeWords["street"]))
+	case strings.Contains(lower, "phone"):
+		value = fmt.Sprintf("+1-555-%03d-%04d", g.rnd.IntN(1000), g.rnd.IntN(10000))
+	case lower == "id" || strings.HasSuffix(lower, "id"):
+		value = g.hex(12)
+	default:
+		value = g.pick(fakeWords["word"]) + "-" + g.hex(4)
+	}
+
+	minLength := int(number(schema, "minLength", 0))
+	maxLength := int(number(schema, "maxLength", 0))
+	for len(value) < minLength {
+		value += g.pick(fakeWords["word"])
+	}
+	if maxLength > 0 && len(value) > maxLength {
+		value = value[:maxLength]
+	}
+	return value
+}
+
+func newSchemaHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Schema
+	if cfg == nil {
+		check(fmt.Errorf("schema response for %s %s has no schema block", api.Method, api.Url))
+	}
+	definition := cfg.Definition
+	if cfg.File != "" {
+		file, err := os.ReadFile(cfg.File)
+		check(err)
+		if err := json.Unmarshal(file, &definition); err != nil {
+			check(fmt.Errorf("parse %s%s: %w", cfg.File, jsonErrorPosition(file, err), err))
+		}
+	}
+	if definition == nil {
+		check(fmt.Errorf("schema response for %s %s has no definition or file", api.Method, api.Url))
+	}
+	headers := compileHeaders(api.Response.Headers)
+	status := api.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// checked once so a broken schema fails at load like other config
+	_, err := (&fakeGenerator{rnd: rand.New(rand.NewPCG(1, 1)), root: definition}).generate(definition, "", 0)
+	check(err)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		seed := cfg.Seed
+		if seed == 0 {
+			seed = random.Uint64()
+		}
+		g := &fakeGenerator{rnd: rand.New(rand.NewPCG(seed, seed)), root: definition}
+		body, err := g.generate(definition, "", 0)
+		if err != nil {
+			slog.Error("Failed to generate response body", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !headers.apply(w, r, api) {
+			return
+		}
+		w.WriteHeader(status)
+		slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"testing"
+	"unicode/utf8"
+)
+
+// validate checks value against the keywords of schema the generator
+// honours, returning what it breaks.
+func validate(schema map[string]interface{}, value interface{}) error {
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v isn't an object", value)
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for key, prop := range props {
+			if err := validate(prop.(map[string]interface{}), obj[key]); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v isn't an array", value)
+		}
+		for i, item := range list {
+			if err := validate(schema["items"].(map[string]interface{}), item); err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+		}
+	case "integer", "number":
+		var v float64
+		switch n := value.(type) {
+		case int64:
+			v = float64(n)
+		case float64:
+			if schema["type"] == "integer" {
+				return fmt.Errorf("%v isn't an integer", value)
+			}
+			v = n
+		default:
+			return fmt.Errorf("%v isn't a number", value)
+		}
+		exclusiveMin, _ := schema["exclusiveMinimum"].(bool)
+		exclusiveMax, _ := schema["exclusiveMaximum"].(bool)
+		if min, ok := schema["minimum"].(float64); ok && (v < min || exclusiveMin && v == min) {
+			return fmt.Errorf("%v below the minimum %v", v, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && (v > max || exclusiveMax && v == max) {
+			return fmt.Errorf("%v above the maximum %v", v, max)
+		}
+		if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+			return fmt.Errorf("%v not above the exclusive minimum %v", v, min)
+		}
+		if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+			return fmt.Errorf("%v not below the exclusive maximum %v", v, max)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v isn't a string", value)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			return fmt.Errorf("%q doesn't match %s", s, pattern)
+		}
+		n := utf8.RuneCountInString(s)
+		if min, ok := schema["minLength"].(float64); ok && n < int(min) {
+			return fmt.Errorf("%q shorter than %v", s, min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && n > int(max) {
+			return fmt.Errorf("%q longer than %v", s, max)
+		}
+	}
+	return nil
+}
+
+func TestSchemaSamplesValidate(t *testing.T) {
+	schema := decodeJSON(t, `{"type": "object", "properties": {
+		"rating": {"type": "number", "minimum": 0, "exclusiveMaximum": 5},
+		"discount": {"type": "number", "exclusiveMinimum": 0, "maximum": 0.05},
+		"ratio": {"type": "number", "exclusiveMinimum": 0.001, "exclusiveMaximum": 0.002},
+		"score": {"type": "number", "minimum": 1, "maximum": 2, "exclusiveMinimum": true, "exclusiveMaximum": true},
+		"count": {"type": "integer", "exclusiveMinimum": 0, "exclusiveMaximum": 3},
+		"level": {"type": "integer", "minimum": 1, "exclusiveMaximum": 10.5},
+		"legacy": {"type": "integer", "minimum": 1, "maximum": 3, "exclusiveMinimum": true, "exclusiveMaximum": true},
+		"offset": {"type": "integer", "exclusiveMaximum": -5},
+		"sku": {"type": "string", "pattern": "^[A-Z]{3}-\\d{4}$"},
+		"code": {"type": "string", "pattern": "^(red|green|blue)(-[a-f0-9]+)?$", "maxLength": 8},
+		"slug": {"type": "string", "pattern": "[a-z]+(_[a-z]+)*", "minLength": 5},
+		"initials": {"type": "string", "pattern": "(?i)^[a-z]\\.[^\\s.]\\.$"},
+		"tags": {"type": "array", "items": {"type": "string", "pattern": "^#\\w{2,5}$"}, "maxItems": 4}
+	}}`).(map[string]interface{})
+	for seed := uint64(1); seed <= 500; seed++ {
+		g := &fakeGenerator{rnd: rand.New(rand.NewPCG(seed, seed)), root: schema}
+		value, err := g.generate(schema, "", 0)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if err := validate(schema, value); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestSchemaBoundsErrors(t *testing.T) {
+	for _, tt := range []string{
+		`{"type": "integer", "exclusiveMinimum": 1, "exclusiveMaximum": 2}`,
+		`{"type": "number", "exclusiveMinimum": 1, "maximum": 1}`,
+		`{"type": "string", "pattern": "(unclosed"}`,
+		`{"type": "string", "pattern": "^a\\bb$"}`,
+	} {
+		schema := decodeJSON(t, tt).(map[string]interface{})
+		g := &fakeGenerator{rnd: rand.New(rand.NewPCG(1, 1)), root: schema}
+		if value, err := g.generate(schema, "", 0); err == nil {
+			t.Errorf("%s generated %v, want an error", tt, value)
+		}
+	}
+	// narrower than the cents numbers are generated in
+	schema := decodeJSON(t, `{"type": "number", "exclusiveMinimum": 0.001, "exclusiveMaximum": 0.002}`).(map[string]interface{})
+	if v, _ := (&fakeGenerator{rnd: rand.New(rand.NewPCG(1, 1))}).generate(schema, "", 0); math.Abs(v.(float64)-0.0015) > 1e-12 {
+		t.Errorf("got %v, want the middle of the range", v)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// SessionFormat updates the caller's session before the response is built.
+// Values are templates, so {"user": "{{.Query.name}}"} stores a query param.
+type SessionFormat struct {
+	Set    map[string]string `json:"set"`
+	Append map[string]string `json:"append"`
+	Delete []string          `json:"delete"`
+	// Clear ends the session and expires its cookie
+	Clear bool `json:"clear"`
+}
+
+// sessionStore keeps per-client state keyed by the session cookie, so
+// concurrent users of the mock don't see each other's values.
+type sessionStore struct {
+	mu       sync.Mutex
+	cookie   string
+	sessions map[string]map[string]interface{}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// id returns the session id sent by the client, or "" if it has none.
+func (s *sessionStore) id(r *http.Request) string {
+	c, err := r.Cookie(s.cookie)
+	if err != nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[c.Value]; !ok {
+		return ""
+	}
+	return c.Value
+}
+
+// values returns a copy of the request's session values.
+func (s *sessionStore) values(r *http.Request) map[string]interface{} {
+	values := map[string]interface{}{}
+	c, err := r.Cookie(s.cookie)
+	if err != nil {
+		return values
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, val := range s.sessions[c.Value] {
+		values[key] = val
+	}
+	return values
+}
+
+// start returns the request's session id, creating a session and setting
+// its cookie on w when the client doesn't have one yet.
+func (s *sessionStore) start(w http.ResponseWriter, r *http.Request) string {
+	if id := s.id(r); id != "" {
+		return id
+	}
+	id := newSessionID()
+	s.mu.Lock()
+	s.sessions[id] = map[string]interface{}{}
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: id, Path: "/", HttpOnly: true})
+	// later handlers in this request must see the new session, not a
+	// stale cookie the client sent
+	replaceCookie(r, &http.Cookie{Name: s.cookie, Value: id})
+	slog.Debug("Session started", "session", id)
+	return id
+}
+
+// replaceCookie sets c on r in place of any cookies with its name.
+func replaceCookie(r *http.Request, c *http.Cookie) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, other := range cookies {
+		if other.Name != c.Name {
+			r.AddCookie(other)
+		}
+	}
+	r.AddCookie(c)
+}
+
+func (s *sessionStore) update(id string, fn func(values map[string]interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if values, ok := s.sessions[id]; ok {
+		fn(values)
+	}
+}
+
+func (s *sessionStore) end(w http.ResponseWriter, r *http.Request) {
+	id := s.id(r)
+	if id == "" {
+		return
+	}
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: "", Path: "/", MaxAge: -1})
+	slog.Debug("Session ended", "session", id)
+}
+
+// snapshot copies every session, see takeSnapshot.
+func (s *sessionStore) snapshot() map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(map[string]map[string]interface{}, len(s.sessions))
+	for id, values := range s.sessions {
+		copied[id] = map[string]interface{}{}
+		for key, val := range values {
+			copied[id][key] = val
+		}
+	}
+	return copied
+}
+
+func (s *sessionStore) restore(saved map[string]map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]map[string]interface{}{}
+	for id, values := range saved {
+		if values == nil {
+			values = map[string]interface{}{}
+		}
+		s.sessions[id] = values
+	}
+}
+
+func withSession(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	cfg := api.Session
+	set, err := compileTemplates(api.Url, cfg.Set)
+	check(err)
+	appends, err := compileTemplates(api.Url, cfg.Append)
+	check(err)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions := routesFor(r).sessions
+		if cfg.Clear {
+			sessions.end(w, r)
+			next(w, r)
+			return
+		}
+
+		id := sessions.start(w, r)
+		data := newTemplateData(r, api)
+		rendered, err := renderTemplates(set, data)
+		var appended map[string]string
+		if err == nil {
+			appended, err = renderTemplates(appends, data)
+		}
+		if err != nil {
+			slog.Error("Failed to render session value", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sessions.update(id, func(values map[string]interface{}) {
+			for key, val := range rendered {
+				values[key] = val
+			}
+			for key, val := range appended {
+				list, _ := values[key].([]interface{})
+				values[key] = append(append([]interface{}{}, list...), val)
+			}
+			for _, key := range cfg.Delete {
+				delete(values, key)
+			}
+		})
+		next(w, r)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSessionStartedOverStaleCookie(t *testing.T) {
+	_, server := newTestRoutes(t, `[{"url": "/login", "method": "GET",
+		"session": {"set": {"user": "{{.Query.name}}"}},
+		"response": {"status": 200, "body": {"user": "{{.Session.user}}"}}}]`)
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/login?name=ada", nil)
+	req.Header.Set("Cookie", "theme=dark; mock_session=expired")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"user":"ada"`) {
+		t.Fatalf("got %s, want the value stored in the new session", body)
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "mock_session" || cookies[0].Value == "expired" {
+		t.Fatalf("got cookies %v, want a new mock_session", cookies)
+	}
+}
+
+func TestReplaceCookie(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Cookie", "a=1; mock_session=old; b=2")
+	r.Header.Add("Cookie", "mock_session=older")
+	replaceCookie(r, &http.Cookie{Name: "mock_session", Value: "new"})
+	if got := r.Header.Get("Cookie"); got != "a=1; b=2; mock_session=new" {
+		t.Fatalf("got Cookie %q", got)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capturedEmail is a message accepted by the SMTP listener.
+type capturedEmail struct {
+	ID      string              `json:"id"`
+	Time    time.Time           `json:"time"`
+	From    string              `json:"from"`
+	To      []string            `json:"to"`
+	Subject string              `json:"subject"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	// Raw is the message as received, only in GET /__admin/emails/{id}
+	Raw string `json:"raw,omitempty"`
+}
+
+// mailboxLog keeps the most recent emails for the admin API.
+type mailboxLog struct {
+	mu     sync.Mutex
+	emails []*capturedEmail
+}
+
+const maxEmails = 1000
+
+var mailbox = &mailboxLog{}
+
+func (l *mailboxLog) add(email *capturedEmail) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.emails) == maxEmails {
+		l.emails = l.emails[1:]
+	}
+	l.emails = append(l.emails, email)
+}
+
+type emailsReport struct {
+	Total  int             `json:"total"`
+	Emails []capturedEmail `json:"emails"`
+}
+
+// report lists the emails sent to the recipient, all for "", without
+// their raw text.
+func (l *mailboxLog) report(to string) emailsReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	report := emailsReport{Emails: []capturedEmail{}}
+	for _, email := range l.emails {
+		if to != "" && !containsFold(email.To, to) {
+			continue
+		}
+		e := *email
+		e.Raw = ""
+		report.Emails = append(report.Emails, e)
+	}
+	report.Total = len(report.Emails)
+	return report
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *mailboxLog) get(id string) (capturedEmail, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, email := range l.emails {
+		if email.ID == id {
+			return *email, true
+		}
+	}
+	return capturedEmail{}, false
+}
+
+func (l *mailboxLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.emails = nil
+}
+
+// parseEmail fills in the parts of a captured email read from raw.
+func parseEmail(email *capturedEmail, raw []byte) {
+	email.Raw = string(raw)
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		email.Body = email.Raw
+		return
+	}
+	email.Headers = msg.Header
+	subject := msg.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	email.Subject = subject
+	body, _ := io.ReadAll(msg.Body)
+	email.Body = string(body)
+}
+
+// smtpServer accepts mail for any sender and recipient and keeps it in the
+// mailbox instead of delivering it. Any AUTH credentials are accepted.
+type smtpServer struct {
+	hostname string
+	// maxSize is the largest message in bytes, advertised as SIZE
+	maxSize int64
+}
+
+// maxEmailSize bounds the messages the capture listener keeps in memory.
+const maxEmailSize = 25 << 20
+
+func serveSMTP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("Starting SMTP capture", "address", ln.Addr().String())
+	srv := &smtpServer{hostname: "mock-server", maxSize: maxEmailSize}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				slog.Error("SMTP accept failed", "error", err)
+				return
+			}
+			go srv.session(conn)
+		}
+	}()
+	return nil
+}
+
+func (srv *smtpServer) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return tp.PrintfLine(format, args...) == nil
+	}
+	if !reply("220 %s ESMTP mock-server capture", srv.hostname) {
+		return
+	}
+	var from string
+	var to []string
+	inMail := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		ok := true
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ok = reply("250 %s", srv.hostname)
+		case "EHLO":
+			ok = reply("250-%s", srv.hostname) && reply("250-8BITMIME") && reply("250-SMTPUTF8") &&
+				reply("250-SIZE %d", srv.maxSize) && reply("250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			ok = srv.auth(tp, arg, reply)
+		case "MAIL":
+			addr, found := smtpAddress(arg, "FROM:")
+			if !found {
+				ok = reply("501 syntax: MAIL FROM:<address>")
+				break
+			}
+			if size, declared := smtpSize(arg); declared && size > srv.maxSize {
+				ok = reply("552 message size exceeds the %d byte limit", srv.maxSize)
+				break
+			}
+			from, to, inMail = addr, nil, true
+			ok = reply("250 OK")
+		case "RCPT":
+			addr, found := smtpAddress(arg, "TO:")
+			switch {
+			case !inMail:
+				ok = reply("503 MAIL first")
+			case !found:
+				ok = reply("501 syntax: RCPT TO:<address>")
+			default:
+				to = append(to, addr)
+				ok = reply("250 OK")
+			}
+		case "DATA":
+			if len(to) == 0 {
+				ok = reply("503 RCPT first")
+				break
+			}
+			if !reply("354 end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			dot := tp.DotReader()
+			raw, err := io.ReadAll(io.LimitReader(dot, srv.maxSize+1))
+			if err != nil {
+				return
+			}
+			if int64(len(raw)) > srv.maxSize {
+				// the rest is read and dropped to stay in step with the client
+				if _, err := io.Copy(io.Discard, dot); err != nil {
+					return
+				}
+				from, to, inMail = "", nil, false
+				ok = reply("552 message size exceeds the %d byte limit", srv.maxSize)
+				break
+			}
+			email := &capturedEmail{ID: randomUUID(), Time: clock.Now(), From: from, To: to}
+			parseEmail(email, raw)
+			mailbox.add(email)
+			slog.Info("Email captured", "id", email.ID, "from", from, "to", to, "subject", email.Subject)
+			from, to, inMail = "", nil, false
+			ok = reply("250 OK queued as %s", email.ID)
+		case "RSET":
+			from, to, inMail = "", nil, false
+			ok = reply("250 OK")
+		case "NOOP":
+			ok = reply("250 OK")
+		case "VRFY":
+			ok = reply("252 cannot verify, will accept")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			ok = reply("502 command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// auth accepts PLAIN and LOGIN with whatever credentials are sent.
+func (srv *smtpServer) auth(tp *textproto.Conn, arg string, reply func(string, ...interface{}) bool) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var user string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			if !reply("334 ") {
+				return false
+			}
+			var err error
+			if initial, err = tp.ReadLine(); err != nil {
+				return false
+			}
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		if fields := strings.Split(string(decoded), "\x00"); len(fields) == 3 {
+			user = fields[1]
+		}
+	case "LOGIN":
+		if !reply("334 VXNlcm5hbWU6") {
+			return false
+		}
+		line, err := tp.ReadLine()
+		if err != nil {
+			return false
+		}
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		user = string(decoded)
+		if !reply("334 UGFzc3dvcmQ6") {
+			return false
+		}
+		if _, err := tp.ReadLine(); err != nil {
+			return false
+		}
+	default:
+		return reply("504 unrecognized authentication type")
+	}
+	slog.Debug("SMTP client authenticated", "user", user)
+	return reply("235 authentication successful")
+}
+
+// smtpAddress extracts the address of a MAIL or RCPT argument such as
+// "FROM:<a@example.com> SIZE=100".
+func smtpAddress(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if start := strings.Index(rest, "<"); start >= 0 {
+		if end := strings.Index(rest[start:], ">"); end >= 0 {
+			return rest[start+1 : start+end], true
+		}
+		return "", false
+	}
+	addr, _, _ := strings.Cut(rest, " ")
+	return addr, addr != ""
+}
+
+// smtpSize returns the SIZE parameter of a MAIL command, the message size
+// the client declares.
+func smtpSize(arg string) (int64, bool) {
+	for _, param := range strings.Fields(arg) {
+		if len(param) > 5 && strings.EqualFold(param[:5], "SIZE=") {
+			size, err := strconv.ParseInt(param[5:], 10, 64)
+			return size, err == nil
+		}
+	}
+	return 0, false
+}
+
+func serveEmail(w http.ResponseWriter, r *http.Request) {
+	email, ok := mailbox.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("no email %q", r.PathValue("id")), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, email)
+}
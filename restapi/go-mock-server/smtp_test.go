@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dialSMTP starts a capture session and returns a client connected to it.
+func dialSMTP(t *testing.T) *smtp.Client {
+	t.Helper()
+	client, server := net.Pipe()
+	go (&smtpServer{hostname: "mock-server", maxSize: maxEmailSize}).session(server)
+	c, err := smtp.NewClient(client, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSMTPCapture(t *testing.T) {
+	mailbox.reset()
+	defer mailbox.reset()
+	c := dialSMTP(t)
+	if ok, mechanisms := c.Extension("AUTH"); !ok || mechanisms != "PLAIN LOGIN" {
+		t.Errorf("AUTH advertised as %v %q", ok, mechanisms)
+	}
+	if err := c.Auth(smtp.PlainAuth("", "ada", "secret", "localhost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"bob@example.com", "eve@example.com"} {
+		if err := c.Rcpt(to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client escapes the line starting with a dot
+	w.Write([]byte("Subject: =?UTF-8?Q?Order_=E2=84=967?=\r\nX-Order: 7\r\n\r\nShipped.\r\n.hidden\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := mailbox.report("BOB@example.com")
+	if report.Total != 1 {
+		t.Fatalf("%d emails for bob", report.Total)
+	}
+	email := report.Emails[0]
+	if email.From != "ada@example.com" || !reflect.DeepEqual(email.To, []string{"bob@example.com", "eve@example.com"}) {
+		t.Errorf("from %q to %v", email.From, email.To)
+	}
+	if email.Subject != "Order №7" || email.Body != "Shipped.\n.hidden\n" || email.Headers["X-Order"][0] != "7" {
+		t.Errorf("subject %q, body %q, headers %v", email.Subject, email.Body, email.Headers)
+	}
+	if email.Raw != "" {
+		t.Error("the report includes the raw message")
+	}
+	if full, ok := mailbox.get(email.ID); !ok || !strings.HasPrefix(full.Raw, "Subject: ") {
+		t.Errorf("get %s: %v, raw %q", email.ID, ok, full.Raw)
+	}
+	if report := mailbox.report("carol@example.com"); report.Total != 0 {
+		t.Errorf("%d emails for carol", report.Total)
+	}
+}
+
+func TestSMTPCommandOrder(t *testing.T) {
+	c := dialSMTP(t)
+	if err := c.Rcpt("bob@example.com"); err == nil || !strings.Contains(err.Error(), "MAIL first") {
+		t.Errorf("RCPT before MAIL: %v", err)
+	}
+	if err := c.Mail("ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Data(); err == nil || !strings.Contains(err.Error(), "RCPT first") {
+		t.Errorf("DATA before RCPT: %v", err)
+	}
+}
+
+func TestSMTPSizeLimit(t *testing.T) {
+	mailbox.reset()
+	defer mailbox.reset()
+	client, server := net.Pipe()
+	go (&smtpServer{hostname: "mock-server", maxSize: 64}).session(server)
+	c, err := smtp.NewClient(client, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, size := c.Extension("SIZE"); !ok || size != "64" {
+		t.Errorf("SIZE advertised as %v %q", ok, size)
+	}
+	send := func(body string) error {
+		if err := c.Mail("ada@example.com"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("bob@example.com"); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		w.Write([]byte(body))
+		return w.Close()
+	}
+	if err := send("Subject: big\r\n\r\n" + strings.Repeat("x", 100) + "\r\n"); err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("oversized message: %v, want a 552", err)
+	}
+	// the session carries on after the refused message
+	if err := send("Subject: small\r\n\r\nok\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if report := mailbox.report(""); report.Total != 1 || report.Emails[0].Subject != "small" {
+		t.Errorf("captured %+v, want only the small message", report.Emails)
+	}
+	for arg, want := range map[string]bool{"FROM:<a@example.com> SIZE=64": false, "FROM:<a@example.com> size=65": true, "FROM:<a@example.com>": false} {
+		if size, ok := smtpSize(arg); (ok && size > 64) != want {
+			t.Errorf("smtpSize(%q) = %d, %v", arg, size, ok)
+		}
+	}
+}
+
+func TestSMTPAddress(t *testing.T) {
+	for _, tt := range []struct {
+		arg, prefix, want string
+		ok                bool
+	}{
+		{"FROM:<a@example.com>", "FROM:", "a@example.com", true},
+		{"from: <a@example.com> SIZE=100", "FROM:", "a@example.com", true},
+		{"TO:b@example.com", "TO:", "b@example.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"FROM:<a@example.com", "FROM:", "", false},
+		{"TO:<b@example.com>", "FROM:", "", false},
+		{"FROM:", "FROM:", "", false},
+	} {
+		if got, ok := smtpAddress(tt.arg, tt.prefix); got != tt.want || ok != tt.ok {
+			t.Errorf("smtpAddress(%q, %q) = %q, %v, want %q, %v", tt.arg, tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseEmailUnparsable(t *testing.T) {
+	var email capturedEmail
+	parseEmail(&email, []byte("no headers here"))
+	if email.Body != "no headers here" || email.Subject != "" {
+		t.Errorf("got %+v, want the raw text as the body", email)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshot is the runtime state that can be saved through the admin API
+// and restored later, e.g. to share a prepared demo state.
+type snapshot struct {
+	// Stubs maps stub ids to their enabled state
+	Stubs    map[string]bool                   `json:"stubs"`
+	Clock    clockReport                       `json:"clock"`
+	Sessions map[string]map[string]interface{} `json:"sessions"`
+	// Uploads are the files held in memory, with their content
+	Uploads []snapshotUpload `json:"uploads"`
+	// Profile is the active profile, "" for none
+	Profile *string `json:"profile"`
+	// Added are the stubs added through the admin API
+	Added []ApiFormat `json:"added"`
+	// Patches are the changes made to stubs through the admin API, by id
+	Patches map[string][]json.RawMessage `json:"patches"`
+}
+
+type snapshotUpload struct {
+	uploadedFile
+	Data []byte `json:"data"`
+}
+
+func takeSnapshot(lr *liveRoutes) snapshot {
+	snap := snapshot{Stubs: map[string]bool{}, Clock: clock.report(), Sessions: lr.sessions.snapshot(), Uploads: []snapshotUpload{}}
+	lr.mu.Lock()
+	profile := lr.profile
+	snap.Profile = &profile
+	snap.Added = append([]ApiFormat{}, lr.added...)
+	snap.Patches = map[string][]json.RawMessage{}
+	for id, list := range lr.patches {
+		snap.Patches[id] = list
+	}
+	lr.mu.Unlock()
+	for _, s := range lr.registry.list() {
+		snap.Stubs[s.id] = s.Enabled()
+	}
+	lr.uploads.Lock()
+	for _, file := range lr.uploads.files {
+		snap.Uploads = append(snap.Uploads, snapshotUpload{*file, file.data})
+	}
+	lr.uploads.Unlock()
+	return snap
+}
+
+// restoreSnapshot replaces the runtime state with snap, reloading with
+// its profile, added stubs and patches first. Stubs it doesn't mention
+// keep their state, ids no longer configured are skipped, as are parts
+// missing from snapshots of older versions.
+func restoreSnapshot(lr *liveRoutes, snap snapshot) error {
+	if err := clock.restore(snap.Clock); err != nil {
+		return fmt.Errorf("clock: %w", err)
+	}
+	if err := lr.restoreStubs(snap); err != nil {
+		return fmt.Errorf("stubs: %w", err)
+	}
+	for id, enabled := range snap.Stubs {
+		s := lr.registry.get(id)
+		if s == nil {
+			slog.Warn("Snapshot stub not configured", "id", id)
+			continue
+		}
+		s.enabled.Store(enabled)
+	}
+	lr.sessions.restore(snap.Sessions)
+	files := map[string]*uploadedFile{}
+	for _, upload := range snap.Uploads {
+		file := upload.uploadedFile
+		file.data = upload.Data
+		files[file.ID] = &file
+	}
+	lr.uploads.Lock()
+	lr.uploads.files = files
+	lr.uploads.Unlock()
+	return nil
+}
+
+// restoreStubs reloads with the profile, added stubs and patches of snap,
+// keeping the current ones if they can't be loaded.
+func (lr *liveRoutes) restoreStubs(snap snapshot) error {
+	if snap.Profile == nil && snap.Added == nil && snap.Patches == nil {
+		return nil
+	}
+	if lr.current.Load() == nil {
+		return errors.New("restoring stubs is not available")
+	}
+	lr.mu.Lock()
+	profile, added, addedSeq, patches := lr.profile, lr.added, lr.addedSeq, lr.patches
+	if snap.Profile != nil {
+		lr.profile = *snap.Profile
+	}
+	if snap.Added != nil {
+		lr.added = snap.Added
+		// ids given to stubs added later mustn't clash with restored ones
+		for _, api := range lr.added {
+			if n, err := strconv.Atoi(strings.TrimPrefix(api.Id, "added-")); err == nil && n > lr.addedSeq {
+				lr.addedSeq = n
+			}
+		}
+	}
+	if snap.Patches != nil {
+		lr.patches = snap.Patches
+	}
+	lr.mu.Unlock()
+	if _, err := lr.load(); err != nil {
+		lr.mu.Lock()
+		lr.profile, lr.added, lr.addedSeq, lr.patches = profile, added, addedSeq, patches
+		lr.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap := takeSnapshot(routesFor(r))
+	if file := r.URL.Query().Get("file"); file != "" {
+		encoded, err := json.MarshalIndent(snap, "", "  ")
+		if err == nil {
+			err = os.WriteFile(file, encoded, 0o644)
+		}
+		if err != nil {
+			slog.Error("Failed to write snapshot", "file", file, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Snapshot written", "file", file)
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+func serveRestore(w http.ResponseWriter, r *http.Request) {
+	var snap snapshot
+	var err error
+	if file := r.URL.Query().Get("file"); file != "" {
+		var encoded []byte
+		if encoded, err = os.ReadFile(file); err == nil {
+			err = json.Unmarshal(encoded, &snap)
+		}
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&snap)
+	}
+	if err == nil {
+		err = restoreSnapshot(routesFor(r), snap)
+	}
+	if err != nil {
+		http.Error(w, "invalid snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Snapshot restored", "stubs", len(snap.Stubs), "added", len(snap.Added), "patched", len(snap.Patches), "sessions", len(snap.Sessions), "uploads", len(snap.Uploads))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restore puts the clock back into a reported state: frozen at its time,
+// or ticking with its offset.
+func (c *mockClock) restore(rep clockReport) error {
+	offset := time.Duration(0)
+	if !rep.Frozen && rep.Offset != "" {
+		var err error
+		if offset, err = time.ParseDuration(rep.Offset); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frozen, c.frozenAt, c.offset = rep.Frozen, rep.Now, offset
+	return nil
+}
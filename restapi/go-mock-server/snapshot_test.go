@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSnapshotRoundTripsRuntimeStubs(t *testing.T) {
+	config := `[
+		{"id": "orders", "url": "/orders", "method": "GET", "response": {"status": 200}},
+		{"id": "users", "url": "/users", "method": "GET", "response": {"status": 200}},
+		{"profile": "outage", "overrides": [{"id": "users", "response": {"status": 503}}]}
+	]`
+	lr, server := newTestRoutes(t, config)
+	if _, err := lr.addStubs([]ApiFormat{{Method: "GET", Url: "/added", Response: ResponseFormat{Status: 201}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lr.patchStub("orders", json.RawMessage(`{"response": {"status": 202}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lr.switchProfile("outage"); err != nil {
+		t.Fatal(err)
+	}
+	lr.registry.get("added-1").enabled.Store(false)
+
+	encoded, err := json.Marshal(takeSnapshot(lr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(encoded, &snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh server from the same config, as after a restart
+	restored, restoredServer := newTestRoutes(t, config)
+	if err := restoreSnapshot(restored, snap); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{"/orders": 202, "/users": 503, "/added": 404} {
+		if got := getStatus(t, restoredServer.URL+path); got != want {
+			t.Errorf("%s answered %d after restore, want %d", path, got, want)
+		}
+	}
+	if report := restored.profileReport(); report.Active != "outage" {
+		t.Errorf("active profile %q after restore, want outage", report.Active)
+	}
+	restored.registry.get("added-1").enabled.Store(true)
+	if got := getStatus(t, restoredServer.URL+"/added"); got != 201 {
+		t.Errorf("restored added stub answered %d, want 201", got)
+	}
+	if _, err := restored.addStubs([]ApiFormat{{Method: "GET", Url: "/later", Response: ResponseFormat{Status: 200}}}); err != nil {
+		t.Fatalf("adding a stub after restore: %v", err)
+	}
+
+	// restoring over the original leaves it as it was
+	if err := restoreSnapshot(lr, snap); err != nil {
+		t.Fatal(err)
+	}
+	if got := getStatus(t, server.URL+"/orders"); got != 202 {
+		t.Errorf("/orders answered %d, want 202", got)
+	}
+}
+
+func TestSnapshotWithoutStubsKeepsThem(t *testing.T) {
+	lr, server := newTestRoutes(t, `[{"id": "orders", "url": "/orders", "method": "GET", "response": {"status": 200}}]`)
+	if _, err := lr.addStubs([]ApiFormat{{Method: "GET", Url: "/added", Response: ResponseFormat{Status: 201}}}); err != nil {
+		t.Fatal(err)
+	}
+	// as written by versions before stubs were saved
+	var snap snapshot
+	if err := json.Unmarshal([]byte(`{"stubs": {"orders": false}, "clock": {}, "sessions": {}, "uploads": []}`), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreSnapshot(lr, snap); err != nil {
+		t.Fatal(err)
+	}
+	if got := getStatus(t, server.URL+"/added"); got != 201 {
+		t.Errorf("/added answered %d, want it kept", got)
+	}
+	if got := getStatus(t, server.URL+"/orders"); got != http.StatusNotFound {
+		t.Errorf("/orders answered %d, want it disabled", got)
+	}
+}
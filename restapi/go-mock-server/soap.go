@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SoapFormat configures a "soap" response: XML wrapped in a SOAP envelope.
+type SoapFormat struct {
+	// Version is "1.1", the default, or "1.2"
+	Version string `json:"version"`
+	// Body is the XML inside the envelope's Body, a template
+	Body string `json:"body"`
+	// Fault answers a SOAP fault instead of Body, with status 500
+	Fault *SoapFault `json:"fault"`
+}
+
+type SoapFault struct {
+	// Code is e.g. "Client" or "Server" for 1.1, "Sender" or "Receiver"
+	// for 1.2, the default being the server side one
+	Code string `json:"code"`
+	// String is the human readable reason, a template
+	String string `json:"string"`
+	// Detail is optional XML, a template
+	Detail string `json:"detail"`
+}
+
+const (
+	soap11Envelope = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Envelope = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// soapContentType is the media type a SOAP version's messages use.
+func soapContentType(version string) string {
+	if version == "1.2" {
+		return "application/soap+xml; charset=utf-8"
+	}
+	return "text/xml; charset=utf-8"
+}
+
+// soapFaultXML lays out a fault for the version; reason and detail are
+// already rendered, reason still unescaped.
+func soapFaultXML(version, code, reason, detail string) string {
+	var sb strings.Builder
+	if version == "1.2" {
+		if code == "" {
+			code = "Receiver"
+		}
+		fmt.Fprintf(&sb, "<soap:Fault><soap:Code><soap:Value>soap:%s</soap:Value></soap:Code>", code)
+		fmt.Fprintf(&sb, `<soap:Reason><soap:Text xml:lang="en">%s</soap:Text></soap:Reason>`, xmlEscape(reason))
+		if detail != "" {
+			fmt.Fprintf(&sb, "<soap:Detail>%s</soap:Detail>", detail)
+		}
+		sb.WriteString("</soap:Fault>")
+		return sb.String()
+	}
+	if code == "" {
+		code = "Server"
+	}
+	fmt.Fprintf(&sb, "<soap:Fault><faultcode>soap:%s</faultcode><faultstring>%s</faultstring>", code, xmlEscape(reason))
+	if detail != "" {
+		fmt.Fprintf(&sb, "<detail>%s</detail>", detail)
+	}
+	sb.WriteString("</soap:Fault>")
+	return sb.String()
+}
+
+func xmlEscape(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+func newSoapHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Soap
+	if cfg == nil {
+		check(fmt.Errorf("soap response for %s %s has no soap block", api.Method, api.Url))
+	}
+	envelope := soap11Envelope
+	switch cfg.Version {
+	case "", "1.1":
+	case "1.2":
+		envelope = soap12Envelope
+	default:
+		check(fmt.Errorf("unknown soap version %q for %s %s", cfg.Version, api.Method, api.Url))
+	}
+	headers := compileHeaders(api.Response.Headers)
+	status := api.Response.Status
+	body, err := compileTemplate(api.Url, cfg.Body)
+	check(err)
+	var reason, detail *textTemplate
+	if cfg.Fault != nil {
+		reason, err = compileTemplate(api.Url, cfg.Fault.String)
+		check(err)
+		detail, err = compileTemplate(api.Url, cfg.Fault.Detail)
+		check(err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := newTemplateData(r, api)
+		var content string
+		var err error
+		if cfg.Fault != nil {
+			var text, extra string
+			if text, err = reason.render(data); err == nil {
+				extra, err = detail.render(data)
+			}
+			content = soapFaultXML(cfg.Version, cfg.Fault.Code, text, extra)
+		} else {
+			content, err = body.render(data)
+		}
+		if err != nil {
+			slog.Error("Failed to render soap body", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		payload := `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+			`<soap:Envelope xmlns:soap="` + envelope + `"><soap:Body>` + content + "</soap:Body></soap:Envelope>\n"
+		w.Header().Set("Content-Type", soapContentType(cfg.Version))
+		if !headers.render(w, data) {
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.WriteHeader(status)
+		slog.Debug("API request handled", "method", api.Method, "url", api.Url, "status", status)
+		w.Write([]byte(payload))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencySamples bounds the memory used per stub for percentiles; once
+// full, the oldest samples are overwritten.
+const latencySamples = 1024
+
+// stubStats counts the requests served by one stub. Latency is measured
+// around the whole handler, so it includes the configured delay.
+type stubStats struct {
+	id     string
+	method string
+	url    string
+
+	mu       sync.Mutex
+	hits     int
+	panics   int
+	statuses map[int]int
+	samples  []time.Duration
+	next     int
+}
+
+func (s *stubStats) record(status int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits++
+	s.statuses[status]++
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, latency)
+	} else {
+		s.samples[s.next] = latency
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+// panicked counts a request whose handler panicked; it is recorded as
+// well, with the 500 it was answered with.
+func (s *stubStats) panicked() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.panics++
+}
+
+func (s *stubStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = 0
+	s.panics = 0
+	s.statuses = map[int]int{}
+	s.samples = s.samples[:0]
+	s.next = 0
+}
+
+type latencyReport struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+type statsReport struct {
+	Id       string         `json:"id"`
+	Method   string         `json:"method"`
+	Url      string         `json:"url"`
+	Hits     int            `json:"hits"`
+	Panics   int            `json:"panics"`
+	Statuses map[string]int `json:"statuses"`
+	// Latency is in milliseconds
+	Latency latencyReport `json:"latency"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (s *stubStats) report() statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := statsReport{Id: s.id, Method: s.method, Url: s.url, Hits: s.hits, Panics: s.panics, Statuses: map[string]int{}}
+	for status, n := range s.statuses {
+		report.Statuses[strconv.Itoa(status)] = n
+	}
+	if len(s.samples) > 0 {
+		sorted := append([]time.Duration(nil), s.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		at := func(p float64) float64 {
+			return milliseconds(sorted[int(p*float64(len(sorted)-1))])
+		}
+		report.Latency = latencyReport{P50: at(0.50), P95: at(0.95), Max: milliseconds(sorted[len(sorted)-1])}
+	}
+	return report
+}
+
+func newStubStats(id string, api ApiFormat) *stubStats {
+	return &stubStats{id: id, method: api.Method, url: api.Url, statuses: map[int]int{}}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stub is a registered api together with its runtime state.
+type stub struct {
+	id         string
+	api        ApiFormat
+	handler    http.HandlerFunc
+	enabled    atomic.Bool
+	conditions *requestConditions
+	stats      *stubStats
+	// source is the stub's config as loaded, to detect changes on reload
+	source []byte
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setServingStub(r, s.id)
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.access, info.mirror = s.api.AccessLog, s.api.Mirror
+	}
+	s.handler(w, r)
+}
+
+// Enabled reports whether the stub is switched on in the admin API.
+func (s *stub) Enabled() bool {
+	return s.enabled.Load()
+}
+
+// Matches lets the router skip disabled stubs, as if they weren't there,
+// and stubs whose match conditions fail.
+func (s *stub) Matches(r *http.Request) bool {
+	return s.Enabled() && (s.conditions == nil || s.conditions.matches(r))
+}
+
+func (s *stub) Conditional() bool {
+	return s.conditions != nil
+}
+
+// stubRegistry holds every registered stub in load order.
+type stubRegistry struct {
+	mu    sync.RWMutex
+	stubs []*stub
+	byID  map[string]*stub
+}
+
+func newStubRegistry() *stubRegistry {
+	return &stubRegistry{byID: map[string]*stub{}}
+}
+
+var registry = newStubRegistry()
+
+// add builds the handler for api and registers it under its id, which
+// defaults to "stub-N" by load order.
+func (reg *stubRegistry) add(api ApiFormat) (*stub, error) {
+	return reg.addFrom(api, nil)
+}
+
+// addFrom is add, except that a stub of previous with the same id and
+// config is registered as is, keeping its state and stats.
+func (reg *stubRegistry) addFrom(api ApiFormat, previous *stubRegistry) (*stub, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	id := api.Id
+	if id == "" {
+		id = fmt.Sprintf("stub-%d", len(reg.stubs)+1)
+	}
+	if _, dup := reg.byID[id]; dup {
+		return nil, fmt.Errorf("stub id %q is used twice", id)
+	}
+	if err := validateMethod(api.Method); err != nil {
+		return nil, fmt.Errorf("stub %s: %w", id, err)
+	}
+	// encoded before building the handler, which fills in defaults
+	source, err := json.Marshal(api)
+	if err != nil {
+		return nil, fmt.Errorf("stub %s: %w", id, err)
+	}
+	s := previous.get(id)
+	if s == nil || !bytes.Equal(s.source, source) {
+		conditions, err := compileConditions(api.Match)
+		if err != nil {
+			return nil, fmt.Errorf("stub %s: %w", id, err)
+		}
+		if conditions != nil {
+			conditions.bodyLimit = stubBodyLimit(api)
+		}
+		// built from a copy, as the defaults are filled in through pointer
+		// fields the caller's config shares, e.g. stubs added at runtime
+		built := ApiFormat{}
+		if err := json.Unmarshal(source, &built); err != nil {
+			return nil, fmt.Errorf("stub %s: %w", id, err)
+		}
+		built.source = api.source
+		api = built
+		s = &stub{id: id, api: api, conditions: conditions, stats: newStubStats(id, api), source: source}
+		s.enabled.Store(api.Enabled == nil || *api.Enabled)
+		s.handler = newHandler(api, s.stats)
+	}
+	reg.stubs = append(reg.stubs, s)
+	reg.byID[id] = s
+	return s, nil
+}
+
+// String names the stub in routing conflicts.
+func (s *stub) String() string {
+	return "stub " + s.id
+}
+
+// validateMethod rejects methods no request could have, as the method is
+// matched case-sensitively; "" stands for every method.
+func validateMethod(method string) error {
+	if method == "" {
+		return nil
+	}
+	token := func(c rune) bool {
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}
+	if strings.IndexFunc(method, func(c rune) bool { return !token(c) }) >= 0 {
+		return fmt.Errorf("invalid method %q", method)
+	}
+	if upper := strings.ToUpper(method); upper != method {
+		return fmt.Errorf("method %q must be upper case, e.g. %q", method, upper)
+	}
+	return nil
+}
+
+// replace swaps in the stubs of other, e.g. after a reload.
+func (reg *stubRegistry) replace(other *stubRegistry) {
+	stubs, byID := other.list(), map[string]*stub{}
+	for _, s := range stubs {
+		byID[s.id] = s
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.stubs, reg.byID = stubs, byID
+}
+
+func (reg *stubRegistry) get(id string) *stub {
+	if reg == nil {
+		return nil
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.byID[id]
+}
+
+func (reg *stubRegistry) list() []*stub {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return append([]*stub(nil), reg.stubs...)
+}
+
+type stubReport struct {
+	Id      string `json:"id"`
+	Method  string `json:"method"`
+	Url     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (s *stub) report() stubReport {
+	return stubReport{Id: s.id, Method: s.api.Method, Url: s.api.Url, Enabled: s.Enabled()}
+}
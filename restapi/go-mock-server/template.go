@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// templateFuncs are available in every template, e.g.
+// {{now.Format "2006-01-02"}} or {{(now.Add (duration "1h")).Unix}}.
+var templateFuncs = template.FuncMap{
+	"now":      func() time.Time { return clock.Now() },
+	"duration": time.ParseDuration,
+	"lookup":   dataLookup,
+	"where":    dataWhere,
+	"rows":     tableRows,
+	"uuid":     randomUUID,
+	"randInt":  randomInt,
+	"counter":  templateCounters.next,
+	"number":   toNumber,
+}
+
+// randomUUID returns a version 4 UUID drawn from random, so -seed repeats it.
+func randomUUID() string {
+	hi, lo := random.Uint64(), random.Uint64()
+	hi = hi&^0xf000 | 0x4000
+	lo = lo&^(0x3<<62) | 0x2<<62
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", hi>>32, hi>>16&0xffff, hi&0xffff, lo>>48, lo&0xffffffffffff)
+}
+
+// randomInt returns a number between min and max inclusive.
+func randomInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + random.IntN(max-min+1)
+}
+
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// toNumber formats v as a JSON number, failing for text that isn't one.
+// In a JSON body a string that is only a {{number ...}} action renders as
+// the number instead of a string, e.g. "created": "{{number now.Unix}}".
+func toNumber(v interface{}) (string, error) {
+	text := jsonText(v)
+	if !jsonNumberPattern.MatchString(text) {
+		return "", fmt.Errorf("%q is not a number", text)
+	}
+	return text, nil
+}
+
+// counterSet holds the named counters of {{counter "name"}}, which count
+// from 1 across every stub using the name, e.g. for order numbers.
+type counterSet struct {
+	mu     sync.Mutex
+	values map[string]int
+}
+
+var templateCounters = &counterSet{values: map[string]int{}}
+
+func (c *counterSet) next(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name]++
+	return c.values[name]
+}
+
+func (c *counterSet) report() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := make(map[string]int, len(c.values))
+	for name, val := range c.values {
+		report[name] = val
+	}
+	return report
+}
+
+func (c *counterSet) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values = map[string]int{}
+}
+
+// templateData is the request context available to response templates,
+// e.g. {{.Params.id}}, {{.Query.page}} or {{.Header "X-Trace"}}.
+type templateData struct {
+	Method  string
+	Path    string
+	Params  map[string]string
+	Query   map[string]string
+	Headers map[string]string
+	// ClientIP is the caller's remote address without the port
+	ClientIP string
+	// RequestID is the X-Request-ID sent back with the response
+	RequestID string
+	// Session holds the caller's session values, see sessionStore
+	Session map[string]interface{}
+	// Vars holds values contributed by the response type, e.g. redirect hops
+	Vars map[string]interface{}
+
+	req  *http.Request
+	uuid *string
+}
+
+// Header returns the named request header using canonical matching.
+func (d templateData) Header(name string) string {
+	return d.req.Header.Get(name)
+}
+
+// Form returns the named field of a url-encoded request body, e.g.
+// {{.Form "amount"}}.
+func (d templateData) Form(name string) string {
+	form, _ := url.ParseQuery(string(readBody(d.req)))
+	return form.Get(name)
+}
+
+// UUID returns a UUID generated once per request, so a Location header and
+// the body can carry the same new id. {{uuid}} makes a new one each call.
+func (d templateData) UUID() string {
+	if *d.uuid == "" {
+		*d.uuid = randomUUID()
+	}
+	return *d.uuid
+}
+
+var wildcardPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}`)
+
+// patternParams returns the wildcard names used in a ServeMux style url.
+func patternParams(url string) []string {
+	names := []string{}
+	for _, m := range wildcardPattern.FindAllStringSubmatch(url, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+func newTemplateData(r *http.Request, api ApiFormat) templateData {
+	data := templateData{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Params:    map[string]string{},
+		Query:     map[string]string{},
+		Headers:   map[string]string{},
+		ClientIP:  clientHost(r),
+		RequestID: r.Header.Get(requestIDHeader),
+		Session:   routesFor(r).sessions.values(r),
+		Vars:      map[string]interface{}{},
+		req:       r,
+		uuid:      new(string),
+	}
+	if shared, ok := r.Context().Value(requestUUIDKey{}).(*string); ok {
+		data.uuid = shared
+	}
+	for _, name := range patternParams(api.Url) {
+		data.Params[name] = r.PathValue(name)
+	}
+	for key, vals := range r.URL.Query() {
+		data.Query[key] = vals[0]
+	}
+	for key := range r.Header {
+		data.Headers[key] = r.Header.Get(key)
+	}
+	return data
+}
+
+// textTemplate is a config string which may contain template actions.
+// Strings without actions are returned verbatim and never parsed.
+type textTemplate struct {
+	raw  string
+	tmpl *template.Template
+	// number marks a single {{number ...}} action, see toNumber
+	number bool
+}
+
+func compileTemplate(name, text string) (*textTemplate, error) {
+	t := &textTemplate{raw: text}
+	if !strings.Contains(text, "{{") {
+		return t, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs).
+		Funcs(template.FuncMap{blankMissingFunc: blankMissing}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t.number = numberAction(tmpl.Tree)
+	for _, defined := range tmpl.Templates() {
+		pipeMissing(defined.Tree.Root)
+	}
+	t.tmpl = tmpl
+	return t, nil
+}
+
+const blankMissingFunc = "_blankMissing"
+
+// blankMissing stands in "" for a missing value.
+func blankMissing(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// pipeMissing ends the pipeline of every action printing a value with
+// blankMissing. missingkey=zero gives the zero value of a missing map key,
+// which for the interface{} values of .Session, .Vars or a lookup row is
+// nil and would print as "<no value>".
+func pipeMissing(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			pipeMissing(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos,
+				Args: []parse.Node{parse.NewIdentifier(blankMissingFunc).SetPos(n.Pos)}})
+		}
+	case *parse.IfNode:
+		pipeMissing(n.List)
+		pipeMissing(n.ElseList)
+	case *parse.RangeNode:
+		pipeMissing(n.List)
+		pipeMissing(n.ElseList)
+	case *parse.WithNode:
+		pipeMissing(n.List)
+		pipeMissing(n.ElseList)
+	}
+}
+
+func (t *textTemplate) render(data templateData) (string, error) {
+	if t.tmpl == nil {
+		return t.raw, nil
+	}
+	var sb strings.Builder
+	if err := t.tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func compileTemplates(name string, values map[string]string) (map[string]*textTemplate, error) {
+	compiled := make(map[string]*textTemplate, len(values))
+	for key, val := range values {
+		t, err := compileTemplate(name, val)
+		if err != nil {
+			return nil, err
+		}
+		compiled[key] = t
+	}
+	return compiled, nil
+}
+
+func renderTemplates(templates map[string]*textTemplate, data templateData) (map[string]string, error) {
+	rendered := make(map[string]string, len(templates))
+	for key, t := range templates {
+		val, err := t.render(data)
+		if err != nil {
+			return nil, err
+		}
+		rendered[key] = val
+	}
+	return rendered, nil
+}
+
+// compileJSON replaces string values containing template actions in a
+// decoded JSON document with compiled templates. It reports whether any
+// template was found so static bodies can skip rendering entirely.
+func compileJSON(name string, v interface{}) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case string:
+		t, err := compileTemplate(name, v)
+		if err != nil || t.tmpl == nil {
+			return v, false, err
+		}
+		return t, true, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		dynamic := false
+		for key, val := range v {
+			compiled, d, err := compileJSON(name, val)
+			if err != nil {
+				return nil, false, err
+			}
+			out[key] = compiled
+			dynamic = dynamic || d
+		}
+		return out, dynamic, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		dynamic := false
+		for i, val := range v {
+			compiled, d, err := compileJSON(name, val)
+			if err != nil {
+				return nil, false, err
+			}
+			out[i] = compiled
+			dynamic = dynamic || d
+		}
+		return out, dynamic, nil
+	}
+	return v, false, nil
+}
+
+// numberAction reports whether tree is a single action ending in the
+// number func, e.g. {{number now.Unix}} or {{.Form "amount" | number}}.
+func numberAction(tree *parse.Tree) bool {
+	if len(tree.Root.Nodes) != 1 {
+		return false
+	}
+	action, ok := tree.Root.Nodes[0].(*parse.ActionNode)
+	if !ok || len(action.Pipe.Decl) > 0 {
+		return false
+	}
+	last := action.Pipe.Cmds[len(action.Pipe.Cmds)-1]
+	ident, ok := last.Args[0].(*parse.IdentifierNode)
+	return ok && ident.Ident == "number"
+}
+
+// bodyTemplate is a configured message body: a string template sent as
+// is, or a JSON document with templates in its strings.
+type bodyTemplate struct {
+	text *textTemplate
+	json interface{}
+}
+
+func compileBody(name string, v interface{}) (bodyTemplate, error) {
+	if text, ok := v.(string); ok {
+		t, err := compileTemplate(name, text)
+		return bodyTemplate{text: t}, err
+	}
+	doc, _, err := compileJSON(name, v)
+	return bodyTemplate{json: doc}, err
+}
+
+// render returns the body and its media type, nothing for an unset one.
+func (b bodyTemplate) render(data templateData) ([]byte, string, error) {
+	if b.text != nil {
+		text, err := b.text.render(data)
+		return []byte(text), "text/plain", err
+	}
+	if b.json == nil {
+		return nil, "", nil
+	}
+	doc, err := renderJSON(b.json, data)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded, err := json.Marshal(doc)
+	return encoded, "application/json", err
+}
+
+// shareUUID makes the template data of r and of whatever handlers derive
+// from it agree on {{.UUID}}, e.g. a response and the message it triggers.
+func shareUUID(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestUUIDKey{}).(*string); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestUUIDKey{}, new(string)))
+}
+
+// requestUUIDKey holds the UUID shared through shareUUID.
+type requestUUIDKey struct{}
+
+// renderJSON executes the templates left in a document by compileJSON.
+func renderJSON(v interface{}, data templateData) (interface{}, error) {
+	switch v := v.(type) {
+	case *textTemplate:
+		text, err := v.render(data)
+		if err != nil || !v.number {
+			return text, err
+		}
+		return json.Number(text), nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			rendered, err := renderJSON(val, data)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			rendered, err := renderJSON(val, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTemplatesBlankMissingValues(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	data := newTemplateData(r, ApiFormat{Url: "/"})
+	data.Vars["known"] = "yes"
+	for text, want := range map[string]string{
+		`[{{.Vars.unknown}}]`: "[]",
+		`[{{.Session.user}}]`: "[]",
+		`{{if true}}[{{(lookup "none" "id" 1).name}}]{{end}}`: "[]",
+		`{{range $k, $v := .Vars}}{{$k}}={{$v}}{{end}}`:       "known=yes",
+		`{{$x := .Vars.unknown}}[{{$x}}]`:                     "[]",
+		// literal text is left alone
+		`<no value> {{.Vars.known}}`: "<no value> yes",
+	} {
+		tmpl, err := compileTemplate("test", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tmpl.render(data); err != nil || got != want {
+			t.Errorf("%s rendered %q, %v; want %q", text, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// clientCertConfig asks clients for a certificate, so stubs can match on
+// it. With a CA file presented certificates must verify against it;
+// without one any certificate is accepted as is.
+func clientCertConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{ClientAuth: tls.RequestClientCert}, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tlsFaults are the faults a --tls-fault listener can serve. The
+// certificate faults are signed by a CA generated at startup, served at
+// /__admin/tls-faults/ca.pem, so a client trusting it sees only the fault.
+var tlsFaults = map[string]string{
+	"expired":         "a certificate that expired yesterday",
+	"not-yet-valid":   "a certificate valid from tomorrow",
+	"wrong-host":      "a certificate for wrong-host.invalid only",
+	"self-signed":     "a self-signed certificate not issued by the CA",
+	"handshake-close": "the connection reset after the client hello",
+	"handshake-stall": "the connection held open without an answer",
+}
+
+func tlsFaultNames() []string {
+	names := []string{}
+	for name := range tlsFaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsFaultFlag collects repeated "fault=address" --tls-fault flags.
+type tlsFaultFlag map[string]string
+
+func (f tlsFaultFlag) String() string {
+	pairs := []string{}
+	for fault, addr := range f {
+		pairs = append(pairs, fault+"="+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f tlsFaultFlag) Set(value string) error {
+	fault, addr, ok := strings.Cut(value, "=")
+	if !ok || addr == "" {
+		return fmt.Errorf("want fault=address, e.g. expired=:8443")
+	}
+	if tlsFaults[fault] == "" {
+		return fmt.Errorf("unknown TLS fault %q, available: %s", fault, strings.Join(tlsFaultNames(), ", "))
+	}
+	f[fault] = addr
+	return nil
+}
+
+type tlsFaultInfo struct {
+	Fault       string `json:"fault"`
+	Description string `json:"description"`
+	Address     string `json:"address"`
+}
+
+type tlsFaultsReport struct {
+	Listeners []tlsFaultInfo `json:"listeners"`
+}
+
+// tlsFaultState is what the admin API tells about the fault listeners.
+var tlsFaultState = struct {
+	report tlsFaultsReport
+	// caPEM is the certificate of the generated CA, nil without listeners
+	caPEM []byte
+}{report: tlsFaultsReport{Listeners: []tlsFaultInfo{}}}
+
+// issueCert makes the certificate tmpl describes with a new P-256 key,
+// signed by parent or, when nil, by itself.
+func issueCert(tmpl *x509.Certificate, parent *tls.Certificate) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// faultCert issues the certificate a certificate fault serves.
+func faultCert(fault string, ca *tls.Certificate) (*tls.Certificate, error) {
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(30 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	switch fault {
+	case "expired":
+		tmpl.NotBefore, tmpl.NotAfter = now.Add(-30*24*time.Hour), now.Add(-24*time.Hour)
+	case "not-yet-valid":
+		tmpl.NotBefore = now.Add(24 * time.Hour)
+	case "wrong-host":
+		tmpl.Subject.CommonName = "wrong-host.invalid"
+		tmpl.DNSNames, tmpl.IPAddresses = []string{"wrong-host.invalid"}, nil
+	case "self-signed":
+		ca = nil
+	}
+	return issueCert(tmpl, ca)
+}
+
+// serveTLSFaults opens a listener per fault, serving handler behind the
+// certificate faults and breaking the handshake for the others.
+func serveTLSFaults(faults tlsFaultFlag, handler http.Handler) error {
+	if len(faults) == 0 {
+		return nil
+	}
+	now := time.Now()
+	ca, err := issueCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "mock-server fault CA"},
+		NotBefore:             now.Add(-365 * 24 * time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	tlsFaultState.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	for _, fault := range tlsFaultNames() {
+		addr, ok := faults[fault]
+		if !ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		tlsFaultState.report.Listeners = append(tlsFaultState.report.Listeners,
+			tlsFaultInfo{Fault: fault, Description: tlsFaults[fault], Address: ln.Addr().String()})
+		slog.Info("Starting TLS fault listener", "fault", fault, "address", ln.Addr().String())
+		switch fault {
+		case "handshake-close", "handshake-stall":
+			go breakHandshakes(ln, fault)
+			continue
+		}
+		cert, err := faultCert(fault, ca)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: handler, TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}}}
+		go func() {
+			check(server.ServeTLS(ln, "", ""))
+		}()
+	}
+	return nil
+}
+
+// breakHandshakes reads the client hello of every connection, then resets
+// the connection or keeps it open, silent, until the client gives up.
+func breakHandshakes(ln net.Listener, fault string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("TLS fault accept failed", "fault", fault, "error", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if fault == "handshake-stall" {
+				io.Copy(io.Discard, conn)
+				return
+			}
+			// the record header and as much of the hello as has arrived
+			buf := make([]byte, 4096)
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			conn.Read(buf)
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				// a reset rather than an orderly close
+				tcp.SetLinger(0)
+			}
+			slog.Debug("TLS handshake reset", "remote", conn.RemoteAddr().String())
+		}()
+	}
+}
+
+// serveTLSFaultCA answers the fault CA's certificate for clients to trust.
+func serveTLSFaultCA(w http.ResponseWriter, r *http.Request) {
+	if tlsFaultState.caPEM == nil {
+		http.Error(w, "no TLS fault listeners, see -tls-fault", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(tlsFaultState.caPEM)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// trailerWriter announces a stub's trailers before the headers go out and
+// digests the body written after them.
+type trailerWriter struct {
+	http.ResponseWriter
+	names  string
+	status int
+	length int64
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func (t *trailerWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+		h := t.ResponseWriter.Header()
+		h.Set("Trailer", t.names)
+		// trailers need a chunked body over HTTP/1.1
+		h.Del("Content-Length")
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *trailerWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.length += int64(n)
+	t.sha256.Write(b[:n])
+	t.md5.Write(b[:n])
+	return n, err
+}
+
+func (t *trailerWriter) Flush() {
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+func (t *trailerWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// withTrailers sends the stub's trailers after the body. They are templates
+// rendered once the body is written, with its digests as .Vars.sha256 and
+// .Vars.md5 (hex), its size as .Vars.length and the status as .Vars.status.
+func withTrailers(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	templates, err := compileTemplates(api.Url, api.Trailers)
+	check(err)
+	names := make([]string, 0, len(api.Trailers))
+	for name := range api.Trailers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+	announced := strings.Join(names, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = shareUUID(r)
+		tw := &trailerWriter{ResponseWriter: w, names: announced, sha256: sha256.New(), md5: md5.New()}
+		next(tw, r)
+		if tw.status == 0 {
+			tw.WriteHeader(http.StatusOK)
+		}
+		data := newTemplateData(r, api)
+		data.Vars["status"] = tw.status
+		data.Vars["length"] = tw.length
+		data.Vars["sha256"] = hex.EncodeToString(tw.sha256.Sum(nil))
+		data.Vars["md5"] = hex.EncodeToString(tw.md5.Sum(nil))
+		values, err := renderTemplates(templates, data)
+		if err != nil {
+			// too late for an error response, the client sees no trailers
+			slog.Error("Failed to render trailers", "url", api.Url, "error", err)
+			return
+		}
+		for name, val := range values {
+			w.Header().Set(name, val)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TransformStep is one step of a stub's response pipeline. The steps run
+// in order on the finished response, so a stub imported or shared from
+// elsewhere can be adjusted without editing its source.
+type TransformStep struct {
+	// Set puts Value at a dotted JSON path, e.g. "$.user.name" or
+	// "items.*.price", creating objects for missing fields
+	Set   string      `json:"set"`
+	Value interface{} `json:"value"`
+	// Delete removes the field or array element at a dotted JSON path
+	Delete string `json:"delete"`
+	// Replace substitutes With for every occurrence in the body text
+	Replace string `json:"replace"`
+	With    string `json:"with"`
+	// Header sets a response header to Value, removing it for ""
+	Header string `json:"header"`
+}
+
+// compiledStep is a TransformStep ready to run; exactly one of the
+// actions is set.
+type compiledStep struct {
+	set, remove []string
+	value       interface{}
+	replace     []byte
+	with        []byte
+	header      string
+	headerValue *textTemplate
+}
+
+// transformPath splits a dotted path, allowing a JSONPath style "$." prefix.
+func transformPath(path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+func compileTransform(api ApiFormat) ([]compiledStep, bool, error) {
+	steps := make([]compiledStep, 0, len(api.Transform))
+	dynamic := false
+	for i, t := range api.Transform {
+		step := compiledStep{}
+		actions := 0
+		if t.Set != "" {
+			actions++
+			if step.set = transformPath(t.Set); step.set == nil {
+				return nil, false, fmt.Errorf("transform step %d: set needs a field path", i+1)
+			}
+			value, d, err := compileJSON(api.Url, t.Value)
+			if err != nil {
+				return nil, false, fmt.Errorf("transform step %d: %w", i+1, err)
+			}
+			step.value, dynamic = value, dynamic || d
+		}
+		if t.Delete != "" {
+			actions++
+			if step.remove = transformPath(t.Delete); step.remove == nil {
+				return nil, false, fmt.Errorf("transform step %d: delete needs a field path", i+1)
+			}
+		}
+		if t.Replace != "" {
+			actions++
+			step.replace, step.with = []byte(t.Replace), []byte(t.With)
+		}
+		if t.Header != "" {
+			actions++
+			step.header = http.CanonicalHeaderKey(t.Header)
+			text := ""
+			if t.Value != nil {
+				text = fmt.Sprint(t.Value)
+			}
+			tmpl, err := compileTemplate(step.header, text)
+			if err != nil {
+				return nil, false, fmt.Errorf("transform step %d: %w", i+1, err)
+			}
+			step.headerValue, dynamic = tmpl, dynamic || tmpl.tmpl != nil
+		}
+		if actions != 1 {
+			return nil, false, fmt.Errorf("transform step %d needs exactly one of set, delete, replace or header", i+1)
+		}
+		steps = append(steps, step)
+	}
+	return steps, dynamic, nil
+}
+
+// setField returns doc with val at the path. A "*" part applies to every
+// element of an array or field of an object.
+func setField(doc interface{}, parts []string, val func() interface{}) interface{} {
+	if len(parts) == 0 {
+		return val()
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if parts[0] == "*" {
+			for key, child := range v {
+				v[key] = setField(child, parts[1:], val)
+			}
+			return v
+		}
+		v[parts[0]] = setField(v[parts[0]], parts[1:], val)
+		return v
+	case []interface{}:
+		for i := range v {
+			if parts[0] == "*" || parts[0] == strconv.Itoa(i) {
+				v[i] = setField(v[i], parts[1:], val)
+			}
+		}
+		return v
+	}
+	if parts[0] == "*" {
+		return doc
+	}
+	return map[string]interface{}{parts[0]: setField(nil, parts[1:], val)}
+}
+
+// deleteField returns doc without the value at the path.
+func deleteField(doc interface{}, parts []string) interface{} {
+	last := len(parts) == 1
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if parts[0] != "*" && parts[0] != key {
+				continue
+			}
+			if last {
+				delete(v, key)
+			} else {
+				v[key] = deleteField(child, parts[1:])
+			}
+		}
+	case []interface{}:
+		kept := v[:0]
+		for i, child := range v {
+			if parts[0] != "*" && parts[0] != strconv.Itoa(i) {
+				kept = append(kept, child)
+			} else if !last {
+				kept = append(kept, deleteField(child, parts[1:]))
+			}
+		}
+		return kept
+	}
+	return doc
+}
+
+// withTransform runs the stub's transform steps on each response before
+// any other middleware sees it.
+func withTransform(api ApiFormat, next http.HandlerFunc) http.HandlerFunc {
+	steps, dynamic, err := compileTransform(api)
+	if err != nil {
+		check(fmt.Errorf("%s %s: %w", api.Method, api.Url, err))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := getResponseBuffer()
+		defer buf.release()
+		next(buf, r)
+		var data templateData
+		if dynamic {
+			data = newTemplateData(r, api)
+		}
+		body := buf.body.Bytes()
+		// JSON steps share one decoded document, encoded again for text
+		// steps and at the end
+		var doc interface{}
+		decoded := false
+		for _, step := range steps {
+			switch {
+			case step.header != "":
+				val, err := step.headerValue.render(data)
+				if err != nil {
+					slog.Error("Failed to render transform header", "url", api.Url, "header", step.header, "error", err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if val == "" {
+					buf.header.Del(step.header)
+				} else {
+					buf.header.Set(step.header, val)
+				}
+			case step.replace != nil:
+				if decoded {
+					body, _ = json.Marshal(doc)
+					doc, decoded = nil, false
+				}
+				body = bytes.ReplaceAll(body, step.replace, step.with)
+			default:
+				if !decoded {
+					if json.Unmarshal(body, &doc) != nil {
+						slog.Debug("Transform skipped for non-JSON body", "url", api.Url)
+						continue
+					}
+					decoded = true
+				}
+				if step.remove != nil {
+					doc = deleteField(doc, step.remove)
+					continue
+				}
+				var renderErr error
+				doc = setField(doc, step.set, func() interface{} {
+					// rendered per use, so each target gets its own copy
+					val, err := renderJSON(step.value, data)
+					if err != nil {
+						renderErr = err
+					}
+					return val
+				})
+				if renderErr != nil {
+					slog.Error("Failed to render transform value", "url", api.Url, "error", renderErr)
+					http.Error(w, renderErr.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		if decoded {
+			body, _ = json.Marshal(doc)
+			body = append(body, '\n')
+		}
+		buf.send(w, body)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxMisses bounds the unmatched requests kept for the admin API; the
+// total keeps counting past it.
+const maxMisses = 1000
+
+type missReport struct {
+	RequestID  string    `json:"requestId"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Closest    string    `json:"closest,omitempty"`
+	Mismatches []string  `json:"mismatches,omitempty"`
+}
+
+// missLog records unmatched requests as failures in --strict mode.
+type missLog struct {
+	mu     sync.Mutex
+	total  int
+	misses []missReport
+}
+
+func (m *missLog) add(miss missReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	if len(m.misses) < maxMisses {
+		m.misses = append(m.misses, miss)
+	}
+}
+
+func (m *missLog) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+type missesReport struct {
+	Total    int          `json:"total"`
+	Requests []missReport `json:"requests"`
+}
+
+func (m *missLog) report() missesReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return missesReport{Total: m.total, Requests: append([]missReport{}, m.misses...)}
+}
+
+func (m *missLog) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total = 0
+	m.misses = nil
+}
+
+// pathMatches reports whether url, a stub pattern, covers the path of r.
+func pathMatches(url string, r *http.Request) bool {
+	rt := newRouter()
+	if rt.handle(url, http.NotFoundHandler()) != nil {
+		return false
+	}
+	var pathOnly *route
+	e, _ := rt.root.lookup(r, pathSegments(r.URL), nil, &pathOnly)
+	return e != nil
+}
+
+func methodMatches(method string, r *http.Request) bool {
+	return method == "" || method == r.Method || method == http.MethodGet && r.Method == http.MethodHead
+}
+
+// closestStub finds the stub that came nearest to serving r, and why it
+// didn't. A wrong path counts most, then a wrong method, then each failed
+// condition or the stub being disabled.
+func closestStub(r *http.Request) (*stub, []string) {
+	var closest *stub
+	var reasons []string
+	best := -1
+	for _, s := range routesFor(r).registry.list() {
+		why := []string{}
+		score := 0
+		if !pathMatches(s.api.Url, r) {
+			why = append(why, fmt.Sprintf("path %s does not match %s", r.URL.Path, s.api.Url))
+			score += 4
+		}
+		if !methodMatches(s.api.Method, r) {
+			why = append(why, fmt.Sprintf("method %s, stub expects %s", r.Method, s.api.Method))
+			score += 2
+		}
+		if !s.Enabled() {
+			why = append(why, "stub is disabled")
+			score++
+		}
+		if s.conditions != nil {
+			failed := s.conditions.mismatches(r, true)
+			why = append(why, failed...)
+			score += len(failed)
+		}
+		if best < 0 || score < best {
+			closest, reasons, best = s, why, score
+		}
+	}
+	return closest, reasons
+}
+
+// newUnmatchedHandler logs every request no stub serves, together with the
+// closest stub, and answers it with response or else a plain 404 or 405.
+// In strict mode the misses are also recorded as failures.
+func newUnmatchedHandler(response *ResponseFormat, strict bool) http.HandlerFunc {
+	var respond http.HandlerFunc
+	if response != nil {
+		if response.Status == 0 {
+			response.Status = http.StatusNotFound
+		}
+		respond = newResponder(ApiFormat{Url: "/", Response: *response})
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		miss := missReport{RequestID: id, Time: time.Now(), Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery}
+		if s, reasons := closestStub(r); s != nil {
+			miss.Closest, miss.Mismatches = s.id, reasons
+			slog.Info("Unmatched request", "request_id", id, "method", r.Method, "path", r.URL.Path, "closest", s.id, "mismatches", reasons)
+		} else {
+			slog.Info("Unmatched request", "request_id", id, "method", r.Method, "path", r.URL.Path)
+		}
+		if strict {
+			routesFor(r).misses.add(miss)
+		}
+		if respond == nil {
+			unmatchedStatus(w, r)
+			return
+		}
+		respond(w, r)
+	}
+}
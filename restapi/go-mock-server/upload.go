@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadFormat configures an "upload" response which accepts a file either
+// as a multipart form field or as the raw request body. Registered for GET
+// on a url with an {id} wildcard the same type serves stored files back,
+// and for DELETE removes them and answers 204.
+type UploadFormat struct {
+	// Field is the multipart field holding the file, default "file"
+	Field string `json:"field"`
+	// MaxSize in bytes, larger files get a 413; 0 means unlimited
+	MaxSize int64 `json:"maxSize"`
+	// AllowedTypes lists accepted media types, "image/*" style wildcards
+	// are allowed; other types get a 415
+	AllowedTypes []string `json:"allowedTypes"`
+	// Dir stores files on disk, named by id; empty keeps them in memory
+	Dir string `json:"dir"`
+	// Key names files by a template instead of a random id, e.g.
+	// "{{.Params.bucket}}/{{.Params.key}}"; a GET renders it to find
+	// the file again, so the url needs no {id}
+	Key string `json:"key"`
+	// List makes a GET answer with the stored files whose ids start with
+	// the rendered prefix instead of serving one, as .Vars.files
+	List string `json:"list"`
+	// Missing answers a GET for a file that isn't stored, default a
+	// plain 404
+	Missing *ResponseFormat `json:"missing"`
+}
+
+type uploadedFile struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	// MD5 is the hex digest S3 clients expect as the ETag
+	MD5      string    `json:"md5"`
+	Modified time.Time `json:"modified"`
+	data     []byte
+}
+
+func newUploadedFile(id, filename, contentType string, data []byte) *uploadedFile {
+	sum := sha256.Sum256(data)
+	digest := md5.Sum(data)
+	return &uploadedFile{
+		ID:          id,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Checksum:    hex.EncodeToString(sum[:]),
+		MD5:         hex.EncodeToString(digest[:]),
+		Modified:    clock.Now(),
+	}
+}
+
+// uploadStore holds files of upload stubs without a storage dir.
+type uploadStore struct {
+	sync.Mutex
+	files map[string]*uploadedFile
+}
+
+var errUploadTooLarge = errors.New("upload exceeds the maximum size")
+
+func typeAllowed(allowed []string, contentType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if strings.EqualFold(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadSource finds the uploaded file in the request.
+func uploadSource(r *http.Request, field string) (io.Reader, string, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, "", r.Header.Get("Content-Type"), nil
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", "", err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, "", "", fmt.Errorf("no %q field in upload: %w", field, err)
+		}
+		if part.FormName() == field {
+			return part, part.FileName(), part.Header.Get("Content-Type"), nil
+		}
+	}
+}
+
+// uploadPath is where a file is stored in dir; keys may contain slashes.
+// Ids that can't name a file inside dir give "".
+func uploadPath(dir, id string) string {
+	name := url.PathEscape(id)
+	if name == "" || name == "." || name == ".." {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+func serveUpload(w http.ResponseWriter, r *http.Request, cfg *UploadFormat, id string, missing http.HandlerFunc) {
+	if cfg.Dir != "" {
+		path := uploadPath(cfg.Dir, id)
+		if info, err := os.Stat(path); path == "" || err != nil || info.IsDir() {
+			missing(w, r)
+			return
+		}
+		http.ServeFile(w, r, path)
+		return
+	}
+	uploads := routesFor(r).uploads
+	uploads.Lock()
+	file, ok := uploads.files[id]
+	uploads.Unlock()
+	if !ok {
+		missing(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("ETag", `"`+file.MD5+`"`)
+	http.ServeContent(w, r, file.Filename, file.Modified, bytes.NewReader(file.data))
+}
+
+// deleteUpload removes a stored file; one that isn't there is no error.
+func deleteUpload(r *http.Request, cfg *UploadFormat, id string) error {
+	if cfg.Dir != "" {
+		path := uploadPath(cfg.Dir, id)
+		if path == "" {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	uploads := routesFor(r).uploads
+	uploads.Lock()
+	delete(uploads.files, id)
+	uploads.Unlock()
+	return nil
+}
+
+// listUploads returns the stored files whose ids start with prefix, in id
+// order. Files on disk are read for their metadata.
+func listUploads(r *http.Request, cfg *UploadFormat, prefix string) ([]*uploadedFile, error) {
+	files := []*uploadedFile{}
+	if cfg.Dir == "" {
+		uploads := routesFor(r).uploads
+		uploads.Lock()
+		for id, file := range uploads.files {
+			if strings.HasPrefix(id, prefix) {
+				files = append(files, file)
+			}
+		}
+		uploads.Unlock()
+	} else {
+		entries, err := os.ReadDir(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			id, err := url.PathUnescape(e.Name())
+			if err != nil || e.IsDir() || !strings.HasPrefix(id, prefix) {
+				continue
+			}
+			path := filepath.Join(cfg.Dir, e.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			file := newUploadedFile(id, "", http.DetectContentType(data), data)
+			file.Modified = info.ModTime()
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files, nil
+}
+
+func newUploadHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Upload
+	headers := compileHeaders(api.Response.Headers)
+	if cfg == nil {
+		check(fmt.Errorf("upload response for %s %s has no upload block", api.Method, api.Url))
+	}
+	if cfg.Field == "" {
+		cfg.Field = "file"
+	}
+	if cfg.Dir != "" {
+		check(os.MkdirAll(cfg.Dir, 0o755))
+	}
+	status := api.Response.Status
+	if status == 0 {
+		status = http.StatusCreated
+		if cfg.List != "" {
+			status = http.StatusOK
+		}
+	}
+	body, _, err := compileJSON(api.Url, api.Response.Body)
+	check(err)
+	var text *textTemplate
+	if api.Response.Text != nil {
+		text, err = compileTemplate(api.Url, *api.Response.Text)
+		check(err)
+	}
+	key, err := compileTemplate(api.Url, cfg.Key)
+	check(err)
+	list, err := compileTemplate(api.Url, cfg.List)
+	check(err)
+	fileKey := func(r *http.Request) (string, error) {
+		if cfg.Key == "" {
+			return r.PathValue("id"), nil
+		}
+		return key.render(newTemplateData(r, api))
+	}
+	var missing http.HandlerFunc = http.NotFound
+	if cfg.Missing != nil {
+		response := *cfg.Missing
+		if response.Status == 0 {
+			response.Status = http.StatusNotFound
+		}
+		missing = newResponder(ApiFormat{Url: api.Url, Method: api.Method, Response: response})
+	}
+
+	// respond writes the configured body or text, or fallback as JSON
+	// without either; body and headers share td, e.g. for
+	// "Location": "/files/{{.Vars.id}}"
+	respond := func(w http.ResponseWriter, td templateData, fallback interface{}) {
+		var payload []byte
+		var err error
+		if text != nil {
+			var rendered string
+			rendered, err = text.render(td)
+			payload = []byte(rendered)
+		} else {
+			if api.Response.Body != nil {
+				fallback, err = renderJSON(body, td)
+			}
+			if err == nil {
+				payload, err = json.Marshal(fallback)
+				payload = append(payload, '\n')
+				w.Header().Set("Content-Type", "application/json")
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to render response body", "url", api.Url, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !headers.render(w, td) {
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(payload)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.List != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			td := newTemplateData(r, api)
+			prefix, err := list.render(td)
+			var files []*uploadedFile
+			if err == nil {
+				files, err = listUploads(r, cfg, prefix)
+			}
+			if err != nil {
+				slog.Error("Failed to list uploads", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			listed := make([]map[string]interface{}, len(files))
+			for i, file := range files {
+				listed[i] = map[string]interface{}{
+					"id":          file.ID,
+					"key":         strings.TrimPrefix(file.ID, prefix),
+					"filename":    file.Filename,
+					"contentType": file.ContentType,
+					"size":        file.Size,
+					"checksum":    file.Checksum,
+					"md5":         file.MD5,
+					"modified":    file.Modified,
+				}
+			}
+			td.Vars["files"] = listed
+			respond(w, td, files)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodDelete {
+			id, err := fileKey(r)
+			if err != nil {
+				slog.Error("Failed to render upload key", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if r.Method != http.MethodDelete {
+				serveUpload(w, r, cfg, id, missing)
+				return
+			}
+			if err := deleteUpload(r, cfg, id); err != nil {
+				slog.Error("Failed to delete upload", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			slog.Debug("Upload deleted", "url", api.Url, "id", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		src, filename, contentType, err := uploadSource(r, cfg.Field)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.MaxSize > 0 {
+			src = io.LimitReader(src, cfg.MaxSize+1)
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, src); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := buf.Bytes()
+		if cfg.MaxSize > 0 && int64(len(data)) > cfg.MaxSize {
+			slog.Debug("Upload rejected", "url", api.Url, "reason", errUploadTooLarge, "max", cfg.MaxSize)
+			w.Header().Set("Connection", "close")
+			http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if contentType == "" || contentType == "application/octet-stream" {
+			contentType = http.DetectContentType(data)
+		}
+		if !typeAllowed(cfg.AllowedTypes, contentType) {
+			slog.Debug("Upload rejected", "url", api.Url, "reason", "content type", "type", contentType)
+			http.Error(w, "content type "+contentType+" is not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		fileID := fmt.Sprintf("%016x%016x", random.Uint64(), random.Uint64())
+		if cfg.Key != "" {
+			if fileID, err = fileKey(r); err != nil {
+				slog.Error("Failed to render upload key", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		file := newUploadedFile(fileID, filename, contentType, data)
+		if cfg.Dir != "" {
+			path := uploadPath(cfg.Dir, file.ID)
+			if path == "" {
+				http.Error(w, "invalid upload key "+strconv.Quote(file.ID), http.StatusBadRequest)
+				return
+			}
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				slog.Error("Failed to store upload", "url", api.Url, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			file.data = data
+			uploads := routesFor(r).uploads
+			uploads.Lock()
+			uploads.files[file.ID] = file
+			uploads.Unlock()
+		}
+		slog.Debug("Upload stored", "url", api.Url, "id", file.ID, "size", file.Size, "type", file.ContentType)
+
+		td := newTemplateData(r, api)
+		td.Vars["id"] = file.ID
+		td.Vars["filename"] = file.Filename
+		td.Vars["contentType"] = file.ContentType
+		td.Vars["size"] = file.Size
+		td.Vars["checksum"] = file.Checksum
+		td.Vars["md5"] = file.MD5
+		td.Vars["modified"] = file.Modified
+		respond(w, td, file)
+	}
+}
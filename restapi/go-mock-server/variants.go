@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// VariantsFormat picks one of several responses by the experiment value a
+// request carries in a cookie or header, simulating A/B tests and flags.
+type VariantsFormat struct {
+	// Cookie and Header name where the variant is read from, cookie first
+	Cookie string `json:"cookie"`
+	Header string `json:"header"`
+	// Responses maps variant names to the response served for them
+	Responses map[string]ResponseFormat `json:"responses"`
+	// Sticky assigns callers without a variant one at random and stores it
+	// in Cookie so later requests get the same one
+	Sticky bool `json:"sticky"`
+	// Weights bias the sticky assignment, default equal for all variants
+	Weights map[string]int `json:"weights"`
+	// Default is served to callers without a variant when not sticky;
+	// empty serves the stub's own response
+	Default string `json:"default"`
+}
+
+func newVariantsHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Variants
+	if cfg.Cookie == "" && cfg.Header == "" {
+		check(fmt.Errorf("variants of %s %s need a cookie or header", api.Method, api.Url))
+	}
+	if cfg.Sticky && cfg.Cookie == "" {
+		check(fmt.Errorf("sticky variants of %s %s need a cookie", api.Method, api.Url))
+	}
+	if _, ok := cfg.Responses[cfg.Default]; cfg.Default != "" && !ok {
+		check(fmt.Errorf("default variant %q of %s %s is not defined", cfg.Default, api.Method, api.Url))
+	}
+	handlers := map[string]http.HandlerFunc{}
+	names := []string{}
+	for name, response := range cfg.Responses {
+		variant := api
+		variant.Variants = nil
+		variant.Response = response
+		handlers[name] = newResponder(variant)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	plain := api
+	plain.Variants = nil
+	fallback := newResponder(plain)
+
+	weight := func(name string) int {
+		if len(cfg.Weights) == 0 {
+			return 1
+		}
+		return cfg.Weights[name]
+	}
+	total := 0
+	for _, name := range names {
+		total += weight(name)
+	}
+	assign := func() string {
+		if total <= 0 {
+			return cfg.Default
+		}
+		n := random.IntN(total)
+		for _, name := range names {
+			if n < weight(name) {
+				return name
+			}
+			n -= weight(name)
+		}
+		return cfg.Default
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if cfg.Cookie != "" {
+			if c, err := r.Cookie(cfg.Cookie); err == nil {
+				name = c.Value
+			}
+		}
+		if _, ok := handlers[name]; !ok && cfg.Header != "" {
+			name = r.Header.Get(cfg.Header)
+		}
+		if _, ok := handlers[name]; !ok {
+			name = cfg.Default
+			if cfg.Sticky {
+				name = assign()
+				http.SetCookie(w, &http.Cookie{Name: cfg.Cookie, Value: name, Path: "/"})
+				slog.Debug("Variant assigned", "method", api.Method, "url", api.Url, "variant", name)
+			}
+		}
+		if handler, ok := handlers[name]; ok {
+			handler(w, r)
+			return
+		}
+		fallback(w, r)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebdavFormat configures a "webdav" response: a WebDAV server for the
+// files below the stub's url, which must end in a wildcard such as
+// "/dav/{path...}". Register it without a method.
+type WebdavFormat struct {
+	// Dir serves and stores the files in a directory; empty keeps them in
+	// memory, starting empty
+	Dir string `json:"dir"`
+	// ReadOnly answers 403 to every change
+	ReadOnly bool `json:"readOnly"`
+}
+
+// davFile describes a file or collection, named by its slash separated
+// path from the root, "/" for the root itself.
+type davFile struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// davFS is the storage behind a WebDAV stub. Names are clean absolute
+// slash paths.
+type davFS interface {
+	stat(name string) (davFile, error)
+	// list returns the direct members of a collection
+	list(name string) ([]davFile, error)
+	read(name string) ([]byte, error)
+	write(name string, data []byte) error
+	mkdir(name string) error
+	removeAll(name string) error
+}
+
+// memFS keeps files in memory. Collections are entries with a nil data.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memEntry
+}
+
+type memEntry struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memEntry{"/": {dir: true, modTime: clock.Now()}}}
+}
+
+func (m *memFS) stat(name string) (davFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.files[name]
+	if !ok {
+		return davFile{}, fs.ErrNotExist
+	}
+	return davFile{name, e.dir, int64(len(e.data)), e.modTime}, nil
+}
+
+func (m *memFS) list(name string) ([]davFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []davFile{}
+	for member, e := range m.files {
+		if member != "/" && path.Dir(member) == name {
+			members = append(members, davFile{member, e.dir, int64(len(e.data)), e.modTime})
+		}
+	}
+	return members, nil
+}
+
+func (m *memFS) read(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.files[name]
+	if !ok || e.dir {
+		return nil, fs.ErrNotExist
+	}
+	return e.data, nil
+}
+
+func (m *memFS) write(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if parent, ok := m.files[path.Dir(name)]; !ok || !parent.dir {
+		return fs.ErrNotExist
+	}
+	m.files[name] = &memEntry{data: data, modTime: clock.Now()}
+	return nil
+}
+
+func (m *memFS) mkdir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		return fs.ErrExist
+	}
+	if parent, ok := m.files[path.Dir(name)]; !ok || !parent.dir {
+		return fs.ErrNotExist
+	}
+	m.files[name] = &memEntry{dir: true, modTime: clock.Now()}
+	return nil
+}
+
+func (m *memFS) removeAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return fs.ErrNotExist
+	}
+	for member := range m.files {
+		if member == name || strings.HasPrefix(member, name+"/") {
+			delete(m.files, member)
+		}
+	}
+	return nil
+}
+
+// dirFS keeps files in a directory on disk.
+type dirFS string
+
+func (d dirFS) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+func fileInfo(name string, info fs.FileInfo) davFile {
+	return davFile{name, info.IsDir(), info.Size(), info.ModTime()}
+}
+
+func (d dirFS) stat(name string) (davFile, error) {
+	info, err := os.Stat(d.path(name))
+	if err != nil {
+		return davFile{}, err
+	}
+	return fileInfo(name, info), nil
+}
+
+func (d dirFS) list(name string) ([]davFile, error) {
+	entries, err := os.ReadDir(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+	members := []davFile{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, fileInfo(path.Join(name, e.Name()), info))
+	}
+	return members, nil
+}
+
+func (d dirFS) read(name string) ([]byte, error) {
+	return os.ReadFile(d.path(name))
+}
+
+func (d dirFS) write(name string, data []byte) error {
+	return os.WriteFile(d.path(name), data, 0o644)
+}
+
+func (d dirFS) mkdir(name string) error {
+	return os.Mkdir(d.path(name), 0o755)
+}
+
+func (d dirFS) removeAll(name string) error {
+	if _, err := os.Stat(d.path(name)); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.path(name))
+}
+
+// copyTree copies a file or collection with everything below it.
+func copyTree(store davFS, src, dst string) error {
+	f, err := store.stat(src)
+	if err != nil {
+		return err
+	}
+	if !f.dir {
+		data, err := store.read(src)
+		if err != nil {
+			return err
+		}
+		return store.write(dst, data)
+	}
+	if err := store.mkdir(dst); err != nil {
+		return err
+	}
+	members, err := store.list(src)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := copyTree(store, m.name, path.Join(dst, path.Base(m.name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, PROPFIND, PROPPATCH, COPY, MOVE, LOCK, UNLOCK"
+
+// davChanges are the methods a read-only server rejects.
+var davChanges = map[string]bool{"PUT": true, "DELETE": true, "MKCOL": true, "PROPPATCH": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true}
+
+// davStatus maps storage errors to responses.
+func davStatus(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrExist):
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+	default:
+		slog.Error("WebDAV storage failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// davResponse writes the multistatus response element of one file.
+func davResponse(sb *strings.Builder, href string, f davFile) {
+	sb.WriteString("<D:response><D:href>" + xmlEscape(href) + "</D:href><D:propstat><D:prop>")
+	sb.WriteString("<D:displayname>" + xmlEscape(path.Base(f.name)) + "</D:displayname>")
+	sb.WriteString("<D:getlastmodified>" + f.modTime.UTC().Format(http.TimeFormat) + "</D:getlastmodified>")
+	if f.dir {
+		sb.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		contentType := mime.TypeByExtension(path.Ext(f.name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		sb.WriteString("<D:resourcetype/>")
+		sb.WriteString("<D:getcontentlength>" + strconv.FormatInt(f.size, 10) + "</D:getcontentlength>")
+		sb.WriteString("<D:getcontenttype>" + xmlEscape(contentType) + "</D:getcontenttype>")
+		sb.WriteString(fmt.Sprintf(`<D:getetag>"%x-%x"</D:getetag>`, f.modTime.UnixNano(), f.size))
+	}
+	sb.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+func writeMultistatus(w http.ResponseWriter, body string) {
+	payload := `<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">` + body + "</D:multistatus>\n"
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(payload))
+}
+
+func newWebdavHandler(api ApiFormat) http.HandlerFunc {
+	cfg := api.Response.Webdav
+	if cfg == nil {
+		cfg = &WebdavFormat{}
+	}
+	headers := compileHeaders(api.Response.Headers)
+	m := wildcardPattern.FindStringSubmatchIndex(api.Url)
+	if m == nil || m[1] != len(api.Url) || m[4] < 0 {
+		check(fmt.Errorf("webdav url %s must end in a wildcard such as {path...}", api.Url))
+	}
+	prefix, wildcard := api.Url[:m[0]], api.Url[m[2]:m[3]]
+	var store davFS = newMemFS()
+	if cfg.Dir != "" {
+		store = dirFS(cfg.Dir)
+	}
+	href := func(f davFile) string {
+		u := &url.URL{Path: path.Join(prefix, f.name)}
+		if f.dir && !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		return u.EscapedPath()
+	}
+	// target resolves a Destination header to a name on this server
+	target := func(r *http.Request) (string, bool) {
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || (dest.Host != "" && dest.Host != r.Host) {
+			return "", false
+		}
+		// the prefix must end at a segment boundary, so /davx isn't /dav
+		rest, ok := strings.CutPrefix(dest.Path, strings.TrimSuffix(prefix, "/"))
+		if !ok || rest != "" && !strings.HasPrefix(rest, "/") {
+			return "", false
+		}
+		return path.Clean("/" + rest), true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.PathValue(wildcard))
+		if !headers.apply(w, r, api) {
+			return
+		}
+		if cfg.ReadOnly && davChanges[r.Method] {
+			http.Error(w, "read-only WebDAV server", http.StatusForbidden)
+			return
+		}
+		slog.Debug("WebDAV request", "method", r.Method, "url", api.Url, "name", name)
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("Allow", davAllow)
+			w.Header().Set("DAV", "1, 2")
+			w.Header().Set("MS-Author-Via", "DAV")
+			w.WriteHeader(http.StatusOK)
+		case "GET", "HEAD":
+			f, err := store.stat(name)
+			if err != nil {
+				davStatus(w, err)
+				return
+			}
+			if f.dir {
+				members, err := store.list(name)
+				if err != nil {
+					davStatus(w, err)
+					return
+				}
+				sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+				var sb strings.Builder
+				for _, m := range members {
+					sb.WriteString(href(m) + "\n")
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Write([]byte(sb.String()))
+				return
+			}
+			data, err := store.read(name)
+			if err != nil {
+				davStatus(w, err)
+				return
+			}
+			if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, f.modTime.UnixNano(), f.size))
+			http.ServeContent(w, r, path.Base(name), f.modTime, bytes.NewReader(data))
+		case "PUT":
+			existing, err := store.stat(name)
+			if err == nil && existing.dir {
+				http.Error(w, "cannot PUT to a collection", http.StatusMethodNotAllowed)
+				return
+			}
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.write(name, data); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					http.Error(w, "parent collection does not exist", http.StatusConflict)
+					return
+				}
+				davStatus(w, err)
+				return
+			}
+			if existing.name != "" {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+		case "MKCOL":
+			if r.ContentLength > 0 {
+				http.Error(w, "MKCOL bodies are not supported", http.StatusUnsupportedMediaType)
+				return
+			}
+			if _, err := store.stat(name); err == nil {
+				http.Error(w, "already exists", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := store.mkdir(name); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					http.Error(w, "parent collection does not exist", http.StatusConflict)
+					return
+				}
+				davStatus(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if name == "/" {
+				http.Error(w, "cannot delete the root", http.StatusForbidden)
+				return
+			}
+			if err := store.removeAll(name); err != nil {
+				davStatus(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "COPY", "MOVE":
+			dest, ok := target(r)
+			if !ok {
+				http.Error(w, "destination is not on this server", http.StatusBadGateway)
+				return
+			}
+			if dest == name || strings.HasPrefix(dest, name+"/") || name == "/" {
+				http.Error(w, "destination overlaps the source", http.StatusForbidden)
+				return
+			}
+			if _, err := store.stat(name); err != nil {
+				davStatus(w, err)
+				return
+			}
+			_, err := store.stat(dest)
+			overwrite := err == nil
+			if overwrite {
+				if r.Header.Get("Overwrite") == "F" {
+					http.Error(w, "destination exists", http.StatusPreconditionFailed)
+					return
+				}
+				if err := store.removeAll(dest); err != nil {
+					davStatus(w, err)
+					return
+				}
+			}
+			if err := copyTree(store, name, dest); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					http.Error(w, "destination parent does not exist", http.StatusConflict)
+					return
+				}
+				davStatus(w, err)
+				return
+			}
+			if r.Method == "MOVE" {
+				if err := store.removeAll(name); err != nil {
+					davStatus(w, err)
+					return
+				}
+			}
+			if overwrite {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+		case "PROPFIND":
+			f, err := store.stat(name)
+			if err != nil {
+				davStatus(w, err)
+				return
+			}
+			var sb strings.Builder
+			davResponse(&sb, href(f), f)
+			// "infinity" is answered like 1, which clients then walk
+			if f.dir && r.Header.Get("Depth") != "0" {
+				members, err := store.list(name)
+				if err != nil {
+					davStatus(w, err)
+					return
+				}
+				sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+				for _, m := range members {
+					davResponse(&sb, href(m), m)
+				}
+			}
+			writeMultistatus(w, sb.String())
+		case "PROPPATCH":
+			// dead properties are accepted but not stored
+			f, err := store.stat(name)
+			if err != nil {
+				davStatus(w, err)
+				return
+			}
+			writeMultistatus(w, "<D:response><D:href>"+xmlEscape(href(f))+"</D:href><D:propstat><D:prop/><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+		case "LOCK":
+			// locks are granted but not enforced, enough for clients that
+			// insist on locking before they write
+			token := "opaquelocktoken:" + randomUUID()
+			payload := `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+				`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>` +
+				`<D:depth>infinity</D:depth><D:timeout>Second-3600</D:timeout><D:locktoken><D:href>` + token + `</D:href></D:locktoken></D:activelock></D:lockdiscovery></D:prop>` + "\n"
+			w.Header().Set("Lock-Token", "<"+token+">")
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(payload))
+		case "UNLOCK":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", davAllow)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebdavDestinationNeedsSegmentBoundary(t *testing.T) {
+	_, server := newTestRoutes(t, `[{"url": "/dav/{path...}", "response": {"type": "webdav"}}]`)
+	do := func(method, path, destination string) int {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader("hello"))
+		if destination != "" {
+			r.Header.Set("Destination", destination)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := do(http.MethodPut, "/dav/a.txt", ""); got != http.StatusCreated {
+		t.Fatalf("PUT answered %d", got)
+	}
+	for _, dest := range []string{"/davx/b.txt", server.URL + "/davx/b.txt", "/da"} {
+		if got := do("COPY", "/dav/a.txt", dest); got != http.StatusBadGateway {
+			t.Errorf("COPY to %s answered %d, want 502", dest, got)
+		}
+	}
+	if got := do("MOVE", "/dav/a.txt", server.URL+"/dav/b.txt"); got != http.StatusCreated {
+		t.Errorf("MOVE within the share answered %d, want 201", got)
+	}
+	if got := getStatus(t, server.URL+"/dav/b.txt"); got != http.StatusOK {
+		t.Errorf("GET of the moved file answered %d", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// workspacePrefix mounts each workspace under /workspaces/{name}/, as an
+// alternative to selecting it by header.
+const workspacePrefix = "/workspaces/"
+
+// workspaceFlag collects repeated "name=path" --workspace flags.
+type workspaceFlag map[string]string
+
+func (f workspaceFlag) String() string {
+	pairs := []string{}
+	for name, path := range f {
+		pairs = append(pairs, name+"="+path)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f workspaceFlag) names() []string {
+	names := []string{}
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f workspaceFlag) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok {
+		// without a name the file name minus extension is used
+		path = value
+		name = strings.TrimSuffix(filepath.Base(value), filepath.Ext(value))
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid workspace name %q", name)
+	}
+	f[name] = path
+	return nil
+}
+
+// workspaceStores is the request state each workspace keeps apart from
+// the others, reached through routesFor.
+type workspaceStores struct {
+	journal   *requestJournal
+	misses    *missLog
+	sessions  *sessionStore
+	uploads   *uploadStore
+	mutations *mutationLog
+}
+
+// newWorkspaceStores returns empty stores keeping journalSize requests and
+// sessions by the cookie named.
+func newWorkspaceStores(journalSize int, cookie string) workspaceStores {
+	return workspaceStores{
+		journal:   &requestJournal{size: journalSize},
+		misses:    &missLog{},
+		sessions:  &sessionStore{cookie: cookie, sessions: map[string]map[string]interface{}{}},
+		uploads:   &uploadStore{files: map[string]*uploadedFile{}},
+		mutations: &mutationLog{},
+	}
+}
+
+// workspaceSet holds the workspaces next to the default routes. Each has
+// its own stubs, with their state and stats, its own admin API and its own
+// workspaceStores. The clock, template counters and captured emails are
+// shared: the clock drives every schedule, counters are bound when
+// templates compile and the SMTP listener serves no workspace.
+type workspaceSet struct {
+	header string
+	byName map[string]*liveRoutes
+}
+
+var workspaces = &workspaceSet{header: "X-Mock-Workspace", byName: map[string]*liveRoutes{}}
+
+func (ws *workspaceSet) names() []string {
+	names := []string{}
+	for name := range ws.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// add creates a workspace serving the stubs of mockData, with the base
+// path, presets and setup of the default routes and stores like theirs.
+func (ws *workspaceSet) add(name, mockData string, defaults *liveRoutes) error {
+	lr := &liveRoutes{name: name, registry: newStubRegistry(), mockData: mockData,
+		basePath: defaults.basePath, presets: defaults.presets, setup: defaults.setup,
+		workspaceStores: newWorkspaceStores(defaults.journal.size, defaults.sessions.cookie)}
+	if _, err := lr.load(); err != nil {
+		return fmt.Errorf("workspace %s: %w", name, err)
+	}
+	ws.byName[name] = lr
+	return nil
+}
+
+type workspaceKey struct{}
+
+// routesFor returns the routes of the workspace r was sent to, the default
+// ones if it named none.
+func routesFor(r *http.Request) *liveRoutes {
+	if lr, ok := r.Context().Value(workspaceKey{}).(*liveRoutes); ok {
+		return lr
+	}
+	return routes
+}
+
+// withWorkspaces picks the workspace of each request, by the workspace
+// header or a /workspaces/{name}/ path prefix, which is then stripped.
+// Requests naming no workspace go to the default routes.
+func withWorkspaces(next http.Handler) http.Handler {
+	if len(workspaces.byName) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(workspaces.header)
+		if rest, ok := strings.CutPrefix(r.URL.Path, workspacePrefix); ok && name == "" {
+			name, rest, _ = strings.Cut(rest, "/")
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = "/"+rest, ""
+		}
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lr, ok := workspaces.byName[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no workspace %q, available: %s", name, strings.Join(workspaces.names(), ", ")), http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), workspaceKey{}, lr)))
+	})
+}
+
+// serveRoutes dispatches to the routes of the request's workspace.
+func serveRoutes(w http.ResponseWriter, r *http.Request) {
+	routesFor(r).ServeHTTP(w, r)
+}
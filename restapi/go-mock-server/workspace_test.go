@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWorkspaceUsesBasePathAndPresets(t *testing.T) {
+	ws := &workspaceSet{header: "X-Mock-Workspace", byName: map[string]*liveRoutes{}}
+	defaults := &liveRoutes{basePath: "/api", presets: map[string]string{"sendgrid": ""}, workspaceStores: newWorkspaceStores(1000, "mock_session")}
+	if err := ws.add("team-a", writeConfig(t, `[{"url": "/orders", "method": "GET", "response": {"status": 200}}]`), defaults); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(ws.byName["team-a"])
+	defer server.Close()
+	for path, want := range map[string]int{"/api/orders": http.StatusOK, "/orders": http.StatusNotFound} {
+		if got := getStatus(t, server.URL+path); got != want {
+			t.Errorf("GET %s answered %d, want %d", path, got, want)
+		}
+	}
+	// without an API key the preset answers 401
+	resp, err := http.Post(server.URL+"/api/v3/mail/send", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("preset stub answered %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestWorkspaceStoresAreIsolated(t *testing.T) {
+	defer func(byName map[string]*liveRoutes) { workspaces.byName = byName }(workspaces.byName)
+	workspaces.byName = map[string]*liveRoutes{}
+	defaults := &liveRoutes{setup: func(mux *router) { registerAdmin(mux, adminAuth{}) },
+		workspaceStores: newWorkspaceStores(1000, "mock_session")}
+	config := writeConfig(t, `[{"url": "/login", "method": "POST", "session": {"set": {"user": "ada"}}, "response": {"status": 200}},
+		{"url": "/me", "method": "GET", "requireSession": {}, "response": {"status": 200}}]`)
+	for _, name := range []string{"a", "b"} {
+		if err := workspaces.add(name, config, defaults); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(withWorkspaces(withRequestTracking(http.HandlerFunc(serveRoutes))))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/workspaces/a/login", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookie := resp.Cookies()[0]
+	me := func(workspace string) int {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+"/workspaces/"+workspace+"/me", nil)
+		r.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := me("a"); got != http.StatusOK {
+		t.Errorf("workspace a answered %d with its session, want 200", got)
+	}
+	if got := me("b"); got != http.StatusUnauthorized {
+		t.Errorf("workspace b answered %d with a's session, want 401", got)
+	}
+
+	requests := func(workspace string) []journalEntry {
+		var report journalReport
+		resp, err := http.Get(server.URL + "/workspaces/" + workspace + "/__admin/requests")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&report)
+		return report.Requests
+	}
+	for workspace, want := range map[string]int{"a": 2, "b": 1} {
+		got := requests(workspace)
+		if len(got) != want {
+			t.Errorf("workspace %s journaled %d requests, want %d", workspace, len(got), want)
+		}
+		for _, e := range got {
+			if e.Workspace != workspace {
+				t.Errorf("workspace %s journaled a request of %q", workspace, e.Workspace)
+			}
+		}
+	}
+	r, _ := http.NewRequest(http.MethodDelete, server.URL+"/workspaces/a/__admin/requests", nil)
+	if resp, err := http.DefaultClient.Do(r); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	if len(requests("a")) != 0 || len(requests("b")) != 1 {
+		t.Error("clearing workspace a's journal didn't keep b's")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// wsdlDefinitions is the part of a WSDL 1.1 document the importer reads.
+type wsdlDefinitions struct {
+	TargetNamespace string      `xml:"targetNamespace,attr"`
+	Schemas         []xsdSchema `xml:"types>schema"`
+	Messages        []struct {
+		Name  string `xml:"name,attr"`
+		Parts []struct {
+			Name    string `xml:"name,attr"`
+			Element string `xml:"element,attr"`
+			Type    string `xml:"type,attr"`
+		} `xml:"part"`
+	} `xml:"http://schemas.xmlsoap.org/wsdl/ message"`
+	PortTypes []struct {
+		Name       string `xml:"name,attr"`
+		Operations []struct {
+			Name  string `xml:"name,attr"`
+			Input struct {
+				Message string `xml:"message,attr"`
+			} `xml:"http://schemas.xmlsoap.org/wsdl/ input"`
+			Output struct {
+				Message string `xml:"message,attr"`
+			} `xml:"http://schemas.xmlsoap.org/wsdl/ output"`
+		} `xml:"http://schemas.xmlsoap.org/wsdl/ operation"`
+	} `xml:"http://schemas.xmlsoap.org/wsdl/ portType"`
+	Bindings []struct {
+		Name       string `xml:"name,attr"`
+		Type       string `xml:"type,attr"`
+		Operations []struct {
+			Name   string      `xml:"name,attr"`
+			Soap11 *wsdlSoapOp `xml:"http://schemas.xmlsoap.org/wsdl/soap/ operation"`
+			Soap12 *wsdlSoapOp `xml:"http://schemas.xmlsoap.org/wsdl/soap12/ operation"`
+		} `xml:"http://schemas.xmlsoap.org/wsdl/ operation"`
+	} `xml:"http://schemas.xmlsoap.org/wsdl/ binding"`
+	Services []struct {
+		Name  string `xml:"name,attr"`
+		Ports []struct {
+			Name      string       `xml:"name,attr"`
+			Binding   string       `xml:"binding,attr"`
+			Address11 *wsdlAddress `xml:"http://schemas.xmlsoap.org/wsdl/soap/ address"`
+			Address12 *wsdlAddress `xml:"http://schemas.xmlsoap.org/wsdl/soap12/ address"`
+		} `xml:"http://schemas.xmlsoap.org/wsdl/ port"`
+	} `xml:"http://schemas.xmlsoap.org/wsdl/ service"`
+}
+
+type wsdlSoapOp struct {
+	Action string `xml:"soapAction,attr"`
+}
+
+type wsdlAddress struct {
+	Location string `xml:"location,attr"`
+}
+
+type xsdSchema struct {
+	TargetNamespace    string           `xml:"targetNamespace,attr"`
+	ElementFormDefault string           `xml:"elementFormDefault,attr"`
+	Elements           []xsdElement     `xml:"element"`
+	ComplexTypes       []xsdComplexType `xml:"complexType"`
+}
+
+type xsdElement struct {
+	Name        string          `xml:"name,attr"`
+	Type        string          `xml:"type,attr"`
+	Ref         string          `xml:"ref,attr"`
+	ComplexType *xsdComplexType `xml:"complexType"`
+}
+
+type xsdComplexType struct {
+	Name     string       `xml:"name,attr"`
+	Sequence []xsdElement `xml:"sequence>element"`
+	All      []xsdElement `xml:"all>element"`
+}
+
+// localName drops the namespace prefix of a QName such as "tns:GetQuote".
+func localName(qname string) string {
+	if _, name, ok := strings.Cut(qname, ":"); ok {
+		return name
+	}
+	return qname
+}
+
+// xsdSamples are placeholder values by simple type; the rest get "?".
+var xsdSamples = map[string]string{
+	"string":   "string",
+	"boolean":  "false",
+	"int":      "0",
+	"integer":  "0",
+	"long":     "0",
+	"short":    "0",
+	"decimal":  "0",
+	"float":    "0",
+	"double":   "0",
+	"dateTime": `{{now.Format "2006-01-02T15:04:05Z07:00"}}`,
+	"date":     `{{now.Format "2006-01-02"}}`,
+}
+
+// maxSampleDepth stops recursive types from expanding forever.
+const maxSampleDepth = 8
+
+// wsdlSampler writes sample XML for the schema elements of a WSDL.
+type wsdlSampler struct {
+	schemas []xsdSchema
+	sb      strings.Builder
+}
+
+func (s *wsdlSampler) element(name string) (*xsdElement, *xsdSchema) {
+	for i := range s.schemas {
+		for j := range s.schemas[i].Elements {
+			if s.schemas[i].Elements[j].Name == name {
+				return &s.schemas[i].Elements[j], &s.schemas[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *wsdlSampler) complexType(name string) *xsdComplexType {
+	for i := range s.schemas {
+		for j := range s.schemas[i].ComplexTypes {
+			if s.schemas[i].ComplexTypes[j].Name == name {
+				return &s.schemas[i].ComplexTypes[j]
+			}
+		}
+	}
+	return nil
+}
+
+// write adds el, qualified with the tns prefix when the element is global
+// or the schema qualifies local elements.
+func (s *wsdlSampler) write(el xsdElement, schema *xsdSchema, global bool, depth int) {
+	if el.Ref != "" {
+		if ref, refSchema := s.element(localName(el.Ref)); ref != nil {
+			s.write(*ref, refSchema, true, depth)
+		}
+		return
+	}
+	tag := el.Name
+	if global || schema.ElementFormDefault == "qualified" {
+		tag = "tns:" + tag
+	}
+	s.sb.WriteString("<" + tag)
+	if depth == 0 {
+		s.sb.WriteString(` xmlns:tns="` + schema.TargetNamespace + `"`)
+	}
+	s.sb.WriteString(">")
+	ct := el.ComplexType
+	if ct == nil && el.Type != "" {
+		ct = s.complexType(localName(el.Type))
+	}
+	switch {
+	case ct != nil && depth < maxSampleDepth:
+		for _, child := range append(ct.Sequence, ct.All...) {
+			s.write(child, schema, false, depth+1)
+		}
+	case ct == nil:
+		sample, ok := xsdSamples[localName(el.Type)]
+		if !ok {
+			sample = "?"
+		}
+		s.sb.WriteString(sample)
+	}
+	s.sb.WriteString("</" + tag + ">")
+}
+
+// outputSample returns sample XML for the body of an operation's response.
+func (d *wsdlDefinitions) outputSample(operation, message string) string {
+	s := &wsdlSampler{schemas: d.Schemas}
+	for _, m := range d.Messages {
+		if m.Name != localName(message) {
+			continue
+		}
+		for _, part := range m.Parts {
+			if part.Element != "" {
+				if el, schema := s.element(localName(part.Element)); el != nil {
+					s.write(*el, schema, true, 0)
+				}
+				continue
+			}
+			// rpc style: parts are plain elements in an operation wrapper
+			wrapper := xsdElement{Name: operation + "Response", ComplexType: &xsdComplexType{}}
+			for _, p := range m.Parts {
+				wrapper.ComplexType.Sequence = append(wrapper.ComplexType.Sequence, xsdElement{Name: p.Name, Type: p.Type})
+			}
+			s.write(wrapper, &xsdSchema{TargetNamespace: d.TargetNamespace}, true, 0)
+			break
+		}
+	}
+	return s.sb.String()
+}
+
+// inputElement returns the namespace and name of the body element of a
+// document style request message, "" for rpc style ones.
+func (d *wsdlDefinitions) inputElement(message string) (string, string) {
+	s := &wsdlSampler{schemas: d.Schemas}
+	for _, m := range d.Messages {
+		if m.Name != localName(message) || len(m.Parts) == 0 || m.Parts[0].Element == "" {
+			continue
+		}
+		if el, schema := s.element(localName(m.Parts[0].Element)); el != nil {
+			return schema.TargetNamespace, el.Name
+		}
+	}
+	return "", ""
+}
+
+// operationMatcher tells an operation's requests apart by its SOAP action,
+// accepted quoted or not from SOAPAction for 1.1 or the Content-Type
+// action parameter for 1.2, and by the element inside the envelope's Body.
+// It returns nil when the operation has neither.
+func operationMatcher(version, action, space, element string) *MatchFormat {
+	match := &MatchFormat{}
+	quoted := regexp.QuoteMeta(action)
+	switch {
+	case action == "":
+	case version == "1.2":
+		match.Headers = map[string]ValueMatcher{"Content-Type": {Pattern: `action="?` + quoted + `"?\s*(;|$)`}}
+	default:
+		match.Headers = map[string]ValueMatcher{"SOAPAction": {Pattern: `^"?` + quoted + `"?$`}}
+	}
+	if element != "" {
+		envelope := "soap"
+		if version == "1.2" {
+			envelope = "soap12"
+		}
+		match.Xpath = map[string]ValueMatcher{"/" + envelope + ":Envelope/" + envelope + ":Body/op:" + element: {}}
+		match.Namespaces = map[string]string{"op": space}
+	}
+	if match.Headers == nil && match.Xpath == nil {
+		return nil
+	}
+	return match
+}
+
+// importWSDL turns the SOAP ports of a WSDL 1.1 document into stubs, one
+// per operation, with id "port.operation". Each answers POSTs to the port's
+// address path, matched by operationMatcher, with an envelope holding
+// sample XML for the response message.
+func importWSDL(path string, file []byte) ([]ApiFormat, error) {
+	var defs wsdlDefinitions
+	if err := xml.Unmarshal(file, &defs); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	inputs, outputs := map[string]string{}, map[string]string{}
+	for _, pt := range defs.PortTypes {
+		for _, op := range pt.Operations {
+			inputs[pt.Name+"."+op.Name] = op.Input.Message
+			outputs[pt.Name+"."+op.Name] = op.Output.Message
+		}
+	}
+	stubs := []ApiFormat{}
+	for _, service := range defs.Services {
+		for _, port := range service.Ports {
+			version, address := "1.1", port.Address11
+			if port.Address12 != nil {
+				version, address = "1.2", port.Address12
+			}
+			if address == nil {
+				continue
+			}
+			location, err := url.Parse(address.Location)
+			if err != nil {
+				return nil, fmt.Errorf("%s port %s: %w", path, port.Name, err)
+			}
+			urlPath := location.Path
+			if urlPath == "" {
+				urlPath = "/"
+			}
+			fallback := ""
+			for _, binding := range defs.Bindings {
+				if binding.Name != localName(port.Binding) {
+					continue
+				}
+				for _, op := range binding.Operations {
+					soapOp := op.Soap11
+					if version == "1.2" {
+						soapOp = op.Soap12
+					}
+					action := ""
+					if soapOp != nil {
+						action = soapOp.Action
+					}
+					space, element := defs.inputElement(inputs[localName(binding.Type)+"."+op.Name])
+					stub := ApiFormat{
+						Id:     port.Name + "." + op.Name,
+						Method: "POST",
+						Url:    urlPath,
+						Response: ResponseFormat{Type: "soap", Soap: &SoapFormat{
+							Version: version,
+							Body:    defs.outputSample(op.Name, outputs[localName(binding.Type)+"."+op.Name]),
+						}},
+					}
+					stub.Match = operationMatcher(version, action, space, element)
+					switch {
+					case stub.Match != nil:
+					case fallback == "":
+						// nothing tells the operation apart, so it answers
+						// everything the others don't
+						fallback = stub.Id
+					default:
+						slog.Warn("Skipped SOAP operation without an action or body element", "file", path, "operation", stub.Id, "answered_by", fallback)
+						continue
+					}
+					stubs = append(stubs, stub)
+				}
+			}
+		}
+	}
+	if len(stubs) == 0 {
+		return nil, fmt.Errorf("%s has no SOAP operations", path)
+	}
+	return stubs, nil
+}
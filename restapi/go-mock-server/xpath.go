@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// xpathNamespaces are the prefixes every XPath condition can use besides
+// those in MatchFormat.Namespaces.
+var xpathNamespaces = map[string]string{
+	"soap":   soap11Envelope,
+	"soap12": soap12Envelope,
+}
+
+// xmlNode is an element of a parsed XML body; the document node has no
+// name.
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+	// text is the node's character data, children's excluded
+	text strings.Builder
+	// all is the character data inside the node in document order,
+	// children's included
+	all strings.Builder
+}
+
+func parseXML(body []byte) (*xmlNode, error) {
+	doc := &xmlNode{}
+	stack := []*xmlNode{doc}
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if len(stack) == 1 && len(doc.children) > 0 {
+				return doc, nil
+			}
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name, attrs: t.Attr}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			top.text.Write(t)
+			for _, n := range stack {
+				n.all.Write(t)
+			}
+		}
+	}
+}
+
+// value is the XPath string value of an element: all the text inside it.
+func (n *xmlNode) value() string {
+	return n.all.String()
+}
+
+// xpathName is a node test: a namespace URI and local name, "*" for any.
+type xpathName struct {
+	space, local string
+	anySpace     bool
+}
+
+func (t xpathName) matches(name xml.Name) bool {
+	return (t.local == "*" || t.local == name.Local) && (t.anySpace || t.space == name.Space)
+}
+
+// xpathPredicate filters the nodes of a step: by position, or by an
+// attribute or child element, present or with a given value.
+type xpathPredicate struct {
+	position  int
+	attribute bool
+	name      xpathName
+	value     *string
+}
+
+type xpathStep struct {
+	descendant bool
+	// attribute or text() steps end the path
+	attribute, text bool
+	name            xpathName
+	predicates      []xpathPredicate
+}
+
+// xpathExpr is a compiled location path of the supported XPath subset:
+// steps separated by / or //, names with prefixes, *, @attr, text(), and
+// predicates [n], [@attr], [@attr='v'], [child] and [child='v'].
+type xpathExpr struct {
+	source string
+	steps  []xpathStep
+}
+
+// splitXPath cuts a path into steps, leaving brackets and quotes whole. A
+// step after // is prefixed with "/".
+func splitXPath(expr string) ([]string, error) {
+	steps := []string{}
+	depth, quote, start := 0, byte(0), 0
+	descendant := false
+	flush := func(end int) {
+		step := expr[start:end]
+		if descendant {
+			step = "/" + step
+		}
+		steps = append(steps, step)
+	}
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '/' && depth == 0:
+			if i > start {
+				flush(i)
+				descendant = false
+			} else if i > 0 {
+				descendant = true
+			}
+			start = i + 1
+		}
+	}
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("unbalanced %q", expr)
+	}
+	if start == len(expr) {
+		return nil, fmt.Errorf("%q ends without a step", expr)
+	}
+	flush(len(expr))
+	return steps, nil
+}
+
+func resolveXPathName(qname string, namespaces map[string]string) (xpathName, error) {
+	prefix, local, ok := strings.Cut(qname, ":")
+	if !ok {
+		// unprefixed names are in no namespace, except the * wildcard
+		return xpathName{local: qname, anySpace: qname == "*"}, nil
+	}
+	space, known := namespaces[prefix]
+	if !known {
+		if space, known = xpathNamespaces[prefix]; !known {
+			return xpathName{}, fmt.Errorf("unknown namespace prefix %q", prefix)
+		}
+	}
+	if local == "" {
+		return xpathName{}, fmt.Errorf("bad name %q", qname)
+	}
+	return xpathName{space: space, local: local}, nil
+}
+
+func compilePredicate(text string, namespaces map[string]string) (xpathPredicate, error) {
+	text = strings.TrimSpace(text)
+	if n, err := strconv.Atoi(text); err == nil {
+		if n < 1 {
+			return xpathPredicate{}, fmt.Errorf("position %d, positions start at 1", n)
+		}
+		return xpathPredicate{position: n}, nil
+	}
+	p := xpathPredicate{}
+	target, literal, hasValue := strings.Cut(text, "=")
+	target = strings.TrimSpace(target)
+	if hasValue {
+		literal = strings.TrimSpace(literal)
+		if len(literal) < 2 || (literal[0] != '\'' && literal[0] != '"') || literal[len(literal)-1] != literal[0] {
+			return p, fmt.Errorf("predicate value %s is not a quoted string", literal)
+		}
+		value := literal[1 : len(literal)-1]
+		p.value = &value
+	}
+	target, p.attribute = strings.CutPrefix(target, "@")
+	var err error
+	p.name, err = resolveXPathName(target, namespaces)
+	return p, err
+}
+
+// predicateEnd finds the "]" closing the predicate s starts with, -1 if
+// there is none.
+func predicateEnd(s string) int {
+	if !strings.HasPrefix(s, "[") {
+		return -1
+	}
+	quote := byte(0)
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func compileXPath(expr string, namespaces map[string]string) (*xpathExpr, error) {
+	parts, err := splitXPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	x := &xpathExpr{source: expr}
+	for i, part := range parts {
+		step := xpathStep{}
+		part, step.descendant = strings.CutPrefix(part, "/")
+		if i == 0 && !strings.HasPrefix(expr, "/") {
+			// relative paths search the whole document
+			step.descendant = true
+		}
+		name, rest, _ := strings.Cut(part, "[")
+		if rest != "" {
+			rest = "[" + rest
+		}
+		for rest != "" {
+			end := predicateEnd(rest)
+			if end < 0 {
+				return nil, fmt.Errorf("%q: bad predicate in %q", expr, part)
+			}
+			pred, err := compilePredicate(rest[1:end], namespaces)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", expr, err)
+			}
+			step.predicates = append(step.predicates, pred)
+			rest = rest[end+1:]
+		}
+		switch {
+		case name == "text()":
+			step.text = true
+		case strings.HasPrefix(name, "@"):
+			step.attribute = true
+			name = name[1:]
+		}
+		if !step.text {
+			if step.name, err = resolveXPathName(name, namespaces); err != nil {
+				return nil, fmt.Errorf("%q: %w", expr, err)
+			}
+		}
+		if (step.attribute || step.text) && i != len(parts)-1 {
+			return nil, fmt.Errorf("%q: %s must be the last step", expr, part)
+		}
+		x.steps = append(x.steps, step)
+	}
+	return x, nil
+}
+
+func (p xpathPredicate) keeps(n *xmlNode) bool {
+	if p.attribute {
+		for _, a := range n.attrs {
+			if p.name.matches(a.Name) && (p.value == nil || a.Value == *p.value) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, c := range n.children {
+		if p.name.matches(c.name) && (p.value == nil || c.value() == *p.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// eval returns the string values the path selects in doc.
+func (x *xpathExpr) eval(doc *xmlNode) []string {
+	nodes := []*xmlNode{doc}
+	for _, step := range x.steps {
+		if step.attribute || step.text {
+			values := []string{}
+			for _, n := range nodes {
+				if step.descendant {
+					n.walk(func(d *xmlNode) { values = append(values, step.leafValues(d)...) })
+				} else {
+					values = append(values, step.leafValues(n)...)
+				}
+			}
+			return values
+		}
+		// a // step selects children of the node or any descendant, so
+		// positions count among siblings as in //item[1]
+		next, seen := []*xmlNode{}, map[*xmlNode]bool{}
+		for _, n := range nodes {
+			parents := []*xmlNode{n}
+			if step.descendant {
+				parents = nil
+				n.walk(func(d *xmlNode) { parents = append(parents, d) })
+			}
+			for _, parent := range parents {
+				for _, c := range step.children(parent) {
+					if !seen[c] {
+						seen[c] = true
+						next = append(next, c)
+					}
+				}
+			}
+		}
+		nodes = next
+	}
+	values := make([]string, len(nodes))
+	for i, n := range nodes {
+		values[i] = n.value()
+	}
+	return values
+}
+
+// children returns the children of n the step's name test and predicates
+// keep.
+func (s xpathStep) children(n *xmlNode) []*xmlNode {
+	matched := []*xmlNode{}
+	for _, c := range n.children {
+		if s.name.matches(c.name) {
+			matched = append(matched, c)
+		}
+	}
+	for _, p := range s.predicates {
+		if p.position > 0 {
+			if p.position > len(matched) {
+				matched = nil
+			} else {
+				matched = matched[p.position-1 : p.position]
+			}
+			continue
+		}
+		kept := []*xmlNode{}
+		for _, c := range matched {
+			if p.keeps(c) {
+				kept = append(kept, c)
+			}
+		}
+		matched = kept
+	}
+	return matched
+}
+
+func (s xpathStep) leafValues(n *xmlNode) []string {
+	if s.text {
+		if text := n.text.String(); n.name.Local != "" && text != "" {
+			return []string{text}
+		}
+		return nil
+	}
+	values := []string{}
+	for _, a := range n.attrs {
+		if s.name.matches(a.Name) {
+			values = append(values, a.Value)
+		}
+	}
+	return values
+}
+
+// walk visits n and every element below it in document order.
+func (n *xmlNode) walk(visit func(*xmlNode)) {
+	visit(n)
+	for _, c := range n.children {
+		c.walk(visit)
+	}
+}
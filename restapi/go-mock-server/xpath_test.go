@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const xpathDoc = `<order xmlns:p="urn:pay" id="7">
+	<lines>
+		<item sku="a1">1</item>
+		<item sku="b2">2</item>
+	</lines>
+	<extras>
+		<item sku="c3">3</item>
+		<note>rush <b>now</b></note>
+	</extras>
+	<p:payment p:method="card"><p:amount>12.50</p:amount></p:payment>
+	<amount>99</amount>
+</order>`
+
+func TestXPathEval(t *testing.T) {
+	namespaces := map[string]string{"pay": "urn:pay"}
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		// child and descendant axes
+		{"/order/lines/item", []string{"1", "2"}},
+		{"/order/item", []string{}},
+		{"//item", []string{"1", "2", "3"}},
+		{"item", []string{"1", "2", "3"}},
+		{"/order//item", []string{"1", "2", "3"}},
+		{"//extras//b", []string{"now"}},
+		{"/order/*/item", []string{"1", "2", "3"}},
+		// positions count per parent, (//item)[1] isn't supported
+		{"//item[1]", []string{"1", "3"}},
+		{"//item[2]", []string{"2"}},
+		{"/order/lines/item[3]", []string{}},
+		{"/order/*[2]/item", []string{"3"}},
+		// attribute and child predicates, combined left to right
+		{"//item[@sku='b2']", []string{"2"}},
+		{`//item[@sku="c3"]`, []string{"3"}},
+		{"//item[@sku]", []string{"1", "2", "3"}},
+		{"//item[@sku='zz']", []string{}},
+		{"/order/*[item='3']/note", []string{"rush now"}},
+		{"/order/*[note]", []string{"\n\t\t3\n\t\trush now\n\t"}},
+		{"//note", []string{"rush now"}},
+		{"//item[@sku][2]", []string{"2"}},
+		// attributes and text
+		{"/order/@id", []string{"7"}},
+		{"//@sku", []string{"a1", "b2", "c3"}},
+		{"//note/text()", []string{"rush "}},
+		{"/order/lines/item[1]/text()", []string{"1"}},
+		// namespaces: prefixed names resolve through the config, and
+		// unprefixed names are in no namespace
+		{"//pay:payment/pay:amount", []string{"12.50"}},
+		{"//pay:payment/@pay:method", []string{"card"}},
+		{"/order/amount", []string{"99"}},
+		{"/order/*[pay:amount]/@pay:method", []string{"card"}},
+		{"//*:amount", nil},
+	}
+	doc, err := parseXML([]byte(xpathDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		x, err := compileXPath(tt.expr, namespaces)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: compiled, want an error", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := x.eval(doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestXPathSoapPrefixes(t *testing.T) {
+	doc, err := parseXML([]byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+		<soap:Body><GetUser><id>42</id></GetUser></soap:Body></soap:Envelope>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := compileXPath("/soap:Envelope/soap:Body/GetUser/id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := x.eval(doc); !reflect.DeepEqual(got, []string{"42"}) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestCompileXPathErrors(t *testing.T) {
+	for _, expr := range []string{
+		"/order/",
+		"/order[@id='7'",
+		"/order[@id=7]",
+		"/order/item[0]",
+		"/order/@id/item",
+		"/order/text()/item",
+		"/nope:order",
+	} {
+		if _, err := compileXPath(expr, nil); err == nil {
+			t.Errorf("%s: compiled, want an error", expr)
+		}
+	}
+}